@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
 	log "github.com/Sirupsen/logrus"
 	"github.com/majestrate/bdsmail/lib/server"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
+// how long to let smtp transactions in progress finish when stopping
+const shutdownTimeout = time.Minute
+
 func main() {
 	sigchnl := make(chan os.Signal)
 	log.SetLevel(log.InfoLevel)
@@ -41,7 +46,12 @@ func main() {
 						}
 					} else if sig == syscall.SIGTERM || sig == syscall.SIGINT {
 						log.Info("Stopping Server")
-						s.Stop()
+						ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+						err := s.Shutdown(ctx)
+						cancel()
+						if err != nil {
+							log.Error("Server did not stop cleanly ", err)
+						}
 					}
 				} else {
 					return
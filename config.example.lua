@@ -9,6 +9,18 @@ bind = ":2525"
 domain = "myserver.tld"
 -- where do we put recv'd mail ?
 maildir = "/tmp/mail"
+-- uncomment to get a STARTTLS certificate for domain from letsencrypt
+-- where do we keep acme certificates ?
+-- acme_cache = "/tmp/acme"
+-- contact email for the acme account
+-- acme_email = "admin@myserver.tld"
+-- what address do we answer acme http challenges on? (port 80 must reach it)
+-- acme_http = ":8080"
+-- uncomment to dkim sign mail sent by authenticated users
+-- pem file holding the rsa private key
+-- dkim_key = "/etc/bdsmail/dkim.pem"
+-- selector the public key is published under
+-- dkim_selector = "mail"
 
 
 --
@@ -0,0 +1,4 @@
+//
+// dkim signing of outbound mail and verification of inbound mail
+//
+package dkim
@@ -0,0 +1,222 @@
+package dkim
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// returned when signing without a key
+var ErrNoKey = errors.New("dkim: no signing key")
+
+// returned when a pem file holds no usable rsa key
+var ErrBadKey = errors.New("dkim: not an rsa private key")
+
+// headers signed when present, from is always signed
+var SignedHeaders = []string{
+	"From",
+	"Reply-To",
+	"Subject",
+	"Date",
+	"To",
+	"Cc",
+	"Message-ID",
+	"In-Reply-To",
+	"References",
+	"MIME-Version",
+	"Content-Type",
+	"Content-Transfer-Encoding",
+}
+
+// signs messages with rsa-sha256 and relaxed/relaxed canonicalization per RFC 6376
+type Signer struct {
+	// selector used by callers that don't pick one, like the smtp server
+	Selector string
+
+	key *rsa.PrivateKey
+}
+
+func New(selector string) *Signer {
+	return &Signer{
+		Selector: selector,
+	}
+}
+
+// sign with this key
+func (s *Signer) WithKey(privKey *rsa.PrivateKey) *Signer {
+	s.key = privKey
+	return s
+}
+
+// load an rsa private key from a pem file in either PKCS#1 or PKCS#8 form
+func LoadKey(path string) (key *rsa.PrivateKey, err error) {
+	var data []byte
+	data, err = ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		err = ErrBadKey
+		return
+	}
+	key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		var k interface{}
+		k, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err == nil {
+			var ok bool
+			key, ok = k.(*rsa.PrivateKey)
+			if !ok {
+				err = ErrBadKey
+			}
+		}
+	}
+	return
+}
+
+// sign a message for a domain and selector
+// returns the message with a DKIM-Signature header prepended
+func (s *Signer) Sign(msg io.Reader, selector, domain string) (signed io.Reader, err error) {
+	if s.key == nil {
+		err = ErrNoKey
+		return
+	}
+	var data []byte
+	data, err = ioutil.ReadAll(msg)
+	if err != nil {
+		return
+	}
+	nl := "\n"
+	if bytes.Contains(data, []byte("\r\n")) {
+		nl = "\r\n"
+	}
+	headers, body := splitMessage(data)
+	bh := sha256.Sum256(relaxedBody(body))
+
+	// sign the last instance of each header present, bottom up like verifiers look them up
+	var names []string
+	var canon bytes.Buffer
+	for _, name := range SignedHeaders {
+		if h := lastHeader(headers, name); h != "" {
+			names = append(names, strings.ToLower(name))
+			canon.WriteString(relaxedHeader(h))
+		}
+	}
+	if len(names) == 0 || names[0] != "from" {
+		err = errors.New("dkim: message has no From header")
+		return
+	}
+	sig := fmt.Sprintf("DKIM-Signature: v=1; a=rsa-sha256; c=relaxed/relaxed; d=%s; s=%s;%s\tt=%d; h=%s;%s\tbh=%s;%s\tb=",
+		domain, selector, nl, time.Now().Unix(), strings.Join(names, ":"), nl,
+		base64.StdEncoding.EncodeToString(bh[:]), nl)
+	// the signature header is hashed last with an empty b= and no trailing crlf
+	canon.WriteString(strings.TrimSuffix(relaxedHeader(sig), "\r\n"))
+	h := sha256.Sum256(canon.Bytes())
+	var b []byte
+	b, err = rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, h[:])
+	if err != nil {
+		return
+	}
+	sig += wrap(base64.StdEncoding.EncodeToString(b), nl) + nl
+	signed = io.MultiReader(strings.NewReader(sig), bytes.NewReader(data))
+	return
+}
+
+// fold a base64 value so lines stay short
+func wrap(str, nl string) string {
+	var parts []string
+	for len(str) > 64 {
+		parts = append(parts, str[:64])
+		str = str[64:]
+	}
+	parts = append(parts, str)
+	return strings.Join(parts, nl+"\t")
+}
+
+// split a message into its header fields, continuation lines included, and body
+func splitMessage(data []byte) (headers []string, body []byte) {
+	rest := string(data)
+	for len(rest) > 0 {
+		idx := strings.Index(rest, "\n")
+		line := rest
+		if idx >= 0 {
+			line = rest[:idx+1]
+		}
+		rest = rest[len(line):]
+		if strings.TrimRight(line, "\r\n") == "" {
+			break
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(headers) > 0 {
+			headers[len(headers)-1] += line
+		} else {
+			headers = append(headers, line)
+		}
+	}
+	body = []byte(rest)
+	return
+}
+
+// find the last header field with a name
+func lastHeader(headers []string, name string) string {
+	for idx := len(headers) - 1; idx >= 0; idx-- {
+		h := headers[idx]
+		colon := strings.Index(h, ":")
+		if colon > 0 && strings.EqualFold(strings.TrimSpace(h[:colon]), name) {
+			return h
+		}
+	}
+	return ""
+}
+
+// canonicalize a header field with the relaxed algorithm from RFC 6376 3.4.2
+func relaxedHeader(h string) string {
+	colon := strings.Index(h, ":")
+	if colon < 0 {
+		return ""
+	}
+	name := strings.ToLower(strings.TrimSpace(h[:colon]))
+	value := strings.Replace(h[colon+1:], "\r\n", "", -1)
+	value = strings.Replace(value, "\n", "", -1)
+	value = strings.Join(strings.Fields(value), " ")
+	return name + ":" + value + "\r\n"
+}
+
+// canonicalize a body with the relaxed algorithm from RFC 6376 3.4.4
+func relaxedBody(body []byte) []byte {
+	var buf bytes.Buffer
+	lines := strings.Split(strings.Replace(string(body), "\r\n", "\n", -1), "\n")
+	// drop trailing empty lines
+	for len(lines) > 0 && strings.Trim(lines[len(lines)-1], " \t") == "" {
+		lines = lines[:len(lines)-1]
+	}
+	for _, line := range lines {
+		// runs of whitespace become one space, trailing whitespace goes
+		space := false
+		for idx := 0; idx < len(line); idx++ {
+			c := line[idx]
+			if c == ' ' || c == '\t' {
+				space = true
+				continue
+			}
+			if space {
+				buf.WriteByte(' ')
+				space = false
+			}
+			buf.WriteByte(c)
+		}
+		buf.WriteString("\r\n")
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,92 @@
+package dkim
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRelaxedBody(t *testing.T) {
+	got := string(relaxedBody([]byte(" C \r\nD \t E\r\n\r\n\r\n")))
+	if got != " C\r\nD E\r\n" {
+		t.Fatalf("got %q", got)
+	}
+	if len(relaxedBody([]byte("\r\n\r\n"))) != 0 {
+		t.Fatal("empty body not empty")
+	}
+}
+
+func TestRelaxedHeader(t *testing.T) {
+	got := relaxedHeader("SubJect :  hello \r\n\t world  \r\n")
+	if got != "subject:hello world\r\n" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+// parse the tags of a DKIM-Signature header
+func tags(h string) map[string]string {
+	m := map[string]string{}
+	h = h[strings.Index(h, ":")+1:]
+	for _, tag := range strings.Split(h, ";") {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) == 2 {
+			m[strings.TrimSpace(kv[0])] = strings.Join(strings.Fields(kv[1]), "")
+		}
+	}
+	return m
+}
+
+func TestSign(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// round trip the key through a pem file
+	fname := filepath.Join(t.TempDir(), "dkim.pem")
+	data, _ := x509.MarshalPKCS8PrivateKey(key)
+	ioutil.WriteFile(fname, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: data}), 0600)
+	loaded, err := LoadKey(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := "From: a@example.com\nTo: b@example.net\nSubject: hi\n  there\n\nbody  text\n\n"
+	r, err := New("mail").WithKey(loaded).Sign(strings.NewReader(msg), "sel", "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, _ := ioutil.ReadAll(r)
+	if !bytes.HasSuffix(signed, []byte(msg)) {
+		t.Fatal("message changed")
+	}
+	headers, body := splitMessage(signed)
+	sig := headers[0]
+	tg := tags(sig)
+	if tg["d"] != "example.com" || tg["s"] != "sel" || tg["h"] != "from:subject:to" {
+		t.Fatalf("bad tags %v", tg)
+	}
+	bh := sha256.Sum256(relaxedBody(body))
+	if tg["bh"] != base64.StdEncoding.EncodeToString(bh[:]) {
+		t.Fatal("bad body hash")
+	}
+	// verify like a receiver would
+	var canon bytes.Buffer
+	for _, name := range strings.Split(tg["h"], ":") {
+		canon.WriteString(relaxedHeader(lastHeader(headers[1:], name)))
+	}
+	unsigned := sig[:strings.Index(sig, "\tb=")+3]
+	canon.WriteString(strings.TrimSuffix(relaxedHeader(unsigned), "\r\n"))
+	h := sha256.Sum256(canon.Bytes())
+	b, _ := base64.StdEncoding.DecodeString(tg["b"])
+	if err = rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, h[:], b); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,320 @@
+package dkim
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// result of checking a signature, named like the dkim= results of RFC 8601
+type Result string
+
+const (
+	ResultPass      Result = "pass"
+	ResultFail      Result = "fail"
+	ResultTempError Result = "temperror"
+	ResultPermError Result = "permerror"
+)
+
+// returned when a signature is missing tags or has bad values
+var ErrMalformed = errors.New("dkim: malformed signature")
+
+// returned for signature or key algorithms we don't verify, rsa-sha1 included
+var ErrUnsupported = errors.New("dkim: unsupported algorithm")
+
+// returned when the signing domain publishes no usable key for the selector
+var ErrNoPublicKey = errors.New("dkim: no public key")
+
+// returned when the signature's x= time has passed
+var ErrExpired = errors.New("dkim: signature expired")
+
+// returned when the body doesn't hash to the signed body hash
+var ErrBodyHash = errors.New("dkim: body hash doesn't match")
+
+// returned when the signature doesn't verify with the key
+var ErrBadSignature = errors.New("dkim: bad signature")
+
+// smallest rsa key we accept, RFC 8301 forbids anything smaller
+const minRSABits = 1024
+
+// dns lookups verifying needs, a *net.Resolver does this
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// outcome of checking one DKIM-Signature header
+type Verification struct {
+	// signing domain from d=, empty if the signature didn't have one
+	Domain string
+	Result Result
+	// why it didn't pass, nil if it did
+	Err error
+}
+
+// check every DKIM-Signature header of a message
+// returns one verification per signature in the order they appear
+func Verify(ctx context.Context, r Resolver, msg io.Reader) (vs []Verification, err error) {
+	var data []byte
+	data, err = ioutil.ReadAll(msg)
+	if err != nil {
+		return
+	}
+	headers, body := splitMessage(data)
+	for idx, h := range headers {
+		colon := strings.Index(h, ":")
+		if colon > 0 && strings.EqualFold(strings.TrimSpace(h[:colon]), "DKIM-Signature") {
+			vs = append(vs, verifyOne(ctx, r, h, headers[:idx], headers[idx+1:], body))
+		}
+	}
+	return
+}
+
+// parse tag=value pairs, whitespace around and inside values is dropped
+// returns nil if a tag is repeated or has no name
+func parseTags(str string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(str, ";") {
+		if strings.TrimSpace(tag) == "" {
+			continue
+		}
+		kv := strings.SplitN(tag, "=", 2)
+		name := strings.TrimSpace(kv[0])
+		if _, ok := tags[name]; ok || len(kv) != 2 || name == "" {
+			return nil
+		}
+		tags[name] = strings.Join(strings.Fields(kv[1]), "")
+	}
+	return tags
+}
+
+// check one signature header
+// above and below are the other header fields, a signature covers the ones after it
+// as well as any before it, so both are searched bottom up like one header
+func verifyOne(ctx context.Context, r Resolver, sig string, above, below []string, body []byte) (v Verification) {
+	v.Result = ResultPermError
+	tags := parseTags(sig[strings.Index(sig, ":")+1:])
+	if tags == nil {
+		v.Err = ErrMalformed
+		return
+	}
+	v.Domain = tags["d"]
+	for _, name := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if tags[name] == "" {
+			v.Err = ErrMalformed
+			return
+		}
+	}
+	if tags["v"] != "1" || !strings.Contains(":"+strings.ToLower(tags["h"])+":", ":from:") {
+		v.Err = ErrMalformed
+		return
+	}
+	if i := strings.ToLower(tags["i"]); i != "" {
+		domain := strings.ToLower(v.Domain)
+		at := strings.LastIndex(i, "@")
+		if at < 0 || (i[at+1:] != domain && !strings.HasSuffix(i[at+1:], "."+domain)) {
+			v.Err = ErrMalformed
+			return
+		}
+	}
+	if x := tags["x"]; x != "" {
+		expires, err := strconv.ParseInt(x, 10, 64)
+		if err != nil {
+			v.Err = ErrMalformed
+			return
+		}
+		if time.Now().Unix() > expires {
+			v.Err = ErrExpired
+			return
+		}
+	}
+	keyType := ""
+	switch strings.ToLower(tags["a"]) {
+	case "rsa-sha256":
+		keyType = "rsa"
+	case "ed25519-sha256":
+		keyType = "ed25519"
+	default:
+		v.Err = ErrUnsupported
+		return
+	}
+	headerCanon, bodyCanon := "simple", "simple"
+	if c := strings.ToLower(tags["c"]); c != "" {
+		parts := strings.SplitN(c, "/", 2)
+		headerCanon = parts[0]
+		if len(parts) == 2 {
+			bodyCanon = parts[1]
+		}
+	}
+	if (headerCanon != "simple" && headerCanon != "relaxed") || (bodyCanon != "simple" && bodyCanon != "relaxed") {
+		v.Err = ErrMalformed
+		return
+	}
+	sigBytes, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		v.Err = ErrMalformed
+		return
+	}
+
+	// the body hash is cheap and needs no dns so check it first
+	canonBody := simpleBody(body)
+	if bodyCanon == "relaxed" {
+		canonBody = relaxedBody(body)
+	}
+	if l := tags["l"]; l != "" {
+		n, err := strconv.ParseInt(l, 10, 64)
+		if err != nil || n < 0 || n > int64(len(canonBody)) {
+			v.Err = ErrMalformed
+			return
+		}
+		canonBody = canonBody[:n]
+	}
+	bh := sha256.Sum256(canonBody)
+	if tags["bh"] != base64.StdEncoding.EncodeToString(bh[:]) {
+		v.Result = ResultFail
+		v.Err = ErrBodyHash
+		return
+	}
+
+	canonHeader := simpleHeader
+	if headerCanon == "relaxed" {
+		canonHeader = relaxedHeader
+	}
+	// signed header fields are taken bottom up, each instance used once
+	// a name with no instance left signs nothing
+	all := append(append([]string{}, above...), below...)
+	used := make(map[int]bool)
+	var canon bytes.Buffer
+	for _, name := range strings.Split(tags["h"], ":") {
+		name = strings.TrimSpace(name)
+		for idx := len(all) - 1; idx >= 0; idx-- {
+			h := all[idx]
+			colon := strings.Index(h, ":")
+			if !used[idx] && colon > 0 && strings.EqualFold(strings.TrimSpace(h[:colon]), name) {
+				used[idx] = true
+				canon.WriteString(canonHeader(h))
+				break
+			}
+		}
+	}
+	canon.WriteString(strings.TrimSuffix(canonHeader(withoutSignature(sig)), "\r\n"))
+	hashed := sha256.Sum256(canon.Bytes())
+
+	var key crypto.PublicKey
+	key, v.Result, v.Err = lookupKey(ctx, r, tags["s"], v.Domain, keyType)
+	if v.Err != nil {
+		return
+	}
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(k, crypto.SHA256, hashed[:], sigBytes)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, hashed[:], sigBytes) {
+			err = ErrBadSignature
+		}
+	}
+	if err != nil {
+		v.Result = ResultFail
+		v.Err = ErrBadSignature
+		return
+	}
+	v.Result = ResultPass
+	return
+}
+
+// empty the b= value of a signature header so it can be hashed
+// everything else, whitespace included, is kept as it was
+func withoutSignature(sig string) string {
+	colon := strings.Index(sig, ":")
+	tags := strings.Split(sig[colon+1:], ";")
+	for idx, tag := range tags {
+		eq := strings.Index(tag, "=")
+		if eq > 0 && strings.TrimSpace(tag[:eq]) == "b" {
+			tags[idx] = tag[:eq+1]
+		}
+	}
+	return sig[:colon+1] + strings.Join(tags, ";")
+}
+
+// get the public key for a selector of a domain from dns
+func lookupKey(ctx context.Context, r Resolver, selector, domain, keyType string) (key crypto.PublicKey, res Result, err error) {
+	res = ResultPermError
+	txts, e := r.LookupTXT(ctx, selector+"._domainkey."+domain)
+	if e != nil {
+		if dnsErr, ok := e.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+			res = ResultTempError
+		}
+		err = ErrNoPublicKey
+		return
+	}
+	if len(txts) != 1 {
+		err = ErrNoPublicKey
+		return
+	}
+	tags := parseTags(txts[0])
+	if tags == nil || (tags["v"] != "" && tags["v"] != "DKIM1") {
+		err = ErrNoPublicKey
+		return
+	}
+	if k := tags["k"]; (k == "" && keyType != "rsa") || (k != "" && k != keyType) {
+		err = ErrUnsupported
+		return
+	}
+	if h := tags["h"]; h != "" && !strings.Contains(":"+h+":", ":sha256:") {
+		err = ErrUnsupported
+		return
+	}
+	// an empty p= means the key was revoked
+	data, e := base64.StdEncoding.DecodeString(tags["p"])
+	if e != nil || len(data) == 0 {
+		err = ErrNoPublicKey
+		return
+	}
+	if keyType == "ed25519" {
+		if len(data) != ed25519.PublicKeySize {
+			err = ErrNoPublicKey
+			return
+		}
+		key = ed25519.PublicKey(data)
+		return
+	}
+	var rsaKey *rsa.PublicKey
+	if k, e := x509.ParsePKIXPublicKey(data); e == nil {
+		rsaKey, _ = k.(*rsa.PublicKey)
+	} else {
+		rsaKey, _ = x509.ParsePKCS1PublicKey(data)
+	}
+	if rsaKey == nil || rsaKey.N.BitLen() < minRSABits {
+		err = ErrNoPublicKey
+		return
+	}
+	key = rsaKey
+	return
+}
+
+// canonicalize a header field with the simple algorithm from RFC 6376 3.4.1
+// it is unchanged except for line endings
+func simpleHeader(h string) string {
+	return strings.Replace(strings.Replace(h, "\r\n", "\n", -1), "\n", "\r\n", -1)
+}
+
+// canonicalize a body with the simple algorithm from RFC 6376 3.4.3
+func simpleBody(body []byte) []byte {
+	lines := strings.Split(strings.Replace(string(body), "\r\n", "\n", -1), "\n")
+	// drop trailing empty lines, an empty body is one empty line
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
@@ -0,0 +1,95 @@
+package dkim
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+// answers key lookups from a map, names missing from it don't exist
+type testResolver map[string]string
+
+func (r testResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if name == "broken._domainkey.example.com" {
+		return nil, &net.DNSError{Err: "server failure", Name: name, IsTemporary: true}
+	}
+	if txt, ok := r[name]; ok {
+		return []string{txt}, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func TestVerify(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	r := testResolver{
+		"sel._domainkey.example.com":     "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(pub),
+		"revoked._domainkey.example.com": "v=DKIM1; p=",
+	}
+	msg := "From: a@example.com\nTo: b@example.net\nSubject: hi\n\nbody  text\n\n"
+	sign := func(selector, msg string) string {
+		signed, err := New("").WithKey(key).Sign(strings.NewReader(msg), selector, "example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(signed)
+		return string(data)
+	}
+	check := func(msg string, want Result, wantErr error) {
+		vs, err := Verify(context.Background(), r, strings.NewReader(msg))
+		if err != nil || len(vs) != 1 {
+			t.Fatalf("verified %v %v", vs, err)
+		}
+		if vs[0].Result != want || !errors.Is(vs[0].Err, wantErr) || vs[0].Domain != "example.com" {
+			t.Fatalf("got %+v wanted %s %v", vs[0], want, wantErr)
+		}
+	}
+	signed := sign("sel", msg)
+	check(signed, ResultPass, nil)
+	// relaxed canonicalization allows whitespace changes
+	check(strings.Replace(signed, "Subject: hi", "Subject:   hi", 1), ResultPass, nil)
+	check(strings.Replace(signed, "body  text", "body text!", 1), ResultFail, ErrBodyHash)
+	check(strings.Replace(signed, "Subject: hi", "Subject: ho", 1), ResultFail, ErrBadSignature)
+	check(sign("revoked", msg), ResultPermError, ErrNoPublicKey)
+	check(sign("missing", msg), ResultPermError, ErrNoPublicKey)
+	check(sign("broken", msg), ResultTempError, ErrNoPublicKey)
+	check(strings.Replace(signed, "a=rsa-sha256", "a=rsa-sha1", 1), ResultPermError, ErrUnsupported)
+
+	if vs, err := Verify(context.Background(), r, strings.NewReader(msg)); err != nil || len(vs) != 0 {
+		t.Fatalf("unsigned message gave %v %v", vs, err)
+	}
+}
+
+func TestVerifySimpleEd25519(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := testResolver{
+		"ed._domainkey.example.com": "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub),
+	}
+	headers := "From: a@example.com\r\nSubject:  hi\r\n"
+	body := "body\r\n\r\n"
+	bh := sha256.Sum256([]byte("body\r\n"))
+	sig := "DKIM-Signature: v=1; a=ed25519-sha256; d=example.com; s=ed; h=from:subject;\r\n\tbh=" +
+		base64.StdEncoding.EncodeToString(bh[:]) + "; b="
+	h := sha256.Sum256([]byte(headers + sig))
+	sig += base64.StdEncoding.EncodeToString(ed25519.Sign(priv, h[:])) + "\r\n"
+	vs, err := Verify(context.Background(), r, bytes.NewBufferString(sig+headers+"\r\n"+body))
+	if err != nil || len(vs) != 1 || vs[0].Result != ResultPass {
+		t.Fatalf("verified %+v %v", vs, err)
+	}
+}
@@ -0,0 +1,33 @@
+package imap
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+)
+
+// require clients to present a certificate signed by a ca in pool when starting tls
+// the user a certificate names, its first email address or else its common name,
+// can then log in with AUTHENTICATE EXTERNAL without a password
+func (s *Server) WithClientCertAuth(pool *x509.CertPool) *Server {
+	s.clientCAs = pool
+	return s
+}
+
+// get the tls config a session starts tls with
+func (s *Server) sessionTLSConfig() (cfg *tls.Config) {
+	cfg = s.tlsConfig
+	if s.clientCAs != nil {
+		cfg = cfg.Clone()
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		cfg.ClientCAs = s.clientCAs
+	}
+	return
+}
+
+// get the user a verified client certificate names
+func certUser(cert *x509.Certificate) string {
+	if len(cert.EmailAddresses) > 0 {
+		return cert.EmailAddresses[0]
+	}
+	return cert.Subject.CommonName
+}
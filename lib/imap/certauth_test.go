@@ -0,0 +1,95 @@
+package imap
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-sasl"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// make a certificate signed by parent, self signed if parent is nil
+func testCert(t *testing.T, tmpl *x509.Certificate, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	signer, signKey := tmpl, interface{}(key)
+	if parent != nil {
+		signer, signKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestClientCertAuth(t *testing.T) {
+	ca := testCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	srv := testCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, &ca)
+	alice := testCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "alice"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, &ca)
+	_, addr, _ := testServer(t, func(s *Server) {
+		s.AllowInsecureAuth = false
+		s.WithTLS(&tls.Config{Certificates: []tls.Certificate{srv}}).WithClientCertAuth(pool)
+	})
+
+	c, err := client.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Logout()
+	if err = c.StartTLS(&tls.Config{RootCAs: pool, Certificates: []tls.Certificate{alice}}); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := c.SupportAuth(sasl.External); !ok {
+		t.Fatal("EXTERNAL not offered with a client certificate")
+	}
+	// the certificate's user is the only one we can act as
+	if err = c.Authenticate(sasl.NewExternalClient("bob")); err == nil {
+		t.Fatal("acted as another user")
+	}
+	if err = c.Authenticate(sasl.NewExternalClient("")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Select("INBOX", false); err != nil {
+		t.Fatal(err)
+	}
+
+	// clients without a certificate can't start tls
+	c2, err := client.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Terminate()
+	if err = c2.StartTLS(&tls.Config{RootCAs: pool}); err == nil {
+		if _, err = c2.Capability(); err == nil {
+			t.Fatal("tls started without a client certificate")
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package imap
+
+import (
+	"bufio"
+	"compress/flate"
+	"strings"
+)
+
+// handle COMPRESS DEFLATE from RFC 4978
+// after the OK both directions are raw deflate streams, the writer is flushed
+// after every response so nothing sits in it waiting for more
+func (sess *session) compress(tag string, args list) (err error) {
+	strs, ok := args.strings()
+	if !ok || len(strs) != 1 {
+		return sess.bad(tag, "Syntax: COMPRESS mechanism")
+	}
+	if sess.zw != nil {
+		return sess.no(tag, "[COMPRESSIONACTIVE] Already compressing")
+	}
+	if !strings.EqualFold(strs[0], "DEFLATE") {
+		return sess.bad(tag, "Unsupported compression mechanism")
+	}
+	err = sess.ok(tag, "DEFLATE active")
+	if err == nil {
+		// the client may have sent compressed data after the command already,
+		// it is in the buffered reader so decompress from that
+		sess.r = bufio.NewReader(flate.NewReader(sess.r))
+		sess.zw, err = flate.NewWriter(sess.c, flate.DefaultCompression)
+		sess.w = bufio.NewWriter(sess.zw)
+	}
+	return
+}
@@ -0,0 +1,64 @@
+package imap
+
+import (
+	"bufio"
+	"compress/flate"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestCompressDeflate(t *testing.T) {
+	_, addr, _ := testServer(t)
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	r := bufio.NewReader(c)
+	// read lines until the tagged response for tag
+	expect := func(r *bufio.Reader, tag string) (lines []string) {
+		t.Helper()
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines = append(lines, line)
+			if strings.HasPrefix(line, tag+" ") {
+				if !strings.HasPrefix(line, tag+" OK") {
+					t.Fatalf("got %q", line)
+				}
+				return
+			}
+		}
+	}
+	if greeting, _ := r.ReadString('\n'); strings.Contains(greeting, "COMPRESS") {
+		t.Fatal("COMPRESS offered before login")
+	}
+	c.Write([]byte("a COMPRESS DEFLATE\r\n"))
+	if line, _ := r.ReadString('\n'); !strings.HasPrefix(line, "a NO") {
+		t.Fatalf("COMPRESS before login got %q", line)
+	}
+	c.Write([]byte("b LOGIN alice secret\r\n"))
+	if lines := expect(r, "b"); !strings.Contains(lines[len(lines)-1], "COMPRESS=DEFLATE") {
+		t.Fatalf("COMPRESS not offered after login: %q", lines)
+	}
+	c.Write([]byte("c COMPRESS DEFLATE\r\n"))
+	expect(r, "c")
+	zw, _ := flate.NewWriter(c, flate.DefaultCompression)
+	zr := bufio.NewReader(flate.NewReader(r))
+	zw.Write([]byte("d SELECT INBOX\r\ne CAPABILITY\r\n"))
+	zw.Flush()
+	expect(zr, "d")
+	for _, line := range expect(zr, "e") {
+		if strings.Contains(line, "COMPRESS") {
+			t.Fatalf("COMPRESS offered while compressing: %q", line)
+		}
+	}
+	zw.Write([]byte("f COMPRESS DEFLATE\r\n"))
+	zw.Flush()
+	if line, _ := zr.ReadString('\n'); !strings.HasPrefix(line, "f NO [COMPRESSIONACTIVE]") {
+		t.Fatalf("second COMPRESS got %q", line)
+	}
+}
@@ -0,0 +1,63 @@
+package imap
+
+import (
+	"strconv"
+	"strings"
+)
+
+// parse a modifier list like (CHANGEDSINCE 12) from RFC 7162
+// returns false if it isn't the named modifier with a modseq
+func modifier(arg interface{}, name string) (modseq uint64, ok bool) {
+	l, isList := arg.(list)
+	if !isList || len(l) != 2 {
+		return
+	}
+	strs, ok := l.strings()
+	if ok && strings.EqualFold(strs[0], name) {
+		var err error
+		modseq, err = strconv.ParseUint(strs[1], 10, 64)
+		ok = err == nil
+	} else {
+		ok = false
+	}
+	return
+}
+
+// check if search keys use MODSEQ, which puts the highest modseq found in the response
+func usesModSeq(args list) bool {
+	for _, arg := range args {
+		if l, isList := arg.(list); isList && usesModSeq(l) {
+			return true
+		} else if str, _ := arg.(string); strings.EqualFold(str, "MODSEQ") {
+			return true
+		}
+	}
+	return false
+}
+
+// get the FLAGS of a message for an untagged FETCH, with its MODSEQ once the client uses CONDSTORE
+func (sess *session) flagsItem(m *mailboxMessage) string {
+	str := "FLAGS " + m.flags()
+	if sess.condstore {
+		str += " MODSEQ (" + strconv.FormatUint(m.modseq, 10) + ")"
+	}
+	return str
+}
+
+// make a sequence set from ascending sequence numbers or uids, runs become ranges
+func numberSet(nums []uint32) string {
+	var strs []string
+	for idx := 0; idx < len(nums); {
+		end := idx
+		for end+1 < len(nums) && nums[end+1] == nums[end]+1 {
+			end++
+		}
+		str := strconv.FormatUint(uint64(nums[idx]), 10)
+		if end > idx {
+			str += ":" + strconv.FormatUint(uint64(nums[end]), 10)
+		}
+		strs = append(strs, str)
+		idx = end + 1
+	}
+	return strings.Join(strs, ",")
+}
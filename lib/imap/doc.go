@@ -0,0 +1,4 @@
+//
+// imap4rev1 server serving maildirs
+//
+package imap
@@ -0,0 +1,440 @@
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/majestrate/bdsmail/lib/maildir"
+	"mime"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// layout of INTERNALDATE
+const internalDateLayout = "02-Jan-2006 15:04:05 -0700"
+
+// fetch macros and the items they stand for
+var fetchMacros = map[string][]string{
+	"ALL":  {"FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE"},
+	"FAST": {"FLAGS", "INTERNALDATE", "RFC822.SIZE"},
+}
+
+// a data item asked for in FETCH
+type fetchItem struct {
+	// item name, BODY for BODY[section] and BODY.PEEK[section]
+	name string
+	// section of a BODY item, empty for the whole message
+	section string
+	// header fields named in a HEADER.FIELDS or HEADER.FIELDS.NOT section
+	fields []string
+	// BODY.PEEK doesn't set \Seen
+	peek bool
+	// the <offset.count> of a partial fetch
+	partial       bool
+	offset, count int
+}
+
+// does getting this item mark the message seen
+func (it fetchItem) setsSeen() bool {
+	return (it.name == "BODY" && !it.peek) || it.name == "RFC822" || it.name == "RFC822.TEXT"
+}
+
+// does getting this item need the message read
+func (it fetchItem) needsBody() bool {
+	switch it.name {
+	case "UID", "FLAGS", "MODSEQ", "PREVIEW":
+		return false
+	}
+	return true
+}
+
+// the name an item is given in the response
+func (it fetchItem) label() string {
+	if it.name != "BODY" {
+		return it.name
+	}
+	str := "BODY[" + it.section
+	if len(it.fields) > 0 {
+		str += " (" + strings.Join(it.fields, " ") + ")"
+	}
+	str += "]"
+	if it.partial {
+		str += "<" + strconv.Itoa(it.offset) + ">"
+	}
+	return str
+}
+
+// parse the data items of a FETCH
+func parseFetchItems(arg interface{}) (items []fetchItem, err error) {
+	var names []string
+	if l, isList := arg.(list); isList {
+		var ok bool
+		names, ok = l.strings()
+		if !ok {
+			err = errSyntax
+			return
+		}
+	} else if str, _ := arg.(string); fetchMacros[strings.ToUpper(str)] != nil {
+		names = fetchMacros[strings.ToUpper(str)]
+	} else {
+		names = []string{str}
+	}
+	for _, name := range names {
+		var it fetchItem
+		it, err = parseFetchItem(name)
+		if err != nil {
+			return
+		}
+		items = append(items, it)
+	}
+	return
+}
+
+// parse one fetch data item
+func parseFetchItem(str string) (it fetchItem, err error) {
+	upper := strings.ToUpper(str)
+	switch upper {
+	case "UID", "FLAGS", "MODSEQ", "INTERNALDATE", "RFC822.SIZE", "RFC822", "RFC822.HEADER", "RFC822.TEXT", "ENVELOPE", "EMAILID", "THREADID", "PREVIEW":
+		it.name = upper
+		return
+	}
+	if strings.HasPrefix(upper, "BODY.PEEK[") {
+		it.peek = true
+		upper = "BODY[" + upper[len("BODY.PEEK["):]
+	}
+	end := strings.LastIndex(upper, "]")
+	if !strings.HasPrefix(upper, "BODY[") || end < 0 {
+		err = fmt.Errorf("unsupported fetch item %s", str)
+		return
+	}
+	it.name = "BODY"
+	it.section = upper[len("BODY["):end]
+	if rest := upper[end+1:]; rest != "" {
+		// <offset.count>
+		var n int
+		n, err = fmt.Sscanf(rest, "<%d.%d>", &it.offset, &it.count)
+		if n != 2 || it.offset < 0 || it.count <= 0 {
+			err = errSyntax
+			return
+		}
+		it.partial = true
+	}
+	if i := strings.Index(it.section, " "); i > 0 {
+		fields := strings.Trim(it.section[i+1:], "()")
+		it.section = it.section[:i]
+		for _, f := range strings.Fields(fields) {
+			it.fields = append(it.fields, strings.Trim(f, `"`))
+		}
+		if len(it.fields) == 0 {
+			err = errSyntax
+			return
+		}
+	}
+	switch it.section {
+	case "", "HEADER", "TEXT":
+		if len(it.fields) == 0 {
+			return
+		}
+	case "HEADER.FIELDS", "HEADER.FIELDS.NOT":
+		if len(it.fields) > 0 {
+			return
+		}
+	}
+	err = fmt.Errorf("unsupported section %s", it.section)
+	return
+}
+
+// handle FETCH
+func (sess *session) fetch(tag string, args list) error {
+	return sess.fetchWith(tag, args, false)
+}
+
+// handle FETCH set items [(CHANGEDSINCE modseq)]
+func (sess *session) fetchWith(tag string, args list, uid bool) (err error) {
+	var idxs []int
+	var since uint64
+	ok := len(args) == 2 || len(args) == 3
+	if ok {
+		idxs, ok = sess.lookupArg(args[0], uid)
+	}
+	if ok && len(args) == 3 {
+		since, ok = modifier(args[2], "CHANGEDSINCE")
+	}
+	if !ok {
+		return sess.bad(tag, "Syntax: FETCH set items [(CHANGEDSINCE modseq)]")
+	}
+	items, e := parseFetchItems(args[1])
+	if e != nil {
+		return sess.bad(tag, "Bad fetch: "+e.Error())
+	}
+	modseq := false
+	for _, it := range items {
+		modseq = modseq || it.name == "MODSEQ"
+	}
+	if len(args) == 3 {
+		// only messages changed since, and they say when
+		mb := sess.mbox
+		changed := idxs[:0]
+		for _, i := range idxs {
+			if mb.msgs[i].modseq > since {
+				changed = append(changed, i)
+			}
+		}
+		idxs = changed
+		if !modseq {
+			items = append(items, fetchItem{name: "MODSEQ"})
+			modseq = true
+		}
+	}
+	if modseq {
+		sess.condstore = true
+	}
+	for _, i := range idxs {
+		e, err = sess.fetchMessage(i, items, uid)
+		if e != nil {
+			return sess.fail(tag, e)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return sess.ok(tag, sess.cmd+" completed")
+}
+
+// send one message's FETCH response
+// e is an error reading the message, err an error talking to the client
+func (sess *session) fetchMessage(i int, items []fetchItem, uid bool) (e, err error) {
+	mb := sess.mbox
+	m := &mb.msgs[i]
+	var body []byte
+	loaded, addFlags := false, false
+	for _, it := range items {
+		if it.needsBody() && !loaded {
+			body, e = mb.read(i)
+			if e != nil {
+				return
+			}
+			body = toCRLF(body)
+			loaded = true
+		}
+		if it.setsSeen() && !mb.readOnly && !m.msg.HasFlag(maildir.Seen) {
+			e = setFlags(mb.dir, m, m.msg.Flags().Add(maildir.Seen))
+			if e != nil {
+				return
+			}
+			addFlags = true
+		}
+	}
+	var parts []string
+	if uid {
+		parts = append(parts, fmt.Sprintf("UID %d", m.uid))
+	}
+	addModSeq := addFlags && sess.condstore
+	for _, it := range items {
+		var val string
+		switch it.name {
+		case "UID":
+			if uid {
+				continue
+			}
+			val = strconv.FormatUint(uint64(m.uid), 10)
+		case "FLAGS":
+			val = m.flags()
+			addFlags = false
+		case "MODSEQ":
+			val = "(" + strconv.FormatUint(m.modseq, 10) + ")"
+			addModSeq = false
+		case "INTERNALDATE":
+			val = `"` + internalDate(mb.dir, m.msg).Format(internalDateLayout) + `"`
+		case "RFC822.SIZE":
+			val = strconv.Itoa(len(body))
+		case "ENVELOPE":
+			val = envelope(body)
+		case "EMAILID":
+			val = "(" + emailID(body) + ")"
+		case "THREADID":
+			val = "(" + threadID(body) + ")"
+		case "PREVIEW":
+			var preview string
+			preview, e = mb.preview(i)
+			if e != nil {
+				return
+			}
+			val = quote(preview)
+		default:
+			data := it.data(body)
+			val = fmt.Sprintf("{%d}\r\n%s", len(data), data)
+		}
+		parts = append(parts, it.label()+" "+val)
+	}
+	if addFlags {
+		parts = append(parts, "FLAGS "+m.flags())
+	}
+	if addModSeq {
+		parts = append(parts, "MODSEQ ("+strconv.FormatUint(m.modseq, 10)+")")
+	}
+	_, err = fmt.Fprintf(sess.w, "* %d FETCH (%s)\r\n", i+1, strings.Join(parts, " "))
+	return
+}
+
+// get the part of a message a body item asks for
+func (it fetchItem) data(body []byte) (data []byte) {
+	header, text := splitMessage(body)
+	switch it.name {
+	case "RFC822":
+		return body
+	case "RFC822.HEADER":
+		return header
+	case "RFC822.TEXT":
+		return text
+	}
+	switch it.section {
+	case "":
+		data = body
+	case "HEADER":
+		data = header
+	case "TEXT":
+		data = text
+	case "HEADER.FIELDS":
+		data = headerFields(header, it.fields, false)
+	case "HEADER.FIELDS.NOT":
+		data = headerFields(header, it.fields, true)
+	}
+	if it.partial {
+		if it.offset > len(data) {
+			it.offset = len(data)
+		}
+		data = data[it.offset:]
+		if it.count < len(data) {
+			data = data[:it.count]
+		}
+	}
+	return
+}
+
+// turn bare LF and CR line endings into CRLF as imap needs
+func toCRLF(body []byte) []byte {
+	var out bytes.Buffer
+	out.Grow(len(body) + len(body)/32)
+	for i, c := range body {
+		if c == '\n' && (i == 0 || body[i-1] != '\r') {
+			out.WriteByte('\r')
+		}
+		out.WriteByte(c)
+		if c == '\r' && (i+1 == len(body) || body[i+1] != '\n') {
+			out.WriteByte('\n')
+		}
+	}
+	return out.Bytes()
+}
+
+// split a message into its header with the blank line ending it and its text
+func splitMessage(body []byte) (header, text []byte) {
+	if bytes.HasPrefix(body, []byte("\r\n")) {
+		return body[:2], body[2:]
+	}
+	if i := bytes.Index(body, []byte("\r\n\r\n")); i >= 0 {
+		return body[:i+4], body[i+4:]
+	}
+	return body, nil
+}
+
+// get the header lines with or without the named fields followed by a blank line
+func headerFields(header []byte, fields []string, not bool) []byte {
+	var out bytes.Buffer
+	keep := false
+	for _, line := range bytes.SplitAfter(header, []byte("\r\n")) {
+		if len(line) == 0 || bytes.Equal(line, []byte("\r\n")) {
+			continue
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			name := string(line)
+			if i := strings.Index(name, ":"); i >= 0 {
+				name = name[:i]
+			}
+			named := false
+			for _, f := range fields {
+				if strings.EqualFold(strings.TrimSpace(name), f) {
+					named = true
+				}
+			}
+			keep = named != not
+		}
+		if keep {
+			out.Write(line)
+		}
+	}
+	out.WriteString("\r\n")
+	return out.Bytes()
+}
+
+// get when a message arrived from its name or else its file
+func internalDate(d maildir.MailDir, msg maildir.Message) time.Time {
+	if t, ok := msg.Timestamp(); ok {
+		return t
+	}
+	for _, sub := range []string{"cur", "new"} {
+		if st, err := os.Stat(filepath.Join(d.Filepath(), sub, msg.Filepath())); err == nil {
+			return st.ModTime()
+		}
+	}
+	return time.Now()
+}
+
+// make an ENVELOPE from a message's header
+func envelope(body []byte) string {
+	header, _ := splitMessage(body)
+	m, err := mail.ReadMessage(bufio.NewReader(bytes.NewReader(header)))
+	var h mail.Header
+	if err == nil {
+		h = m.Header
+	} else {
+		h = mail.Header{}
+	}
+	from := addressList(h, "From")
+	sender := addressList(h, "Sender")
+	if sender == "NIL" {
+		sender = from
+	}
+	replyTo := addressList(h, "Reply-To")
+	if replyTo == "NIL" {
+		replyTo = from
+	}
+	return "(" + strings.Join([]string{
+		nstring(h.Get("Date")),
+		nstring(h.Get("Subject")),
+		from,
+		sender,
+		replyTo,
+		addressList(h, "To"),
+		addressList(h, "Cc"),
+		addressList(h, "Bcc"),
+		nstring(h.Get("In-Reply-To")),
+		nstring(h.Get("Message-Id")),
+	}, " ") + ")"
+}
+
+// make an envelope address list from a header field, NIL if it has none
+func addressList(h mail.Header, key string) string {
+	addrs, err := h.AddressList(key)
+	if err != nil || len(addrs) == 0 {
+		return "NIL"
+	}
+	var strs []string
+	for _, a := range addrs {
+		local, domain := a.Address, ""
+		if i := strings.LastIndex(local, "@"); i >= 0 {
+			local, domain = local[:i], local[i+1:]
+		}
+		name := a.Name
+		if !isASCII(name) {
+			name = mime.QEncoding.Encode("utf-8", name)
+		}
+		strs = append(strs, "("+nstring(name)+" NIL "+nstring(local)+" "+nstring(domain)+")")
+	}
+	return "(" + strings.Join(strs, "") + ")"
+}
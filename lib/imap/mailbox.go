@@ -0,0 +1,486 @@
+package imap
+
+import (
+	"errors"
+	"fmt"
+	"github.com/majestrate/bdsmail/lib/maildir"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// hierarchy delimiter between maildir++ folder names
+const delimiter = "."
+
+// flags a client can set on messages
+const permanentFlags = `\Answered \Flagged \Deleted \Seen \Draft`
+
+// a message in a mailbox
+type mailboxMessage struct {
+	uid    uint32
+	msg    maildir.Message
+	modseq uint64
+}
+
+// messages in new are recent, nobody has looked at them yet
+func (m mailboxMessage) recent() bool {
+	return !strings.Contains(m.msg.Filepath(), ":2,")
+}
+
+// get the message's imap flags
+func (m mailboxMessage) flags() string {
+	flags := m.msg.Flags().IMAPFlags()
+	if m.recent() {
+		flags = append(flags, `\Recent`)
+	}
+	return "(" + strings.Join(flags, " ") + ")"
+}
+
+// a mailbox as a session sees it, messages are in uid order
+type mailbox struct {
+	name     string
+	dir      maildir.MailDir
+	readOnly bool
+	validity uint32
+	next     uint32
+	// highest modseq when the mailbox was last read
+	highest uint64
+	msgs    []mailboxMessage
+}
+
+// read a mailbox's messages, every message is given a uid first
+func openMailbox(name string, d maildir.MailDir) (mb *mailbox, err error) {
+	var m []maildir.UIDMapping
+	m, err = d.UIDMap()
+	var l *maildir.UIDList
+	if err == nil {
+		l, err = d.UIDList()
+	}
+	var modseqs map[string]uint64
+	if err == nil {
+		modseqs, err = d.ModSeqs()
+	}
+	var highest uint64
+	if err == nil {
+		highest, err = d.HighestModSeq()
+	}
+	if err == nil {
+		mb = &mailbox{
+			name:     name,
+			dir:      d,
+			validity: l.Validity,
+			next:     l.Next,
+			highest:  highest,
+		}
+		for _, e := range m {
+			modseq := modseqs[e.Msg.Name()]
+			if modseq == 0 {
+				modseq = 1
+			}
+			mb.msgs = append(mb.msgs, mailboxMessage{uid: e.UID, msg: e.Msg, modseq: modseq})
+		}
+	}
+	return
+}
+
+// count recent and unseen messages
+func (mb *mailbox) counts() (recent, unseen int) {
+	for _, m := range mb.msgs {
+		if m.recent() {
+			recent++
+		}
+		if !m.msg.HasFlag(maildir.Seen) {
+			unseen++
+		}
+	}
+	return
+}
+
+// largest uid in the mailbox
+func (mb *mailbox) largestUID() uint32 {
+	if len(mb.msgs) == 0 {
+		return 0
+	}
+	return mb.msgs[len(mb.msgs)-1].uid
+}
+
+// get the indexes of messages in a sequence set of sequence numbers or uids
+func (mb *mailbox) lookup(set seqSet, uid bool) (idxs []int) {
+	largest := uint32(len(mb.msgs))
+	if uid {
+		largest = mb.largestUID()
+	}
+	for i, m := range mb.msgs {
+		n := uint32(i + 1)
+		if uid {
+			n = m.uid
+		}
+		if set.contains(n, largest) {
+			idxs = append(idxs, i)
+		}
+	}
+	return
+}
+
+// read a message as it is stored
+// a message renamed by someone else since we listed it is found again by its uid
+func (mb *mailbox) read(i int) (body []byte, err error) {
+	m := &mb.msgs[i]
+	body, err = readMessage(mb.dir, m.msg)
+	if errors.Is(err, os.ErrNotExist) {
+		msg, ok, e := mb.dir.MessageByUID(m.uid)
+		if e == nil && ok {
+			m.msg = msg
+			body, err = readMessage(mb.dir, msg)
+		}
+	}
+	return
+}
+
+// get a message's preview, made once and cached by the maildir
+// a message renamed by someone else since we listed it is found again by its uid
+func (mb *mailbox) preview(i int) (preview string, err error) {
+	m := &mb.msgs[i]
+	preview, err = mb.dir.CachedPreview(m.msg)
+	if errors.Is(err, os.ErrNotExist) {
+		msg, ok, e := mb.dir.MessageByUID(m.uid)
+		if e == nil && ok {
+			m.msg = msg
+			preview, err = mb.dir.CachedPreview(msg)
+		}
+	}
+	return
+}
+
+// read a message from cur or new
+func readMessage(d maildir.MailDir, msg maildir.Message) (body []byte, err error) {
+	open := d.OpenMessage
+	if !strings.Contains(msg.Filepath(), ":2,") {
+		open = d.OpenNewMessage
+	}
+	r, err := open(msg)
+	if err == nil {
+		body, err = ioutil.ReadAll(r)
+		r.Close()
+	}
+	return
+}
+
+// check a mailbox name is one we can keep in a maildir++ folder
+func validName(name string) bool {
+	if name == "" || strings.ContainsAny(name, "/\\") {
+		return false
+	}
+	for _, part := range strings.Split(name, delimiter) {
+		if part == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// get the maildir holding a mailbox, INBOX is the user's maildir itself
+// returns false if the mailbox doesn't exist
+func (sess *session) mailboxDir(name string) (d maildir.MailDir, ok bool) {
+	if strings.EqualFold(name, "INBOX") {
+		return sess.home, true
+	}
+	if !validName(name) {
+		return
+	}
+	d = sess.home.Folder(name)
+	st, err := os.Stat(filepath.Join(d.Filepath(), "cur"))
+	ok = err == nil && st.IsDir()
+	return
+}
+
+// get the names of all the user's mailboxes
+func (sess *session) mailboxes() (names []string, err error) {
+	var ents []os.DirEntry
+	ents, err = os.ReadDir(sess.home.Filepath())
+	if err != nil {
+		return
+	}
+	names = append(names, "INBOX")
+	for _, ent := range ents {
+		name := ent.Name()
+		if ent.IsDir() && strings.HasPrefix(name, ".") && validName(name[1:]) {
+			if _, ok := sess.mailboxDir(name[1:]); ok {
+				names = append(names, name[1:])
+			}
+		}
+	}
+	sort.Strings(names[1:])
+	return
+}
+
+// match a mailbox name against a LIST pattern
+// * matches anything and % matches anything but the hierarchy delimiter
+func matchMailbox(pattern, name string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(name); i >= 0; i-- {
+				if matchMailbox(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		case '%':
+			for i := 0; i <= len(name); i++ {
+				if matchMailbox(pattern[1:], name[i:]) {
+					return true
+				}
+				if i < len(name) && name[i] == delimiter[0] {
+					break
+				}
+			}
+			return false
+		default:
+			if name == "" || name[0] != pattern[0] {
+				return false
+			}
+			pattern, name = pattern[1:], name[1:]
+		}
+	}
+	return name == ""
+}
+
+// handle SELECT and EXAMINE mailbox [(CONDSTORE) | (QRESYNC (uidvalidity modseq [known-uids]))]
+func (sess *session) selectMailbox(tag string, args list) (err error) {
+	var name string
+	var resync *qresyncParam
+	ok := len(args) == 1 || len(args) == 2
+	if ok {
+		name, ok = args[0].(string)
+	}
+	if ok && len(args) == 2 {
+		resync, ok = sess.parseSelectParam(args[1])
+	}
+	if !ok {
+		return sess.bad(tag, "Syntax: "+sess.cmd+" mailbox [(CONDSTORE) | (QRESYNC (uidvalidity modseq [known-uids]))]")
+	}
+	if len(args) == 2 {
+		sess.condstore = true
+	}
+	// any selected mailbox is closed even if this fails
+	sess.mbox = nil
+	d, ok := sess.mailboxDir(name)
+	if !ok {
+		return sess.no(tag, "[NONEXISTENT] No such mailbox")
+	}
+	mb, e := openMailbox(name, d)
+	if e != nil {
+		return sess.fail(tag, e)
+	}
+	mb.readOnly = sess.cmd == "EXAMINE"
+	recent, _ := mb.counts()
+	for _, str := range []string{
+		"FLAGS (" + permanentFlags + ")",
+		"OK [PERMANENTFLAGS (" + permanentFlags + ")] Limited",
+		fmt.Sprintf("%d EXISTS", len(mb.msgs)),
+		fmt.Sprintf("%d RECENT", recent),
+		fmt.Sprintf("OK [UIDVALIDITY %d] UIDs valid", mb.validity),
+		fmt.Sprintf("OK [UIDNEXT %d] Predicted next UID", mb.next),
+		fmt.Sprintf("OK [HIGHESTMODSEQ %d] Highest", mb.highest),
+	} {
+		if err = sess.untagged(str); err != nil {
+			return
+		}
+	}
+	sess.mbox = mb
+	if resync != nil {
+		if e, err = sess.resync(resync); e != nil {
+			sess.mbox = nil
+			return sess.fail(tag, e)
+		} else if err != nil {
+			return
+		}
+	}
+	if mb.readOnly {
+		return sess.ok(tag, "[READ-ONLY] EXAMINE completed")
+	}
+	return sess.ok(tag, "[READ-WRITE] SELECT completed")
+}
+
+// tell the client about messages added, removed or changed by someone else
+// e is an error reading the mailbox, err an error talking to the client
+func (sess *session) refresh() (e, err error) {
+	mb := sess.mbox
+	var now *mailbox
+	now, e = openMailbox(mb.name, mb.dir)
+	if e != nil {
+		return
+	}
+	live := make(map[uint32]mailboxMessage, len(now.msgs))
+	for _, m := range now.msgs {
+		live[m.uid] = m
+	}
+	// expunge from the end so sequence numbers stay right
+	for i := len(mb.msgs) - 1; i >= 0 && err == nil; i-- {
+		if _, ok := live[mb.msgs[i].uid]; !ok {
+			err = sess.expunged(i, mb.msgs[i].uid)
+			mb.msgs = append(mb.msgs[:i], mb.msgs[i+1:]...)
+		}
+	}
+	for i := 0; i < len(mb.msgs) && err == nil; i++ {
+		m := &mb.msgs[i]
+		if l := live[m.uid]; l.msg != m.msg || l.modseq != m.modseq {
+			m.msg, m.modseq = l.msg, l.modseq
+			err = sess.untagged(fmt.Sprintf("%d FETCH (%s)", i+1, sess.flagsItem(m)))
+		}
+	}
+	if err == nil && len(now.msgs) > len(mb.msgs) {
+		mb.msgs = append(mb.msgs, now.msgs[len(mb.msgs):]...)
+		recent, _ := mb.counts()
+		err = sess.untagged(fmt.Sprintf("%d EXISTS", len(mb.msgs)))
+		if err == nil {
+			err = sess.untagged(fmt.Sprintf("%d RECENT", recent))
+		}
+	}
+	mb.next = now.next
+	mb.highest = now.highest
+	return
+}
+
+// handle CREATE
+func (sess *session) create(tag string, args list) (err error) {
+	strs, ok := args.strings()
+	if !ok || len(strs) != 1 {
+		return sess.bad(tag, "Syntax: CREATE mailbox")
+	}
+	name := strings.TrimSuffix(strs[0], delimiter)
+	if _, exists := sess.mailboxDir(name); exists {
+		return sess.no(tag, "[ALREADYEXISTS] Mailbox exists")
+	}
+	if !validName(name) {
+		return sess.no(tag, "[CANNOT] Bad mailbox name")
+	}
+	if _, e := sess.home.EnsureFolder(name); e != nil {
+		return sess.fail(tag, e)
+	}
+	return sess.ok(tag, "CREATE completed")
+}
+
+// handle SUBSCRIBE and UNSUBSCRIBE, every mailbox is always subscribed
+func (sess *session) subscribe(tag string, args list) (err error) {
+	return sess.ok(tag, sess.cmd+" completed")
+}
+
+// handle LIST and LSUB
+func (sess *session) list(tag string, args list) (err error) {
+	strs, ok := args.strings()
+	if !ok || len(strs) != 2 {
+		return sess.bad(tag, "Syntax: "+sess.cmd+" reference pattern")
+	}
+	if strs[1] == "" {
+		// asking for the delimiter
+		err = sess.untagged(sess.cmd + ` (\Noselect) "` + delimiter + `" ""`)
+		if err == nil {
+			err = sess.ok(tag, sess.cmd+" completed")
+		}
+		return
+	}
+	names, e := sess.mailboxes()
+	if e != nil {
+		return sess.fail(tag, e)
+	}
+	pattern := strs[0] + strs[1]
+	for _, name := range names {
+		p := pattern
+		if name == "INBOX" {
+			p = strings.ToUpper(p)
+		}
+		if matchMailbox(p, name) {
+			if err = sess.untagged(sess.cmd + ` () "` + delimiter + `" ` + quote(name)); err != nil {
+				return
+			}
+		}
+	}
+	return sess.ok(tag, sess.cmd+" completed")
+}
+
+// handle STATUS mailbox (items)
+func (sess *session) status(tag string, args list) (err error) {
+	var items []string
+	name, ok := "", len(args) == 2
+	if ok {
+		name, ok = args[0].(string)
+	}
+	if ok {
+		l, isList := args[1].(list)
+		items, ok = l.strings()
+		ok = ok && isList
+	}
+	if !ok {
+		return sess.bad(tag, "Syntax: STATUS mailbox (items)")
+	}
+	d, ok := sess.mailboxDir(name)
+	if !ok {
+		return sess.no(tag, "[NONEXISTENT] No such mailbox")
+	}
+	mb, e := openMailbox(name, d)
+	if e != nil {
+		return sess.fail(tag, e)
+	}
+	recent, unseen := mb.counts()
+	var vals []string
+	for _, item := range items {
+		item = strings.ToUpper(item)
+		switch item {
+		case "MESSAGES":
+			vals = append(vals, fmt.Sprintf("%s %d", item, len(mb.msgs)))
+		case "RECENT":
+			vals = append(vals, fmt.Sprintf("%s %d", item, recent))
+		case "UIDNEXT":
+			vals = append(vals, fmt.Sprintf("%s %d", item, mb.next))
+		case "UIDVALIDITY":
+			vals = append(vals, fmt.Sprintf("%s %d", item, mb.validity))
+		case "UNSEEN":
+			vals = append(vals, fmt.Sprintf("%s %d", item, unseen))
+		case "HIGHESTMODSEQ":
+			vals = append(vals, fmt.Sprintf("%s %d", item, mb.highest))
+		default:
+			return sess.bad(tag, "Unknown status item "+item)
+		}
+	}
+	err = sess.untagged("STATUS " + quote(name) + " (" + strings.Join(vals, " ") + ")")
+	if err == nil {
+		err = sess.ok(tag, "STATUS completed")
+	}
+	return
+}
+
+// handle APPEND mailbox [(flags)] [date-time] message
+// the date is taken but messages are dated by delivery
+func (sess *session) appendMessage(tag string, args list) (err error) {
+	var name, body string
+	var flags []string
+	ok := len(args) >= 2 && len(args) <= 4
+	if ok {
+		name, ok = args[0].(string)
+	}
+	if ok {
+		body, ok = args[len(args)-1].(string)
+	}
+	if ok && len(args) > 2 {
+		if l, isList := args[1].(list); isList {
+			flags, ok = l.strings()
+		} else {
+			ok = len(args) == 3
+		}
+	}
+	if !ok {
+		return sess.bad(tag, "Syntax: APPEND mailbox [(flags)] [date-time] message")
+	}
+	d, ok := sess.mailboxDir(name)
+	if !ok {
+		return sess.no(tag, "[TRYCREATE] No such mailbox")
+	}
+	if _, _, e := d.Append(strings.NewReader(body), maildir.ParseIMAPFlags(flags)); e != nil {
+		return sess.fail(tag, e)
+	}
+	return sess.ok(tag, "APPEND completed")
+}
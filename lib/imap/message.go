@@ -0,0 +1,562 @@
+package imap
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/majestrate/bdsmail/lib/maildir"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// commands that can be given after UID
+var uidCommands = map[string]bool{
+	"FETCH":  true,
+	"STORE":  true,
+	"COPY":   true,
+	"MOVE":   true,
+	"SEARCH": true,
+	"THREAD": true,
+}
+
+// handle UID FETCH, UID STORE, UID COPY, UID MOVE, UID SEARCH and UID THREAD
+func (sess *session) uid(tag string, args list) (err error) {
+	var name string
+	if len(args) > 0 {
+		name, _ = args[0].(string)
+	}
+	name = strings.ToUpper(name)
+	sess.cmd = "UID " + name
+	switch name {
+	case "FETCH":
+		return sess.fetchWith(tag, args[1:], true)
+	case "STORE":
+		return sess.storeWith(tag, args[1:], true)
+	case "COPY":
+		return sess.copyWith(tag, args[1:], true)
+	case "MOVE":
+		return sess.moveWith(tag, args[1:], true)
+	case "SEARCH":
+		return sess.searchWith(tag, args[1:], true)
+	case "THREAD":
+		return sess.threadWith(tag, args[1:], true)
+	}
+	return sess.bad(tag, "Unknown UID command")
+}
+
+// parse a sequence set argument and look up the messages it names
+func (sess *session) lookupArg(arg interface{}, uid bool) (idxs []int, ok bool) {
+	str, ok := arg.(string)
+	if ok {
+		set, err := parseSeqSet(str)
+		ok = err == nil
+		if ok {
+			idxs = sess.mbox.lookup(set, uid)
+		}
+	}
+	return
+}
+
+// handle STORE
+func (sess *session) store(tag string, args list) error {
+	return sess.storeWith(tag, args, false)
+}
+
+// handle STORE set [(UNCHANGEDSINCE modseq)] [+|-]FLAGS[.SILENT] flags
+// messages changed since the modseq are left alone and named in a MODIFIED response code
+func (sess *session) storeWith(tag string, args list, uid bool) (err error) {
+	var idxs []int
+	var item string
+	var flags []string
+	var since uint64
+	conditional := false
+	if len(args) >= 4 {
+		_, conditional = args[1].(list)
+	}
+	if conditional {
+		var ok bool
+		since, ok = modifier(args[1], "UNCHANGEDSINCE")
+		if !ok {
+			return sess.bad(tag, "Syntax: STORE set (UNCHANGEDSINCE modseq) [+|-]FLAGS[.SILENT] (flags)")
+		}
+		args = append(list{args[0]}, args[2:]...)
+	}
+	ok := len(args) >= 3
+	if ok {
+		idxs, ok = sess.lookupArg(args[0], uid)
+	}
+	if ok {
+		item, ok = args[1].(string)
+		item = strings.ToUpper(item)
+	}
+	if ok {
+		if l, isList := args[2].(list); isList && len(args) == 3 {
+			flags, ok = l.strings()
+		} else {
+			flags, ok = args[2:].strings()
+		}
+	}
+	silent := strings.HasSuffix(item, ".SILENT")
+	item = strings.TrimSuffix(item, ".SILENT")
+	if !ok || (item != "FLAGS" && item != "+FLAGS" && item != "-FLAGS") {
+		return sess.bad(tag, "Syntax: STORE set [+|-]FLAGS[.SILENT] (flags)")
+	}
+	mb := sess.mbox
+	if mb.readOnly {
+		return sess.no(tag, "Mailbox is read only")
+	}
+	if conditional {
+		sess.condstore = true
+	}
+	// changes are made in one go so a conditional store is checked against what
+	// is on disk at the time, someone else may have changed flags
+	var todo []int
+	var msgs []maildir.Message
+	var wants []maildir.FlagSet
+	var modified []uint32
+	fs := maildir.ParseIMAPFlags(flags)
+	for _, i := range idxs {
+		m := &mb.msgs[i]
+		// every message has a modseq of at least 1 so 0 fails for all of them
+		if conditional && since == 0 {
+			modified = append(modified, sess.number(i, uid))
+			continue
+		}
+		var want maildir.FlagSet
+		switch item {
+		case "FLAGS":
+			want = fs
+			// flags imap has no name for are kept
+			if m.msg.HasFlag(maildir.Passed) {
+				want = want.Add(maildir.Passed)
+			}
+		case "+FLAGS":
+			want = m.msg.Flags()
+			for _, f := range fs {
+				want = want.Add(f)
+			}
+		case "-FLAGS":
+			want = m.msg.Flags()
+			for _, f := range fs {
+				want = want.Remove(f)
+			}
+		}
+		todo = append(todo, i)
+		msgs = append(msgs, m.msg)
+		wants = append(wants, want)
+	}
+	after, modseqs, errs := mb.dir.SetFlags(msgs, wants, since)
+	for j, i := range todo {
+		m := &mb.msgs[i]
+		if errors.Is(errs[j], maildir.ErrModified) {
+			modified = append(modified, sess.number(i, uid))
+			continue
+		} else if errors.Is(errs[j], os.ErrNotExist) {
+			// expunged by someone else, we say so on the next NOOP
+			continue
+		} else if errs[j] != nil {
+			return sess.fail(tag, errs[j])
+		}
+		m.msg = after[j]
+		if modseqs[j] > 0 {
+			m.modseq = modseqs[j]
+		}
+		if !silent {
+			err = sess.untagged(fmt.Sprintf("%d FETCH (%s%s)", i+1, uidItem(m, uid), sess.flagsItem(m)))
+			if err != nil {
+				return
+			}
+		}
+	}
+	if len(modified) > 0 {
+		return sess.ok(tag, "[MODIFIED "+numberSet(modified)+"] Conditional STORE failed")
+	}
+	return sess.ok(tag, sess.cmd+" completed")
+}
+
+// get the uid of the message at index i for a UID command, its sequence number otherwise
+func (sess *session) number(i int, uid bool) uint32 {
+	if uid {
+		return sess.mbox.msgs[i].uid
+	}
+	return uint32(i + 1)
+}
+
+// the UID item that goes first in a FETCH response to a UID command
+func uidItem(m *mailboxMessage, uid bool) string {
+	if uid {
+		return fmt.Sprintf("UID %d ", m.uid)
+	}
+	return ""
+}
+
+// change a message's flags to exactly a set of flags and get its new modseq
+// a message in new is moved to cur when it gets any
+func setFlags(d maildir.MailDir, m *mailboxMessage, want maildir.FlagSet) (err error) {
+	after, modseqs, errs := d.SetFlags([]maildir.Message{m.msg}, []maildir.FlagSet{want}, 0)
+	err = errs[0]
+	if err == nil {
+		m.msg = after[0]
+		if modseqs[0] > 0 {
+			m.modseq = modseqs[0]
+		}
+	}
+	return
+}
+
+// remove messages flagged \Deleted
+// with report set each one is told to the client
+func (sess *session) expungeDeleted(report bool) (e, err error) {
+	mb := sess.mbox
+	for i := len(mb.msgs) - 1; i >= 0 && err == nil; i-- {
+		m := mb.msgs[i]
+		if !m.msg.HasFlag(maildir.Trashed) {
+			continue
+		}
+		e = mb.dir.Remove(m.msg)
+		if errors.Is(e, os.ErrNotExist) {
+			e = nil
+		} else if e != nil {
+			return
+		}
+		mb.msgs = append(mb.msgs[:i], mb.msgs[i+1:]...)
+		if report {
+			err = sess.expunged(i, m.uid)
+		}
+	}
+	return
+}
+
+// handle EXPUNGE
+func (sess *session) expunge(tag string, args list) (err error) {
+	if sess.mbox.readOnly {
+		return sess.no(tag, "Mailbox is read only")
+	}
+	var e error
+	e, err = sess.expungeDeleted(true)
+	if e != nil {
+		return sess.fail(tag, e)
+	}
+	if err == nil {
+		err = sess.ok(tag, "EXPUNGE completed")
+	}
+	return
+}
+
+// handle CLOSE and UNSELECT, only CLOSE expunges
+func (sess *session) close(tag string, args list) (err error) {
+	if sess.cmd == "CLOSE" && !sess.mbox.readOnly {
+		e, _ := sess.expungeDeleted(false)
+		if e != nil {
+			sess.mbox = nil
+			return sess.fail(tag, e)
+		}
+	}
+	sess.mbox = nil
+	return sess.ok(tag, sess.cmd+" completed")
+}
+
+// handle COPY
+func (sess *session) copyMessages(tag string, args list) error {
+	return sess.copyWith(tag, args, false)
+}
+
+// handle COPY set mailbox
+func (sess *session) copyWith(tag string, args list, uid bool) (err error) {
+	var idxs []int
+	var name string
+	ok := len(args) == 2
+	if ok {
+		idxs, ok = sess.lookupArg(args[0], uid)
+	}
+	if ok {
+		name, ok = args[1].(string)
+	}
+	if !ok {
+		return sess.bad(tag, "Syntax: COPY set mailbox")
+	}
+	dest, ok := sess.mailboxDir(name)
+	if !ok {
+		return sess.no(tag, "[TRYCREATE] No such mailbox")
+	}
+	mb := sess.mbox
+	for _, i := range idxs {
+		body, e := mb.read(i)
+		if e == nil {
+			_, _, e = dest.Append(bytes.NewReader(body), mb.msgs[i].msg.Flags())
+		}
+		if e != nil && !errors.Is(e, os.ErrNotExist) {
+			return sess.fail(tag, e)
+		}
+	}
+	return sess.ok(tag, sess.cmd+" completed")
+}
+
+// handle MOVE
+func (sess *session) moveMessages(tag string, args list) error {
+	return sess.moveWith(tag, args, false)
+}
+
+// handle MOVE set mailbox from RFC 6851
+// the messages keep their flags and are expunged from the selected mailbox
+func (sess *session) moveWith(tag string, args list, uid bool) (err error) {
+	var idxs []int
+	var name string
+	ok := len(args) == 2
+	if ok {
+		idxs, ok = sess.lookupArg(args[0], uid)
+	}
+	if ok {
+		name, ok = args[1].(string)
+	}
+	if !ok {
+		return sess.bad(tag, "Syntax: MOVE set mailbox")
+	}
+	mb := sess.mbox
+	if mb.readOnly {
+		return sess.no(tag, "Mailbox is read only")
+	}
+	dest, ok := sess.mailboxDir(name)
+	if !ok {
+		return sess.no(tag, "[TRYCREATE] No such mailbox")
+	}
+	if dest.Filepath() == mb.dir.Filepath() {
+		return sess.no(tag, "Cannot move to the selected mailbox")
+	}
+	var msgs []maildir.Message
+	for _, i := range idxs {
+		msgs = append(msgs, mb.msgs[i].msg)
+	}
+	moved, e := mb.dir.MoveBatch(msgs, dest)
+	gone := make(map[string]bool)
+	for _, m := range moved {
+		gone[m.Src.Name()] = true
+	}
+	// tell the client what left even if some failed
+	for i := len(mb.msgs) - 1; i >= 0 && err == nil; i-- {
+		if gone[mb.msgs[i].msg.Name()] {
+			uid := mb.msgs[i].uid
+			mb.msgs = append(mb.msgs[:i], mb.msgs[i+1:]...)
+			err = sess.expunged(i, uid)
+		}
+	}
+	if err == nil && e != nil && !vanished(e) {
+		return sess.fail(tag, e)
+	}
+	if err == nil {
+		err = sess.ok(tag, sess.cmd+" completed")
+	}
+	return
+}
+
+// check if every error in a batch is from a message that was already gone
+func vanished(e error) bool {
+	var me *maildir.Error
+	if errors.As(e, &me) {
+		e = me.Err
+	}
+	if j, ok := e.(interface{ Unwrap() []error }); ok {
+		for _, err := range j.Unwrap() {
+			if !errors.Is(err, os.ErrNotExist) {
+				return false
+			}
+		}
+		return true
+	}
+	return errors.Is(e, os.ErrNotExist)
+}
+
+// a search key matching messages in the selected mailbox
+type searchKey func(mb *mailbox, i int) bool
+
+// flag search keys
+var flagKeys = map[string]maildir.Flag{
+	"ANSWERED": maildir.Replied,
+	"DELETED":  maildir.Trashed,
+	"DRAFT":    maildir.Draft,
+	"FLAGGED":  maildir.Flagged,
+	"SEEN":     maildir.Seen,
+}
+
+// parse search keys up to the end of the list, all of them must match
+func (sess *session) parseSearch(args list) (key searchKey, err error) {
+	var keys []searchKey
+	for len(args) > 0 {
+		var k searchKey
+		k, args, err = sess.parseSearchKey(args)
+		if err != nil {
+			return
+		}
+		keys = append(keys, k)
+	}
+	key = func(mb *mailbox, i int) bool {
+		for _, k := range keys {
+			if !k(mb, i) {
+				return false
+			}
+		}
+		return true
+	}
+	return
+}
+
+// parse one search key, returns what is left after it
+// only keys that look at flags, numbers and object ids are supported
+func (sess *session) parseSearchKey(args list) (key searchKey, rest list, err error) {
+	rest = args[1:]
+	if l, isList := args[0].(list); isList {
+		key, err = sess.parseSearch(l)
+		return
+	}
+	str, _ := args[0].(string)
+	name := strings.ToUpper(str)
+	if f, ok := flagKeys[name]; ok {
+		key = func(mb *mailbox, i int) bool {
+			return mb.msgs[i].msg.HasFlag(f)
+		}
+		return
+	}
+	if f, ok := flagKeys[strings.TrimPrefix(name, "UN")]; ok {
+		key = func(mb *mailbox, i int) bool {
+			return !mb.msgs[i].msg.HasFlag(f)
+		}
+		return
+	}
+	switch name {
+	case "ALL":
+		key = func(mb *mailbox, i int) bool { return true }
+	case "RECENT":
+		key = func(mb *mailbox, i int) bool { return mb.msgs[i].recent() }
+	case "OLD":
+		key = func(mb *mailbox, i int) bool { return !mb.msgs[i].recent() }
+	case "NEW":
+		key = func(mb *mailbox, i int) bool {
+			return mb.msgs[i].recent() && !mb.msgs[i].msg.HasFlag(maildir.Seen)
+		}
+	case "NOT":
+		var k searchKey
+		if len(rest) > 0 {
+			k, rest, err = sess.parseSearchKey(rest)
+		} else {
+			err = errSyntax
+		}
+		key = func(mb *mailbox, i int) bool { return !k(mb, i) }
+	case "OR":
+		var k1, k2 searchKey
+		if len(rest) > 1 {
+			k1, rest, err = sess.parseSearchKey(rest)
+		} else {
+			err = errSyntax
+		}
+		if err == nil && len(rest) > 0 {
+			k2, rest, err = sess.parseSearchKey(rest)
+		} else if err == nil {
+			err = errSyntax
+		}
+		key = func(mb *mailbox, i int) bool { return k1(mb, i) || k2(mb, i) }
+	case "UID":
+		var set seqSet
+		err = errSyntax
+		if len(rest) > 0 {
+			if str, ok := rest[0].(string); ok {
+				set, err = parseSeqSet(str)
+				rest = rest[1:]
+			}
+		}
+		key = func(mb *mailbox, i int) bool { return set.contains(mb.msgs[i].uid, mb.largestUID()) }
+	case "EMAILID", "THREADID":
+		var id string
+		err = errSyntax
+		if len(rest) > 0 {
+			id, _ = rest[0].(string)
+			if id != "" {
+				err = nil
+			}
+			rest = rest[1:]
+		}
+		objectID := emailID
+		if name == "THREADID" {
+			objectID = threadID
+		}
+		key = func(mb *mailbox, i int) bool {
+			body, e := mb.read(i)
+			return e == nil && objectID(toCRLF(body)) == id
+		}
+	case "MODSEQ":
+		// every flag shares one modseq so an entry name and type are skipped
+		if len(rest) > 2 {
+			if str, ok := rest[0].(string); ok && strings.HasPrefix(str, "/") {
+				rest = rest[2:]
+			}
+		}
+		var n uint64
+		err = errSyntax
+		if len(rest) > 0 {
+			if str, ok := rest[0].(string); ok {
+				n, err = strconv.ParseUint(str, 10, 64)
+				rest = rest[1:]
+			}
+		}
+		key = func(mb *mailbox, i int) bool { return mb.msgs[i].modseq >= n }
+	default:
+		var set seqSet
+		set, err = parseSeqSet(str)
+		if err != nil {
+			err = fmt.Errorf("unsupported search key %s", str)
+		}
+		key = func(mb *mailbox, i int) bool { return set.contains(uint32(i+1), uint32(len(mb.msgs))) }
+	}
+	return
+}
+
+// handle SEARCH
+func (sess *session) search(tag string, args list) error {
+	return sess.searchWith(tag, args, false)
+}
+
+// handle SEARCH [CHARSET charset] keys
+func (sess *session) searchWith(tag string, args list, uid bool) (err error) {
+	if len(args) > 1 {
+		if str, _ := args[0].(string); strings.EqualFold(str, "CHARSET") {
+			charset, _ := args[1].(string)
+			if !strings.EqualFold(charset, "US-ASCII") && !strings.EqualFold(charset, "UTF-8") {
+				return sess.no(tag, "[BADCHARSET (US-ASCII UTF-8)] Unsupported charset")
+			}
+			args = args[2:]
+		}
+	}
+	if len(args) == 0 {
+		return sess.bad(tag, "Syntax: SEARCH keys")
+	}
+	key, e := sess.parseSearch(args)
+	if e != nil {
+		return sess.bad(tag, "Bad search: "+e.Error())
+	}
+	mb := sess.mbox
+	res := "SEARCH"
+	var highest uint64
+	for i, m := range mb.msgs {
+		if key(mb, i) {
+			if uid {
+				res += " " + strconv.FormatUint(uint64(m.uid), 10)
+			} else {
+				res += " " + strconv.Itoa(i+1)
+			}
+			if m.modseq > highest {
+				highest = m.modseq
+			}
+		}
+	}
+	if usesModSeq(args) {
+		sess.condstore = true
+		if highest > 0 {
+			res += " (MODSEQ " + strconv.FormatUint(highest, 10) + ")"
+		}
+	}
+	err = sess.untagged(res)
+	if err == nil {
+		err = sess.ok(tag, sess.cmd+" completed")
+	}
+	return
+}
@@ -0,0 +1,50 @@
+package imap
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"strings"
+	"time"
+)
+
+// make a middleware that counts commands by name and status and records how long they take
+// the collectors are registered with reg, commands we don't know are counted as UNKNOWN
+func MetricsMiddleware(reg prometheus.Registerer) IMAPMiddleware {
+	commands := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "bdsmail",
+		Subsystem: "imap",
+		Name:      "commands_total",
+		Help:      "IMAP commands handled by command and status.",
+	}, []string{"command", "status"})
+	durations := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "bdsmail",
+		Subsystem: "imap",
+		Name:      "command_duration_seconds",
+		Help:      "Time taken handling IMAP commands.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"command"})
+	reg.MustRegister(commands, durations)
+	return func(next CommandHandler) CommandHandler {
+		return func(cmd *Command) (err error) {
+			start := time.Now()
+			err = next(cmd)
+			name := metricName(cmd.Name)
+			durations.WithLabelValues(name).Observe(time.Since(start).Seconds())
+			if cmd.Status != "" {
+				commands.WithLabelValues(name, cmd.Status).Inc()
+			}
+			return
+		}
+	}
+}
+
+// get a command's label, clients can send anything so unknown names are collapsed
+func metricName(name string) string {
+	if strings.HasPrefix(name, "UID ") {
+		if uidCommands[name[len("UID "):]] {
+			return name
+		}
+	} else if _, ok := commands[name]; ok && name != "UID" {
+		return name
+	}
+	return "UNKNOWN"
+}
@@ -0,0 +1,118 @@
+package imap
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// a command as middleware sees it
+type Command struct {
+	// tag the client gave
+	Tag string
+	// command name in upper case, UID commands are named like "UID FETCH"
+	Name string
+	// arguments after the name, each a string or a []interface{} for a parenthesized list
+	Args []interface{}
+	// user logged in, empty before login
+	User string
+	// client address
+	Addr net.Addr
+	// OK, NO or BAD from the tagged response, set once the command ran
+	Status string
+}
+
+// runs a command and sends its responses
+// the error is one talking to the client and ends the session
+type CommandHandler func(cmd *Command) error
+
+// wraps command handling like net/http middleware
+type IMAPMiddleware func(next CommandHandler) CommandHandler
+
+// something to log to, a *log.Logger or a logrus logger
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+// make a middleware that logs every command with its arguments, status and duration
+// passwords and long literals are left out
+func LoggingMiddleware(logger Logger) IMAPMiddleware {
+	return func(next CommandHandler) CommandHandler {
+		return func(cmd *Command) (err error) {
+			start := time.Now()
+			err = next(cmd)
+			user := cmd.User
+			if user == "" {
+				user = "-"
+			}
+			logger.Printf("imap %s %s %s %s %s: %s in %s", cmd.Addr, user, cmd.Tag, cmd.Name, formatArgs(cmd), cmd.Status, time.Since(start))
+			return
+		}
+	}
+}
+
+// longest argument logged as is
+const maxLoggedArg = 64
+
+// format a command's arguments for logging
+func formatArgs(cmd *Command) string {
+	switch cmd.Name {
+	case "LOGIN":
+		if len(cmd.Args) > 0 {
+			return formatArg(cmd.Args[0]) + " ***"
+		}
+	case "AUTHENTICATE":
+		if len(cmd.Args) > 0 {
+			return formatArg(cmd.Args[0]) + " ***"
+		}
+	}
+	return formatArg(cmd.Args)
+}
+
+func formatArg(arg interface{}) string {
+	switch a := arg.(type) {
+	case []interface{}:
+		var strs []string
+		for _, e := range a {
+			str := formatArg(e)
+			if _, isList := e.([]interface{}); isList {
+				str = "(" + str + ")"
+			}
+			strs = append(strs, str)
+		}
+		return strings.Join(strs, " ")
+	case string:
+		if len(a) > maxLoggedArg || strings.ContainsAny(a, "\r\n") {
+			return fmt.Sprintf("{%d}", len(a))
+		}
+		return a
+	}
+	return ""
+}
+
+// turn read arguments into what middleware sees
+func (l list) plain() []interface{} {
+	args := make([]interface{}, len(l))
+	for i, a := range l {
+		if nested, isList := a.(list); isList {
+			args[i] = nested.plain()
+		} else {
+			args[i] = a
+		}
+	}
+	return args
+}
+
+// turn arguments middleware saw back into what handlers take
+func fromPlain(args []interface{}) list {
+	l := make(list, len(args))
+	for i, a := range args {
+		if nested, isList := a.([]interface{}); isList {
+			l[i] = fromPlain(nested)
+		} else {
+			l[i] = a
+		}
+	}
+	return l
+}
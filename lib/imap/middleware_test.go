@@ -0,0 +1,99 @@
+package imap
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// collects log lines
+type testLogger struct {
+	mtx   sync.Mutex
+	lines []string
+}
+
+func (l *testLogger) Printf(format string, args ...interface{}) {
+	l.mtx.Lock()
+	l.lines = append(l.lines, fmt.Sprintf(format, args...))
+	l.mtx.Unlock()
+}
+
+func TestMiddleware(t *testing.T) {
+	logger := new(testLogger)
+	reg := prometheus.NewRegistry()
+	var order []string
+	trace := func(name string) IMAPMiddleware {
+		return func(next CommandHandler) CommandHandler {
+			return func(cmd *Command) error {
+				order = append(order, name)
+				return next(cmd)
+			}
+		}
+	}
+	_, addr, _ := testServer(t, func(s *Server) {
+		s.Use(LoggingMiddleware(logger), MetricsMiddleware(reg)).Use(trace("first"), trace("second"))
+	})
+	c := testClient(t, addr)
+	if _, err := c.Select("INBOX", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Select("Missing", false); err == nil {
+		t.Fatal("selected a missing mailbox")
+	}
+	if err := c.Noop(); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(order[:2], " ") != "first second" {
+		t.Fatalf("middleware ran in order %q", order)
+	}
+	logger.mtx.Lock()
+	logged := strings.Join(logger.lines, "\n")
+	logger.mtx.Unlock()
+	if !strings.Contains(logged, "LOGIN alice ***: OK") || strings.Contains(logged, "secret") {
+		t.Fatalf("login logged as %q", logged)
+	}
+	if !strings.Contains(logged, "alice") || !strings.Contains(logged, "SELECT Missing: NO") {
+		t.Fatalf("select logged as %q", logged)
+	}
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[string]float64)
+	observed := uint64(0)
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			if f.GetName() == "bdsmail_imap_commands_total" {
+				var labels []string
+				for _, l := range m.GetLabel() {
+					labels = append(labels, l.GetValue())
+				}
+				counts[strings.Join(labels, " ")] = m.GetCounter().GetValue()
+			} else if f.GetName() == "bdsmail_imap_command_duration_seconds" {
+				observed += m.GetHistogram().GetSampleCount()
+			}
+		}
+	}
+	if counts["SELECT OK"] != 1 || counts["SELECT NO"] != 1 || counts["LOGIN OK"] != 1 || counts["NOOP OK"] != 1 {
+		t.Fatalf("counted %v", counts)
+	}
+	if observed < 4 {
+		t.Fatalf("observed %d durations", observed)
+	}
+}
+
+func TestMetricName(t *testing.T) {
+	for name, label := range map[string]string{
+		"FETCH":     "FETCH",
+		"UID FETCH": "UID FETCH",
+		"UID":       "UNKNOWN",
+		"UID NOOP":  "UNKNOWN",
+		"XYZZY":     "UNKNOWN",
+	} {
+		if metricName(name) != label {
+			t.Errorf("%s labelled %s", name, metricName(name))
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/mail"
+	"strings"
+)
+
+// make an object id from a prefix and a hash of data
+// ids only use letters, digits, - and _ as the OBJECTID extension needs
+func objectID(prefix string, data []byte) string {
+	sum := sha256.Sum256(data)
+	return prefix + base64.RawURLEncoding.EncodeToString(sum[:18])
+}
+
+// get the EMAILID of a message from RFC 8474
+// it is a hash of the message with crlf line endings so copies of it
+// in any mailbox have the same id
+func emailID(body []byte) string {
+	return objectID("M", body)
+}
+
+// get the THREADID of a message from RFC 8474
+// messages in a thread share the first message id in References, falling back to
+// In-Reply-To and then their own Message-Id, a message with none is its own thread
+func threadID(body []byte) string {
+	header, _ := splitMessage(body)
+	var h mail.Header
+	if m, err := mail.ReadMessage(bufio.NewReader(bytes.NewReader(header))); err == nil {
+		h = m.Header
+	}
+	for _, key := range []string{"References", "In-Reply-To", "Message-Id"} {
+		if ids := strings.Fields(h.Get(key)); len(ids) > 0 {
+			return objectID("T", []byte(ids[0]))
+		}
+	}
+	return objectID("T", body)
+}
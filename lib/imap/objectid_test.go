@@ -0,0 +1,64 @@
+package imap
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestObjectID(t *testing.T) {
+	_, addr, a := testServer(t)
+	archive, err := a.dir.EnsureFolder("Archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := "Message-Id: <first@example.com>\r\nSubject: hi\r\n\r\nbody\r\n"
+	reply := "Message-Id: <reply@example.com>\r\nReferences: <first@example.com>\r\nSubject: re: hi\r\n\r\nreply\r\n"
+	other := "Message-Id: <other@example.com>\r\nSubject: other\r\n\r\nother\r\n"
+	for _, body := range []string{original, reply, other} {
+		if _, _, err = a.dir.Append(strings.NewReader(body), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err = archive.Append(strings.NewReader(original), nil); err != nil {
+		t.Fatal(err)
+	}
+	thread := threadID([]byte(original))
+	if threadID([]byte(reply)) != thread || threadID([]byte(other)) == thread {
+		t.Fatal("replies aren't threaded with what they reference")
+	}
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(c)
+	if greeting, _ := r.ReadString('\n'); !strings.Contains(greeting, "OBJECTID") {
+		t.Fatalf("OBJECTID not offered: %q", greeting)
+	}
+	command := rawCommand(t, c, r)
+	command("a", "LOGIN alice secret")
+	command("b", "SELECT INBOX")
+	untagged, _ := command("c", "UID FETCH 1:* (EMAILID THREADID)")
+	got := make(map[string]bool)
+	for _, line := range untagged {
+		got[line[strings.Index(line, "EMAILID"):]] = true
+	}
+	for _, body := range []string{original, reply, other} {
+		want := "EMAILID (" + emailID([]byte(body)) + ") THREADID (" + threadID([]byte(body)) + "))"
+		if !got[want] {
+			t.Fatalf("%q not in %q", want, untagged)
+		}
+	}
+	if untagged, _ = command("d", "SEARCH THREADID "+thread); len(untagged) != 1 || len(strings.Fields(untagged[0])) != 4 {
+		t.Fatalf("search for the thread gave %q", untagged)
+	}
+	// a copy has the same EMAILID in another mailbox
+	command("e", "SELECT Archive")
+	if untagged, _ = command("f", "SEARCH EMAILID "+emailID([]byte(original))); len(untagged) != 1 || untagged[0] != "* SEARCH 1" {
+		t.Fatalf("search for the copy gave %q", untagged)
+	}
+}
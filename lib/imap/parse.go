@@ -0,0 +1,336 @@
+package imap
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+var errSyntax = errors.New("syntax error")
+var errTooBig = errors.New("literal too big")
+var errCommandTooBig = errors.New("command too big")
+
+// longest atom or quoted string we read
+const maxString = 8192
+
+// deepest nesting of parenthesized lists we read
+const maxDepth = 16
+
+// most bytes a command may take besides its literals after login
+// before login this covers the literals too
+const maxCommandSize = 64 * 1024
+
+// a parenthesized list of arguments
+// each element is a string for atoms, quoted strings and literals or a nested list
+type list []interface{}
+
+// get the strings in a list, false if it holds a nested list
+func (l list) strings() (strs []string, ok bool) {
+	for _, a := range l {
+		str, isStr := a.(string)
+		if !isStr {
+			return nil, false
+		}
+		strs = append(strs, str)
+	}
+	return strs, true
+}
+
+// read a byte of the command being read
+// returns errCommandTooBig once the command has used up what it may take
+func (sess *session) readByte() (c byte, err error) {
+	if sess.left <= 0 {
+		err = errCommandTooBig
+		return
+	}
+	c, err = sess.r.ReadByte()
+	if err == nil {
+		sess.left--
+	}
+	return
+}
+
+// give back the last byte read with readByte
+func (sess *session) unreadByte() {
+	if sess.r.UnreadByte() == nil {
+		sess.left++
+	}
+}
+
+// read a line of the command being read, with its line ending
+func (sess *session) readLine() (line string, err error) {
+	var sb strings.Builder
+	for err == nil && !strings.HasSuffix(sb.String(), "\n") {
+		var c byte
+		c, err = sess.readByte()
+		if err == nil {
+			sb.WriteByte(c)
+		}
+	}
+	line = sb.String()
+	return
+}
+
+// skip the rest of a command line we can't parse
+func (sess *session) skipLine() (err error) {
+	for c := byte(0); err == nil && c != '\n'; {
+		c, err = sess.readByte()
+	}
+	return
+}
+
+// read a command line as its tag and arguments, the command name is the first argument
+// returns errSyntax with the line consumed if it was bad
+// returns errTooBig if a literal was refused, the client sends nothing more for a
+// {n} literal and the rest of the command is consumed after a {n+} one
+// returns errCommandTooBig if the command is bigger than we read, the session can't go on
+func (sess *session) readCommand() (tag string, args list, err error) {
+	sess.tooBig = false
+	sess.left = maxCommandSize
+	if sess.user != "" {
+		sess.left += sess.s.maxLiteralSize()
+	}
+	args, err = sess.readArgs(0)
+	if err == errSyntax {
+		// the rest of the line means nothing now
+		err = sess.skipLine()
+		if err == nil {
+			err = errSyntax
+		}
+	}
+	if len(args) > 0 {
+		tag, _ = args[0].(string)
+		args = args[1:]
+	}
+	if err == nil && tag == "" && len(args) > 0 {
+		err = errSyntax
+	}
+	if err == nil && sess.tooBig {
+		err = errTooBig
+	}
+	return
+}
+
+// read arguments up to the end of the line or the end of a list nested depth deep
+func (sess *session) readArgs(depth int) (args list, err error) {
+	for {
+		var c byte
+		c, err = sess.readByte()
+		if err != nil {
+			return
+		}
+		var arg interface{}
+		switch c {
+		case ' ', '\r':
+			continue
+		case '\n':
+			if depth > 0 {
+				// leave the newline for skipLine
+				sess.unreadByte()
+				err = errSyntax
+			}
+			return
+		case ')':
+			if depth == 0 {
+				err = errSyntax
+			}
+			return
+		case '(':
+			if depth >= maxDepth {
+				err = errSyntax
+				return
+			}
+			arg, err = sess.readArgs(depth + 1)
+		case '"':
+			arg, err = sess.readQuoted()
+		case '{':
+			arg, err = sess.readLiteral()
+		default:
+			sess.unreadByte()
+			arg, err = sess.readAtom()
+		}
+		if err != nil {
+			return
+		}
+		args = append(args, arg)
+	}
+}
+
+// read an atom up to a space, parenthesis or the end of the line
+// a [section] in an atom may hold spaces and parentheses as in BODY[HEADER.FIELDS (FROM)]
+func (sess *session) readAtom() (str string, err error) {
+	var sb strings.Builder
+	bracket := false
+	for {
+		var c byte
+		c, err = sess.readByte()
+		if err != nil {
+			return
+		}
+		if c == '\r' || c == '\n' || (!bracket && (c == ' ' || c == '(' || c == ')')) {
+			sess.unreadByte()
+			if bracket || sb.Len() == 0 {
+				err = errSyntax
+			}
+			return sb.String(), err
+		}
+		if sb.Len() >= maxString || (!bracket && (c == '"' || c == '{')) {
+			sess.unreadByte()
+			err = errSyntax
+			return
+		}
+		if c == '[' {
+			bracket = true
+		} else if c == ']' {
+			bracket = false
+		}
+		sb.WriteByte(c)
+	}
+}
+
+// read a quoted string after its opening quote
+func (sess *session) readQuoted() (str string, err error) {
+	var sb strings.Builder
+	for {
+		var c byte
+		c, err = sess.readByte()
+		if err != nil {
+			return
+		}
+		switch c {
+		case '"':
+			return sb.String(), nil
+		case '\\':
+			c, err = sess.readByte()
+			if err != nil {
+				return
+			}
+		case '\r', '\n':
+			sess.unreadByte()
+			err = errSyntax
+			return
+		}
+		if sb.Len() >= maxString {
+			err = errSyntax
+			return
+		}
+		sb.WriteByte(c)
+	}
+}
+
+// read a {n} or non-synchronizing {n+} literal after its opening brace
+// the client waits for a continuation before sending a {n} literal
+// literals over the size limit are refused with errTooBig, a {n+} literal was
+// sent anyway so it is skipped and the rest of the command is read before
+// readCommand refuses the command
+// before login literals can't be bigger than a string so only APPEND takes big ones
+func (sess *session) readLiteral() (str string, err error) {
+	var spec string
+	spec, err = sess.readLine()
+	if err != nil {
+		return
+	}
+	spec = strings.TrimRight(spec, "\r\n")
+	if !strings.HasSuffix(spec, "}") {
+		// we ate the line so give back its newline to be skipped
+		sess.unreadByte()
+		err = errSyntax
+		return
+	}
+	spec = strings.TrimSuffix(spec, "}")
+	sync := !strings.HasSuffix(spec, "+")
+	n, perr := strconv.ParseInt(strings.TrimSuffix(spec, "+"), 10, 64)
+	if perr != nil || n < 0 {
+		sess.unreadByte()
+		err = errSyntax
+		return
+	}
+	limit := int64(maxString)
+	if sess.user != "" {
+		limit = sess.s.maxLiteralSize()
+	}
+	if n > limit || n > sess.left {
+		if sync {
+			err = errTooBig
+		} else if n > sess.left {
+			// too much to even skip
+			err = errCommandTooBig
+		} else {
+			sess.tooBig = true
+			sess.left -= n
+			_, err = io.CopyN(ioutil.Discard, sess.r, n)
+		}
+		return
+	}
+	if sync {
+		err = sess.line("+ Ready for literal data")
+	}
+	if err == nil {
+		sess.left -= n
+		buf := make([]byte, n)
+		_, err = io.ReadFull(sess.r, buf)
+		str = string(buf)
+	}
+	return
+}
+
+// a range in a sequence set, 0 stands for *
+type seqRange struct {
+	lo, hi uint32
+}
+
+// a sequence set of message numbers or uids like 1:3,5,7:*
+type seqSet []seqRange
+
+// parse a sequence set
+func parseSeqSet(str string) (set seqSet, err error) {
+	for _, part := range strings.Split(str, ",") {
+		var r seqRange
+		bounds := strings.SplitN(part, ":", 2)
+		r.lo, err = parseSeqNumber(bounds[0])
+		r.hi = r.lo
+		if err == nil && len(bounds) == 2 {
+			r.hi, err = parseSeqNumber(bounds[1])
+		}
+		if err != nil {
+			return nil, err
+		}
+		set = append(set, r)
+	}
+	return
+}
+
+func parseSeqNumber(str string) (n uint32, err error) {
+	if str == "*" {
+		return
+	}
+	v, e := strconv.ParseUint(str, 10, 32)
+	if e != nil || v == 0 {
+		err = errSyntax
+	} else {
+		n = uint32(v)
+	}
+	return
+}
+
+// check if a number is in the set, * stands for largest
+func (set seqSet) contains(n, largest uint32) bool {
+	for _, r := range set {
+		lo, hi := r.lo, r.hi
+		if lo == 0 {
+			lo = largest
+		}
+		if hi == 0 {
+			hi = largest
+		}
+		if lo > hi {
+			lo, hi = hi, lo
+		}
+		if n >= lo && n <= hi {
+			return true
+		}
+	}
+	return false
+}
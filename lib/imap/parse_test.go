@@ -0,0 +1,55 @@
+package imap
+
+import (
+	"testing"
+)
+
+func TestSeqSet(t *testing.T) {
+	set, err := parseSeqSet("1:3,5,7:*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		n, largest uint32
+		in         bool
+	}{
+		{1, 10, true},
+		{3, 10, true},
+		{4, 10, false},
+		{5, 10, true},
+		{6, 10, false},
+		{7, 10, true},
+		{10, 10, true},
+		// 7:* is 5:7 when the largest is 5
+		{6, 6, true},
+	} {
+		if set.contains(tc.n, tc.largest) != tc.in {
+			t.Errorf("%d in 1:3,5,7:* with largest %d is %v", tc.n, tc.largest, !tc.in)
+		}
+	}
+	for _, bad := range []string{"", "0", "1:", "a", "1,,2", "-1"} {
+		if _, err = parseSeqSet(bad); err == nil {
+			t.Errorf("parsed %q", bad)
+		}
+	}
+}
+
+func TestMatchMailbox(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, name string
+		match         bool
+	}{
+		{"*", "INBOX", true},
+		{"*", "Lists.go", true},
+		{"%", "Lists", true},
+		{"%", "Lists.go", false},
+		{"Lists.%", "Lists.go", true},
+		{"Lists*", "Lists.go.dev", true},
+		{"L%s", "Lists", true},
+		{"Sent", "Lists", false},
+	} {
+		if matchMailbox(tc.pattern, tc.name) != tc.match {
+			t.Errorf("%q matching %q is %v", tc.pattern, tc.name, !tc.match)
+		}
+	}
+}
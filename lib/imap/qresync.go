@@ -0,0 +1,162 @@
+package imap
+
+import (
+	"errors"
+	"fmt"
+	"github.com/majestrate/bdsmail/lib/maildir"
+	"strconv"
+	"strings"
+)
+
+// what a client knew when it last synced a mailbox, from SELECT's QRESYNC parameter
+type qresyncParam struct {
+	validity uint32
+	modseq   uint64
+	// uids the client knows of, nil for all of them
+	known seqSet
+}
+
+// handle ENABLE capabilities from RFC 5161
+// QRESYNC enables CONDSTORE too, anything we don't know is ignored
+func (sess *session) enable(tag string, args list) (err error) {
+	names, ok := args.strings()
+	if !ok || len(names) == 0 {
+		return sess.bad(tag, "Syntax: ENABLE capabilities")
+	}
+	if sess.mbox != nil {
+		return sess.bad(tag, "ENABLE is not allowed with a mailbox selected")
+	}
+	var enabled []string
+	for _, name := range names {
+		switch strings.ToUpper(name) {
+		case "CONDSTORE":
+			sess.condstore = true
+			enabled = append(enabled, "CONDSTORE")
+		case "QRESYNC":
+			sess.condstore = true
+			sess.qresync = true
+			enabled = append(enabled, "QRESYNC")
+		}
+	}
+	err = sess.untagged(strings.TrimSpace("ENABLED " + strings.Join(enabled, " ")))
+	if err == nil {
+		err = sess.ok(tag, "ENABLE completed")
+	}
+	return
+}
+
+// parse the parameter list of SELECT and EXAMINE, either (CONDSTORE) or
+// (QRESYNC (uidvalidity modseq [known-uids [seq-match]])) once QRESYNC is enabled
+// the sequence match data is taken but not used
+func (sess *session) parseSelectParam(arg interface{}) (resync *qresyncParam, ok bool) {
+	l, isList := arg.(list)
+	if !isList || len(l) == 0 {
+		return
+	}
+	name, _ := l[0].(string)
+	name = strings.ToUpper(name)
+	if name == "CONDSTORE" && len(l) == 1 {
+		ok = true
+		return
+	}
+	if name != "QRESYNC" || len(l) != 2 || !sess.qresync {
+		return
+	}
+	params, isList := l[1].(list)
+	if !isList || len(params) < 2 || len(params) > 4 {
+		return
+	}
+	strs, isStrings := params[:2].strings()
+	if !isStrings {
+		return
+	}
+	resync = new(qresyncParam)
+	validity, e := strconv.ParseUint(strs[0], 10, 32)
+	if e == nil {
+		resync.validity = uint32(validity)
+		resync.modseq, e = strconv.ParseUint(strs[1], 10, 64)
+	}
+	if e == nil && len(params) > 2 {
+		known, isString := params[2].(string)
+		if isString {
+			resync.known, e = parseSeqSet(known)
+		} else {
+			e = errSyntax
+		}
+	}
+	ok = e == nil && resync.validity > 0 && resync.modseq > 0
+	return
+}
+
+// tell a client what changed in the selected mailbox since it last synced
+// messages removed since are VANISHED and messages changed since are fetched
+// if removals that far back were forgotten every uid not in the mailbox is
+// VANISHED and every message fetched, clients ignore uids they never had
+// nothing is sent if the mailbox isn't the one the client synced with
+// e is an error reading the mailbox, err an error talking to the client
+func (sess *session) resync(resync *qresyncParam) (e, err error) {
+	mb := sess.mbox
+	if resync.validity != mb.validity {
+		return
+	}
+	full := false
+	var uids []uint32
+	uids, e = mb.dir.ExpungedSince(resync.modseq)
+	if errors.Is(e, maildir.ErrExpungesTrimmed) {
+		full = true
+		e = nil
+	}
+	if e != nil {
+		return
+	}
+	var vanished string
+	if full {
+		vanished = mb.missing()
+	} else {
+		var known []uint32
+		for _, uid := range uids {
+			if uid < mb.next && (resync.known == nil || resync.known.contains(uid, mb.next-1)) {
+				known = append(known, uid)
+			}
+		}
+		vanished = numberSet(known)
+	}
+	if vanished != "" {
+		err = sess.untagged("VANISHED (EARLIER) " + vanished)
+	}
+	for i := 0; i < len(mb.msgs) && err == nil; i++ {
+		m := &mb.msgs[i]
+		if full || m.modseq > resync.modseq {
+			err = sess.untagged(fmt.Sprintf("%d FETCH (UID %d %s)", i+1, m.uid, sess.flagsItem(m)))
+		}
+	}
+	return
+}
+
+// get the uids below the next one that aren't in the mailbox as a sequence set
+func (mb *mailbox) missing() string {
+	var strs []string
+	gap := func(first, last uint32) {
+		if first == last {
+			strs = append(strs, strconv.FormatUint(uint64(first), 10))
+		} else if first < last {
+			strs = append(strs, fmt.Sprintf("%d:%d", first, last))
+		}
+	}
+	var prev uint32
+	for _, m := range mb.msgs {
+		gap(prev+1, m.uid-1)
+		prev = m.uid
+	}
+	gap(prev+1, mb.next-1)
+	return strings.Join(strs, ",")
+}
+
+// tell the client a message in the selected mailbox is gone
+// it is VANISHED by uid once the client enabled QRESYNC
+func (sess *session) expunged(i int, uid uint32) error {
+	if sess.qresync {
+		return sess.untagged(fmt.Sprintf("VANISHED %d", uid))
+	}
+	return sess.untagged(fmt.Sprintf("%d EXPUNGE", i+1))
+}
@@ -0,0 +1,134 @@
+package imap
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	log "github.com/Sirupsen/logrus"
+	"github.com/majestrate/bdsmail/lib/maildir"
+	"net"
+	"time"
+)
+
+// largest literal we take by default, this bounds APPEND
+const DefaultMaxLiteralSize = 64 * 1024 * 1024
+
+// how long a client may be idle before we log it out, RFC 3501 asks for at least 30 minutes
+const DefaultAutologout = 30 * time.Minute
+
+// checks login credentials
+type Authenticator interface {
+	// check a username and password given with LOGIN or AUTHENTICATE PLAIN
+	Authenticate(username, password string) (bool, error)
+}
+
+// maps users to their maildir
+// the maildir is INBOX and its maildir++ folders are the other mailboxes
+type Router interface {
+	Route(user string) (maildir.MailDir, error)
+}
+
+// imap server
+type Server struct {
+	// hostname we announce ourselves as
+	Hostname string
+	// checks logins
+	Auth Authenticator
+	// maps users to maildirs
+	Router Router
+	// largest literal in bytes, 0 for DefaultMaxLiteralSize
+	MaxLiteralSize int64
+	// idle time before a client is logged out, 0 for DefaultAutologout
+	Autologout time.Duration
+	// allow LOGIN without tls, only for connections that can't be snooped on
+	AllowInsecureAuth bool
+
+	// unexported fields
+
+	// listener for serving
+	listener net.Listener
+	// tls config for STARTTLS, nil to not offer it
+	tlsConfig *tls.Config
+	// cas client certificates must be signed by, nil to not ask for them
+	clientCAs *x509.CertPool
+	// wraps every command in order
+	middleware []IMAPMiddleware
+}
+
+// offer STARTTLS with a tls config
+func (s *Server) WithTLS(cfg *tls.Config) *Server {
+	s.tlsConfig = cfg
+	return s
+}
+
+// add middleware wrapping every command
+// middleware runs in the order it was added
+func (s *Server) Use(middlewares ...IMAPMiddleware) *Server {
+	s.middleware = append(s.middleware, middlewares...)
+	return s
+}
+
+func (s *Server) maxLiteralSize() int64 {
+	if s.MaxLiteralSize > 0 {
+		return s.MaxLiteralSize
+	}
+	return DefaultMaxLiteralSize
+}
+
+func (s *Server) autologout() time.Duration {
+	if s.Autologout > 0 {
+		return s.Autologout
+	}
+	return DefaultAutologout
+}
+
+// serve imap on a tcp address, usually port 143
+// blocks until the server is closed
+func (s *Server) ListenAndServe(addr string) (err error) {
+	var l net.Listener
+	l, err = net.Listen("tcp", addr)
+	if err == nil {
+		err = s.Serve(l)
+	}
+	return
+}
+
+// serve imap on an existing listener
+// blocks until the server is closed
+func (s *Server) Serve(l net.Listener) (err error) {
+	s.listener = l
+	log.Info("Serving IMAP server on ", l.Addr())
+	for {
+		var c net.Conn
+		c, err = l.Accept()
+		if err != nil {
+			break
+		}
+		go s.handle(c)
+	}
+	log.Info("IMAP server ended")
+	return
+}
+
+// stop serving
+func (s *Server) Close() (err error) {
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	return
+}
+
+// handle an inbound connection
+func (s *Server) handle(c net.Conn) {
+	sess := newSession(s, c)
+	sess.run()
+	sess.c.Close()
+}
+
+// create a new imap server
+func New(hostname string, auth Authenticator, router Router) *Server {
+	return &Server{
+		Hostname: hostname,
+		Auth:     auth,
+		Router:   router,
+	}
+}
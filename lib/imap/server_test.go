@@ -0,0 +1,492 @@
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	goimap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/majestrate/bdsmail/lib/maildir"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// one user with one password and maildir
+type testAuth struct {
+	user, pass string
+	dir        maildir.MailDir
+}
+
+func (a *testAuth) Authenticate(user, pass string) (bool, error) {
+	return user == a.user && pass == a.pass, nil
+}
+
+func (a *testAuth) Route(user string) (maildir.MailDir, error) {
+	return a.dir, nil
+}
+
+// start a server for one user on a random port, setup is run on it before it serves
+func testServer(t *testing.T, setup ...func(s *Server)) (*Server, string, *testAuth) {
+	a := &testAuth{user: "alice", pass: "secret", dir: maildir.MailDir(t.TempDir())}
+	if err := a.dir.Ensure(); err != nil {
+		t.Fatal(err)
+	}
+	s := New("localhost", a, a)
+	s.AllowInsecureAuth = true
+	for _, f := range setup {
+		f(s)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	return s, l.Addr().String(), a
+}
+
+// dial a server and log in
+func testClient(t *testing.T, addr string) *client.Client {
+	c, err := client.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Logout() })
+	if err = c.Login("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestIMAPSelectFetchIntegration(t *testing.T) {
+	_, addr, a := testServer(t)
+	// imap sends crlf line endings
+	want := make(map[string]bool)
+	for i := 0; i < 5; i++ {
+		body := fmt.Sprintf("From: bob@example.com\nTo: alice@example.com\nSubject: test %d\n\nmessage number %d\n", i, i)
+		if _, err := a.dir.Deliver(strings.NewReader(body)); err != nil {
+			t.Fatal(err)
+		}
+		want[strings.Replace(body, "\n", "\r\n", -1)] = true
+	}
+	c := testClient(t, addr)
+	mbox, err := c.Select("INBOX", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mbox.Messages != 5 || mbox.UidNext != 6 || mbox.UidValidity == 0 {
+		t.Fatalf("selected %d messages, uidnext %d, uidvalidity %d", mbox.Messages, mbox.UidNext, mbox.UidValidity)
+	}
+	seq := new(goimap.SeqSet)
+	seq.AddRange(1, 5)
+	msgs := make(chan *goimap.Message, 5)
+	section, _ := goimap.ParseBodySectionName(goimap.FetchRFC822)
+	if err = c.Fetch(seq, []goimap.FetchItem{goimap.FetchUid, goimap.FetchRFC822}, msgs); err != nil {
+		t.Fatal(err)
+	}
+	for msg := range msgs {
+		r := msg.GetBody(section)
+		if r == nil {
+			t.Fatalf("message %d has no body", msg.SeqNum)
+		}
+		data, _ := ioutil.ReadAll(r)
+		if !want[string(data)] {
+			t.Fatalf("message %d is %q", msg.SeqNum, data)
+		}
+		delete(want, string(data))
+		// messages are numbered in uid order
+		if msg.Uid != msg.SeqNum {
+			t.Fatalf("message %d has uid %d", msg.SeqNum, msg.Uid)
+		}
+	}
+	if len(want) != 0 {
+		t.Fatalf("%d messages not fetched", len(want))
+	}
+	// RFC822 marks messages seen
+	unseen, err := a.dir.ListUnseen()
+	if err != nil || len(unseen) != 0 {
+		t.Fatalf("unseen after fetch %q %v", unseen, err)
+	}
+}
+
+func TestIMAPStoreExpunge(t *testing.T) {
+	_, addr, a := testServer(t)
+	for i := 0; i < 3; i++ {
+		a.dir.Deliver(strings.NewReader(fmt.Sprintf("Subject: %d\n\nbody\n", i)))
+	}
+	c := testClient(t, addr)
+	if _, err := c.Select("INBOX", false); err != nil {
+		t.Fatal(err)
+	}
+	seq := new(goimap.SeqSet)
+	seq.AddNum(2)
+	if err := c.Store(seq, goimap.FormatFlagsOp(goimap.AddFlags, true), []interface{}{goimap.DeletedFlag}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Expunge(nil); err != nil {
+		t.Fatal(err)
+	}
+	ids, err := c.UidSearch(&goimap.SearchCriteria{WithoutFlags: []string{goimap.DeletedFlag}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(ids) != "[1 3]" {
+		t.Fatalf("uids left %v", ids)
+	}
+	// another delivery shows up on NOOP
+	a.dir.Deliver(strings.NewReader("Subject: late\n\nbody\n"))
+	if err = c.Noop(); err != nil {
+		t.Fatal(err)
+	}
+	if c.Mailbox().Messages != 3 {
+		t.Fatalf("mailbox has %d messages", c.Mailbox().Messages)
+	}
+}
+
+func TestIMAPFolders(t *testing.T) {
+	_, addr, a := testServer(t)
+	c := testClient(t, addr)
+	if err := c.Create("Archive"); err != nil {
+		t.Fatal(err)
+	}
+	body := bytes.NewBufferString("Subject: kept\r\n\r\nbody\r\n")
+	if err := c.Append("Archive", []string{goimap.SeenFlag}, time.Now(), body); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Append("Missing", nil, time.Now(), bytes.NewBufferString("x")); err == nil {
+		t.Fatal("appended to a mailbox that doesn't exist")
+	}
+	boxes := make(chan *goimap.MailboxInfo, 10)
+	if err := c.List("", "*", boxes); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for info := range boxes {
+		names = append(names, info.Name)
+	}
+	if strings.Join(names, " ") != "INBOX Archive" {
+		t.Fatalf("listed %q", names)
+	}
+	status, err := c.Status("Archive", []goimap.StatusItem{goimap.StatusMessages, goimap.StatusUnseen})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Messages != 1 || status.Unseen != 0 {
+		t.Fatalf("archive has %d messages %d unseen", status.Messages, status.Unseen)
+	}
+	msgs, err := a.dir.Folder("Archive").ListCur()
+	if err != nil || len(msgs) != 1 || !msgs[0].HasFlag(maildir.Seen) {
+		t.Fatalf("archive holds %q %v", msgs, err)
+	}
+}
+
+func TestLiteralPlus(t *testing.T) {
+	_, addr, a := testServer(t, func(s *Server) {
+		s.MaxLiteralSize = 64
+	})
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(c)
+	if greeting, _ := r.ReadString('\n'); !strings.Contains(greeting, "LITERAL+") {
+		t.Fatalf("LITERAL+ not offered: %q", greeting)
+	}
+	body := "Subject: hi\r\n\r\nbody\r\n"
+	big := strings.Repeat("x", 100)
+	// everything is sent at once, the server must not wait to send continuations
+	fmt.Fprintf(c, "a LOGIN {5+}\r\nalice {6+}\r\nsecret\r\n")
+	fmt.Fprintf(c, "b APPEND INBOX {%d+}\r\n%s\r\n", len(body), body)
+	fmt.Fprintf(c, "c APPEND INBOX {%d+}\r\n%s\r\n", len(big), big)
+	fmt.Fprintf(c, "d NOOP\r\n")
+	for _, want := range []string{"a OK", "b OK", "c NO [TOOBIG]", "d OK"} {
+		line, err := r.ReadString('\n')
+		for err == nil && strings.HasPrefix(line, "* ") {
+			line, err = r.ReadString('\n')
+		}
+		if err != nil || !strings.HasPrefix(line, want) {
+			t.Fatalf("expected %q got %q %v", want, line, err)
+		}
+	}
+	msgs, _ := a.dir.ListCur()
+	newMsgs, _ := a.dir.ListNew()
+	if len(msgs)+len(newMsgs) != 1 {
+		t.Fatalf("%d messages appended", len(msgs)+len(newMsgs))
+	}
+}
+
+func TestCommandLimits(t *testing.T) {
+	_, addr, _ := testServer(t, func(s *Server) {
+		s.Autologout = time.Second
+	})
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(c)
+	r.ReadString('\n')
+	command := rawCommand(t, c, r)
+	// deep nesting is a syntax error and the session goes on
+	if _, tagged := command("a", "NOOP "+strings.Repeat("(", 1000)); !strings.HasPrefix(tagged, "a BAD") {
+		t.Fatalf("deep nesting gave %q", tagged)
+	}
+	if _, tagged := command("b", "NOOP"); !strings.HasPrefix(tagged, "b OK") {
+		t.Fatalf("session broken after deep nesting: %q", tagged)
+	}
+	// big literals need a login
+	fmt.Fprintf(c, "c LOGIN alice {%d}\r\n", maxString+1)
+	if line, _ := r.ReadString('\n'); !strings.HasPrefix(line, "c NO [TOOBIG]") {
+		t.Fatalf("big literal before login gave %q", line)
+	}
+	// an idle client is logged out
+	if line, _ := r.ReadString('\n'); !strings.HasPrefix(line, "* BYE") {
+		t.Fatalf("expected autologout got %q", line)
+	}
+	if _, err = r.ReadString('\n'); err == nil {
+		t.Fatal("connection still open after autologout")
+	}
+}
+
+func TestIMAPMove(t *testing.T) {
+	_, addr, a := testServer(t)
+	archive, err := a.dir.EnsureFolder("Archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		body := fmt.Sprintf("Subject: %d\r\n\r\nbody\r\n", i)
+		if _, _, err = a.dir.Append(strings.NewReader(body), maildir.NewFlagSet(maildir.Flagged)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := testClient(t, addr)
+	if ok, _ := c.Support("MOVE"); !ok {
+		t.Fatal("MOVE not advertised")
+	}
+	if _, err = c.Select("INBOX", false); err != nil {
+		t.Fatal(err)
+	}
+	updates := make(chan client.Update, 10)
+	c.Updates = updates
+	seq := new(goimap.SeqSet)
+	seq.AddRange(1, 2)
+	if err = c.Move(seq, "Archive"); err != nil {
+		t.Fatal(err)
+	}
+	expunged := 0
+	for len(updates) > 0 {
+		if _, ok := (<-updates).(*client.ExpungeUpdate); ok {
+			expunged++
+		}
+	}
+	if expunged != 2 {
+		t.Fatalf("%d expunges for a move of 2", expunged)
+	}
+	left, _ := a.dir.ListCur()
+	moved, _ := archive.ListCur()
+	if len(left) != 1 || len(moved) != 2 {
+		t.Fatalf("%d left and %d moved", len(left), len(moved))
+	}
+	for _, msg := range moved {
+		if !msg.HasFlag(maildir.Flagged) {
+			t.Fatalf("%s lost its flags", msg)
+		}
+	}
+	seq = new(goimap.SeqSet)
+	seq.AddNum(1)
+	if err = c.UidMove(seq, "Missing"); err == nil {
+		t.Fatal("moved to a mailbox that doesn't exist")
+	}
+}
+
+// make a function sending a command over a raw connection that gets its
+// untagged responses and tagged response
+func rawCommand(t *testing.T, c net.Conn, r *bufio.Reader) func(tag, cmd string) ([]string, string) {
+	return func(tag, cmd string) (untagged []string, tagged string) {
+		t.Helper()
+		fmt.Fprintf(c, "%s %s\r\n", tag, cmd)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			line = strings.TrimRight(line, "\r\n")
+			if !strings.HasPrefix(line, "* ") {
+				return untagged, line
+			}
+			untagged = append(untagged, line)
+		}
+	}
+}
+
+func TestCondStore(t *testing.T) {
+	_, addr, a := testServer(t)
+	for i := 0; i < 3; i++ {
+		body := fmt.Sprintf("Subject: %d\r\n\r\nbody\r\n", i)
+		if _, _, err := a.dir.Append(strings.NewReader(body), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(c)
+	if greeting, _ := r.ReadString('\n'); !strings.Contains(greeting, "CONDSTORE") {
+		t.Fatalf("CONDSTORE not offered: %q", greeting)
+	}
+	command := rawCommand(t, c, r)
+	command("a", "LOGIN alice secret")
+	untagged, _ := command("b", "SELECT INBOX (CONDSTORE)")
+	if !strings.Contains(strings.Join(untagged, "\n"), "[HIGHESTMODSEQ 1]") {
+		t.Fatalf("select gave %q", untagged)
+	}
+	untagged, _ = command("c", `STORE 1 +FLAGS (\Seen)`)
+	if len(untagged) != 1 || untagged[0] != `* 1 FETCH (FLAGS (\Seen) MODSEQ (2))` {
+		t.Fatalf("store gave %q", untagged)
+	}
+	untagged, _ = command("d", "FETCH 1:* (FLAGS) (CHANGEDSINCE 1)")
+	if len(untagged) != 1 || untagged[0] != `* 1 FETCH (FLAGS (\Seen) MODSEQ (2))` {
+		t.Fatalf("fetch changed since 1 gave %q", untagged)
+	}
+	untagged, tagged := command("e", `STORE 1:2 (UNCHANGEDSINCE 1) +FLAGS (\Flagged)`)
+	if len(untagged) != 1 || untagged[0] != `* 2 FETCH (FLAGS (\Flagged) MODSEQ (3))` {
+		t.Fatalf("conditional store gave %q", untagged)
+	}
+	if tagged != "e OK [MODIFIED 1] Conditional STORE failed" {
+		t.Fatalf("conditional store ended with %q", tagged)
+	}
+	if msgs, _ := a.dir.ListCur(); len(msgs) != 3 {
+		t.Fatalf("%d messages after store", len(msgs))
+	}
+	untagged, _ = command("f", "SEARCH MODSEQ 3")
+	if len(untagged) != 1 || untagged[0] != "* SEARCH 2 (MODSEQ 3)" {
+		t.Fatalf("search gave %q", untagged)
+	}
+	untagged, _ = command("g", "STATUS INBOX (HIGHESTMODSEQ)")
+	if len(untagged) != 1 || untagged[0] != `* STATUS "INBOX" (HIGHESTMODSEQ 3)` {
+		t.Fatalf("status gave %q", untagged)
+	}
+}
+
+func TestQResync(t *testing.T) {
+	_, addr, a := testServer(t)
+	for i := 0; i < 4; i++ {
+		body := fmt.Sprintf("Subject: %d\r\n\r\nbody\r\n", i)
+		if _, _, err := a.dir.Append(strings.NewReader(body), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(c)
+	r.ReadString('\n')
+	command := rawCommand(t, c, r)
+	command("a", "LOGIN alice secret")
+	if _, tagged := command("b", "SELECT INBOX (QRESYNC (1 1))"); !strings.HasPrefix(tagged, "b BAD") {
+		t.Fatalf("QRESYNC used without ENABLE gave %q", tagged)
+	}
+	if untagged, _ := command("c", "ENABLE QRESYNC"); len(untagged) != 1 || untagged[0] != "* ENABLED QRESYNC" {
+		t.Fatalf("enable gave %q", untagged)
+	}
+	command("d", "SELECT INBOX")
+	command("e", "UNSELECT")
+	l, err := a.dir.UIDList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// change flags and remove a message while the client is away
+	msg, _, _ := a.dir.MessageByUID(2)
+	if _, err = a.dir.AddFlag(msg, maildir.Seen); err != nil {
+		t.Fatal(err)
+	}
+	msg, _, _ = a.dir.MessageByUID(3)
+	if err = a.dir.Remove(msg); err != nil {
+		t.Fatal(err)
+	}
+	untagged, _ := command("f", fmt.Sprintf("SELECT INBOX (QRESYNC (%d 1 1:4))", l.Validity))
+	want := []string{"* VANISHED (EARLIER) 3", `* 2 FETCH (UID 2 FLAGS (\Seen) MODSEQ (2))`}
+	if len(untagged) < 2 || strings.Join(untagged[len(untagged)-2:], "\n") != strings.Join(want, "\n") {
+		t.Fatalf("select with qresync gave %q", untagged)
+	}
+	command("g", `STORE 1 +FLAGS.SILENT (\Deleted)`)
+	if untagged, _ = command("h", "EXPUNGE"); len(untagged) != 1 || untagged[0] != "* VANISHED 1" {
+		t.Fatalf("expunge gave %q", untagged)
+	}
+	// a client from before the trimmed part of the expunge journal gets everything
+	highest, _ := a.dir.HighestModSeq()
+	f, err := os.OpenFile(filepath.Join(a.dir.Filepath(), "bdsmail-expunged.log"), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(f, "%d 0\n", highest)
+	f.Close()
+	untagged, _ = command("j", fmt.Sprintf("SELECT INBOX (QRESYNC (%d 1))", l.Validity))
+	if !strings.Contains(strings.Join(untagged, "\n"), "* VANISHED (EARLIER) 1,3\n* 1 FETCH (UID 2 ") || !strings.Contains(untagged[len(untagged)-1], "UID 4 ") {
+		t.Fatalf("select from before the trimmed journal gave %q", untagged)
+	}
+	// a client with an old uidvalidity gets no changes
+	untagged, _ = command("i", fmt.Sprintf("SELECT INBOX (QRESYNC (%d 1))", l.Validity+1))
+	for _, line := range untagged {
+		if strings.Contains(line, "VANISHED") || strings.Contains(line, "FETCH") {
+			t.Fatalf("select with another uidvalidity gave %q", untagged)
+		}
+	}
+}
+
+func TestPreview(t *testing.T) {
+	_, addr, a := testServer(t)
+	body := "Subject: hi\r\n\r\nH\xc3\xa9llo,\r\n  see you   soon\r\n"
+	if _, _, err := a.dir.Append(strings.NewReader(body), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := a.dir.Append(strings.NewReader("Subject: plain\r\n\r\nplain text\r\n"), nil); err != nil {
+		t.Fatal(err)
+	}
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(c)
+	if greeting, _ := r.ReadString('\n'); !strings.Contains(greeting, "PREVIEW") {
+		t.Fatalf("PREVIEW not offered: %q", greeting)
+	}
+	command := rawCommand(t, c, r)
+	command("a", "LOGIN alice secret")
+	command("b", "SELECT INBOX")
+	// the literal is read as lines of its own
+	fmt.Fprintf(c, "c FETCH 1:2 (PREVIEW)\r\n")
+	var got, line string
+	for !strings.HasPrefix(line, "c ") {
+		if line, err = r.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+		got += line
+	}
+	// non-ascii previews are sent as literals
+	for _, want := range []string{`FETCH (PREVIEW "plain text")`, "FETCH (PREVIEW {20}\r\nH\xc3\xa9llo, see you soon)"} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("%q not in %q", want, got)
+		}
+	}
+	if msgs, _ := a.dir.ListCur(); msgs[0].HasFlag(maildir.Seen) || msgs[1].HasFlag(maildir.Seen) {
+		t.Fatal("fetching a preview marked a message seen")
+	}
+}
@@ -0,0 +1,441 @@
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/majestrate/bdsmail/lib/maildir"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// states a command can be given in
+const (
+	// any time
+	anyState = iota
+	// after logging in
+	authState
+	// with a mailbox selected
+	selectedState
+)
+
+// a command handler
+type handler func(sess *session, tag string, args list) error
+
+type command struct {
+	state int
+	fn    handler
+}
+
+// all commands we know by name
+var commands = map[string]command{
+	"CAPABILITY":   {anyState, (*session).capability},
+	"NOOP":         {anyState, (*session).noop},
+	"LOGOUT":       {anyState, (*session).logout},
+	"STARTTLS":     {anyState, (*session).startTLS},
+	"LOGIN":        {anyState, (*session).login},
+	"AUTHENTICATE": {anyState, (*session).authenticate},
+	"SELECT":       {authState, (*session).selectMailbox},
+	"EXAMINE":      {authState, (*session).selectMailbox},
+	"CREATE":       {authState, (*session).create},
+	"SUBSCRIBE":    {authState, (*session).subscribe},
+	"UNSUBSCRIBE":  {authState, (*session).subscribe},
+	"LIST":         {authState, (*session).list},
+	"LSUB":         {authState, (*session).list},
+	"STATUS":       {authState, (*session).status},
+	"APPEND":       {authState, (*session).appendMessage},
+	"COMPRESS":     {authState, (*session).compress},
+	"ENABLE":       {authState, (*session).enable},
+	"CHECK":        {selectedState, (*session).noop},
+	"CLOSE":        {selectedState, (*session).close},
+	"UNSELECT":     {selectedState, (*session).close},
+	"EXPUNGE":      {selectedState, (*session).expunge},
+	"SEARCH":       {selectedState, (*session).search},
+	"THREAD":       {selectedState, (*session).thread},
+	"FETCH":        {selectedState, (*session).fetch},
+	"STORE":        {selectedState, (*session).store},
+	"COPY":         {selectedState, (*session).copyMessages},
+	"MOVE":         {selectedState, (*session).moveMessages},
+	"UID":          {selectedState, (*session).uid},
+}
+
+// an imap session for one connection
+type session struct {
+	s   *Server
+	c   net.Conn
+	r   *bufio.Reader
+	w   *bufio.Writer
+	tls bool
+	// compresses responses after COMPRESS DEFLATE, nil before
+	zw *flate.Writer
+	// user named by the client's verified certificate, empty if it gave none
+	certUser string
+	// logged in user, empty before LOGIN
+	user string
+	// the user's maildir
+	home maildir.MailDir
+	// selected mailbox, nil if none
+	mbox *mailbox
+	// the command name being handled, for handlers shared by commands
+	cmd string
+	// the client used CONDSTORE so untagged FETCHes carry MODSEQ
+	condstore bool
+	// the client enabled QRESYNC so expunges are told as VANISHED
+	qresync bool
+	// set by LOGOUT
+	done bool
+	// a non-synchronizing literal in the command being read was too big
+	tooBig bool
+	// bytes the command being read may still take
+	left int64
+	// status of the last tagged response
+	result string
+	// runs commands through the server's middleware
+	handle CommandHandler
+}
+
+func newSession(s *Server, c net.Conn) (sess *session) {
+	sess = &session{
+		s: s,
+		c: c,
+		r: bufio.NewReader(c),
+		w: bufio.NewWriter(c),
+	}
+	sess.handle = sess.dispatch
+	// first middleware runs first so wrap in reverse
+	for idx := len(s.middleware) - 1; idx >= 0; idx-- {
+		sess.handle = s.middleware[idx](sess.handle)
+	}
+	return
+}
+
+// run a command's handler if it can be used now
+func (sess *session) dispatch(c *Command) (err error) {
+	tag, args := c.Tag, fromPlain(c.Args)
+	name := c.Name
+	if strings.HasPrefix(name, "UID ") {
+		// the UID handler takes what it does as its first argument
+		args = append(list{name[len("UID "):]}, args...)
+		name = "UID"
+	}
+	sess.cmd = name
+	sess.result = ""
+	cmd, ok := commands[name]
+	if !ok {
+		err = sess.bad(tag, "Unknown command")
+	} else if cmd.state >= authState && sess.user == "" {
+		err = sess.no(tag, "Log in first")
+	} else if cmd.state == selectedState && sess.mbox == nil {
+		err = sess.no(tag, "No mailbox selected")
+	} else {
+		err = cmd.fn(sess, tag, args)
+	}
+	c.Status = sess.result
+	return
+}
+
+// quote a string for a response, strings that can't be quoted are sent as literals
+func quote(str string) string {
+	if len(str) > maxString || strings.ContainsAny(str, "\r\n") || !isASCII(str) {
+		return fmt.Sprintf("{%d}\r\n%s", len(str), str)
+	}
+	str = strings.Replace(str, `\`, `\\`, -1)
+	return `"` + strings.Replace(str, `"`, `\"`, -1) + `"`
+}
+
+// quote a string or give NIL if it is empty
+func nstring(str string) string {
+	if str == "" {
+		return "NIL"
+	}
+	return quote(str)
+}
+
+func isASCII(str string) bool {
+	for i := 0; i < len(str); i++ {
+		if str[i] >= 0x80 || str[i] == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// send a response line
+func (sess *session) line(str string) (err error) {
+	_, err = sess.w.WriteString(str + "\r\n")
+	if err == nil {
+		err = sess.w.Flush()
+	}
+	if err == nil && sess.zw != nil {
+		err = sess.zw.Flush()
+	}
+	return
+}
+
+// send an untagged response, it is flushed with the next line
+func (sess *session) untagged(str string) (err error) {
+	_, err = sess.w.WriteString("* " + str + "\r\n")
+	return
+}
+
+func (sess *session) ok(tag, msg string) error {
+	sess.result = "OK"
+	return sess.line(tag + " OK " + msg)
+}
+
+func (sess *session) no(tag, msg string) error {
+	sess.result = "NO"
+	return sess.line(tag + " NO " + msg)
+}
+
+func (sess *session) bad(tag, msg string) error {
+	sess.result = "BAD"
+	return sess.line(tag + " BAD " + msg)
+}
+
+// log an error we can't tell the client more about and fail the command
+func (sess *session) fail(tag string, e error) error {
+	log.Error("imap ", sess.cmd, " for ", sess.user, " failed: ", e)
+	return sess.no(tag, "[SERVERBUG] Internal error")
+}
+
+// can we take a password on this session
+func (sess *session) authAllowed() bool {
+	return sess.s.Auth != nil && (sess.tls || sess.s.AllowInsecureAuth)
+}
+
+// get our capabilities in this session
+func (sess *session) capabilities() string {
+	caps := []string{"IMAP4rev1", "CONDSTORE", "ENABLE", "LITERAL+", "MOVE", "OBJECTID", "PREVIEW", "QRESYNC", "SASL-IR", "THREAD=REFERENCES", "UNSELECT"}
+	if sess.s.tlsConfig != nil && !sess.tls {
+		caps = append(caps, "STARTTLS")
+	}
+	if sess.user != "" && sess.zw == nil {
+		caps = append(caps, "COMPRESS=DEFLATE")
+	}
+	if sess.user == "" {
+		if sess.authAllowed() {
+			caps = append(caps, "AUTH=PLAIN")
+		} else {
+			caps = append(caps, "LOGINDISABLED")
+		}
+		if sess.certUser != "" {
+			caps = append(caps, "AUTH=EXTERNAL")
+		}
+	}
+	return strings.Join(caps, " ")
+}
+
+// run the session until the client logs out or the connection drops
+func (sess *session) run() {
+	err := sess.line("* OK [CAPABILITY " + sess.capabilities() + "] " + sess.s.Hostname + " IMAP4rev1 ready")
+	for err == nil && !sess.done {
+		var tag string
+		var args list
+		sess.c.SetReadDeadline(time.Now().Add(sess.s.autologout()))
+		tag, args, err = sess.readCommand()
+		if tag == "" {
+			tag = "*"
+		}
+		if err == errSyntax {
+			err = sess.bad(tag, "Syntax error")
+			continue
+		} else if err == errTooBig {
+			err = sess.no(tag, "[TOOBIG] Literal too big")
+			continue
+		} else if err == errCommandTooBig {
+			sess.line("* BYE Command too big")
+			break
+		} else if e, ok := err.(net.Error); ok && e.Timeout() {
+			sess.line("* BYE Autologout, idle for too long")
+			break
+		} else if err != nil || len(args) == 0 {
+			if err == nil && tag != "*" {
+				err = sess.bad(tag, "Missing command")
+			}
+			continue
+		}
+		name, _ := args[0].(string)
+		args = args[1:]
+		cmd := &Command{
+			Tag:  tag,
+			Name: strings.ToUpper(name),
+			User: sess.user,
+			Addr: sess.c.RemoteAddr(),
+		}
+		if cmd.Name == "UID" && len(args) > 0 {
+			// name UID commands by what they do
+			sub, _ := args[0].(string)
+			cmd.Name += " " + strings.ToUpper(sub)
+			args = args[1:]
+		}
+		cmd.Args = args.plain()
+		err = sess.handle(cmd)
+	}
+	if err != nil && err != io.EOF {
+		log.Warn("imap session with ", sess.c.RemoteAddr(), " ended: ", err)
+	}
+}
+
+// handle CAPABILITY
+func (sess *session) capability(tag string, args list) (err error) {
+	err = sess.untagged("CAPABILITY " + sess.capabilities())
+	if err == nil {
+		err = sess.ok(tag, "CAPABILITY completed")
+	}
+	return
+}
+
+// handle NOOP and CHECK, both tell the client about changes to the selected mailbox
+func (sess *session) noop(tag string, args list) (err error) {
+	if sess.mbox != nil {
+		var e error
+		e, err = sess.refresh()
+		if e != nil {
+			return sess.fail(tag, e)
+		}
+	}
+	if err == nil {
+		err = sess.ok(tag, sess.cmd+" completed")
+	}
+	return
+}
+
+// handle LOGOUT
+func (sess *session) logout(tag string, args list) (err error) {
+	sess.done = true
+	err = sess.untagged("BYE " + sess.s.Hostname + " logging out")
+	if err == nil {
+		err = sess.ok(tag, "LOGOUT completed")
+	}
+	return
+}
+
+// handle STARTTLS
+func (sess *session) startTLS(tag string, args list) (err error) {
+	if sess.s.tlsConfig == nil || sess.tls || sess.zw != nil {
+		return sess.no(tag, "STARTTLS not available")
+	}
+	err = sess.ok(tag, "Begin TLS negotiation")
+	if err == nil {
+		tc := tls.Server(sess.c, sess.s.sessionTLSConfig())
+		err = tc.Handshake()
+		if err == nil {
+			sess.c = tc
+			sess.r = bufio.NewReader(tc)
+			sess.w = bufio.NewWriter(tc)
+			sess.tls = true
+			certs := tc.ConnectionState().PeerCertificates
+			if sess.s.clientCAs != nil && len(certs) > 0 {
+				sess.certUser = certUser(certs[0])
+			}
+		}
+	}
+	return
+}
+
+// handle LOGIN username password
+func (sess *session) login(tag string, args list) (err error) {
+	strs, ok := args.strings()
+	if !ok || len(strs) != 2 {
+		return sess.bad(tag, "Syntax: LOGIN username password")
+	}
+	return sess.checkLogin(tag, strs[0], strs[1])
+}
+
+// handle AUTHENTICATE PLAIN|EXTERNAL [initial-response]
+func (sess *session) authenticate(tag string, args list) (err error) {
+	strs, ok := args.strings()
+	if !ok || len(strs) == 0 || len(strs) > 2 {
+		return sess.bad(tag, "Syntax: AUTHENTICATE mechanism [initial-response]")
+	}
+	if sess.user != "" {
+		return sess.bad(tag, "Already authenticated")
+	}
+	mech := strings.ToUpper(strs[0])
+	if !(mech == "PLAIN" && sess.authAllowed()) && !(mech == "EXTERNAL" && sess.certUser != "") {
+		return sess.no(tag, "Unsupported mechanism")
+	}
+	var resp string
+	if len(strs) == 2 {
+		resp = strs[1]
+	} else {
+		err = sess.line("+ ")
+		if err == nil {
+			resp, err = sess.readLine()
+		}
+		if err != nil {
+			return
+		}
+		resp = strings.TrimRight(resp, "\r\n")
+	}
+	if resp == "*" {
+		return sess.bad(tag, "Authentication cancelled")
+	}
+	var data []byte
+	var e error
+	if resp != "=" {
+		// = is an empty initial response
+		data, e = base64.StdEncoding.DecodeString(resp)
+	}
+	if e != nil {
+		return sess.bad(tag, "Bad authentication response")
+	}
+	if mech == "EXTERNAL" {
+		// the response is who to act as, only the certificate's user is allowed
+		if len(data) > 0 && string(data) != sess.certUser {
+			return sess.no(tag, "[AUTHENTICATIONFAILED] Authentication failed")
+		}
+		return sess.loginAs(tag, sess.certUser)
+	}
+	parts := bytes.Split(data, []byte{0})
+	if len(parts) != 3 {
+		return sess.bad(tag, "Bad authentication response")
+	}
+	// we don't support acting as someone else
+	user := string(parts[1])
+	if len(parts[0]) > 0 && string(parts[0]) != user {
+		return sess.no(tag, "[AUTHENTICATIONFAILED] Authentication failed")
+	}
+	return sess.checkLogin(tag, user, string(parts[2]))
+}
+
+// check a username and password and log in as the user if they are right
+func (sess *session) checkLogin(tag, user, pass string) (err error) {
+	if sess.user != "" {
+		return sess.bad(tag, "Already authenticated")
+	}
+	if !sess.authAllowed() {
+		return sess.no(tag, "[PRIVACYREQUIRED] Use STARTTLS first")
+	}
+	ok, e := sess.s.Auth.Authenticate(user, pass)
+	if e != nil {
+		log.Error("imap failed to check login for ", user, ": ", e)
+		return sess.no(tag, "[UNAVAILABLE] Authentication failed")
+	}
+	if !ok {
+		return sess.no(tag, "[AUTHENTICATIONFAILED] Authentication failed")
+	}
+	return sess.loginAs(tag, user)
+}
+
+// log in as a user whose credentials were checked
+func (sess *session) loginAs(tag, user string) (err error) {
+	d, e := sess.s.Router.Route(user)
+	if e == nil {
+		e = d.Ensure()
+	}
+	if e != nil {
+		log.Error("imap failed to route ", user, ": ", e)
+		return sess.no(tag, "[UNAVAILABLE] Mailbox unavailable")
+	}
+	sess.user = user
+	sess.home = d
+	return sess.ok(tag, "[CAPABILITY "+sess.capabilities()+"] Logged in")
+}
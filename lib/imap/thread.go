@@ -0,0 +1,190 @@
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"net/mail"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// a message in a thread and the replies to it
+type threadNode struct {
+	// index into the mailbox, -1 for the dummy parent of a thread with several roots
+	idx      int
+	date     time.Time
+	parent   *threadNode
+	children []*threadNode
+}
+
+// get a message's Message-Id and what it replies to, the direct parent last
+func threadRefs(body []byte) (id string, refs []string) {
+	header, _ := splitMessage(toCRLF(body))
+	m, err := mail.ReadMessage(bufio.NewReader(bytes.NewReader(header)))
+	if err != nil {
+		return
+	}
+	if ids := strings.Fields(m.Header.Get("Message-Id")); len(ids) > 0 {
+		id = ids[0]
+	}
+	refs = strings.Fields(m.Header.Get("References"))
+	if len(refs) == 0 {
+		refs = strings.Fields(m.Header.Get("In-Reply-To"))
+	}
+	return
+}
+
+// check if node is an ancestor of n or n itself
+func (n *threadNode) under(node *threadNode) bool {
+	for ; n != nil; n = n.parent {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+// sort nodes by date, then by where they are in the mailbox
+func sortThread(nodes []*threadNode) {
+	sort.SliceStable(nodes, func(i, j int) bool {
+		if !nodes[i].date.Equal(nodes[j].date) {
+			return nodes[i].date.Before(nodes[j].date)
+		}
+		return nodes[i].idx < nodes[j].idx
+	})
+	for _, n := range nodes {
+		sortThread(n.children)
+	}
+}
+
+// write a thread as RFC 5256 has it, a message followed by its only reply or
+// by each of its replies in parentheses, without the parentheses around it
+func (n *threadNode) format(sb *strings.Builder, number func(int) uint32) {
+	if n.idx >= 0 {
+		sb.WriteString(strconv.FormatUint(uint64(number(n.idx)), 10))
+	}
+	if len(n.children) == 1 && n.idx >= 0 {
+		sb.WriteByte(' ')
+		n.children[0].format(sb, number)
+		return
+	}
+	if len(n.children) > 0 && n.idx >= 0 {
+		sb.WriteByte(' ')
+	}
+	for _, c := range n.children {
+		sb.WriteByte('(')
+		c.format(sb, number)
+		sb.WriteByte(')')
+	}
+}
+
+// thread messages with the REFERENCES algorithm of RFC 5256
+// messages are grouped by THREADID, and in a group each one hangs under the
+// latest message it references, ones referencing none of the group are its roots
+func (sess *session) threadReferences(idxs []int) (threads []*threadNode) {
+	mb := sess.mbox
+	groups := make(map[string][]*threadNode)
+	var order []string
+	// messages by thread and Message-Id, replies are only hung under their own thread
+	byID := make(map[string]*threadNode)
+	refsOf := make(map[*threadNode][]string)
+	for _, i := range idxs {
+		n := &threadNode{idx: i}
+		n.date, _ = mb.dir.Date(mb.msgs[i].msg)
+		tid := ""
+		body, e := mb.read(i)
+		if e == nil {
+			tid = threadID(toCRLF(body))
+			var id string
+			id, refsOf[n] = threadRefs(body)
+			if _, dup := byID[tid+" "+id]; id != "" && !dup {
+				byID[tid+" "+id] = n
+			}
+		} else {
+			// unreadable messages are threads of their own
+			tid = "unread " + strconv.Itoa(i)
+		}
+		if _, ok := groups[tid]; !ok {
+			order = append(order, tid)
+		}
+		groups[tid] = append(groups[tid], n)
+	}
+	for _, tid := range order {
+		var roots []*threadNode
+		for _, n := range groups[tid] {
+			refs := refsOf[n]
+			for j := len(refs) - 1; j >= 0 && n.parent == nil; j-- {
+				p := byID[tid+" "+refs[j]]
+				// a reference loop must not take a message out of its thread
+				if p != nil && !p.under(n) {
+					n.parent = p
+					p.children = append(p.children, n)
+				}
+			}
+		}
+		for _, n := range groups[tid] {
+			if n.parent == nil {
+				roots = append(roots, n)
+			}
+		}
+		sortThread(roots)
+		if len(roots) == 1 {
+			threads = append(threads, roots[0])
+		} else {
+			threads = append(threads, &threadNode{idx: -1, date: roots[0].date, children: roots})
+		}
+	}
+	sort.SliceStable(threads, func(i, j int) bool {
+		return threads[i].date.Before(threads[j].date)
+	})
+	return
+}
+
+// handle THREAD
+func (sess *session) thread(tag string, args list) error {
+	return sess.threadWith(tag, args, false)
+}
+
+// handle THREAD algorithm charset keys from RFC 5256, only REFERENCES is supported
+func (sess *session) threadWith(tag string, args list, uid bool) (err error) {
+	if len(args) < 3 {
+		return sess.bad(tag, "Syntax: THREAD algorithm charset keys")
+	}
+	algorithm, _ := args[0].(string)
+	if !strings.EqualFold(algorithm, "REFERENCES") {
+		return sess.bad(tag, "Unsupported threading algorithm")
+	}
+	charset, _ := args[1].(string)
+	if !strings.EqualFold(charset, "US-ASCII") && !strings.EqualFold(charset, "UTF-8") {
+		return sess.no(tag, "[BADCHARSET (US-ASCII UTF-8)] Unsupported charset")
+	}
+	key, e := sess.parseSearch(args[2:])
+	if e != nil {
+		return sess.bad(tag, "Bad search: "+e.Error())
+	}
+	mb := sess.mbox
+	var idxs []int
+	for i := range mb.msgs {
+		if key(mb, i) {
+			idxs = append(idxs, i)
+		}
+	}
+	number := func(i int) uint32 { return sess.number(i, uid) }
+	var sb strings.Builder
+	sb.WriteString("THREAD")
+	for idx, n := range sess.threadReferences(idxs) {
+		if idx == 0 {
+			sb.WriteByte(' ')
+		}
+		sb.WriteByte('(')
+		n.format(&sb, number)
+		sb.WriteByte(')')
+	}
+	err = sess.untagged(sb.String())
+	if err == nil {
+		err = sess.ok(tag, sess.cmd+" completed")
+	}
+	return
+}
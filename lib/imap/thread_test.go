@@ -0,0 +1,59 @@
+package imap
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestThread(t *testing.T) {
+	_, addr, a := testServer(t)
+	msg := func(id, refs, date string) string {
+		body := "Message-Id: <" + id + "@example.com>\r\nDate: Mon, 1 Jan 2024 " + date + " +0000\r\n"
+		if refs != "" {
+			body += "References: " + refs + "\r\n"
+		}
+		return body + "Subject: hi\r\n\r\nbody\r\n"
+	}
+	for _, body := range []string{
+		msg("first", "", "10:00:00"),
+		msg("other", "", "10:30:00"),
+		// two replies to the first, and a reply to the earlier reply
+		msg("reply", "<first@example.com>", "11:00:00"),
+		msg("second", "<first@example.com>", "12:00:00"),
+		msg("third", "<first@example.com> <reply@example.com>", "13:00:00"),
+		// replies to a message that isn't here share a thread with no root
+		msg("orphan", "<gone@example.com>", "14:00:00"),
+		msg("orphan2", "<gone@example.com>", "15:00:00"),
+	} {
+		if _, _, err := a.dir.Append(strings.NewReader(body), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(c)
+	if greeting, _ := r.ReadString('\n'); !strings.Contains(greeting, "THREAD=REFERENCES") {
+		t.Fatalf("THREAD=REFERENCES not offered: %q", greeting)
+	}
+	command := rawCommand(t, c, r)
+	command("a", "LOGIN alice secret")
+	command("b", "SELECT INBOX")
+	want := "* THREAD (1 (3 5)(4))(2)((6)(7))"
+	if untagged, tagged := command("c", "THREAD REFERENCES UTF-8 ALL"); len(untagged) != 1 || untagged[0] != want || !strings.HasPrefix(tagged, "c OK") {
+		t.Fatalf("THREAD gave %q %q", untagged, tagged)
+	}
+	// only messages matching the search are threaded, without the first its replies are siblings
+	if untagged, _ := command("d", "UID THREAD REFERENCES US-ASCII 2:4"); len(untagged) != 1 || untagged[0] != "* THREAD (2)((3)(4))" {
+		t.Fatalf("UID THREAD gave %q", untagged)
+	}
+	if _, tagged := command("e", "THREAD ORDEREDSUBJECT UTF-8 ALL"); !strings.HasPrefix(tagged, "e BAD") {
+		t.Fatalf("unsupported algorithm gave %q", tagged)
+	}
+}
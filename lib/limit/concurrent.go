@@ -0,0 +1,31 @@
+package limit
+
+import (
+	"net"
+)
+
+// limits how many connections may be open at once
+type Concurrent struct {
+	// holds a token for each open connection
+	slots chan struct{}
+}
+
+// create a limiter allowing max connections open at once
+func NewConcurrent(max int) *Concurrent {
+	return &Concurrent{
+		slots: make(chan struct{}, max),
+	}
+}
+
+func (l *Concurrent) Allow(c net.Conn) bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *Concurrent) Release(c net.Conn) {
+	<-l.slots
+}
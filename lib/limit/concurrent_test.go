@@ -0,0 +1,62 @@
+package limit
+
+import (
+	"bufio"
+	"net"
+	"testing"
+)
+
+func TestConcurrentListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := Listen(inner, NewConcurrent(1), "421 full")
+	defer l.Close()
+	accepted := make(chan net.Conn)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- c
+		}
+	}()
+	first, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	served := <-accepted
+	// no slot left so this one is turned away
+	second, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(second).ReadString('\n')
+	second.Close()
+	if err != nil || line != "421 full\r\n" {
+		t.Fatalf("connection over limit got %q %v", line, err)
+	}
+	// closing frees the slot, twice only frees it once
+	served.Close()
+	served.Close()
+	third, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer third.Close()
+	c := <-accepted
+	defer c.Close()
+	fourth, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, _ = bufio.NewReader(fourth).ReadString('\n')
+	fourth.Close()
+	if line != "421 full\r\n" {
+		t.Fatalf("connection over limit after release got %q", line)
+	}
+}
@@ -0,0 +1,4 @@
+//
+// connection limiting for network servers
+//
+package limit
@@ -0,0 +1,84 @@
+package limit
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"net"
+	"sync"
+	"time"
+)
+
+// decides if an accepted connection may be served
+type Limiter interface {
+	// return true to serve the connection
+	Allow(c net.Conn) bool
+}
+
+// a limiter that needs to know when connections it allowed are closed
+type Releaser interface {
+	Limiter
+	// called once when a connection Allow returned true for is closed
+	Release(c net.Conn)
+}
+
+// listener that rejects connections a limiter does not allow
+type listener struct {
+	net.Listener
+	lim    Limiter
+	reject string
+}
+
+// wrap a listener so connections the limiter does not allow are sent
+// the reject line and closed before they are handed to the server
+func Listen(l net.Listener, lim Limiter, reject string) net.Listener {
+	return &listener{
+		Listener: l,
+		lim:      lim,
+		reject:   reject,
+	}
+}
+
+func (l *listener) Accept() (c net.Conn, err error) {
+	for {
+		c, err = l.Listener.Accept()
+		if err != nil {
+			return
+		}
+		if l.lim.Allow(c) {
+			if r, ok := l.lim.(Releaser); ok {
+				c = &releaseConn{Conn: c, r: r}
+			}
+			return
+		}
+		log.Info("rejecting connection from ", c.RemoteAddr())
+		go func(c net.Conn) {
+			c.SetWriteDeadline(time.Now().Add(time.Second * 5))
+			c.Write([]byte(l.reject + "\r\n"))
+			c.Close()
+		}(c)
+	}
+}
+
+// connection that tells a releaser when it is closed
+type releaseConn struct {
+	net.Conn
+	r    Releaser
+	once sync.Once
+}
+
+func (c *releaseConn) Close() error {
+	c.once.Do(func() {
+		c.r.Release(c.Conn)
+	})
+	return c.Conn.Close()
+}
+
+// get the ip of the remote end of a connection
+func remoteIP(c net.Conn) string {
+	addr := c.RemoteAddr().String()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		// unix sockets and the like
+		return addr
+	}
+	return host
+}
@@ -0,0 +1,81 @@
+package limit
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// limits how many connections each ip may make within a sliding window
+type Rate struct {
+	// max connections allowed per ip in the window
+	max int
+	// length of the window
+	window time.Duration
+	// ip -> *history
+	hosts sync.Map
+	// when ips were last pruned
+	pruned time.Time
+	// protects pruned
+	mtx sync.Mutex
+}
+
+// connection times for one ip
+type history struct {
+	mtx   sync.Mutex
+	times []time.Time
+}
+
+// create a limiter allowing max connections per ip within window
+func NewRate(max int, window time.Duration) *Rate {
+	return &Rate{
+		max:    max,
+		window: window,
+	}
+}
+
+func (r *Rate) Allow(c net.Conn) bool {
+	now := time.Now()
+	r.mtx.Lock()
+	if now.Sub(r.pruned) > r.window {
+		r.pruned = now
+		go r.prune(now)
+	}
+	r.mtx.Unlock()
+	return r.AllowIP(remoteIP(c), now)
+}
+
+// record a connection attempt from an ip at a time
+// return true if it is within the limit
+func (r *Rate) AllowIP(ip string, now time.Time) (allow bool) {
+	v, _ := r.hosts.LoadOrStore(ip, new(history))
+	h := v.(*history)
+	h.mtx.Lock()
+	// drop attempts that slid out of the window
+	cutoff := now.Add(-r.window)
+	idx := 0
+	for idx < len(h.times) && !h.times[idx].After(cutoff) {
+		idx++
+	}
+	h.times = h.times[idx:]
+	allow = len(h.times) < r.max
+	if allow {
+		h.times = append(h.times, now)
+	}
+	h.mtx.Unlock()
+	return
+}
+
+// forget ips that have no connections in the current window
+func (r *Rate) prune(now time.Time) {
+	cutoff := now.Add(-r.window)
+	r.hosts.Range(func(k, v interface{}) bool {
+		h := v.(*history)
+		h.mtx.Lock()
+		if len(h.times) == 0 || !h.times[len(h.times)-1].After(cutoff) {
+			r.hosts.Delete(k)
+		}
+		h.mtx.Unlock()
+		return true
+	})
+}
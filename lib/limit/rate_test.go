@@ -0,0 +1,26 @@
+package limit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateSlidingWindow(t *testing.T) {
+	r := NewRate(2, time.Minute)
+	now := time.Now()
+	if !r.AllowIP("10.0.0.1", now) || !r.AllowIP("10.0.0.1", now.Add(time.Second)) {
+		t.Fatal("connections within limit rejected")
+	}
+	if r.AllowIP("10.0.0.1", now.Add(time.Second*2)) {
+		t.Fatal("connection over limit allowed")
+	}
+	if !r.AllowIP("10.0.0.2", now.Add(time.Second*2)) {
+		t.Fatal("other ip rejected")
+	}
+	if !r.AllowIP("10.0.0.1", now.Add(time.Minute+time.Second/2)) {
+		t.Fatal("connection after window slid rejected")
+	}
+	if r.AllowIP("10.0.0.1", now.Add(time.Minute+time.Second/2)) {
+		t.Fatal("connection over limit allowed after window slid")
+	}
+}
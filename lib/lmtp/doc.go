@@ -0,0 +1,4 @@
+//
+// lmtp protocol implementation
+//
+package lmtp
@@ -0,0 +1,165 @@
+package lmtp
+
+import (
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"github.com/majestrate/bdsmail/lib/limit"
+	"github.com/majestrate/bdsmail/lib/maildir"
+	"net"
+	"os"
+	"time"
+)
+
+// largest message we take by default
+const DefaultMaxSize = 32 * 1024 * 1024
+
+// how long a client may be idle by default, the same as for smtp
+const DefaultIdleTimeout = 5 * time.Minute
+
+// error a router returns for a recipient it has no maildir for
+var ErrUnknownRecipient = errors.New("unknown recipient")
+
+// maps recipients to the maildir their mail is delivered to
+type Router interface {
+	// get the maildir to deliver mail for a recipient to
+	// returns ErrUnknownRecipient, or an error wrapping it, if there is no such recipient
+	// other errors are treated as temporary unless they have a Temporary() method returning false
+	Route(recip string) (maildir.MailDir, error)
+}
+
+// return true if an error means a recipient should not be retried
+func permanent(err error) bool {
+	if errors.Is(err, ErrUnknownRecipient) {
+		return true
+	}
+	if e, ok := err.(interface {
+		Temporary() bool
+	}); ok {
+		return !e.Temporary()
+	}
+	return false
+}
+
+// lmtp server
+type Server struct {
+	// hostname we announce ourselves as
+	Hostname string
+	// maps recipients to maildirs
+	Router Router
+	// maximum message size in bytes, 0 for DefaultMaxSize
+	MaxSize int64
+	// how long a client may be idle between commands or while sending a message,
+	// 0 for DefaultIdleTimeout
+	IdleTimeout time.Duration
+
+	// unexported fields
+
+	// listener for serving
+	listener net.Listener
+	// per ip connection rate limit, nil for none
+	connRate *limit.Rate
+	// limit on open connections, nil for none
+	maxConns *limit.Concurrent
+}
+
+// limit each ip to maxPerIP connections within a sliding window
+// connections over the limit get a 421 reply before any command is read
+func (s *Server) WithConnectionLimit(maxPerIP int, windowDuration time.Duration) *Server {
+	s.connRate = limit.NewRate(maxPerIP, windowDuration)
+	return s
+}
+
+// serve at most n connections at once
+// connections over the limit get a 421 reply and are closed before any command is read
+func (s *Server) WithMaxConnections(n int) *Server {
+	s.maxConns = limit.NewConcurrent(n)
+	return s
+}
+
+func (s *Server) maxSize() int64 {
+	if s.MaxSize > 0 {
+		return s.MaxSize
+	}
+	return DefaultMaxSize
+}
+
+func (s *Server) idleTimeout() time.Duration {
+	if s.IdleTimeout > 0 {
+		return s.IdleTimeout
+	}
+	return DefaultIdleTimeout
+}
+
+// serve lmtp on a tcp address
+// blocks until the server is closed
+func (s *Server) ListenAndServe(addr string) (err error) {
+	var l net.Listener
+	l, err = net.Listen("tcp", addr)
+	if err == nil {
+		err = s.Serve(l)
+	}
+	return
+}
+
+// serve lmtp on a unix socket, a stale socket file is removed first
+// blocks until the server is closed
+func (s *Server) ListenUnix(sockPath string) (err error) {
+	err = os.Remove(sockPath)
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	if err == nil {
+		var l net.Listener
+		l, err = net.Listen("unix", sockPath)
+		if err == nil {
+			err = s.Serve(l)
+		}
+	}
+	return
+}
+
+// serve lmtp on an existing listener
+// blocks until the server is closed
+func (s *Server) Serve(l net.Listener) (err error) {
+	if s.connRate != nil {
+		l = limit.Listen(l, s.connRate, "421 4.7.0 "+s.Hostname+" Too many connections, try again later")
+	}
+	if s.maxConns != nil {
+		l = limit.Listen(l, s.maxConns, "421 4.3.2 "+s.Hostname+" Service temporarily unavailable")
+	}
+	s.listener = l
+	log.Info("Serving LMTP server on ", l.Addr())
+	for {
+		var c net.Conn
+		c, err = l.Accept()
+		if err != nil {
+			break
+		}
+		go s.handle(c)
+	}
+	log.Info("LMTP server ended")
+	return
+}
+
+// stop serving
+func (s *Server) Close() (err error) {
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	return
+}
+
+// handle an inbound connection
+func (s *Server) handle(c net.Conn) {
+	sess := newSession(s, c)
+	sess.run()
+	c.Close()
+}
+
+// create a new lmtp server that delivers using a router
+func New(hostname string, router Router) *Server {
+	return &Server{
+		Hostname: hostname,
+		Router:   router,
+	}
+}
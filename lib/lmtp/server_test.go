@@ -0,0 +1,198 @@
+package lmtp
+
+import (
+	"fmt"
+	"github.com/majestrate/bdsmail/lib/maildir"
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// routes recipients to maildirs by local part
+// unknown recipients get a wrapped ErrUnknownRecipient like real routers give
+type testRouter map[string]maildir.MailDir
+
+func (r testRouter) Route(recip string) (d maildir.MailDir, err error) {
+	d, ok := r[strings.Split(recip, "@")[0]]
+	if !ok {
+		err = fmt.Errorf("no mailbox for %s: %w", recip, ErrUnknownRecipient)
+	}
+	return
+}
+
+// start a server on a unix socket and dial it
+func testServer(t *testing.T, r Router) *textproto.Conn {
+	s := New("localhost", r)
+	c, _ := testServe(t, s)
+	return c
+}
+
+// serve a server on a unix socket and dial it
+func testServe(t *testing.T, s *Server) (*textproto.Conn, string) {
+	sock := filepath.Join(t.TempDir(), "lmtp.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	c, err := textproto.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c, sock
+}
+
+// send a command and expect a reply code
+func expect(t *testing.T, c *textproto.Conn, code int, cmd string) string {
+	if cmd != "" {
+		if err := c.PrintfLine("%s", cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, msg, err := c.ReadResponse(code)
+	if err != nil {
+		t.Fatalf("%s: %s", cmd, err)
+	}
+	return msg
+}
+
+func TestDeliverMultipleRecipients(t *testing.T) {
+	r := testRouter{}
+	for _, user := range []string{"alice", "bob"} {
+		r[user] = maildir.MailDir(filepath.Join(t.TempDir(), user))
+		if err := r[user].Ensure(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := testServer(t, r)
+	expect(t, c, 220, "")
+	expect(t, c, 250, "LHLO client")
+	expect(t, c, 250, "MAIL FROM:<sender@remote>")
+	expect(t, c, 250, "RCPT TO:<alice@localhost>")
+	expect(t, c, 250, "RCPT TO:<bob@localhost>")
+	expect(t, c, 354, "DATA")
+	c.PrintfLine("Subject: hi\r\n\r\nhello\r\n.")
+	expect(t, c, 250, "")
+	expect(t, c, 250, "")
+	expect(t, c, 221, "QUIT")
+	for user, d := range r {
+		msgs, err := d.ListNew()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msgs) != 1 {
+			t.Fatalf("%s got %d messages", user, len(msgs))
+		}
+	}
+}
+
+func TestPerRecipientStatus(t *testing.T) {
+	r := testRouter{
+		"alice": maildir.MailDir(filepath.Join(t.TempDir(), "alice")),
+		// never ensured so delivery fails
+		"broken": maildir.MailDir(filepath.Join(t.TempDir(), "broken")),
+	}
+	if err := r["alice"].Ensure(); err != nil {
+		t.Fatal(err)
+	}
+	c := testServer(t, r)
+	expect(t, c, 220, "")
+	expect(t, c, 250, "LHLO client")
+	expect(t, c, 250, "MAIL FROM:<sender@remote>")
+	expect(t, c, 250, "RCPT TO:<alice@localhost>")
+	if msg := expect(t, c, 550, "RCPT TO:<nobody@localhost>"); !strings.HasPrefix(msg, "5.1.1") {
+		t.Fatalf("unknown user got %q", msg)
+	}
+	expect(t, c, 250, "RCPT TO:<broken@localhost>")
+	expect(t, c, 354, "DATA")
+	c.PrintfLine("Subject: hi\r\n\r\nhello\r\n.")
+	expect(t, c, 250, "")
+	expect(t, c, 450, "")
+	expect(t, c, 221, "QUIT")
+	msgs, err := r["alice"].ListNew()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 {
+		t.Fatalf("alice got %d messages", len(msgs))
+	}
+}
+
+func TestConnectionLimit(t *testing.T) {
+	s := New("localhost", testRouter{}).WithConnectionLimit(1, time.Minute)
+	c, sock := testServe(t, s)
+	expect(t, c, 220, "")
+	c2, err := textproto.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	expect(t, c2, 421, "")
+}
+
+func TestMaxConnections(t *testing.T) {
+	s := New("localhost", testRouter{}).WithMaxConnections(1)
+	c, sock := testServe(t, s)
+	expect(t, c, 220, "")
+	c2, err := textproto.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := expect(t, c2, 421, "")
+	c2.Close()
+	if !strings.HasPrefix(msg, "4.3.2 ") {
+		t.Fatalf("connection over limit got %q", msg)
+	}
+	// a slot frees up once the first client leaves
+	expect(t, c, 221, "QUIT")
+	c.Close()
+	var c3 *textproto.Conn
+	for i := 0; i < 50; i++ {
+		c3, err = textproto.Dial("unix", sock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err = c3.ReadResponse(220); err == nil {
+			break
+		}
+		c3.Close()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("connection after release got %v", err)
+	}
+	c3.Close()
+}
+
+func TestLimits(t *testing.T) {
+	d := maildir.MailDir(filepath.Join(t.TempDir(), "alice"))
+	if err := d.Ensure(); err != nil {
+		t.Fatal(err)
+	}
+	s := New("localhost", testRouter{"alice": d})
+	s.MaxSize = 10
+	s.IdleTimeout = 100 * time.Millisecond
+	c, _ := testServe(t, s)
+	expect(t, c, 220, "")
+	expect(t, c, 250, "LHLO client")
+	expect(t, c, 250, "MAIL FROM:<sender@remote>")
+	expect(t, c, 250, "RCPT TO:<alice@localhost>")
+	expect(t, c, 354, "DATA")
+	c.PrintfLine("Subject: too big\r\n\r\nhello\r\n.")
+	expect(t, c, 552, "")
+	// an idle client is hung up on
+	if msg := expect(t, c, 421, ""); !strings.HasPrefix(msg, "4.4.2") {
+		t.Fatalf("idle client got %q", msg)
+	}
+	if msgs, _ := d.ListNew(); len(msgs) != 0 {
+		t.Fatal("message over the size limit was delivered")
+	}
+	if New("localhost", nil).maxSize() != DefaultMaxSize {
+		t.Fatal("no size limit by default")
+	}
+}
@@ -0,0 +1,233 @@
+package lmtp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/majestrate/bdsmail/lib/maildir"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+var errBadPath = errors.New("bad address syntax")
+
+// an lmtp session for one connection
+type session struct {
+	s    *Server
+	c    net.Conn
+	conn *textproto.Conn
+	// did the client say lhlo yet
+	greeted bool
+	// envelope sender, nil if no transaction
+	from *string
+	// envelope recipients that were accepted
+	to []recipient
+}
+
+// an accepted recipient and where their mail goes
+type recipient struct {
+	addr string
+	dir  maildir.MailDir
+}
+
+func newSession(s *Server, c net.Conn) *session {
+	return &session{
+		s:    s,
+		c:    c,
+		conn: textproto.NewConn(c),
+	}
+}
+
+// send a reply line
+func (sess *session) reply(code int, msg string) error {
+	return sess.conn.PrintfLine("%d %s", code, msg)
+}
+
+// clear the current mail transaction
+func (sess *session) reset() {
+	sess.from = nil
+	sess.to = nil
+}
+
+// parse an address path argument like FROM:<user@host> ignoring any parameters
+func parsePath(arg, prefix string) (addr string, err error) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		err = errBadPath
+		return
+	}
+	arg = strings.TrimSpace(arg[len(prefix):])
+	if !strings.HasPrefix(arg, "<") {
+		err = errBadPath
+		return
+	}
+	idx := strings.Index(arg, ">")
+	if idx < 0 {
+		err = errBadPath
+		return
+	}
+	addr = arg[1:idx]
+	return
+}
+
+// run the session until the client quits or the connection drops
+func (sess *session) run() {
+	err := sess.reply(220, sess.s.Hostname+" LMTP BDSMail ready")
+	for err == nil {
+		var line string
+		sess.c.SetReadDeadline(time.Now().Add(sess.s.idleTimeout()))
+		line, err = sess.conn.ReadLine()
+		if err != nil {
+			break
+		}
+		cmd := line
+		arg := ""
+		if idx := strings.Index(line, " "); idx > 0 {
+			cmd = line[:idx]
+			arg = strings.TrimSpace(line[idx+1:])
+		}
+		switch strings.ToUpper(cmd) {
+		case "LHLO":
+			if arg == "" {
+				err = sess.reply(501, "5.5.4 LHLO requires domain")
+				continue
+			}
+			sess.greeted = true
+			sess.reset()
+			err = sess.conn.PrintfLine("250-%s\r\n250-8BITMIME\r\n250-ENHANCEDSTATUSCODES\r\n250 PIPELINING", sess.s.Hostname)
+		case "MAIL":
+			err = sess.mail(arg)
+		case "RCPT":
+			err = sess.rcpt(arg)
+		case "DATA":
+			err = sess.data()
+		case "RSET":
+			sess.reset()
+			err = sess.reply(250, "2.0.0 OK")
+		case "NOOP":
+			err = sess.reply(250, "2.0.0 OK")
+		case "VRFY":
+			err = sess.reply(252, "2.5.0 Cannot VRFY user")
+		case "QUIT":
+			sess.reply(221, "2.0.0 Bye")
+			return
+		default:
+			err = sess.reply(500, "5.5.2 Unknown command")
+		}
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		// give the goodbye a moment to get out
+		sess.c.SetDeadline(time.Now().Add(time.Second))
+		sess.reply(421, "4.4.2 "+sess.s.Hostname+" Idle timeout, closing connection")
+		log.Info("lmtp session with ", sess.c.RemoteAddr(), " timed out")
+	} else if err != nil && err != io.EOF {
+		log.Warn("lmtp session with ", sess.c.RemoteAddr(), " ended: ", err)
+	}
+}
+
+// handle MAIL command
+func (sess *session) mail(arg string) error {
+	if !sess.greeted {
+		return sess.reply(503, "5.5.1 Send LHLO first")
+	}
+	if sess.from != nil {
+		return sess.reply(503, "5.5.1 Nested MAIL command")
+	}
+	from, err := parsePath(arg, "FROM:")
+	if err != nil {
+		return sess.reply(501, "5.5.4 Syntax: MAIL FROM:<address>")
+	}
+	sess.from = &from
+	return sess.reply(250, "2.1.0 OK")
+}
+
+// handle RCPT command
+func (sess *session) rcpt(arg string) error {
+	if sess.from == nil {
+		return sess.reply(503, "5.5.1 Send MAIL first")
+	}
+	to, err := parsePath(arg, "TO:")
+	if err != nil || to == "" {
+		return sess.reply(501, "5.5.4 Syntax: RCPT TO:<address>")
+	}
+	d, err := sess.s.Router.Route(to)
+	if errors.Is(err, ErrUnknownRecipient) {
+		return sess.reply(550, "5.1.1 User unknown")
+	} else if err != nil {
+		log.Error("failed to route mail for ", to, ": ", err)
+		if permanent(err) {
+			return sess.reply(550, "5.1.0 Mailbox unavailable")
+		}
+		return sess.reply(450, "4.2.0 Mailbox unavailable, try again later")
+	}
+	sess.to = append(sess.to, recipient{to, d})
+	return sess.reply(250, "2.1.5 OK")
+}
+
+// handle DATA command, replies once per recipient
+func (sess *session) data() (err error) {
+	if len(sess.to) == 0 {
+		return sess.reply(503, "5.5.1 Send RCPT first")
+	}
+	err = sess.reply(354, "Start mail input; end with <CRLF>.<CRLF>")
+	if err != nil {
+		return
+	}
+	// the whole message has to arrive within the idle timeout
+	sess.c.SetReadDeadline(time.Now().Add(sess.s.idleTimeout()))
+	dr := sess.conn.DotReader()
+	max := sess.s.maxSize()
+	var body []byte
+	body, err = ioutil.ReadAll(io.LimitReader(dr, max+1))
+	if err != nil {
+		return
+	}
+	from := *sess.from
+	to := sess.to
+	sess.reset()
+	if int64(len(body)) > max {
+		// drain the rest of the message
+		_, err = io.Copy(ioutil.Discard, dr)
+		if err != nil {
+			return
+		}
+		for range to {
+			err = sess.reply(552, "5.3.4 Message too big")
+		}
+		return
+	}
+	// one reply for each accepted recipient in order
+	for _, recip := range to {
+		err = sess.deliver(from, recip, body)
+		if err == nil {
+			err = sess.reply(250, fmt.Sprintf("2.0.0 <%s> delivered", recip.addr))
+		} else {
+			log.Error("failed to deliver mail for ", recip.addr, ": ", err)
+			if permanent(err) {
+				err = sess.reply(550, fmt.Sprintf("5.2.0 <%s> delivery failed", recip.addr))
+			} else {
+				err = sess.reply(450, fmt.Sprintf("4.2.0 <%s> delivery failed, try again later", recip.addr))
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	return
+}
+
+// deliver a message to the maildir of a recipient
+func (sess *session) deliver(from string, recip recipient, body []byte) (err error) {
+	// the dot reader gives us plain newlines so match them
+	hdr := fmt.Sprintf("Return-Path: <%s>\nDelivered-To: %s\n", from, recip.addr)
+	r := io.MultiReader(strings.NewReader(hdr), bytes.NewReader(body))
+	_, err = recip.dir.Deliver(r)
+	if err == nil {
+		log.Info("lmtp delivered mail for ", recip.addr, " from ", from)
+	}
+	return
+}
@@ -0,0 +1,209 @@
+package maildir
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// a single access right on a maildir
+type ACLRight uint16
+
+// a set of access rights
+type ACLRights uint16
+
+// rights in the order dovecot writes their letters
+const (
+	ACLLookup ACLRight = 1 << iota
+	ACLRead
+	ACLWrite
+	ACLWriteSeen
+	ACLWriteDeleted
+	ACLInsert
+	ACLPost
+	ACLExpunge
+	ACLCreate
+	ACLDelete
+	ACLAdmin
+)
+
+// every right
+const ACLAll = ACLRights(ACLAdmin<<1 - 1)
+
+// the dovecot letter for each right in order
+const aclLetters = "lrwstipekxa"
+
+// acl identifiers that are not a single user
+const (
+	ACLAnyone        = "anyone"
+	ACLAuthenticated = "authenticated"
+)
+
+// name of the acl file in the maildir root
+const aclFile = ".acl"
+
+// make a set of rights
+func NewACLRights(rights ...ACLRight) (r ACLRights) {
+	for _, right := range rights {
+		r |= ACLRights(right)
+	}
+	return
+}
+
+// parse rights in dovecot letter form like "lrws"
+func ParseACLRights(str string) (r ACLRights, err error) {
+	for _, c := range str {
+		idx := strings.IndexRune(aclLetters, c)
+		if idx < 0 {
+			err = fmt.Errorf("maildir: bad acl right %q", c)
+			return
+		}
+		r |= 1 << uint(idx)
+	}
+	return
+}
+
+// return true if this set holds a right
+func (r ACLRights) Has(right ACLRight) bool {
+	return r&ACLRights(right) != 0
+}
+
+// the rights as dovecot letters
+func (r ACLRights) String() string {
+	var str []byte
+	for idx := range aclLetters {
+		if r&(1<<uint(idx)) != 0 {
+			str = append(str, aclLetters[idx])
+		}
+	}
+	return string(str)
+}
+
+// identifier used in the acl file for a user
+func aclIdentifier(user string) string {
+	if user == ACLAnyone || user == ACLAuthenticated {
+		return user
+	}
+	return "user=" + user
+}
+
+// read the acl file as identifier to rights
+// negative entries keep their leading '-'
+func (d MailDir) readACL() (acl map[string]ACLRights, err error) {
+	acl = make(map[string]ACLRights)
+	var f *os.File
+	f, err = os.Open(filepath.Join(d.Filepath(), aclFile))
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	} else if err != nil {
+		return
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		idx := strings.LastIndex(line, " ")
+		if idx < 0 {
+			err = fmt.Errorf("maildir: bad acl line %q", line)
+			return
+		}
+		var r ACLRights
+		r, err = ParseACLRights(line[idx+1:])
+		if err != nil {
+			return
+		}
+		acl[strings.TrimSpace(line[:idx])] = r
+	}
+	err = sc.Err()
+	return
+}
+
+// get the rights each user has in this maildir
+// users are keyed by name or by ACLAnyone and ACLAuthenticated
+func (d MailDir) ACL() (acl map[string]ACLRights, err error) {
+	defer d.wrapErr("get acl", &err)
+	var entries map[string]ACLRights
+	entries, err = d.readACL()
+	if err != nil {
+		return
+	}
+	acl = make(map[string]ACLRights)
+	for id, r := range entries {
+		switch {
+		case strings.HasPrefix(id, "-"):
+			// negative entries only take rights away
+			continue
+		case strings.HasPrefix(id, "group="), strings.HasPrefix(id, "group-override="):
+			continue
+		case strings.HasPrefix(id, "user="):
+			id = id[5:]
+		}
+		acl[id] = r
+	}
+	return
+}
+
+// give a user exactly these rights in the dovecot compatible acl file
+// empty rights remove the user's entry
+func (d MailDir) SetACL(user string, rights ACLRights) (err error) {
+	defer d.wrapErr("set acl", &err)
+	mtx := d.mutex()
+	mtx.Lock()
+	defer mtx.Unlock()
+	var acl map[string]ACLRights
+	acl, err = d.readACL()
+	if err != nil {
+		return
+	}
+	id := aclIdentifier(user)
+	if rights == 0 {
+		delete(acl, id)
+	} else {
+		acl[id] = rights
+	}
+	ids := make([]string, 0, len(acl))
+	for id := range acl {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	var buf strings.Builder
+	for _, id := range ids {
+		fmt.Fprintf(&buf, "%s %s\n", id, acl[id])
+	}
+	fname := filepath.Join(d.Filepath(), aclFile)
+	err = ioutil.WriteFile(fname+".tmp", []byte(buf.String()), 0600)
+	if err == nil {
+		err = os.Rename(fname+".tmp", fname)
+	}
+	return
+}
+
+// check if a user has a right in this maildir
+// a user's own entry overrides anyone and authenticated, negative entries take rights away
+func (d MailDir) CheckACL(user string, right ACLRight) (ok bool, err error) {
+	defer d.wrapErr("check acl", &err)
+	var acl map[string]ACLRights
+	acl, err = d.readACL()
+	if err != nil {
+		return
+	}
+	id := aclIdentifier(user)
+	rights, found := acl[id]
+	if !found {
+		rights = acl[ACLAnyone]
+		if user != "" && user != ACLAnyone {
+			rights |= acl[ACLAuthenticated]
+		}
+	}
+	rights &^= acl["-"+id]
+	ok = rights.Has(right)
+	return
+}
@@ -0,0 +1,97 @@
+package maildir
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestACLRights(t *testing.T) {
+	r, err := ParseACLRights("lrwstipekxa")
+	if err != nil || r != ACLAll {
+		t.Fatalf("parsed all rights as %v %v", r, err)
+	}
+	r = NewACLRights(ACLRead, ACLLookup, ACLExpunge)
+	if r.String() != "lre" {
+		t.Fatalf("rights written as %q", r)
+	}
+	if _, err = ParseACLRights("lrz"); err == nil {
+		t.Fatal("parsed an unknown right")
+	}
+}
+
+func TestACL(t *testing.T) {
+	d := testMailDir(t)
+	// no acl file means no rights
+	ok, err := d.CheckACL("bob", ACLRead)
+	if err != nil || ok {
+		t.Fatalf("empty acl gave %v %v", ok, err)
+	}
+	if err = d.SetACL("alice", ACLAll); err != nil {
+		t.Fatal(err)
+	}
+	if err = d.SetACL("bob", NewACLRights(ACLLookup, ACLRead)); err != nil {
+		t.Fatal(err)
+	}
+	if err = d.SetACL(ACLAuthenticated, NewACLRights(ACLLookup)); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(d.Filepath(), aclFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "authenticated l\nuser=alice lrwstipekxa\nuser=bob lr\n" {
+		t.Fatalf("acl file is %q", data)
+	}
+	tests := []struct {
+		user  string
+		right ACLRight
+		ok    bool
+	}{
+		{"alice", ACLAdmin, true},
+		{"bob", ACLRead, true},
+		{"bob", ACLExpunge, false},
+		{"carol", ACLLookup, true},
+		{"carol", ACLRead, false},
+		{"", ACLLookup, false},
+	}
+	for _, test := range tests {
+		ok, err = d.CheckACL(test.user, test.right)
+		if err != nil || ok != test.ok {
+			t.Errorf("%q %s gave %v %v", test.user, ACLRights(test.right), ok, err)
+		}
+	}
+	// removing an entry falls back to authenticated
+	if err = d.SetACL("bob", 0); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ = d.CheckACL("bob", ACLRead); ok {
+		t.Fatal("removed entry still has rights")
+	}
+	acl, err := d.ACL()
+	if err != nil || len(acl) != 2 || acl["alice"] != ACLAll {
+		t.Fatalf("acl is %v %v", acl, err)
+	}
+}
+
+func TestACLNegative(t *testing.T) {
+	d := testMailDir(t)
+	err := ioutil.WriteFile(filepath.Join(d.Filepath(), aclFile), []byte("anyone lr\n-user=mallory r\nuser=mary-jane lrw\ngroup=staff lrwi\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := d.CheckACL("bob", ACLRead); !ok {
+		t.Fatal("anyone right not given")
+	}
+	if ok, _ := d.CheckACL("mallory", ACLRead); ok {
+		t.Fatal("negative right not taken away")
+	}
+	if ok, _ := d.CheckACL("mallory", ACLLookup); !ok {
+		t.Fatal("negative right took too much")
+	}
+	// only negative and group entries are left out, not names with a dash
+	acl, err := d.ACL()
+	if err != nil || len(acl) != 2 || acl["mary-jane"].String() != "lrw" || acl[ACLAnyone].String() != "lr" {
+		t.Fatalf("acl is %v %v", acl, err)
+	}
+}
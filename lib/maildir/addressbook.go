@@ -0,0 +1,138 @@
+package maildir
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// returned when removing an address that isn't in the address book
+var ErrNoAddress = errors.New("maildir: address not in address book")
+
+// name of the address book in the maildir root
+// each line is an email address and a display name separated by a tab
+const addressBookFile = "addressbook.tsv"
+
+// a flat file of addresses for autocompleting recipients
+type AddressBook struct {
+	dir MailDir
+}
+
+// get the address book kept in this maildir
+func (d MailDir) AddressBook() *AddressBook {
+	return &AddressBook{dir: d}
+}
+
+func (ab *AddressBook) path() string {
+	return filepath.Join(ab.dir.Filepath(), addressBookFile)
+}
+
+// read every address in file order
+func (ab *AddressBook) read() (addrs []*mail.Address, err error) {
+	var f *os.File
+	f, err = os.Open(ab.path())
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	} else if err != nil {
+		return
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		parts := strings.SplitN(sc.Text(), "\t", 2)
+		if parts[0] == "" {
+			continue
+		}
+		addr := &mail.Address{Address: parts[0]}
+		if len(parts) == 2 {
+			addr.Name = parts[1]
+		}
+		addrs = append(addrs, addr)
+	}
+	err = sc.Err()
+	return
+}
+
+// atomically replace the address book
+func (ab *AddressBook) write(addrs []*mail.Address) (err error) {
+	var sb strings.Builder
+	clean := strings.NewReplacer("\t", " ", "\r", " ", "\n", " ")
+	for _, addr := range addrs {
+		sb.WriteString(clean.Replace(addr.Address) + "\t" + clean.Replace(addr.Name) + "\n")
+	}
+	fname := ab.path()
+	err = ioutil.WriteFile(fname+".tmp", []byte(sb.String()), 0600)
+	if err == nil {
+		err = os.Rename(fname+".tmp", fname)
+	}
+	return
+}
+
+// find addresses whose display name or email starts with prefix, ignoring case
+func (ab *AddressBook) Lookup(prefix string) (found []*mail.Address, err error) {
+	defer ab.dir.wrapErr("address book lookup", &err)
+	var addrs []*mail.Address
+	addrs, err = ab.read()
+	prefix = strings.ToLower(prefix)
+	for _, addr := range addrs {
+		if strings.HasPrefix(strings.ToLower(addr.Name), prefix) || strings.HasPrefix(strings.ToLower(addr.Address), prefix) {
+			found = append(found, addr)
+		}
+	}
+	return
+}
+
+// add an address, replacing the name of one with the same email
+func (ab *AddressBook) Add(addr *mail.Address) (err error) {
+	defer ab.dir.wrapErr("address book add", &err)
+	mtx := ab.dir.mutex()
+	mtx.Lock()
+	defer mtx.Unlock()
+	var addrs []*mail.Address
+	addrs, err = ab.read()
+	if err != nil {
+		return
+	}
+	replaced := false
+	for idx, a := range addrs {
+		if strings.EqualFold(a.Address, addr.Address) {
+			addrs[idx] = addr
+			replaced = true
+		}
+	}
+	if !replaced {
+		addrs = append(addrs, addr)
+	}
+	err = ab.write(addrs)
+	return
+}
+
+// remove the address with this email, case does not matter
+func (ab *AddressBook) Remove(email string) (err error) {
+	defer ab.dir.wrapErr("address book remove", &err)
+	mtx := ab.dir.mutex()
+	mtx.Lock()
+	defer mtx.Unlock()
+	var addrs []*mail.Address
+	addrs, err = ab.read()
+	if err != nil {
+		return
+	}
+	kept := addrs[:0]
+	for _, a := range addrs {
+		if !strings.EqualFold(a.Address, email) {
+			kept = append(kept, a)
+		}
+	}
+	if len(kept) == len(addrs) {
+		err = ErrNoAddress
+		return
+	}
+	err = ab.write(kept)
+	return
+}
@@ -0,0 +1,68 @@
+package maildir
+
+import (
+	"errors"
+	"net/mail"
+	"testing"
+)
+
+func TestAddressBook(t *testing.T) {
+	ab := testMailDir(t).AddressBook()
+	found, err := ab.Lookup("a")
+	if err != nil || len(found) != 0 {
+		t.Fatalf("empty address book gave %v %v", found, err)
+	}
+	for _, addr := range []*mail.Address{
+		{Name: "Alice Smith", Address: "alice@example.com"},
+		{Name: "Bob", Address: "bob@example.com"},
+		{Name: "", Address: "albert@example.org"},
+		{Name: "Carol\tTabbed", Address: "carol@example.net"},
+	} {
+		if err = ab.Add(addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		prefix string
+		emails string
+	}{
+		{"al", "alice@example.com albert@example.org"},
+		{"ALICE S", "alice@example.com"},
+		{"b", "bob@example.com"},
+		{"carol t", "carol@example.net"},
+		{"example", ""},
+	}
+	for _, test := range tests {
+		found, err = ab.Lookup(test.prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		emails := ""
+		for _, addr := range found {
+			emails += " " + addr.Address
+		}
+		if emails != " "+test.emails && !(emails == "" && test.emails == "") {
+			t.Errorf("%q found%s", test.prefix, emails)
+		}
+	}
+	// same email replaces the name
+	if err = ab.Add(&mail.Address{Name: "Robert", Address: "BOB@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	found, _ = ab.Lookup("rob")
+	if len(found) != 1 {
+		t.Fatalf("renamed address gave %v", found)
+	}
+	if found, _ = ab.Lookup("bob"); len(found) != 1 || found[0].Name != "Robert" {
+		t.Fatalf("bob gave %v", found)
+	}
+	if err = ab.Remove("Alice@Example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if found, _ = ab.Lookup("al"); len(found) != 1 {
+		t.Fatalf("after remove found %v", found)
+	}
+	if err = ab.Remove("alice@example.com"); !errors.Is(err, ErrNoAddress) {
+		t.Fatalf("removing twice gave %v", err)
+	}
+}
@@ -0,0 +1,62 @@
+package maildir
+
+import (
+	"filippo.io/age"
+	"io"
+	"os"
+)
+
+// deliver a message encrypted to an age recipient
+// the plaintext never touches the disk, only the recipient's identity can read it back
+// returns the message in the new directory that was delivered
+func (d MailDir) EncryptDelivery(body io.Reader, recipient age.Recipient) (msg Message, err error) {
+	defer d.wrapErr("encrypt delivery", &err)
+	pr, pw := io.Pipe()
+	go func() {
+		w, err := age.Encrypt(pw, recipient)
+		if err == nil {
+			_, err = io.Copy(w, body)
+			if err == nil {
+				err = w.Close()
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+	msg, err = d.Deliver(pr)
+	// unblock the encrypting goroutine if delivery failed early
+	pr.CloseWithError(io.ErrClosedPipe)
+	return
+}
+
+// open a message delivered with EncryptDelivery and decrypt it with an identity
+func (d MailDir) DecryptOpen(msg Message, identity age.Identity) (r io.ReadCloser, err error) {
+	defer d.wrapErr("decrypt open", &err)
+	var fname string
+	fname, err = d.resolve(msg)
+	if err != nil {
+		return
+	}
+	var f *os.File
+	f, err = os.Open(fname)
+	if err != nil {
+		return
+	}
+	var dr io.Reader
+	dr, err = age.Decrypt(f, identity)
+	if err == nil {
+		r = &decryptReader{Reader: dr, f: f}
+	} else {
+		f.Close()
+	}
+	return
+}
+
+// decrypting reader that closes the underlying file
+type decryptReader struct {
+	io.Reader
+	f *os.File
+}
+
+func (r *decryptReader) Close() error {
+	return r.f.Close()
+}
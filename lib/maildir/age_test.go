@@ -0,0 +1,45 @@
+package maildir
+
+import (
+	"bytes"
+	"filippo.io/age"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestEncryptDelivery(t *testing.T) {
+	d := testMailDir(t)
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := "Subject: secret\n\nfor your eyes only\n"
+	msg, err := d.EncryptDelivery(strings.NewReader(body), id.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := ioutil.ReadFile(d.New(msg.Filepath()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, []byte("eyes only")) {
+		t.Fatal("plaintext on disk")
+	}
+	r, err := d.DecryptOpen(msg, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != body {
+		t.Fatalf("decrypted %q", got)
+	}
+	other, _ := age.GenerateX25519Identity()
+	if _, err = d.DecryptOpen(msg, other); err == nil {
+		t.Fatal("decrypted with the wrong identity")
+	}
+}
@@ -0,0 +1,33 @@
+package maildir
+
+import (
+	"io"
+	"os"
+)
+
+// deliver mail straight into cur with flags set and give it the next uid, like imap APPEND
+// returns the message as named in cur and its uid
+func (d MailDir) Append(body io.Reader, fs FlagSet) (msg Message, uid uint32, err error) {
+	defer d.wrapErr("append", &err)
+	msg, err = d.deliverCur(body, fs...)
+	if err != nil {
+		return
+	}
+	d.audit(d.options(), OpDeliver, msg)
+	mtx := d.mutex()
+	mtx.Lock()
+	defer mtx.Unlock()
+	var l *UIDList
+	l, err = d.UIDList()
+	if err == nil {
+		uid = l.Add(msg)
+		err = d.SaveUIDList(l)
+	}
+	if err != nil {
+		// don't leave a message without a uid
+		os.Remove(d.Cur(msg.Filepath()))
+		msg = ""
+		uid = 0
+	}
+	return
+}
@@ -0,0 +1,41 @@
+package maildir
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAppend(t *testing.T) {
+	d := testMailDir(t)
+	var last uint32
+	for i, fs := range []FlagSet{NewFlagSet(Seen, Flagged), nil, NewFlagSet(Draft)} {
+		msg, uid, err := d.Append(strings.NewReader("hi\n"), fs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uid <= last {
+			t.Fatalf("append %d got uid %d after %d", i, uid, last)
+		}
+		last = uid
+		if is, _ := d.IsCur(msg); !is {
+			t.Fatalf("%s not in cur", msg)
+		}
+		if got := msg.Flags(); len(fs) > 0 && !reflect.DeepEqual(got, fs) {
+			t.Fatalf("%s has flags %q not %q", msg, got, fs)
+		}
+		l, err := d.UIDList()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, ok := l.UID(msg); !ok || got != uid {
+			t.Fatalf("uid list has %d %v for %s", got, ok, msg)
+		}
+	}
+	if last != 3 {
+		t.Fatalf("last uid is %d", last)
+	}
+	if msgs, _ := d.ListNew(); len(msgs) != 0 {
+		t.Fatal("appended message in new")
+	}
+}
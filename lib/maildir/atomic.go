@@ -0,0 +1,67 @@
+package maildir
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// returned by VerifyAtomic when messages don't match their recorded size
+type AtomicityError struct {
+	// maildir checked
+	Dir MailDir
+	// messages whose size on disk differs from their S= field
+	Messages []Message
+}
+
+func (e *AtomicityError) Error() string {
+	var names []string
+	for _, msg := range e.Messages {
+		names = append(names, msg.Filepath())
+	}
+	return "maildir " + e.Dir.String() + ": partially written messages: " + strings.Join(names, ", ")
+}
+
+// get the size recorded in a maildir++ S= field of this message's name
+// returns false if it has none
+func (m Message) Size() (size int64, ok bool) {
+	for _, field := range strings.Split(m.Name(), ",")[1:] {
+		if strings.HasPrefix(field, "S=") {
+			var err error
+			size, err = strconv.ParseInt(field[2:], 10, 64)
+			ok = err == nil
+			return
+		}
+	}
+	return
+}
+
+// check that every message in new and cur with an S= field is that size on disk
+// a mismatch means a partial write was made visible
+// returns an *AtomicityError listing the bad messages
+func (d MailDir) VerifyAtomic() (err error) {
+	var bad []Message
+	for _, sub := range []string{"new", "cur"} {
+		var ents []os.DirEntry
+		ents, err = d.entries(sub)
+		if err != nil {
+			d.wrapErr("verify atomic", &err)
+			return
+		}
+		for _, ent := range ents {
+			msg := Message(ent.Name())
+			size, ok := msg.Size()
+			if !ok {
+				continue
+			}
+			st, e := ent.Info()
+			if e == nil && st.Size() != size {
+				bad = append(bad, msg)
+			}
+		}
+	}
+	if len(bad) > 0 {
+		err = &AtomicityError{Dir: d, Messages: bad}
+	}
+	return
+}
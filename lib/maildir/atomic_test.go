@@ -0,0 +1,29 @@
+package maildir
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestVerifyAtomic(t *testing.T) {
+	d := testMailDir(t)
+	putMessage(t, d, "new", "1.host,S=6", "hello\n")
+	putMessage(t, d, "cur", "2.host,S=6:2,S", "hello\n")
+	putMessage(t, d, "new", "3.host", "no size field\n")
+	if err := d.VerifyAtomic(); err != nil {
+		t.Fatal(err)
+	}
+	// promoted before it was fully written
+	putMessage(t, d, "new", "4.host,S=1000,W=1020", "trunc")
+	err := d.VerifyAtomic()
+	var aerr *AtomicityError
+	if !errors.As(err, &aerr) {
+		t.Fatalf("truncated message gave %v", err)
+	}
+	if len(aerr.Messages) != 1 || aerr.Messages[0] != "4.host,S=1000,W=1020" {
+		t.Fatalf("flagged %v", aerr.Messages)
+	}
+	if size, ok := Message("4.host,S=1000,W=1020:2,S").Size(); !ok || size != 1000 {
+		t.Fatalf("size parsed as %d %v", size, ok)
+	}
+}
@@ -0,0 +1,125 @@
+package maildir
+
+import (
+	"encoding/json"
+	log "github.com/Sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// an operation recorded in the audit log
+type Operation int
+
+const (
+	OpDeliver Operation = iota
+	OpProcessNew
+	OpProcessCur
+	OpDelete
+	OpOpen
+)
+
+var opNames = []string{"deliver", "process_new", "process_cur", "delete", "open"}
+
+func (op Operation) String() string {
+	if op < 0 || int(op) >= len(opNames) {
+		return "unknown"
+	}
+	return opNames[op]
+}
+
+// operations are logged by name
+func (op Operation) MarshalJSON() ([]byte, error) {
+	return json.Marshal(op.String())
+}
+
+// name of the audit log in the maildir root
+// it is only ever appended to
+const auditFile = "bdsmail-audit.log"
+
+// appends a json line to a maildir's audit log for each operation on it
+type AuditLogger struct {
+	// user recorded for operations done through a MailDir
+	User string
+	mtx  sync.Mutex
+}
+
+// a line in the audit log
+type auditEntry struct {
+	Time time.Time `json:"time"`
+	Op   Operation `json:"op"`
+	Dir  string    `json:"dir"`
+	Msg  Message   `json:"msg,omitempty"`
+	User string    `json:"user,omitempty"`
+}
+
+// make an audit logger recording operations as done by user
+func NewAuditLogger(user string) *AuditLogger {
+	return &AuditLogger{User: user}
+}
+
+// append an operation to the audit log in the root of dir
+func (l *AuditLogger) Log(op Operation, dir MailDir, msg Message, user string) (err error) {
+	var line []byte
+	line, err = json.Marshal(auditEntry{
+		Time: time.Now().UTC(),
+		Op:   op,
+		Dir:  dir.Filepath(),
+		Msg:  msg,
+		User: user,
+	})
+	if err != nil {
+		return
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	var f *os.File
+	f, err = os.OpenFile(filepath.Join(dir.Filepath(), auditFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err == nil {
+		_, err = f.Write(append(line, '\n'))
+		if e := f.Close(); err == nil {
+			err = e
+		}
+	}
+	return
+}
+
+// audit loggers set with WithAuditLogger keyed by maildir path
+var auditLoggers sync.Map
+
+// audit loggers of maildirs audited with Options.Audit keyed by maildir path
+// the user comes from the options each time so only the lock is kept here
+var optionAuditLoggers sync.Map
+
+// record every deliver, process, delete and open on this maildir with an audit logger
+// there is one logger per maildir so every MailDir naming it shares l and its lock,
+// it is used instead of Options.Audit and nil stops using it
+func (d MailDir) WithAuditLogger(l *AuditLogger) MailDir {
+	if l == nil {
+		auditLoggers.Delete(d.Filepath())
+	} else {
+		auditLoggers.Store(d.Filepath(), l)
+	}
+	return d
+}
+
+// log an operation that was done if this maildir has an audit logger or Options.Audit set
+// the operation already happened so failures are only logged
+func (d MailDir) audit(o Options, op Operation, msg Message) {
+	var al *AuditLogger
+	user := o.AuditUser
+	if l, ok := auditLoggers.Load(d.Filepath()); ok {
+		al = l.(*AuditLogger)
+		user = al.User
+	} else if o.Audit {
+		l, _ := optionAuditLoggers.LoadOrStore(d.Filepath(), new(AuditLogger))
+		al = l.(*AuditLogger)
+	} else {
+		return
+	}
+	err := al.Log(op, d, msg, user)
+	if err != nil {
+		log.Warn("failed to audit ", op, " of ", msg, " in ", d, ": ", err)
+	}
+}
@@ -0,0 +1,102 @@
+package maildir
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestAuditLogger(t *testing.T) {
+	d := testMailDir(t)
+	if err := d.SetOptions(Options{Audit: true, AuditUser: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := d.Deliver(strings.NewReader("hi\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err = d.ProcessNew(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err = d.ProcessCur(msg, Seen, Flagged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := d.OpenMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if err = d.Remove(msg); err != nil {
+		t.Fatal(err)
+	}
+	// failed operations aren't logged
+	d.Remove(msg)
+
+	f, err := os.Open(filepath.Join(d.Filepath(), auditFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var ops []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var e struct {
+			Op   string
+			Dir  string
+			Msg  string
+			User string
+		}
+		if err = json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.User != "alice" || e.Dir != d.Filepath() || e.Msg == "" {
+			t.Fatalf("bad entry %s", sc.Text())
+		}
+		ops = append(ops, e.Op)
+	}
+	if strings.Join(ops, " ") != "deliver process_new process_cur open delete" {
+		t.Fatalf("logged %v", ops)
+	}
+}
+
+func TestWithAuditLogger(t *testing.T) {
+	d := testMailDir(t).WithAuditLogger(NewAuditLogger("bob"))
+	defer d.WithAuditLogger(nil)
+	// the logger is shared by every MailDir naming the maildir
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			MailDir(d.Filepath()).Deliver(strings.NewReader("hi\n"))
+		}()
+	}
+	wg.Wait()
+	d.WithAuditLogger(nil)
+	if _, err := d.Deliver(strings.NewReader("hi\n")); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(filepath.Join(d.Filepath(), auditFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	n := 0
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var e struct{ Op, User string }
+		if err = json.Unmarshal(sc.Bytes(), &e); err != nil || e.Op != "deliver" || e.User != "bob" {
+			t.Fatalf("bad entry %s %v", sc.Text(), err)
+		}
+		n++
+	}
+	if n != 8 {
+		t.Fatalf("%d entries logged", n)
+	}
+}
@@ -0,0 +1,33 @@
+package maildir
+
+import (
+	"testing"
+)
+
+func TestCountByFlag(t *testing.T) {
+	d := testMailDir(t)
+	putMessage(t, d, "new", "1.host", "new\n")
+	putMessage(t, d, "cur", "2.host:2,S", "seen\n")
+	putMessage(t, d, "cur", "3.host:2,FS", "seen and flagged\n")
+	putMessage(t, d, "cur", "4.host:2,F", "flagged\n")
+	putMessage(t, d, "cur", "5.host:2,DS", "seen draft\n")
+	for flag, want := range map[Flag]int{Seen: 3, Flagged: 2, Draft: 1, Trashed: 0} {
+		n, err := d.CountByFlag(flag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Fatalf("%s count was %d not %d", flag, n, want)
+		}
+	}
+	// flagged or not yet seen
+	n, err := d.CountWhere(func(fs FlagSet) bool {
+		return fs.Has(Flagged) || !fs.Has(Seen)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("custom count was %d", n)
+	}
+}
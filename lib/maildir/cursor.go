@@ -0,0 +1,95 @@
+package maildir
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// returned when a pagination cursor can't be parsed
+var ErrBadCursor = errors.New("maildir: bad pagination cursor")
+
+// a message's place in delivery order
+type cursorKey struct {
+	t    time.Time
+	name string
+}
+
+func (k cursorKey) before(o cursorKey) bool {
+	if k.t.Equal(o.t) {
+		return k.name < o.name
+	}
+	return k.t.Before(o.t)
+}
+
+// cursors are the delivery time in unix nanoseconds and the unique name split by a slash
+// which can't be in a file name
+func (k cursorKey) String() string {
+	return strconv.FormatInt(k.t.UnixNano(), 10) + "/" + k.name
+}
+
+func parseCursor(cursor string) (k cursorKey, err error) {
+	idx := strings.Index(cursor, "/")
+	if idx < 0 {
+		err = ErrBadCursor
+		return
+	}
+	ns, e := strconv.ParseInt(cursor[:idx], 10, 64)
+	if e != nil {
+		err = ErrBadCursor
+		return
+	}
+	k = cursorKey{time.Unix(0, ns), cursor[idx+1:]}
+	return
+}
+
+// list up to limit messages in a subdirectory delivered after a cursor, oldest first
+// an empty cursor starts from the beginning, returns the cursor to get the next page with
+// messages delivered or removed between pages don't cause repeats or skips of the rest
+func (d MailDir) ListAfter(sub string, cursor string, limit int) (msgs []Message, next string, err error) {
+	defer d.wrapErr("list after", &err)
+	next = cursor
+	var after cursorKey
+	if cursor != "" {
+		after, err = parseCursor(cursor)
+		if err != nil {
+			return
+		}
+	}
+	var all []Message
+	all, err = d.listDir(sub)
+	if err != nil {
+		return
+	}
+	type entry struct {
+		msg Message
+		key cursorKey
+	}
+	var entries []entry
+	for _, msg := range all {
+		t, e := d.deliveryTime(sub, msg)
+		if e != nil {
+			// removed while we were listing
+			continue
+		}
+		k := cursorKey{t, msg.Name()}
+		if cursor == "" || after.before(k) {
+			entries = append(entries, entry{msg, k})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key.before(entries[j].key)
+	})
+	if limit > 0 && len(entries) > limit {
+		entries = entries[:limit]
+	}
+	for _, e := range entries {
+		msgs = append(msgs, e.msg)
+	}
+	if len(entries) > 0 {
+		next = entries[len(entries)-1].key.String()
+	}
+	return
+}
@@ -0,0 +1,73 @@
+package maildir
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestListAfter(t *testing.T) {
+	d := testMailDir(t)
+	base := time.Now().Add(-time.Hour)
+	put := func(i int) {
+		msg := putMessage(t, d, "cur", fmt.Sprintf("msg%02d:2,S", i), "hi\n")
+		mt := base.Add(time.Duration(i) * time.Second)
+		if err := os.Chtimes(d.Cur(msg.Filepath()), mt, mt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		put(i * 2)
+	}
+	seen := make(map[string]bool)
+	var order []string
+	cursor := ""
+	for page := 0; ; page++ {
+		msgs, next, err := d.ListAfter("cur", cursor, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msgs) == 0 {
+			if next != cursor {
+				t.Fatal("empty page moved the cursor")
+			}
+			break
+		}
+		for _, msg := range msgs {
+			if seen[msg.Name()] {
+				t.Fatalf("%s listed twice", msg)
+			}
+			seen[msg.Name()] = true
+			order = append(order, msg.Name())
+		}
+		cursor = next
+		if page == 1 {
+			// one before the cursor and one after it
+			put(1)
+			put(19)
+			// flag changes don't matter
+			if _, err = d.ProcessCur(msgs[0], Seen, Flagged); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if len(order) != 11 {
+		t.Fatalf("listed %v", order)
+	}
+	for i := 1; i < len(order); i++ {
+		if order[i-1] >= order[i] {
+			t.Fatalf("out of order %v", order)
+		}
+	}
+	if seen["msg01"] {
+		t.Fatal("message delivered before the cursor was listed")
+	}
+	if !seen["msg19"] {
+		t.Fatal("message delivered after the cursor was skipped")
+	}
+	if _, _, err := d.ListAfter("cur", "garbage", 3); !errors.Is(err, ErrBadCursor) {
+		t.Fatalf("bad cursor gave %v", err)
+	}
+}
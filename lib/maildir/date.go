@@ -0,0 +1,133 @@
+package maildir
+
+import (
+	"errors"
+	"net/mail"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// returned by Date with the date read as utc when the Date header had only
+// a zone name we don't know or no zone at all, the date may be hours off
+var ErrUnknownZone = errors.New("maildir: date has no known zone, read as utc")
+
+// fallback layouts with a numeric zone offset for malformed date headers seen in the wild
+var dateLayouts = []string{
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04 -0700",
+	"Mon, 2 Jan 06 15:04:05 -0700",
+	"Mon 2 Jan 2006 15:04:05 -0700",
+	"2 Jan 2006 15:04:05 -0700",
+	"2 Jan 06 15:04:05 -0700",
+	time.RFC3339,
+}
+
+// fallback layouts with a zone name, time.Parse takes any name and only
+// knows the offset of the local zone's
+var namedZoneLayouts = []string{
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"Mon, 2 Jan 06 15:04:05 MST",
+	"2 Jan 2006 15:04:05 MST",
+	"Monday, 02-Jan-06 15:04:05 MST",
+	time.UnixDate,
+}
+
+// fallback layouts without a zone
+var noZoneLayouts = []string{
+	"Mon, 2 Jan 2006 15:04:05",
+	"2 Jan 2006 15:04:05",
+	time.ANSIC,
+}
+
+// a date ending in a numeric offset
+var numericZone = regexp.MustCompile(`(?:[+-]\d\d:?\d\d|\dZ)$`)
+
+// hours from utc of the zone names RFC 5322 4.3 allows
+var obsZones = map[string]int{
+	"UT": 0, "UTC": 0, "GMT": 0, "Z": 0,
+	"EST": -5, "EDT": -4,
+	"CST": -6, "CDT": -5,
+	"MST": -7, "MDT": -6,
+	"PST": -8, "PDT": -7,
+}
+
+// parse with the first layout that fits
+func parseLayouts(layouts []string, str string) (t time.Time, err error) {
+	for _, layout := range layouts {
+		t, err = time.Parse(layout, str)
+		if err == nil {
+			return
+		}
+	}
+	return
+}
+
+// parse an rfc 5322 date header value
+// tries mail.ParseDate first then some common malformed variants, numeric offsets first
+// a date with a zone name we don't know or none is returned as utc with ErrUnknownZone
+func parseDate(str string) (t time.Time, err error) {
+	// strip comments like "(PST)" and collapse whitespace
+	if i := strings.Index(str, "("); i > 0 {
+		str = str[:i]
+	}
+	str = strings.Join(strings.Fields(str), " ")
+	t, err = mail.ParseDate(str)
+	if numericZone.MatchString(str) {
+		if err != nil {
+			t, err = parseLayouts(dateLayouts, str)
+		}
+		return
+	}
+	if err != nil {
+		t, err = parseLayouts(namedZoneLayouts, str)
+	}
+	if err != nil {
+		t, err = parseLayouts(noZoneLayouts, str)
+		if err == nil {
+			err = ErrUnknownZone
+		}
+		return
+	}
+	name, offset := t.Zone()
+	if hours, ok := obsZones[strings.ToUpper(name)]; ok {
+		t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.FixedZone(name, hours*60*60))
+	} else if offset == 0 {
+		// not a zone we or the local zone know, it was read as utc
+		err = ErrUnknownZone
+	}
+	return
+}
+
+// get the date of a message in utc
+// uses the Date header and falls back to delivery time if it cannot be parsed
+// returns ErrUnknownZone with the header's date read as utc if it had no zone or
+// only a name we don't know, callers can fall back to delivery time themselves
+func (d MailDir) Date(msg Message) (t time.Time, err error) {
+	defer d.wrapErr("date", &err)
+	var fname string
+	fname, err = d.resolve(msg)
+	if err == nil {
+		var f *os.File
+		f, err = os.Open(fname)
+		if err == nil {
+			defer f.Close()
+			var m *mail.Message
+			m, err = mail.ReadMessage(f)
+			if err == nil {
+				t, err = parseDate(m.Header.Get("Date"))
+			}
+			if err != nil && err != ErrUnknownZone {
+				// no usable date header, use delivery time
+				var st os.FileInfo
+				st, err = f.Stat()
+				if err == nil {
+					t = st.ModTime()
+				}
+			}
+			t = t.UTC()
+		}
+	}
+	return
+}
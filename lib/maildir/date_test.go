@@ -0,0 +1,64 @@
+package maildir
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMessageDate(t *testing.T) {
+	d := testMailDir(t)
+	want := time.Date(2016, time.June, 3, 17, 4, 5, 0, time.UTC)
+	for i, hdr := range []string{
+		"Fri, 3 Jun 2016 17:04:05 +0000",
+		"Fri, 03 Jun 2016 10:04:05 -0700 (PDT)",
+		"Fri, 3 Jun 2016 09:04:05 -0800 (PST)",
+		"Fri, 3 Jun 16 17:04:05 +0000",
+		"3 Jun 2016 19:04:05 +0200",
+		"Fri  3 Jun 2016 17:04:05 +0000",
+		// zone names RFC 5322 gives offsets for
+		"Fri, 3 Jun 2016 10:04:05 PDT",
+		"Fri, 3 Jun 2016 12:04:05 EST",
+		"3 Jun 2016 17:04:05 GMT",
+	} {
+		msg := putMessage(t, d, "new", fmt.Sprintf("msg%d.host", i), "Date: "+hdr+"\r\nSubject: test\r\n\r\nbody\r\n")
+		date, err := d.Date(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !date.Equal(want) || date.Location() != time.UTC {
+			t.Errorf("%q parsed as %s", hdr, date)
+		}
+	}
+}
+
+func TestMessageDateMissing(t *testing.T) {
+	d := testMailDir(t)
+	msg := putMessage(t, d, "new", "nodate.host", "Subject: no date\r\n\r\nbody\r\n")
+	delivered := time.Date(2015, time.March, 1, 12, 0, 0, 0, time.Local)
+	os.Chtimes(d.New(msg.Filepath()), delivered, delivered)
+	date, err := d.Date(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !date.Equal(delivered) || date.Location() != time.UTC {
+		t.Errorf("missing date header gave %s", date)
+	}
+}
+
+func TestMessageDateUnknownZone(t *testing.T) {
+	d := testMailDir(t)
+	want := time.Date(2016, time.June, 3, 17, 4, 5, 0, time.UTC)
+	for i, hdr := range []string{
+		"Fri, 3 Jun 2016 17:04:05 QQT",
+		"Fri, 3 Jun 2016 17:04:05",
+	} {
+		msg := putMessage(t, d, "new", fmt.Sprintf("msg%d.host", i), "Date: "+hdr+"\r\nSubject: test\r\n\r\nbody\r\n")
+		date, err := d.Date(msg)
+		if !errors.Is(err, ErrUnknownZone) || !date.Equal(want) {
+			t.Errorf("%q gave %s %v", hdr, date, err)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package maildir
+
+import (
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// returned when a delivery is aborted because the body stalled
+var ErrReadTimeout = errors.New("maildir: read from message body timed out")
+
+// options for delivering a message
+type DeliverOpts struct {
+	// abort the delivery if a single read from the body takes longer than this
+	// 0 means no limit
+	ReadTimeout time.Duration
+	// deliveries with the same key are only written once within IdempotencyWindow
+	// repeats return the first message and ErrAlreadyDelivered, or ErrDeliveryInProgress
+	// while the first is still being written
+	IdempotencyKey string
+	// how long idempotency keys are remembered, 0 means DefaultIdempotencyWindow
+	IdempotencyWindow time.Duration
+	// store the message with CRLF line endings and nothing else changed
+	// so a DKIM signature made over it still verifies
+	DKIMSafe bool
+	// journal the delivery so RecoverWAL can finish it after a crash
+	WAL bool
+	// envelope sender and recipient handed to plugins
+	Sender    string
+	Recipient string
+	// run on the body in order before it is written
+	Plugins []DeliverPlugin
+}
+
+// a reader that can have a deadline set, like a net.Conn
+type deadlineReader interface {
+	io.Reader
+	SetReadDeadline(t time.Time) error
+}
+
+// reader that fails with ErrReadTimeout when a read stalls
+type timeoutReader struct {
+	r       io.Reader
+	timeout time.Duration
+}
+
+func (t *timeoutReader) Read(p []byte) (n int, err error) {
+	if dr, ok := t.r.(deadlineReader); ok {
+		dr.SetReadDeadline(time.Now().Add(t.timeout))
+		n, err = dr.Read(p)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			err = ErrReadTimeout
+		}
+		return
+	}
+	// no deadlines so read in the background and wait for it
+	// if the read stalls the goroutine is left behind until it returns
+	type result struct {
+		n   int
+		err error
+	}
+	buf := make([]byte, len(p))
+	ch := make(chan result, 1)
+	go func() {
+		n, err := t.r.Read(buf)
+		ch <- result{n, err}
+	}()
+	timer := time.NewTimer(t.timeout)
+	defer timer.Stop()
+	select {
+	case res := <-ch:
+		n = copy(p, buf[:res.n])
+		err = res.err
+	case <-timer.C:
+		err = ErrReadTimeout
+	}
+	return
+}
+
+// clear any deadline we left on the underlying reader
+func (t *timeoutReader) clear() {
+	if dr, ok := t.r.(deadlineReader); ok {
+		dr.SetReadDeadline(time.Time{})
+	}
+}
+
+// reader that turns bare LF and bare CR into CRLF and leaves every other byte alone
+// headers keep their order, folding and whitespace
+type crlfReader struct {
+	r io.Reader
+	// last byte read was a CR
+	cr bool
+	// converted bytes not read yet
+	out []byte
+	buf [4096]byte
+}
+
+func (c *crlfReader) Read(p []byte) (n int, err error) {
+	for len(c.out) == 0 {
+		var nr int
+		nr, err = c.r.Read(c.buf[:])
+		for _, b := range c.buf[:nr] {
+			switch {
+			case b == '\r':
+				c.out = append(c.out, '\r', '\n')
+			case b == '\n' && c.cr:
+				// already written with the CR
+			case b == '\n':
+				c.out = append(c.out, '\r', '\n')
+			default:
+				c.out = append(c.out, b)
+			}
+			c.cr = b == '\r'
+		}
+		if err != nil {
+			break
+		}
+	}
+	n = copy(p, c.out)
+	c.out = c.out[n:]
+	if len(c.out) > 0 {
+		err = nil
+	}
+	return
+}
@@ -0,0 +1,85 @@
+package maildir
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// assert nothing was left behind by an aborted delivery
+func assertEmpty(t *testing.T, d MailDir) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		files, err := ioutil.ReadDir(filepath.Join(d.Filepath(), sub))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 0 {
+			t.Fatalf("%s has %d files", sub, len(files))
+		}
+	}
+}
+
+func TestDeliverReadTimeout(t *testing.T) {
+	d := testMailDir(t)
+	// stalls after the first write
+	r, w := io.Pipe()
+	defer w.Close()
+	go w.Write([]byte("Subject: slow\r\n"))
+	_, err := d.DeliverWith(r, DeliverOpts{ReadTimeout: time.Millisecond * 50})
+	if !errors.Is(err, ErrReadTimeout) {
+		t.Fatalf("stalled delivery gave %v", err)
+	}
+	assertEmpty(t, d)
+}
+
+func TestDeliverReadTimeoutDeadline(t *testing.T) {
+	d := testMailDir(t)
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go client.Write([]byte("Subject: slow\r\n"))
+	_, err := d.DeliverWith(server, DeliverOpts{ReadTimeout: time.Millisecond * 50})
+	if !errors.Is(err, ErrReadTimeout) {
+		t.Fatalf("stalled delivery gave %v", err)
+	}
+	assertEmpty(t, d)
+}
+
+func TestDeliverFromPath(t *testing.T) {
+	d := testMailDir(t)
+	if err := ioutil.WriteFile(filepath.Join(d.Filepath(), maildirSizeFile), []byte("1000000S\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	spool := filepath.Join(t.TempDir(), "spool")
+	body := "Subject: hi\n\nbody\n"
+	if err := ioutil.WriteFile(spool, []byte(body), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts := DeliverOpts{IdempotencyKey: "spool-1"}
+	msg, err := d.DeliverFromPathWith(spool, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(d.New(msg.Filepath()))
+	if err != nil || string(data) != body {
+		t.Fatalf("delivered %q %v", data, err)
+	}
+	// the spool is on the same filesystem so it was linked and can't be written to now
+	if st, _ := os.Stat(spool); st.Mode().Perm()&0222 != 0 {
+		t.Fatalf("linked message is %s", st.Mode())
+	}
+	if again, err := d.DeliverFromPathWith(spool, opts); !errors.Is(err, ErrAlreadyDelivered) || again != msg {
+		t.Fatalf("redelivery gave %s %v", again, err)
+	}
+	if _, size, count := readMaildirSize(t, d); size != int64(len(body)) || count != 1 {
+		t.Fatalf("maildirsize has %d bytes in %d messages", size, count)
+	}
+	if _, err = d.DeliverFromPath(t.TempDir()); !errors.Is(err, ErrNotRegular) {
+		t.Fatalf("delivering a directory gave %v", err)
+	}
+}
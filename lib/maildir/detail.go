@@ -0,0 +1,35 @@
+package maildir
+
+import (
+	"io"
+	"strings"
+)
+
+// make an address detail safe to use as a folder name
+// keeps letters, digits, '-' and '_' and lower cases them
+func sanitizeDetail(detail string) string {
+	return strings.Map(func(c rune) rune {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-', c == '_':
+			return c
+		case c >= 'A' && c <= 'Z':
+			return c + 'a' - 'A'
+		}
+		return -1
+	}, detail)
+}
+
+// deliver mail sent to user+detail into the .detail subfolder, creating it if needed
+// an empty detail, or one with nothing safe left in it, delivers to this maildir
+// returns the maildir delivered to and the message in its new directory
+func (d MailDir) DeliverToDetail(body io.Reader, detail string) (f MailDir, msg Message, err error) {
+	defer d.wrapErr("deliver to detail", &err)
+	f = d
+	if name := sanitizeDetail(detail); name != "" {
+		f, err = d.EnsureFolder(name)
+	}
+	if err == nil {
+		msg, err = f.Deliver(body)
+	}
+	return
+}
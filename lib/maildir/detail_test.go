@@ -0,0 +1,37 @@
+package maildir
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDeliverToDetail(t *testing.T) {
+	d := testMailDir(t)
+	tests := []struct {
+		detail string
+		folder MailDir
+	}{
+		{"lists", d.Folder("lists")},
+		{"Lists", d.Folder("lists")},
+		{"../../etc", d.Folder("etc")},
+		{"a.b/c", d.Folder("abc")},
+		{"", d},
+		{"../..", d},
+	}
+	for _, test := range tests {
+		f, msg, err := d.DeliverToDetail(strings.NewReader("hi\n"), test.detail)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Filepath() != test.folder.Filepath() {
+			t.Errorf("%q delivered to %s", test.detail, f)
+		}
+		if is, _ := f.IsNew(msg); !is {
+			t.Errorf("%q message not in %s", test.detail, f)
+		}
+	}
+	msgs, _ := d.Folder("lists").ListNew()
+	if len(msgs) != 2 {
+		t.Fatalf("lists has %d messages", len(msgs))
+	}
+}
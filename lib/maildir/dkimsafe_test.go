@@ -0,0 +1,35 @@
+package maildir
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// sha256 of the message below with every line ending as CRLF
+const dkimSafeHash = "910a5b8e24068eb00c0c128a180cf2a1231f5fa8a8763609448077f3d56943d1"
+
+func TestDeliverDKIMSafe(t *testing.T) {
+	d := testMailDir(t)
+	// mixed line endings, odd spacing and a folded header that must all survive
+	body := "DKIM-Signature: v=1; a=rsa-sha256; d=example.com; s=default;\r\n\th=from:subject; b=abc\n" +
+		"Subject:  spaced   out\r  and folded\n" +
+		"From: a@example.com\r\n\nline one\nline two\r\n\n"
+	// one byte at a time so CRLF is split across reads
+	r := iotest.OneByteReader(strings.NewReader(body))
+	msg, err := d.DeliverWith(r, DeliverOpts{DKIMSafe: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(d.New(msg.Filepath()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := sha256.Sum256(data)
+	if hex.EncodeToString(h[:]) != dkimSafeHash {
+		t.Fatalf("stored %q", data)
+	}
+}
@@ -0,0 +1,40 @@
+package maildir
+
+import (
+	"io"
+)
+
+// save a new draft into the cur directory of a subfolder with the draft flag set
+// returns the draft message in that subfolder
+func (d MailDir) SaveDraft(body io.Reader, draftsFolder string) (msg Message, err error) {
+	defer d.wrapErr("save draft", &err)
+	var drafts MailDir
+	drafts, err = d.EnsureFolder(draftsFolder)
+	if err == nil {
+		msg, err = drafts.deliverCur(body, Draft)
+	}
+	return
+}
+
+// replace the content of a draft held in this maildir
+// the new content is fully delivered before the old draft is removed
+// returns the new draft message, it keeps the old flags and stays flagged as a draft
+func (d MailDir) UpdateDraft(msg Message, body io.Reader) (m Message, err error) {
+	defer d.wrapErr("update draft", &err)
+	_, err = d.resolve(msg)
+	if err == nil {
+		flags := msg.GetFlags()
+		draft := false
+		for _, f := range flags {
+			draft = draft || f == Draft
+		}
+		if !draft {
+			flags = append(flags, Draft)
+		}
+		m, err = d.deliverCur(body, flags...)
+		if err == nil {
+			err = d.Remove(msg)
+		}
+	}
+	return
+}
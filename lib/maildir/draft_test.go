@@ -0,0 +1,50 @@
+package maildir
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSaveAndUpdateDraft(t *testing.T) {
+	d := testMailDir(t)
+	msg, err := d.SaveDraft(bytes.NewBufferString("Subject: draft\r\n\r\nfirst\r\n"), "Drafts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	drafts := d.Folder("Drafts")
+	_, err = os.Stat(filepath.Join(drafts.Filepath(), "maildirfolder"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	is, _ := drafts.IsCur(msg)
+	if !is {
+		t.Fatal("draft not saved in cur")
+	}
+	if flags := msg.GetFlags(); len(flags) != 1 || flags[0] != Draft {
+		t.Fatalf("draft has flags %v", flags)
+	}
+
+	updated, err := drafts.UpdateDraft(msg, bytes.NewBufferString("Subject: draft\r\n\r\nsecond\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	is, _ = drafts.IsCur(msg)
+	if is {
+		t.Fatal("old draft not removed")
+	}
+	if flags := updated.GetFlags(); len(flags) != 1 || flags[0] != Draft {
+		t.Fatalf("updated draft has flags %v", flags)
+	}
+	r, err := drafts.OpenMessage(updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	b, _ := ioutil.ReadAll(r)
+	if !bytes.HasSuffix(b, []byte("second\r\n")) {
+		t.Fatalf("updated draft has content %q", b)
+	}
+}
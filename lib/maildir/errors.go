@@ -0,0 +1,44 @@
+package maildir
+
+import (
+	"errors"
+)
+
+// returned when a maildir or one of its subdirectories is something other than a directory
+var ErrNotDirectory = errors.New("maildir: not a directory")
+
+// returned when delivering from a path that isn't a regular file
+var ErrNotRegular = errors.New("maildir: not a regular file")
+
+// error from an operation on a maildir
+// wraps the underlying error so errors.Is and errors.As see through it
+type Error struct {
+	// maildir the operation was done on
+	Dir MailDir
+	// name of the operation that failed
+	Op string
+	// what went wrong
+	Err error
+}
+
+func (e *Error) Error() string {
+	return "maildir " + e.Dir.String() + ": " + e.Op + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// wrap the error in *err with this maildir and an operation name
+// deferred from exported methods so every error they return says where it came from
+// errors that are already wrapped are left alone so the innermost operation is kept
+func (d MailDir) wrapErr(op string, err *error) {
+	if *err == nil {
+		return
+	}
+	var e *Error
+	if errors.As(*err, &e) {
+		return
+	}
+	*err = &Error{Dir: d, Op: op, Err: *err}
+}
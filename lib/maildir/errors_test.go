@@ -0,0 +1,70 @@
+package maildir
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestErrorWrapping(t *testing.T) {
+	d := testMailDir(t)
+	_, err := d.ProcessNew(Message("missing"))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("ProcessNew gave %v", err)
+	}
+	var e *Error
+	if !errors.As(err, &e) || e.Dir != d || e.Op != "process new" {
+		t.Fatalf("error not wrapped: %#v", err)
+	}
+	if !strings.Contains(err.Error(), d.String()) {
+		t.Fatalf("error does not name the maildir: %s", err)
+	}
+	_, err = d.Folder("nope").ListCur()
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("ListCur gave %v", err)
+	}
+	_, err = d.AddFlag(Message("missing"), Flagged)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("AddFlag gave %v", err)
+	}
+	if err = d.Remove(Message("missing")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Remove gave %v", err)
+	}
+}
+
+func TestErrorWrappingDeliver(t *testing.T) {
+	d := testMailDir(t).Folder("missing")
+	_, err := d.Deliver(strings.NewReader("Subject: hi\n\n"))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Deliver gave %v", err)
+	}
+	var e *Error
+	if !errors.As(err, &e) || e.Op != "deliver" {
+		t.Fatalf("error not wrapped: %#v", err)
+	}
+}
+
+func TestEnsureNotDirectory(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "mail")
+	if err := ioutil.WriteFile(fname, []byte("not a maildir\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	d := MailDir(fname)
+	if err := d.Ensure(); !errors.Is(err, ErrNotDirectory) {
+		t.Fatalf("Ensure on a file gave %v", err)
+	}
+	if _, err := d.Deliver(strings.NewReader("Subject: hi\n\n")); !errors.Is(err, ErrNotDirectory) {
+		t.Fatalf("Deliver to a file gave %v", err)
+	}
+	// a subdirectory that is a file is caught too
+	d = MailDir(t.TempDir())
+	if err := ioutil.WriteFile(filepath.Join(d.Filepath(), "cur"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Ensure(); !errors.Is(err, ErrNotDirectory) {
+		t.Fatalf("Ensure with cur a file gave %v", err)
+	}
+}
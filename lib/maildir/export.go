@@ -0,0 +1,187 @@
+package maildir
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// returned by ImportTar for an entry that would land outside the maildir
+var ErrUnsafeTarEntry = errors.New("maildir: unsafe tar entry")
+
+// write every message in new and cur as a tar archive for moving to another server
+// entries are named by their path in the maildir, new/name and cur/name, with
+// maildir++ subfolders under .Folder/ along with their maildirfolder marker, so
+// the archive can be untarred straight into a fresh maildir
+// messages removed or renamed while exporting are left out
+func (d MailDir) ExportTar(w io.Writer) (err error) {
+	defer d.wrapErr("export tar", &err)
+	tw := tar.NewWriter(w)
+	err = d.exportTar(tw, "")
+	if err == nil {
+		var names []string
+		names, err = d.folders()
+		for _, name := range names {
+			if err != nil {
+				break
+			}
+			err = d.Folder(name).exportTar(tw, "."+name)
+		}
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	return
+}
+
+// write one maildir's directories and messages to a tar archive under a prefix
+func (d MailDir) exportTar(tw *tar.Writer, prefix string) (err error) {
+	if prefix != "" {
+		err = writeTarDir(tw, prefix)
+		if err == nil {
+			err = writeTarFile(tw, filepath.Join(d.Filepath(), "maildirfolder"), path.Join(prefix, "maildirfolder"))
+			if os.IsNotExist(err) {
+				// not marked, write an empty marker so it untars as a subfolder
+				err = tw.WriteHeader(&tar.Header{
+					Typeflag: tar.TypeReg,
+					Name:     path.Join(prefix, "maildirfolder"),
+					Mode:     0600,
+				})
+			}
+		}
+	}
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err == nil {
+			err = writeTarDir(tw, path.Join(prefix, sub))
+		}
+	}
+	for _, sub := range []string{"new", "cur"} {
+		if err != nil {
+			break
+		}
+		var ents []os.DirEntry
+		ents, err = d.entries(sub)
+		for _, ent := range ents {
+			if err != nil {
+				break
+			}
+			if ent.IsDir() {
+				continue
+			}
+			err = writeTarFile(tw, filepath.Join(d.Filepath(), sub, ent.Name()), path.Join(prefix, sub, ent.Name()))
+			if os.IsNotExist(err) {
+				// moved since listing
+				err = nil
+			}
+		}
+	}
+	return
+}
+
+// write a directory entry to a tar archive
+func writeTarDir(tw *tar.Writer, name string) error {
+	return tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     name + "/",
+		Mode:     0700,
+	})
+}
+
+// write a file to a tar archive keeping its mode and modification time
+// nothing is written if the file can't be opened
+func writeTarFile(tw *tar.Writer, fname, name string) (err error) {
+	var f *os.File
+	f, err = os.Open(fname)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	var st os.FileInfo
+	st, err = f.Stat()
+	if err == nil {
+		err = tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Mode:     int64(st.Mode().Perm()),
+			Size:     st.Size(),
+			ModTime:  st.ModTime(),
+		})
+	}
+	if err == nil {
+		// copy exactly what the header says in case it is being appended to
+		_, err = io.CopyN(tw, f, st.Size())
+	}
+	return
+}
+
+// recreate messages from a tar archive made by ExportTar keeping their names and flags
+// the maildir and any subfolders in the archive are created as needed, entries
+// other than messages are skipped and existing messages are never overwritten
+// entries with absolute paths, .. or links stop the import with ErrUnsafeTarEntry,
+// messages before such an entry stay imported
+// returns how many messages were imported
+func (d MailDir) ImportTar(r io.Reader) (n int, err error) {
+	defer d.wrapErr("import tar", &err)
+	err = d.Ensure()
+	tr := tar.NewReader(r)
+	for err == nil {
+		var hdr *tar.Header
+		hdr, err = tr.Next()
+		if err == io.EOF {
+			err = nil
+			break
+		} else if err != nil {
+			break
+		}
+		var folder string
+		var parts []string
+		folder, parts, err = tarEntry(hdr)
+		md := d
+		if err == nil && folder != "" {
+			// subfolders are marked even if the archive has no marker
+			md, err = d.EnsureFolder(folder)
+		}
+		if err == nil && len(parts) == 2 && (parts[0] == "new" || parts[0] == "cur") && hdr.Typeflag == tar.TypeReg {
+			err = md.importTarMessage(tr, hdr, parts[0], parts[1])
+			if err == nil {
+				n++
+			}
+		}
+	}
+	return
+}
+
+// check a tar entry's name and split it into the subfolder it belongs in and its path there
+// folder is empty for the maildir itself
+func tarEntry(hdr *tar.Header) (folder string, parts []string, err error) {
+	name := path.Clean(strings.Replace(hdr.Name, "\\", "/", -1))
+	if (hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeDir) || path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+		err = ErrUnsafeTarEntry
+		return
+	}
+	if name == "." {
+		return
+	}
+	parts = strings.Split(name, "/")
+	if strings.HasPrefix(parts[0], ".") {
+		folder = parts[0][1:]
+		parts = parts[1:]
+	}
+	return
+}
+
+// write a message from a tar archive into a subdirectory, refusing to replace one already there
+func (d MailDir) importTarMessage(r io.Reader, hdr *tar.Header, sub, name string) (err error) {
+	var tmp string
+	tmp, err = d.writeTemp(r)
+	if err == nil {
+		os.Chtimes(d.Temp(tmp), hdr.ModTime, hdr.ModTime)
+		err = os.Link(d.Temp(tmp), filepath.Join(d.Filepath(), sub, name))
+		os.Remove(d.Temp(tmp))
+	}
+	return
+}
@@ -0,0 +1,181 @@
+package maildir
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// untar an archive into a directory
+func untar(t *testing.T, r io.Reader, dir string) {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		target := filepath.Join(dir, hdr.Name)
+		if hdr.Typeflag == tar.TypeDir {
+			err = os.MkdirAll(target, 0700)
+		} else {
+			var body []byte
+			body, err = ioutil.ReadAll(tr)
+			if err == nil {
+				err = ioutil.WriteFile(target, body, 0600)
+			}
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// get the names and bodies of messages in new and cur
+func messageSet(t *testing.T, d MailDir) (names []string, bodies map[string]string) {
+	bodies = make(map[string]string)
+	for _, sub := range []string{"new", "cur"} {
+		msgs, err := d.listDir(sub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, msg := range msgs {
+			body, err := ioutil.ReadFile(d.subdir(sub, msg))
+			if err != nil {
+				t.Fatal(err)
+			}
+			name := sub + "/" + msg.Filepath()
+			names = append(names, name)
+			bodies[name] = string(body)
+		}
+	}
+	sort.Strings(names)
+	return
+}
+
+func TestExportTar(t *testing.T) {
+	d := testMailDir(t)
+	putMessage(t, d, "new", "1.host", "Subject: new\r\n\r\nunread\r\n")
+	putMessage(t, d, "cur", "2.host:2,FS", "Subject: cur\r\n\r\nflagged\r\n")
+	sent, err := d.EnsureFolder("Sent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	putMessage(t, sent, "cur", "3.host:2,RS", "Subject: sent\r\n\r\nreplied\r\n")
+	var buf bytes.Buffer
+	if err = d.ExportTar(&buf); err != nil {
+		t.Fatal(err)
+	}
+	nd := MailDir(filepath.Join(t.TempDir(), "imported"))
+	if err = os.Mkdir(nd.Filepath(), 0700); err != nil {
+		t.Fatal(err)
+	}
+	untar(t, &buf, nd.Filepath())
+	for _, dir := range []MailDir{d, sent} {
+		rel, _ := filepath.Rel(d.Filepath(), dir.Filepath())
+		other := MailDir(filepath.Join(nd.Filepath(), rel))
+		names, bodies := messageSet(t, dir)
+		gotNames, gotBodies := messageSet(t, other)
+		if len(names) != len(gotNames) {
+			t.Fatalf("%s has %v after import not %v", rel, gotNames, names)
+		}
+		for idx, name := range names {
+			if gotNames[idx] != name || gotBodies[name] != bodies[name] {
+				t.Fatalf("%s has %v after import not %v", rel, gotNames, names)
+			}
+		}
+		if _, err = os.Stat(filepath.Join(other.Filepath(), "tmp")); err != nil {
+			t.Fatalf("%s has no tmp after import", rel)
+		}
+	}
+	msgs, _ := nd.Folder("Sent").ListCur()
+	if len(msgs) != 1 || msgs[0].Flags().String() != "RS" {
+		t.Fatalf("subfolder flags after import are %v", msgs)
+	}
+	if _, err = os.Stat(filepath.Join(nd.Folder("Sent").Filepath(), "maildirfolder")); err != nil {
+		t.Fatal("subfolder marker not exported")
+	}
+}
+
+func TestImportTar(t *testing.T) {
+	d := testMailDir(t)
+	putMessage(t, d, "new", "1.host", "Subject: new\r\n\r\nunread\r\n")
+	putMessage(t, d, "cur", "2.host:2,FS", "Subject: cur\r\n\r\nflagged\r\n")
+	sent, err := d.EnsureFolder("Sent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	putMessage(t, sent, "cur", "3.host:2,RS", "Subject: sent\r\n\r\nreplied\r\n")
+	var buf bytes.Buffer
+	if err = d.ExportTar(&buf); err != nil {
+		t.Fatal(err)
+	}
+	nd := MailDir(filepath.Join(t.TempDir(), "imported"))
+	n, err := nd.ImportTar(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("imported %d messages", n)
+	}
+	for _, folder := range []string{"", "Sent"} {
+		src, dst := d, nd
+		if folder != "" {
+			src, dst = d.Folder(folder), nd.Folder(folder)
+		}
+		names, bodies := messageSet(t, src)
+		gotNames, gotBodies := messageSet(t, dst)
+		if len(names) != len(gotNames) {
+			t.Fatalf("%q has %v after import not %v", folder, gotNames, names)
+		}
+		for idx, name := range names {
+			if gotNames[idx] != name || gotBodies[name] != bodies[name] {
+				t.Fatalf("%q has %v after import not %v", folder, gotNames, names)
+			}
+		}
+	}
+	if _, err = os.Stat(filepath.Join(nd.Folder("Sent").Filepath(), "maildirfolder")); err != nil {
+		t.Fatal("subfolder not marked after import")
+	}
+	// importing again doesn't replace anything
+	n, err = nd.ImportTar(bytes.NewReader(buf.Bytes()))
+	if !errors.Is(err, os.ErrExist) || n != 0 {
+		t.Fatalf("second import of %d messages gave %v", n, err)
+	}
+}
+
+func TestImportTarTraversal(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range []string{"cur/1.host:2,S", "cur/../../escaped"} {
+		body := []byte("Subject: hi\r\n\r\nbody\r\n")
+		tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Mode:     0600,
+			Size:     int64(len(body)),
+		})
+		tw.Write(body)
+	}
+	tw.Close()
+	dir := t.TempDir()
+	d := MailDir(filepath.Join(dir, "mail"))
+	n, err := d.ImportTar(&buf)
+	if !errors.Is(err, ErrUnsafeTarEntry) {
+		t.Fatalf("malicious archive gave %v", err)
+	}
+	if n != 1 {
+		t.Fatalf("imported %d messages before the malicious entry", n)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "escaped")); !os.IsNotExist(err) {
+		t.Fatal("malicious entry escaped the maildir")
+	}
+}
@@ -0,0 +1,146 @@
+package maildir
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// returned by ExpungedSince for a modseq from before what the journal still holds
+var ErrExpungesTrimmed = errors.New("maildir: expunges since modseq were trimmed")
+
+// name of the expunge journal in the maildir root
+// each line is <modseq> <uid> for a message that had a uid when it was removed,
+// the modseq being that of its removal
+// once it grows past expungeTrimSize its older half is dropped and a line with
+// uid 0 notes the newest modseq dropped
+const expungeFile = "bdsmail-expunged.log"
+
+// size the expunge journal is trimmed at
+const expungeTrimSize = 256 * 1024
+
+// a line of the expunge journal
+type expungeEntry struct {
+	modseq uint64
+	uid    uint32
+}
+
+// read the expunge journal, lines torn by a crash are skipped
+// floor is the newest modseq trimmed from it
+func (d MailDir) readExpunges() (entries []expungeEntry, floor uint64, err error) {
+	var f *os.File
+	f, err = os.Open(filepath.Join(d.Filepath(), expungeFile))
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var e expungeEntry
+		if _, perr := fmt.Sscanf(sc.Text(), "%d %d", &e.modseq, &e.uid); perr != nil {
+			continue
+		}
+		if e.uid == 0 {
+			floor = e.modseq
+		} else {
+			entries = append(entries, e)
+		}
+	}
+	err = sc.Err()
+	return
+}
+
+// drop the older half of the expunge journal, the caller holds the maildir mutex
+func (d MailDir) trimExpunges() (err error) {
+	var entries []expungeEntry
+	var floor uint64
+	entries, floor, err = d.readExpunges()
+	if err != nil || len(entries) < 2 {
+		return
+	}
+	cut := len(entries) / 2
+	if entries[cut-1].modseq > floor {
+		floor = entries[cut-1].modseq
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%d 0\n", floor)
+	for _, e := range entries[cut:] {
+		fmt.Fprintf(&buf, "%d %d\n", e.modseq, e.uid)
+	}
+	fname := filepath.Join(d.Filepath(), expungeFile)
+	err = ioutil.WriteFile(fname+".tmp", buf.Bytes(), 0600)
+	if err == nil {
+		err = os.Rename(fname+".tmp", fname)
+	}
+	return
+}
+
+// note the removal of messages in the expunge journal, the caller holds the maildir mutex
+// every removal gets a modseq so clients syncing from a modseq learn of it,
+// messages that never got a uid were never seen by a client and are skipped
+// the messages are already gone so failures are only logged
+func (d MailDir) journalExpunges(msgs []Message) {
+	if len(msgs) == 0 {
+		return
+	}
+	l, err := d.UIDList()
+	var f *os.File
+	fname := filepath.Join(d.Filepath(), expungeFile)
+	if err == nil {
+		f, err = os.OpenFile(fname, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	}
+	if err == nil {
+		for _, msg := range msgs {
+			uid, ok := l.UID(msg)
+			if !ok {
+				continue
+			}
+			if modseq := d.bumpModSeq(msg); modseq > 0 && err == nil {
+				_, err = fmt.Fprintf(f, "%d %d\n", modseq, uid)
+			}
+		}
+		if e := f.Close(); err == nil {
+			err = e
+		}
+	}
+	if err != nil {
+		log.Warn("failed to journal removal of ", len(msgs), " messages in ", d, ": ", err)
+	}
+	if st, e := os.Stat(fname); e == nil && st.Size() > expungeTrimSize {
+		if e = d.trimExpunges(); e != nil {
+			log.Warn("failed to trim expunge journal of ", d, ": ", e)
+		}
+	}
+}
+
+// get the uids of messages removed after a modseq in ascending order
+// returns ErrExpungesTrimmed if removals after it were trimmed from the journal
+func (d MailDir) ExpungedSince(modseq uint64) (uids []uint32, err error) {
+	defer d.wrapErr("expunged since", &err)
+	var entries []expungeEntry
+	var floor uint64
+	entries, floor, err = d.readExpunges()
+	if err == nil && modseq < floor {
+		err = ErrExpungesTrimmed
+	}
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if e.modseq > modseq {
+			uids = append(uids, e.uid)
+		}
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	return
+}
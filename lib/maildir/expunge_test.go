@@ -0,0 +1,77 @@
+package maildir
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestExpungedSince(t *testing.T) {
+	d := testMailDir(t)
+	var msgs []Message
+	for i := 0; i < 3; i++ {
+		msg, err := d.Deliver(strings.NewReader("hi\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, msg)
+	}
+	// a message without a uid was never seen so isn't journaled
+	if err := d.Remove(msgs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SyncUIDs(); err != nil {
+		t.Fatal(err)
+	}
+	second, _, _ := d.MessageByUID(2)
+	if err := d.Remove(second); err != nil {
+		t.Fatal(err)
+	}
+	highest, _ := d.HighestModSeq()
+	other, err := d.EnsureFolder("Other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _, _ := d.MessageByUID(1)
+	if _, err = d.MoveBatch([]Message{first}, other); err != nil {
+		t.Fatal(err)
+	}
+	uids, err := d.ExpungedSince(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uids) != 2 || uids[0] != 1 || uids[1] != 2 {
+		t.Fatalf("expunged uids are %v", uids)
+	}
+	if uids, _ = d.ExpungedSince(highest); len(uids) != 1 || uids[0] != 1 {
+		t.Fatalf("uids expunged since %d are %v", highest, uids)
+	}
+}
+
+func TestExpungesTrimmed(t *testing.T) {
+	d := testMailDir(t)
+	var msgs []Message
+	for i := 0; i < 4; i++ {
+		msg, _ := d.Deliver(strings.NewReader("hi\n"))
+		msgs = append(msgs, msg)
+	}
+	d.SyncUIDs()
+	var highest []uint64
+	for _, msg := range msgs {
+		if err := d.Remove(msg); err != nil {
+			t.Fatal(err)
+		}
+		n, _ := d.HighestModSeq()
+		highest = append(highest, n)
+	}
+	if err := d.trimExpunges(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.ExpungedSince(highest[0]); !errors.Is(err, ErrExpungesTrimmed) {
+		t.Fatalf("expunges since a trimmed modseq gave %v", err)
+	}
+	uids, err := d.ExpungedSince(highest[1])
+	if err != nil || len(uids) != 2 {
+		t.Fatalf("expunges since the last trimmed modseq are %v, %v", uids, err)
+	}
+}
@@ -1,5 +1,10 @@
 package maildir
 
+import (
+	"encoding/json"
+	"strings"
+)
+
 // maildir flag
 type Flag rune
 
@@ -17,3 +22,115 @@ const Seen = Flag('S')
 const Trashed = Flag('T')
 const Draft = Flag('D')
 const Flagged = Flag('F')
+
+// a set of maildir flags in ascii order without duplicates
+type FlagSet []Flag
+
+// make a flag set from flags given in any order
+func NewFlagSet(flags ...Flag) (fs FlagSet) {
+	for _, f := range flags {
+		fs = fs.Add(f)
+	}
+	return
+}
+
+// return true if this set holds a flag
+func (fs FlagSet) Has(flag Flag) bool {
+	for _, f := range fs {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// get a copy of this set with a flag added
+func (fs FlagSet) Add(flag Flag) (set FlagSet) {
+	set = make(FlagSet, 0, len(fs)+1)
+	added := false
+	for _, f := range fs {
+		if f == flag {
+			added = true
+		} else if f > flag && !added {
+			set = append(set, flag)
+			added = true
+		}
+		set = append(set, f)
+	}
+	if !added {
+		set = append(set, flag)
+	}
+	return
+}
+
+// get a copy of this set with a flag removed
+func (fs FlagSet) Remove(flag Flag) (set FlagSet) {
+	set = make(FlagSet, 0, len(fs))
+	for _, f := range fs {
+		if f != flag {
+			set = append(set, f)
+		}
+	}
+	return
+}
+
+// get the flags as they appear in a message's info section
+func (fs FlagSet) String() (str string) {
+	for _, f := range fs {
+		str += f.String()
+	}
+	return
+}
+
+// flags are kept in json as they appear in a message's info section
+func (fs FlagSet) MarshalJSON() ([]byte, error) {
+	return json.Marshal(fs.String())
+}
+
+func (fs *FlagSet) UnmarshalJSON(data []byte) (err error) {
+	var str string
+	err = json.Unmarshal(data, &str)
+	if err == nil {
+		*fs = NewFlagSet([]Flag(str)...)
+	}
+	return
+}
+
+// imap system flag for each maildir flag that has one
+var imapFlags = []struct {
+	flag Flag
+	imap string
+}{
+	{Draft, `\Draft`},
+	{Flagged, `\Flagged`},
+	{Replied, `\Answered`},
+	{Seen, `\Seen`},
+	{Trashed, `\Deleted`},
+}
+
+// get the flags as imap system flags
+// flags without an imap equivalent like Passed are left out
+func (fs FlagSet) IMAPFlags() (flags []string) {
+	flags = []string{}
+	for _, f := range fs {
+		for _, m := range imapFlags {
+			if m.flag == f {
+				flags = append(flags, m.imap)
+			}
+		}
+	}
+	return
+}
+
+// make a flag set from imap system flags, case does not matter
+// keywords and flags without a maildir equivalent are ignored
+func ParseIMAPFlags(flags []string) (fs FlagSet) {
+	for _, str := range flags {
+		for _, m := range imapFlags {
+			if strings.EqualFold(m.imap, str) {
+				fs = fs.Add(m.flag)
+			}
+		}
+	}
+	return
+}
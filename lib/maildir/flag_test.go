@@ -0,0 +1,38 @@
+package maildir
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestIMAPFlags(t *testing.T) {
+	tests := []struct {
+		flag Flag
+		imap string
+	}{
+		{Seen, `\Seen`},
+		{Replied, `\Answered`},
+		{Flagged, `\Flagged`},
+		{Trashed, `\Deleted`},
+		{Draft, `\Draft`},
+	}
+	for _, test := range tests {
+		flags := NewFlagSet(test.flag).IMAPFlags()
+		if len(flags) != 1 || flags[0] != test.imap {
+			t.Errorf("%s gave %v", test.flag, flags)
+		}
+		fs := ParseIMAPFlags([]string{test.imap})
+		if !reflect.DeepEqual(fs, NewFlagSet(test.flag)) {
+			t.Errorf("%s parsed as %v", test.imap, fs)
+		}
+	}
+	// passed has no imap flag
+	flags := NewFlagSet(Passed, Seen).IMAPFlags()
+	if !reflect.DeepEqual(flags, []string{`\Seen`}) {
+		t.Fatalf("passed and seen gave %v", flags)
+	}
+	fs := ParseIMAPFlags([]string{`\seen`, `$Junk`, `\Recent`, `\FLAGGED`})
+	if fs.String() != "FS" {
+		t.Fatalf("parsed as %q", fs)
+	}
+}
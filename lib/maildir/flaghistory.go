@@ -0,0 +1,96 @@
+package maildir
+
+import (
+	"bufio"
+	log "github.com/Sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// name of the flag history in the maildir root
+// it is only ever appended to, each line is <timestamp> <unique name> <old> -> <new>
+// with - standing for no flags
+const flagHistoryFile = "bdsmail-flags.log"
+
+// a change of a message's flags read from the flag history
+type FlagChange struct {
+	// when the flags changed
+	Time time.Time
+	// flags before the change
+	Old FlagSet
+	// flags after the change
+	New FlagSet
+}
+
+// get flags as written in the flag history
+func historyFlags(fs FlagSet) string {
+	if len(fs) == 0 {
+		return "-"
+	}
+	return fs.String()
+}
+
+// parse flags written in the flag history
+func parseHistoryFlags(str string) (fs FlagSet) {
+	for _, f := range strings.TrimPrefix(str, "-") {
+		fs = fs.Add(Flag(f))
+	}
+	return
+}
+
+// record a change of flags if this maildir keeps a flag history, set with Options.FlagHistory
+// the change already happened so failures are only logged
+func (d MailDir) recordFlags(o Options, msg Message, old, flags FlagSet) {
+	if old.String() == flags.String() || !o.FlagHistory {
+		return
+	}
+	line := time.Now().UTC().Format(time.RFC3339Nano) + " " + msg.Name() + " " + historyFlags(old) + " -> " + historyFlags(flags) + "\n"
+	f, err := os.OpenFile(filepath.Join(d.Filepath(), flagHistoryFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err == nil {
+		_, err = f.WriteString(line)
+		if e := f.Close(); err == nil {
+			err = e
+		}
+	}
+	if err != nil {
+		log.Warn("failed to record flag change of ", msg, " in ", d, ": ", err)
+	}
+}
+
+// read the recorded flag changes of a message oldest first
+// the message may be given with any flags, changes made while the history was off are missing
+func (d MailDir) FlagHistory(msg Message) (changes []FlagChange, err error) {
+	defer d.wrapErr("flag history", &err)
+	var f *os.File
+	f, err = os.Open(filepath.Join(d.Filepath(), flagHistoryFile))
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	name := msg.Name()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		parts := strings.Fields(sc.Text())
+		if len(parts) != 5 || parts[1] != name || parts[3] != "->" {
+			continue
+		}
+		t, e := time.Parse(time.RFC3339Nano, parts[0])
+		if e != nil {
+			// skip lines torn by a crash
+			continue
+		}
+		changes = append(changes, FlagChange{
+			Time: t,
+			Old:  parseHistoryFlags(parts[2]),
+			New:  parseHistoryFlags(parts[4]),
+		})
+	}
+	err = sc.Err()
+	return
+}
@@ -0,0 +1,59 @@
+package maildir
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFlagHistory(t *testing.T) {
+	d := testMailDir(t)
+	if err := d.SetOptions(Options{FlagHistory: true}); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := d.Deliver(strings.NewReader("hi\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := d.Deliver(strings.NewReader("other\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg, err = d.AddFlag(msg, Seen); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = d.AddFlag(other, Flagged); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err = d.ProcessCur(msg, Seen, Replied, Flagged); err != nil {
+		t.Fatal(err)
+	}
+	// setting the same flags again isn't a change
+	if msg, err = d.ProcessCur(msg, Seen, Replied, Flagged); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err = d.RemoveFlag(msg, Seen); err != nil {
+		t.Fatal(err)
+	}
+	// stale flags find the same history
+	changes, err := d.FlagHistory(Message(msg.Name() + ":2,S"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for idx, c := range changes {
+		if c.Time.IsZero() || (idx > 0 && c.Time.Before(changes[idx-1].Time)) {
+			t.Fatalf("change %d at %s", idx, c.Time)
+		}
+		got = append(got, historyFlags(c.Old)+">"+historyFlags(c.New))
+	}
+	if strings.Join(got, " ") != "->S S>FRS FRS>FR" {
+		t.Fatalf("history is %v", got)
+	}
+	d.SetOptions(Options{})
+	if _, err = d.AddFlag(msg, Trashed); err != nil {
+		t.Fatal(err)
+	}
+	if changes, _ = d.FlagHistory(msg); len(changes) != 3 {
+		t.Fatalf("%d changes after turning history off", len(changes))
+	}
+}
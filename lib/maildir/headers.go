@@ -0,0 +1,88 @@
+package maildir
+
+import (
+	"bufio"
+	"fmt"
+	"golang.org/x/text/encoding/htmlindex"
+	"io"
+	"mime"
+	"net/textproto"
+	"os"
+)
+
+// decodes rfc 2047 encoded-words in any charset the WHATWG encoding standard knows
+var headerDecoder = &mime.WordDecoder{
+	CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+		enc, err := htmlindex.Get(charset)
+		if err != nil {
+			return nil, fmt.Errorf("unknown charset %q", charset)
+		}
+		return enc.NewDecoder().Reader(input), nil
+	},
+}
+
+// read a message's headers for display with rfc 2047 encoded-words decoded to utf-8
+// every encoded-word in a header is decoded even if they use different charsets,
+// headers that can't be decoded are given as they are stored
+// the stored message is not changed
+func (d MailDir) OpenDecodedHeaders(msg Message) (hdr textproto.MIMEHeader, err error) {
+	defer d.wrapErr("open decoded headers", &err)
+	hdr, err = d.readHeader(msg)
+	if err != nil {
+		return
+	}
+	for _, values := range hdr {
+		for idx, v := range values {
+			if decoded, e := headerDecoder.DecodeHeader(v); e == nil {
+				values[idx] = decoded
+			}
+		}
+	}
+	return
+}
+
+// read a message's headers as they are stored from cur or new
+func (d MailDir) readHeader(msg Message) (hdr textproto.MIMEHeader, err error) {
+	var fname string
+	fname, err = d.resolve(msg)
+	if err != nil {
+		return
+	}
+	var f *os.File
+	f, err = os.Open(fname)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	hdr, err = textproto.NewReader(bufio.NewReader(f)).ReadMIMEHeader()
+	if err == io.EOF && len(hdr) > 0 {
+		// headers with no body after them
+		err = nil
+	}
+	if err != nil {
+		hdr = nil
+	}
+	return
+}
+
+// get a message's media type and parameters from its Content-Type for deciding how to render it
+// the media type and parameter names are lower case, a message without a
+// Content-Type or with one that can't be parsed is text/plain in us-ascii as rfc 2045 says
+func (d MailDir) ContentType(msg Message) (mediatype string, params map[string]string, err error) {
+	defer d.wrapErr("content type", &err)
+	var hdr textproto.MIMEHeader
+	hdr, err = d.readHeader(msg)
+	if err != nil {
+		return
+	}
+	if ct := hdr.Get("Content-Type"); ct != "" {
+		var e error
+		mediatype, params, e = mime.ParseMediaType(ct)
+		if e == nil || e == mime.ErrInvalidMediaParameter {
+			return
+		}
+	}
+	mediatype = "text/plain"
+	params = map[string]string{"charset": "us-ascii"}
+	return
+}
@@ -0,0 +1,66 @@
+package maildir
+
+import (
+	"testing"
+)
+
+func TestOpenDecodedHeaders(t *testing.T) {
+	d := testMailDir(t)
+	msg := putMessage(t, d, "cur", "1.host:2,S",
+		"Subject: =?UTF-8?B?R3LDvMOfZSBhdXMgTcO8bmNoZW4=?=\r\n"+
+			"From: =?iso-8859-1?q?J=F6rg?= <jorg@example.com>\r\n"+
+			"To: =?utf-8?q?Ren=C3=A9e?= =?windows-1252?q?_=80?= <renee@example.com>\r\n"+
+			"X-Plain: just text\r\n"+
+			"X-Broken: =?x-unknown?q?abc?=\r\n"+
+			"\r\nbody\r\n")
+	hdr, err := d.OpenDecodedHeaders(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{
+		"Subject":  "Grüße aus München",
+		"From":     "Jörg <jorg@example.com>",
+		"To":       "Renée € <renee@example.com>",
+		"X-Plain":  "just text",
+		"X-Broken": "=?x-unknown?q?abc?=",
+	} {
+		if got := hdr.Get(key); got != want {
+			t.Errorf("%s is %q not %q", key, got, want)
+		}
+	}
+	// q encoded subject in a message still in new
+	msg = putMessage(t, d, "new", "2.host", "Subject: =?utf-8?Q?caf=C3=A9_menu?=\r\n\r\nbody\r\n")
+	if hdr, err = d.OpenDecodedHeaders(msg); err != nil || hdr.Get("Subject") != "café menu" {
+		t.Fatalf("q encoded subject is %q %v", hdr.Get("Subject"), err)
+	}
+}
+
+func TestContentType(t *testing.T) {
+	d := testMailDir(t)
+	for _, test := range []struct {
+		name, header, mediatype string
+		params                  map[string]string
+	}{
+		{"1.host:2,S", "Content-Type: multipart/mixed; boundary=\"b1\"\r\n", "multipart/mixed", map[string]string{"boundary": "b1"}},
+		{"2.host:2,S", "Content-Type: Text/HTML; Charset=ISO-8859-1\r\n", "text/html", map[string]string{"charset": "ISO-8859-1"}},
+		{"3.host:2,S", "Subject: plain\r\n", "text/plain", map[string]string{"charset": "us-ascii"}},
+		{"4.host:2,S", "Content-Type: ;;\r\n", "text/plain", map[string]string{"charset": "us-ascii"}},
+	} {
+		msg := putMessage(t, d, "cur", test.name, test.header+"\r\nbody\r\n")
+		mediatype, params, err := d.ContentType(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mediatype != test.mediatype || len(params) != len(test.params) {
+			t.Fatalf("%q is %s %v", test.header, mediatype, params)
+		}
+		for k, v := range test.params {
+			if params[k] != v {
+				t.Fatalf("%q is %s %v", test.header, mediatype, params)
+			}
+		}
+	}
+	if _, _, err := d.ContentType(Message("missing.host")); err == nil {
+		t.Fatal("content type of a missing message")
+	}
+}
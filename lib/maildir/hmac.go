@@ -0,0 +1,85 @@
+package maildir
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// returned when verifying a message that was not delivered with DeliverSigned
+var ErrNoHMAC = errors.New("maildir: message has no stored hmac")
+
+// directory in the maildir holding the hmac of each signed message by unique name
+// kept out of new and cur so they never look like messages
+const hmacDir = "bdsmail-hmac"
+
+func (d MailDir) hmacPath(msg Message) string {
+	return filepath.Join(d.Filepath(), hmacDir, msg.Name())
+}
+
+// deliver mail and store an HMAC-SHA256 of it under key so it can be checked later
+// returns the message in the new directory that was delivered
+func (d MailDir) DeliverSigned(body io.Reader, key []byte) (msg Message, err error) {
+	defer d.wrapErr("deliver signed", &err)
+	mac := hmac.New(sha256.New, key)
+	msg, err = d.Deliver(io.TeeReader(body, mac))
+	if err != nil {
+		return
+	}
+	err = os.MkdirAll(filepath.Join(d.Filepath(), hmacDir), 0700)
+	if err == nil {
+		fname := d.hmacPath(msg)
+		err = ioutil.WriteFile(fname+".tmp", []byte(hex.EncodeToString(mac.Sum(nil))+"\n"), 0600)
+		if err == nil {
+			err = os.Rename(fname+".tmp", fname)
+		}
+	}
+	if err != nil {
+		// don't leave an unverifiable message around
+		d.Remove(msg)
+		msg = ""
+	}
+	return
+}
+
+// check a message against the hmac stored when it was delivered with DeliverSigned
+// returns false if it changed since
+func (d MailDir) VerifyMessage(msg Message, key []byte) (ok bool, err error) {
+	defer d.wrapErr("verify message", &err)
+	var stored []byte
+	stored, err = ioutil.ReadFile(d.hmacPath(msg))
+	if os.IsNotExist(err) {
+		err = ErrNoHMAC
+	}
+	if err != nil {
+		return
+	}
+	var want []byte
+	want, err = hex.DecodeString(strings.TrimSpace(string(stored)))
+	if err != nil {
+		return
+	}
+	var sub string
+	sub, msg, err = d.find(msg)
+	if err != nil {
+		return
+	}
+	var f *os.File
+	f, err = os.Open(d.subdir(sub, msg))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	mac := hmac.New(sha256.New, key)
+	_, err = io.Copy(mac, f)
+	if err == nil {
+		ok = hmac.Equal(mac.Sum(nil), want)
+	}
+	return
+}
@@ -0,0 +1,47 @@
+package maildir
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDeliverSigned(t *testing.T) {
+	d := testMailDir(t)
+	key := []byte("audit key")
+	msg, err := d.DeliverSigned(strings.NewReader("Subject: hi\n\nbody\n"), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// flag changes don't matter
+	msg, err = d.ProcessNew(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err := d.VerifyMessage(msg, key)
+	if err != nil || !ok {
+		t.Fatalf("untouched message gave %v %v", ok, err)
+	}
+	if ok, _ = d.VerifyMessage(msg, []byte("wrong key")); ok {
+		t.Fatal("verified with the wrong key")
+	}
+	// tamper with it
+	if err = ioutil.WriteFile(d.Cur(msg.Filepath()), []byte("Subject: hi\n\nbody!\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err = d.VerifyMessage(msg, key); err != nil || ok {
+		t.Fatalf("tampered message gave %v %v", ok, err)
+	}
+	if err = d.Remove(msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(d.hmacPath(msg)); !os.IsNotExist(err) {
+		t.Fatal("hmac left behind")
+	}
+	unsigned := putMessage(t, d, "new", "1.host", "hi\n")
+	if _, err = d.VerifyMessage(unsigned, key); !errors.Is(err, ErrNoHMAC) {
+		t.Fatalf("unsigned message gave %v", err)
+	}
+}
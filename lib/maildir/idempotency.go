@@ -0,0 +1,137 @@
+package maildir
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// returned with the original message when a delivery repeats an idempotency key
+var ErrAlreadyDelivered = errors.New("maildir: message already delivered")
+
+// returned when another delivery with the same idempotency key hasn't finished yet
+var ErrDeliveryInProgress = errors.New("maildir: delivery with the same key in progress")
+
+// how long idempotency keys are remembered by default
+const DefaultIdempotencyWindow = time.Hour * 24
+
+// directory in the maildir holding one file per remembered idempotency key
+// the file holds the name of the delivered message and its mtime is when it was delivered
+// an empty file is a key reserved by a delivery that hasn't finished
+const keysDir = "bdsmail-keys"
+
+// how long a reserved key is held before it is taken to be left over from a crash
+const keyReservationTimeout = time.Minute * 10
+
+// get the file recording an idempotency key
+func (d MailDir) keyPath(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return filepath.Join(d.Filepath(), keysDir, hex.EncodeToString(h[:]))
+}
+
+// look up a key delivered within the window
+// returns the message it delivered as it is named now, or ErrDeliveryInProgress if it is reserved
+func (d MailDir) lookupKey(key string, window time.Duration) (msg Message, ok bool, err error) {
+	if window <= 0 {
+		window = DefaultIdempotencyWindow
+	}
+	fname := d.keyPath(key)
+	var st os.FileInfo
+	st, err = os.Stat(fname)
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	} else if err != nil || time.Since(st.ModTime()) > window {
+		return
+	}
+	var data []byte
+	data, err = ioutil.ReadFile(fname)
+	if err == nil && len(data) == 0 {
+		// reserved and not delivered yet
+		if time.Since(st.ModTime()) <= keyReservationTimeout {
+			err = ErrDeliveryInProgress
+		}
+	} else if err == nil {
+		ok = true
+		msg = Message(strings.TrimSpace(string(data)))
+		// it may have been processed since
+		_, m, e := d.find(msg)
+		if e == nil {
+			msg = m
+		}
+	}
+	return
+}
+
+// reserve a key before delivering with it so only one delivery can use it
+// the reservation is made with O_EXCL so it holds across processes too
+// if the key already delivered a message within the window it is returned with ok set
+// and ErrDeliveryInProgress is returned if another delivery holds the key
+func (d MailDir) reserveKey(key string, window time.Duration) (msg Message, ok bool, err error) {
+	err = os.MkdirAll(filepath.Join(d.Filepath(), keysDir), 0700)
+	fname := d.keyPath(key)
+	// a second try after clearing out an expired key or stale reservation
+	for tries := 0; err == nil && tries < 2; tries++ {
+		var f *os.File
+		f, err = os.OpenFile(fname, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			err = f.Close()
+			return
+		} else if !os.IsExist(err) {
+			return
+		}
+		msg, ok, err = d.lookupKey(key, window)
+		if ok || err != nil {
+			return
+		}
+		err = os.Remove(fname)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	if err == nil {
+		err = ErrDeliveryInProgress
+	}
+	return
+}
+
+// give up a key reserved for a delivery that failed so it can be retried
+func (d MailDir) releaseKey(key string) {
+	if err := os.Remove(d.keyPath(key)); err != nil && !os.IsNotExist(err) {
+		log.Warn("failed to release idempotency key in ", d, ": ", err)
+	}
+}
+
+// remember that a key delivered a message and forget expired keys
+// this replaces the key's reservation, the message is already delivered so failures are only logged
+func (d MailDir) recordKey(key string, msg Message, window time.Duration) {
+	if window <= 0 {
+		window = DefaultIdempotencyWindow
+	}
+	dir := filepath.Join(d.Filepath(), keysDir)
+	err := os.MkdirAll(dir, 0700)
+	if err == nil {
+		fname := d.keyPath(key)
+		tmp := fname + ".tmp"
+		err = ioutil.WriteFile(tmp, []byte(msg.Filepath()+"\n"), 0600)
+		if err == nil {
+			err = os.Rename(tmp, fname)
+		}
+	}
+	if err != nil {
+		log.Warn("failed to record idempotency key for ", msg, ": ", err)
+		return
+	}
+	files, _ := ioutil.ReadDir(dir)
+	for _, f := range files {
+		if time.Since(f.ModTime()) > window {
+			os.Remove(filepath.Join(dir, f.Name()))
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package maildir
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestDeliverIdempotencyKey(t *testing.T) {
+	d := testMailDir(t)
+	opts := DeliverOpts{IdempotencyKey: "lmtp-txn-1", IdempotencyWindow: time.Hour}
+	first, err := d.DeliverWith(strings.NewReader("Subject: one\n\n"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// retry is deduped
+	again, err := d.DeliverWith(strings.NewReader("Subject: one\n\n"), opts)
+	if !errors.Is(err, ErrAlreadyDelivered) {
+		t.Fatalf("retry gave %v", err)
+	}
+	if again != first {
+		t.Fatalf("retry gave %s not %s", again, first)
+	}
+	// still found after it is processed
+	cur, err := d.ProcessNew(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err = d.DeliverWith(strings.NewReader("Subject: one\n\n"), opts)
+	if !errors.Is(err, ErrAlreadyDelivered) || again != cur {
+		t.Fatalf("retry after processing gave %s %v", again, err)
+	}
+	msgs, _ := d.ListCur()
+	newMsgs, _ := d.ListNew()
+	if len(msgs)+len(newMsgs) != 1 {
+		t.Fatalf("%d messages delivered", len(msgs)+len(newMsgs))
+	}
+	// expire the key
+	old := time.Now().Add(-time.Hour * 2)
+	if err = os.Chtimes(d.keyPath(opts.IdempotencyKey), old, old); err != nil {
+		t.Fatal(err)
+	}
+	redelivered, err := d.DeliverWith(strings.NewReader("Subject: one\n\n"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if redelivered == first {
+		t.Fatal("expired key was not redelivered")
+	}
+}
+
+func TestDeliverIdempotencyKeyConcurrent(t *testing.T) {
+	d := testMailDir(t)
+	opts := DeliverOpts{IdempotencyKey: "lmtp-txn-2"}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.DeliverWith(strings.NewReader("Subject: one\n\n"), opts)
+		}()
+	}
+	wg.Wait()
+	if msgs, _ := d.ListNew(); len(msgs) != 1 {
+		t.Fatalf("%d messages delivered", len(msgs))
+	}
+}
+
+func TestDeliverIdempotencyKeyReserved(t *testing.T) {
+	d := testMailDir(t)
+	opts := DeliverOpts{IdempotencyKey: "lmtp-txn-3"}
+	// another delivery holds the key
+	if err := os.MkdirAll(filepath.Join(d.Filepath(), keysDir), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(d.keyPath(opts.IdempotencyKey), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.DeliverWith(strings.NewReader("Subject: one\n\n"), opts); !errors.Is(err, ErrDeliveryInProgress) {
+		t.Fatalf("reserved key gave %v", err)
+	}
+	// left over from a crash
+	old := time.Now().Add(-keyReservationTimeout * 2)
+	if err := os.Chtimes(d.keyPath(opts.IdempotencyKey), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.DeliverWith(strings.NewReader("Subject: one\n\n"), opts); err != nil {
+		t.Fatalf("stale reservation gave %v", err)
+	}
+	// failed deliveries give the key back
+	opts.IdempotencyKey = "lmtp-txn-4"
+	if _, err := d.DeliverWith(iotest.ErrReader(errors.New("dropped")), opts); err == nil {
+		t.Fatal("failed read delivered")
+	}
+	if _, err := os.Stat(d.keyPath(opts.IdempotencyKey)); !os.IsNotExist(err) {
+		t.Fatalf("key still reserved after a failed delivery: %v", err)
+	}
+}
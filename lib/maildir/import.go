@@ -0,0 +1,18 @@
+package maildir
+
+import (
+	"io"
+)
+
+// import a message from elsewhere keeping its read state
+// seen messages go into cur with their flags, unseen messages go into new
+// so they still show up as recent, new can't hold flags so theirs are dropped
+func (d MailDir) ImportMessage(body io.Reader, fs FlagSet) (msg Message, err error) {
+	defer d.wrapErr("import", &err)
+	if fs.Has(Seen) {
+		msg, err = d.deliverCur(body, fs...)
+	} else {
+		msg, err = d.Deliver(body)
+	}
+	return
+}
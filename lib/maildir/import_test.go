@@ -0,0 +1,34 @@
+package maildir
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestImportMessage(t *testing.T) {
+	d := testMailDir(t)
+	seen, err := d.ImportMessage(bytes.NewBufferString("Subject: read\r\n\r\nbody\r\n"), NewFlagSet(Seen, Replied))
+	if err != nil {
+		t.Fatal(err)
+	}
+	is, _ := d.IsCur(seen)
+	if !is || seen.Flags().String() != "RS" {
+		t.Fatalf("seen import is %s", seen)
+	}
+	unseen, err := d.ImportMessage(bytes.NewBufferString("Subject: unread\r\n\r\nbody\r\n"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	is, _ = d.IsNew(unseen)
+	if !is {
+		t.Fatalf("unseen import is %s", unseen)
+	}
+	flagged, err := d.ImportMessage(bytes.NewBufferString("Subject: unread\r\n\r\nbody\r\n"), NewFlagSet(Flagged))
+	if err != nil {
+		t.Fatal(err)
+	}
+	is, _ = d.IsNew(flagged)
+	if !is {
+		t.Fatalf("unseen flagged import is %s", flagged)
+	}
+}
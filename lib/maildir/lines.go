@@ -0,0 +1,44 @@
+package maildir
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// count the lines in a message in new or cur, header and body
+// a last line without a newline still counts
+func (d MailDir) LineCount(msg Message) (n int, err error) {
+	defer d.wrapErr("line count", &err)
+	var fname string
+	fname, err = d.resolve(msg)
+	if err != nil {
+		return
+	}
+	var f *os.File
+	f, err = os.Open(fname)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	buf := make([]byte, 32*1024)
+	last := byte('\n')
+	for {
+		var nr int
+		nr, err = f.Read(buf)
+		if nr > 0 {
+			n += bytes.Count(buf[:nr], []byte{'\n'})
+			last = buf[nr-1]
+		}
+		if err == io.EOF {
+			err = nil
+			break
+		} else if err != nil {
+			return
+		}
+	}
+	if last != '\n' {
+		n++
+	}
+	return
+}
@@ -0,0 +1,34 @@
+package maildir
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLineCount(t *testing.T) {
+	d := testMailDir(t)
+	tests := []struct {
+		body  string
+		lines int
+	}{
+		{"", 0},
+		{"Subject: hi\r\n\r\nbody\r\n", 3},
+		{"Subject: hi\n\nno trailing newline", 3},
+		{"\n\n\n", 3},
+		{strings.Repeat("a line that is a bit long\n", 5000), 5000},
+	}
+	for i, test := range tests {
+		sub := "new"
+		if i%2 == 1 {
+			sub = "cur"
+		}
+		msg := putMessage(t, d, sub, string(rune('a'+i))+":2,", test.body)
+		n, err := d.LineCount(msg)
+		if err != nil || n != test.lines {
+			t.Errorf("%q counted %d lines %v", test.body, n, err)
+		}
+	}
+	if _, err := d.LineCount(Message("missing")); err == nil {
+		t.Fatal("counted lines of a missing message")
+	}
+}
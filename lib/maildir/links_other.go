@@ -0,0 +1,12 @@
+//go:build !unix
+
+package maildir
+
+import (
+	"os"
+)
+
+// link counts aren't available here so pooled blobs are never released
+func links(st os.FileInfo) (n uint64, ok bool) {
+	return
+}
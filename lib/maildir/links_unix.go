@@ -0,0 +1,19 @@
+//go:build unix
+
+package maildir
+
+import (
+	"os"
+	"syscall"
+)
+
+// get the number of hard links to a file
+// ok is false if the platform doesn't say
+func links(st os.FileInfo) (n uint64, ok bool) {
+	var sys *syscall.Stat_t
+	sys, ok = st.Sys().(*syscall.Stat_t)
+	if ok {
+		n = uint64(sys.Nlink)
+	}
+	return
+}
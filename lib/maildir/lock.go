@@ -0,0 +1,16 @@
+package maildir
+
+import (
+	"sync"
+)
+
+// mutexes serializing renames within this process keyed by maildir path
+var mutexes sync.Map
+
+// get the mutex that serializes flag changes and removals in this maildir
+// maildirs are keyed by absolute path so every MailDir for the same
+// directory shares one
+func (d MailDir) mutex() *sync.Mutex {
+	mtx, _ := mutexes.LoadOrStore(d.Filepath(), new(sync.Mutex))
+	return mtx.(*sync.Mutex)
+}
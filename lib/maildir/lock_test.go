@@ -0,0 +1,121 @@
+package maildir
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestConcurrentFlagChanges(t *testing.T) {
+	d := testMailDir(t)
+	msg := putMessage(t, d, "new", "1.host", "hello\n")
+	if _, err := d.ProcessNew(msg, Seen); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 64)
+	for _, flag := range []Flag{Flagged, Replied, Passed, Draft} {
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(flag Flag) {
+				defer wg.Done()
+				// everyone starts from the same stale name
+				for j := 0; j < 20; j++ {
+					if _, err := d.AddFlag(msg, flag); err != nil {
+						errs <- err
+						return
+					}
+					if _, err := d.RemoveFlag(msg, flag); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}(flag)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	msgs, err := d.ListCur()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || msgs[0] != "1.host:2,S" {
+		t.Fatalf("final state was %v", msgs)
+	}
+}
+
+func TestConcurrentDeliverAndProcessNew(t *testing.T) {
+	// use a relative maildir so anything changing the working directory under us breaks it
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	d := MailDir("mail")
+	if err = d.Ensure(); err != nil {
+		t.Fatal(err)
+	}
+	const deliverers, perDeliverer, processors = 10, 100, 10
+	var delivering, processing sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < deliverers; i++ {
+		delivering.Add(1)
+		go func() {
+			defer delivering.Done()
+			for j := 0; j < perDeliverer; j++ {
+				if _, err := d.Deliver(strings.NewReader("Subject: hi\n\nbody\n")); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < processors; i++ {
+		processing.Add(1)
+		go func() {
+			defer processing.Done()
+			for {
+				// check before listing so nothing delivered before done is missed
+				finished := false
+				select {
+				case <-done:
+					finished = true
+				default:
+				}
+				msgs, err := d.ListNew()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				for _, msg := range msgs {
+					// another processor may have beaten us to it
+					if _, err := d.ProcessNew(msg); err != nil && !errors.Is(err, os.ErrNotExist) {
+						t.Error(err)
+						return
+					}
+				}
+				if finished && len(msgs) == 0 {
+					return
+				}
+			}
+		}()
+	}
+	delivering.Wait()
+	close(done)
+	processing.Wait()
+	msgs, err := d.ListCur()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != deliverers*perDeliverer {
+		t.Fatalf("%d of %d messages in cur", len(msgs), deliverers*perDeliverer)
+	}
+}
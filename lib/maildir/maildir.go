@@ -27,26 +27,55 @@ func (d MailDir) Filepath() (str string) {
 
 // ensure the maildir is well formed
 func (d MailDir) Ensure() (err error) {
+	defer d.wrapErr("ensure", &err)
 	dir := d.Filepath()
-	_, err = os.Stat(dir)
-	if os.IsNotExist(err) {
-		// create main directory
-		err = os.Mkdir(dir, 0700)
-	}
+	err = ensureDir(dir)
 	if err == nil {
 		// create subdirs
 		for _, subdir := range []string{"new", "cur", "tmp"} {
-			subdir = filepath.Join(dir, subdir)
-			_, err = os.Stat(subdir)
-			if os.IsNotExist(err) {
-				// create non existant subdir
-				err = os.Mkdir(subdir, 0700)
+			err = ensureDir(filepath.Join(dir, subdir))
+			if err != nil {
+				break
 			}
 		}
 	}
 	return
 }
 
+// create a directory if it doesn't exist
+// returns ErrNotDirectory if something else is there
+func ensureDir(dir string) (err error) {
+	var st os.FileInfo
+	st, err = os.Stat(dir)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(dir, 0700)
+	} else if err == nil && !st.IsDir() {
+		err = &os.PathError{Op: "ensure", Path: dir, Err: ErrNotDirectory}
+	}
+	return
+}
+
+// get a maildir++ subfolder of this maildir
+func (d MailDir) Folder(name string) MailDir {
+	return MailDir(filepath.Join(d.String(), "."+name))
+}
+
+// ensure a maildir++ subfolder of this maildir is well formed
+func (d MailDir) EnsureFolder(name string) (f MailDir, err error) {
+	defer d.wrapErr("ensure folder", &err)
+	f = d.Folder(name)
+	err = f.Ensure()
+	if err == nil {
+		// mark it as a subfolder
+		var marker *os.File
+		marker, err = os.OpenFile(filepath.Join(f.Filepath(), "maildirfolder"), os.O_CREATE|os.O_WRONLY, 0600)
+		if err == nil {
+			err = marker.Close()
+		}
+	}
+	return
+}
+
 // get a string of the current filename to use
 func (d MailDir) File() (fname string) {
 	hostname, err := os.Hostname()
@@ -85,54 +114,229 @@ func (d MailDir) Cur(fname string) (f string) {
 	return
 }
 
+// get the full path of a message in a subdirectory
+func (d MailDir) subdir(sub string, msg Message) (f string) {
+	f = filepath.Join(d.Filepath(), sub, msg.Filepath())
+	return
+}
+
 // deliver mail to this maildir
-func (d MailDir) Deliver(body io.Reader) (err error) {
-	var oldwd string
-	oldwd, err = os.Getwd()
-	if err == nil {
-		// no error getting working directory, let's begin
+// returns the message in the new directory that was delivered
+//
+// the message is renamed into new before Deliver returns, so the returned
+// message can be handed straight to ProcessNew without rescanning the
+// directory, nothing in this package moves it out of new in between
+func (d MailDir) Deliver(body io.Reader) (msg Message, err error) {
+	msg, err = d.DeliverWith(body, DeliverOpts{})
+	return
+}
 
-		// when done chdir to previous directory
+// deliver mail to this maildir with options
+// returns the message in the new directory that was delivered
+func (d MailDir) DeliverWith(body io.Reader, opts DeliverOpts) (msg Message, err error) {
+	defer d.wrapErr("deliver", &err)
+	if opts.IdempotencyKey != "" {
+		var ok bool
+		msg, ok, err = d.reserveKey(opts.IdempotencyKey, opts.IdempotencyWindow)
+		if ok {
+			err = ErrAlreadyDelivered
+		}
+		if ok || err != nil {
+			return
+		}
 		defer func() {
-			err := os.Chdir(oldwd)
 			if err != nil {
-				log.Fatal("chdir failed", err)
+				d.releaseKey(opts.IdempotencyKey)
 			}
 		}()
-		// chdir to maildir
-		err = os.Chdir(d.Filepath())
+	}
+	// every path we touch is absolute so we never chdir, which would race
+	// with anything else in the process resolving relative paths
+	var st os.FileInfo
+	st, err = os.Stat(d.Filepath())
+	if err == nil && !st.IsDir() {
+		err = &os.PathError{Op: "deliver", Path: d.Filepath(), Err: ErrNotDirectory}
+	}
+	if err == nil {
+		if opts.ReadTimeout > 0 {
+			tr := &timeoutReader{r: body, timeout: opts.ReadTimeout}
+			defer tr.clear()
+			body = tr
+		}
+		body, err = opts.runPlugins(body)
+		if opts.DKIMSafe {
+			body = &crlfReader{r: body}
+		}
+		var fname string
+		if err == nil && opts.WAL {
+			fname, err = d.writeTempWAL(body)
+		} else if err == nil {
+			fname, err = d.writeTemp(body)
+		}
 		if err == nil {
-			fname := d.File()
-			for {
-				_, err = os.Stat(d.Temp(fname))
-				if os.IsNotExist(err) {
-					break
+			err = os.Rename(d.Temp(fname), d.New(fname))
+			if err == nil && opts.WAL {
+				// recovery copes with a stale journal so this only keeps it small
+				if e := d.checkpoint(fname); e != nil {
+					log.Warn("failed to checkpoint journal in ", d, ": ", e)
 				}
-				time.Sleep(time.Second * 2)
-				fname = d.File()
 			}
-			// set err to nil
-			err = nil
-			var f *os.File
-			// create tmp file
-			f, err = os.Create(d.Temp(fname))
 			if err == nil {
-				// success creation
-				err = f.Close()
+				// it's delivered
+				msg = Message(fname)
+				d.delivered(msg, opts)
 			}
-			// try writing file
-			if err == nil {
-				f, err = os.OpenFile(d.Temp(fname), os.O_CREATE|os.O_WRONLY, 0600)
-				if err == nil {
-					// write body
-					_, err = io.Copy(f, body)
-					f.Close()
-					if err == nil {
-						err = os.Rename(d.Temp(fname), d.New(fname))
-						// if err is nil it's delivered
-					}
-				}
+		}
+	}
+	return
+}
+
+// deliver mail directly into the cur directory with flags set
+func (d MailDir) deliverCur(body io.Reader, flags ...Flag) (msg Message, err error) {
+	var fname string
+	fname, err = d.writeTemp(body)
+	if err == nil {
+		m := infoName(fname, flags)
+		err = os.Rename(d.Temp(fname), d.Cur(m.Filepath()))
+		if err == nil {
+			msg = m
+		}
+	}
+	return
+}
+
+// do the bookkeeping for a message just renamed into new
+func (d MailDir) delivered(msg Message, opts DeliverOpts) {
+	if opts.IdempotencyKey != "" {
+		d.recordKey(opts.IdempotencyKey, msg, opts.IdempotencyWindow)
+	}
+	o := d.options()
+	d.audit(o, OpDeliver, msg)
+	if st, err := os.Stat(d.New(msg.Filepath())); err == nil {
+		d.updateMaildirSize(o, st.Size(), 1)
+	}
+}
+
+// deliver a file already on disk to this maildir without reading it if possible
+// the file is hard linked into tmp when on the same filesystem otherwise it is copied
+// a linked file is shared with the caller so it is made read only, the caller must
+// not change it afterwards and should only ever remove its own link
+// returns the message in the new directory that was delivered
+func (d MailDir) DeliverFromPath(path string) (msg Message, err error) {
+	msg, err = d.DeliverFromPathWith(path, DeliverOpts{})
+	return
+}
+
+// deliver a file already on disk to this maildir with options
+// plugins, DKIMSafe and WAL need the body read so with those it is always copied
+func (d MailDir) DeliverFromPathWith(path string, opts DeliverOpts) (msg Message, err error) {
+	defer d.wrapErr("deliver from path", &err)
+	var st os.FileInfo
+	st, err = os.Lstat(path)
+	if err == nil && !st.Mode().IsRegular() {
+		err = &os.PathError{Op: "deliver from path", Path: path, Err: ErrNotRegular}
+	}
+	if err != nil {
+		return
+	}
+	if len(opts.Plugins) > 0 || opts.DKIMSafe || opts.WAL {
+		var f *os.File
+		f, err = os.Open(path)
+		if err == nil {
+			msg, err = d.DeliverWith(f, opts)
+			f.Close()
+		}
+		return
+	}
+	if opts.IdempotencyKey != "" {
+		var ok bool
+		msg, ok, err = d.reserveKey(opts.IdempotencyKey, opts.IdempotencyWindow)
+		if ok {
+			err = ErrAlreadyDelivered
+		}
+		if ok || err != nil {
+			return
+		}
+		defer func() {
+			if err != nil {
+				d.releaseKey(opts.IdempotencyKey)
 			}
+		}()
+	}
+	fname := d.tempName()
+	err = os.Link(path, d.Temp(fname))
+	if err == nil {
+		// the caller's file is this message now so nothing may write to it
+		err = os.Chmod(d.Temp(fname), 0400)
+		if err != nil {
+			os.Remove(d.Temp(fname))
+		}
+	} else {
+		// probably another filesystem, copy it instead
+		var f *os.File
+		f, err = os.Open(path)
+		if err == nil {
+			fname, err = d.writeTemp(f)
+			f.Close()
+		}
+	}
+	if err == nil {
+		err = os.Rename(d.Temp(fname), d.New(fname))
+		if err == nil {
+			msg = Message(fname)
+			d.delivered(msg, opts)
+		} else {
+			os.Remove(d.Temp(fname))
+		}
+	}
+	return
+}
+
+// get a filename that is not in use in the tmp directory
+func (d MailDir) tempName() (fname string) {
+	fname = d.File()
+	for {
+		_, err := os.Stat(d.Temp(fname))
+		if os.IsNotExist(err) {
+			break
+		}
+		time.Sleep(time.Second * 2)
+		fname = d.File()
+	}
+	return
+}
+
+// write body to a new unique file in the tmp directory
+// returns the name of the file written
+func (d MailDir) writeTemp(body io.Reader) (fname string, err error) {
+	for {
+		fname = d.tempName()
+		_, err = d.writeTempAs(fname, body, false)
+		// a concurrent delivery took the name between checking and creating it
+		// nothing was read from body yet so try another
+		if !os.IsExist(err) {
+			break
+		}
+	}
+	return
+}
+
+// write body to a named file in the tmp directory, syncing it to disk if asked
+// returns the number of bytes written
+func (d MailDir) writeTempAs(fname string, body io.Reader, sync bool) (n int64, err error) {
+	var f *os.File
+	// create tmp file
+	f, err = os.OpenFile(d.Temp(fname), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err == nil {
+		// write body
+		n, err = io.Copy(f, body)
+		if err == nil && sync {
+			err = f.Sync()
+		}
+		f.Close()
+		if err != nil {
+			// don't leave partial files around
+			os.Remove(d.Temp(fname))
 		}
 	}
 	return
@@ -153,61 +357,293 @@ func (d MailDir) listDir(sd string) (msgs []Message, err error) {
 	return
 }
 
+// read the entries of a subdirectory sorted by name
+// an entry's Info may not need another stat, so use this when sizes or times are wanted
+func (d MailDir) entries(sub string) (ents []os.DirEntry, err error) {
+	ents, err = os.ReadDir(filepath.Join(d.Filepath(), sub))
+	return
+}
+
 // list new messages in this maildir
 func (d MailDir) ListNew() (msgs []Message, err error) {
+	defer d.wrapErr("list new", &err)
 	msgs, err = d.listDir("new")
 	return
 }
 
 // list currently held messages in this maildir
 func (d MailDir) ListCur() (msgs []Message, err error) {
+	defer d.wrapErr("list cur", &err)
 	msgs, err = d.listDir("cur")
 	return
 }
 
+// list all unseen messages, everything in new plus messages in cur without the seen flag
+func (d MailDir) ListUnseen() (msgs []Message, err error) {
+	defer d.wrapErr("list unseen", &err)
+	msgs, err = d.ListNew()
+	if err == nil {
+		var cur []Message
+		cur, err = d.ListCur()
+		for _, msg := range cur {
+			if !msg.HasFlag(Seen) {
+				msgs = append(msgs, msg)
+			}
+		}
+	}
+	return
+}
+
+// count unseen messages without building a listing
+func (d MailDir) UnseenCount() (n int, err error) {
+	defer d.wrapErr("unseen count", &err)
+	n, err = d.CountWhere(func(fs FlagSet) bool {
+		return !fs.Has(Seen)
+	})
+	return
+}
+
+// count messages with a flag set
+func (d MailDir) CountByFlag(f Flag) (n int, err error) {
+	defer d.wrapErr("count by flag", &err)
+	n, err = d.CountWhere(func(fs FlagSet) bool {
+		return fs.Has(f)
+	})
+	return
+}
+
+// count messages whose flags match a predicate
+// only filenames are looked at, messages in new have no flags
+func (d MailDir) CountWhere(pred func(FlagSet) bool) (n int, err error) {
+	defer d.wrapErr("count", &err)
+	for _, sub := range []string{"new", "cur"} {
+		var ents []os.DirEntry
+		ents, err = d.entries(sub)
+		if err != nil {
+			return
+		}
+		newOK := sub == "new" && pred(nil)
+		for _, ent := range ents {
+			if ent.IsDir() {
+				continue
+			}
+			if newOK || (sub == "cur" && pred(Message(ent.Name()).Flags())) {
+				n++
+			}
+		}
+	}
+	return
+}
+
 // process new message and move it to the cur directory
-func (d MailDir) ProcessNew(msg Message, flags ...Flag) (err error) {
+// without flags it gets the maildir's default flags, none unless set with Options.ProcessNewDefault
+// returns the message as it is named in the cur directory
+func (d MailDir) ProcessNew(msg Message, flags ...Flag) (m Message, err error) {
+	defer d.wrapErr("process new", &err)
+	mtx := d.mutex()
+	mtx.Lock()
+	defer mtx.Unlock()
+	o := d.options()
+	m, err = d.processNew(o, msg, flags...)
+	if err == nil {
+		d.audit(o, OpProcessNew, m)
+	}
+	return
+}
+
+// move a message from new to cur, the caller holds the maildir mutex
+// o is the maildir's options, read once by the caller
+func (d MailDir) processNew(o Options, msg Message, flags ...Flag) (m Message, err error) {
 	// find message
 	fname := d.New(msg.Filepath())
 	_, err = os.Stat(fname)
 	if err == nil {
 		// message exists and is accessable
-		if len(flags) > 0 {
-			var fl string
-			for _, f := range flags {
-				fl += f.String()
-			}
-			err = os.Rename(fname, d.Cur(fmt.Sprintf("%s:2,%s", msg.Name(), fl)))
+		if len(flags) == 0 {
+			flags = o.ProcessNewDefault
+		}
+		m = infoName(msg.Name(), flags)
+		err = os.Rename(fname, d.Cur(m.Filepath()))
+		if err == nil {
+			d.flagsChanged(o, m, nil, m.Flags())
 		} else {
-			// default to seen if no flags are specified
-			err = os.Rename(fname, d.Cur(fmt.Sprintf("%s:2,S", msg.Name())))
+			m = ""
 		}
 	}
 	return
 }
 
 // process message in cur and change its flags if specified
-func (d MailDir) ProcessCur(msg Message, flags ...Flag) (err error) {
+// returns the message as it is named after the change
+func (d MailDir) ProcessCur(msg Message, flags ...Flag) (m Message, err error) {
+	defer d.wrapErr("process cur", &err)
+	mtx := d.mutex()
+	mtx.Lock()
+	defer mtx.Unlock()
+	o := d.options()
+	m, err = d.processCur(o, msg, flags...)
+	if err == nil {
+		d.audit(o, OpProcessCur, m)
+	}
+	return
+}
+
+// set the flags of a message in cur, the caller holds the maildir mutex
+// if it was renamed under us by another process it is looked up again once
+func (d MailDir) processCur(o Options, msg Message, flags ...Flag) (m Message, err error) {
 	fname := d.Cur(msg.Filepath())
 	_, err = os.Stat(fname)
 	if err == nil {
 		// message exists and is accessable
 		if len(flags) > 0 {
-			var fl string
-			for _, f := range flags {
-				fl += f.String()
-			}
 			// set message flags
-			err = os.Rename(fname, d.Cur(fmt.Sprintf("%s:2,%s", msg.Name(), fl)))
+			old := msg
+			m = infoName(msg.Name(), flags)
+			err = os.Rename(fname, d.Cur(m.Filepath()))
+			if os.IsNotExist(err) {
+				var sub string
+				sub, old, err = d.find(msg)
+				if err == nil && sub == "cur" {
+					err = os.Rename(d.Cur(old.Filepath()), d.Cur(m.Filepath()))
+				} else if err == nil {
+					err = &os.PathError{Op: "rename", Path: fname, Err: os.ErrNotExist}
+				}
+			}
+			if err == nil {
+				d.flagsChanged(o, m, old.Flags(), m.Flags())
+			} else {
+				m = ""
+			}
 		} else {
 			// don't touch the message's flags if non are provided
+			m = msg
+		}
+	}
+	return
+}
+
+// find where a message currently is by its unique name
+// the message may be given with stale flags
+// returns the subdirectory it is in and its current name
+func (d MailDir) find(msg Message) (sub string, m Message, err error) {
+	for _, sub = range []string{"cur", "new"} {
+		_, err = os.Stat(d.subdir(sub, msg))
+		if err == nil {
+			m = msg
+			return
+		}
+	}
+	// flags changed, look it up by name
+	var msgs []Message
+	msgs, err = d.ListCur()
+	if err == nil {
+		sub = "cur"
+		for _, m = range msgs {
+			if m.Name() == msg.Name() {
+				return
+			}
+		}
+		err = &os.PathError{Op: "find", Path: d.Cur(msg.Name()), Err: os.ErrNotExist}
+	}
+	sub = ""
+	m = ""
+	return
+}
+
+// set a flag on a message, moving it to cur if it is new
+// does nothing if the flag is already set
+// returns the message as it is named after the change
+func (d MailDir) AddFlag(msg Message, flag Flag) (m Message, err error) {
+	defer d.wrapErr("add flag", &err)
+	mtx := d.mutex()
+	mtx.Lock()
+	defer mtx.Unlock()
+	o := d.options()
+	// another process may rename it between finding and renaming, try again once
+	for try := 0; try < 2; try++ {
+		var sub string
+		sub, m, err = d.find(msg)
+		if err == nil {
+			if sub == "new" {
+				m, err = d.processNew(o, m, flag)
+			} else if !m.HasFlag(flag) {
+				m, err = d.processCur(o, m, m.Flags().Add(flag)...)
+			}
+		}
+		if !os.IsNotExist(err) {
+			break
 		}
 	}
 	return
 }
 
+// clear a flag on a message
+// does nothing if the flag is not set
+// returns the message as it is named after the change
+func (d MailDir) RemoveFlag(msg Message, flag Flag) (m Message, err error) {
+	defer d.wrapErr("remove flag", &err)
+	mtx := d.mutex()
+	mtx.Lock()
+	defer mtx.Unlock()
+	m, _, err = d.removeFlag(d.options(), msg, flag)
+	return
+}
+
+// clear a flag on a message, the caller holds the maildir mutex
+// changed is false if the flag wasn't set
+func (d MailDir) removeFlag(o Options, msg Message, flag Flag) (m Message, changed bool, err error) {
+	// another process may rename it between finding and renaming, try again once
+	for try := 0; try < 2; try++ {
+		var sub string
+		sub, m, err = d.find(msg)
+		if err == nil && sub == "cur" && m.HasFlag(flag) {
+			nm := infoName(m.Name(), m.Flags().Remove(flag))
+			err = os.Rename(d.Cur(m.Filepath()), d.Cur(nm.Filepath()))
+			if err == nil {
+				d.flagsChanged(o, nm, m.Flags(), nm.Flags())
+				m = nm
+				changed = true
+			} else {
+				m = ""
+			}
+		}
+		if !os.IsNotExist(err) {
+			break
+		}
+	}
+	return
+}
+
+// remove a message from either cur or new directory
+func (d MailDir) Remove(msg Message) (err error) {
+	defer d.wrapErr("remove", &err)
+	mtx := d.mutex()
+	mtx.Lock()
+	defer mtx.Unlock()
+	var fname string
+	fname, err = d.resolve(msg)
+	var st os.FileInfo
+	if err == nil {
+		st, err = os.Stat(fname)
+	}
+	if err == nil {
+		err = os.Remove(fname)
+	}
+	if err == nil {
+		// drop any hmac and preview kept for it
+		os.Remove(d.hmacPath(msg))
+		os.Remove(d.previewPath(msg))
+		o := d.options()
+		d.audit(o, OpDelete, msg)
+		d.journalExpunges([]Message{msg})
+		d.updateMaildirSize(o, -st.Size(), -1)
+	}
+	return
+}
+
 // return true if this message is in cur directory
 func (d MailDir) IsCur(msg Message) (is bool, err error) {
+	defer d.wrapErr("is cur", &err)
 	_, err = os.Stat(d.Cur(msg.Filepath()))
 	if os.IsNotExist(err) {
 		err = nil
@@ -219,6 +655,7 @@ func (d MailDir) IsCur(msg Message) (is bool, err error) {
 
 // return true if this message is in cur directory
 func (d MailDir) IsNew(msg Message) (is bool, err error) {
+	defer d.wrapErr("is new", &err)
 	_, err = os.Stat(d.New(msg.Filepath()))
 	if os.IsNotExist(err) {
 		err = nil
@@ -228,8 +665,33 @@ func (d MailDir) IsNew(msg Message) (is bool, err error) {
 	return
 }
 
+// get the full path of a message in either cur or new directory
+func (d MailDir) resolve(msg Message) (fname string, err error) {
+	fname = d.Cur(msg.Filepath())
+	_, err = os.Stat(fname)
+	if os.IsNotExist(err) {
+		fname = d.New(msg.Filepath())
+		_, err = os.Stat(fname)
+	}
+	return
+}
+
 // open message in cur directory
 func (d MailDir) OpenMessage(msg Message) (r io.ReadCloser, err error) {
+	defer d.wrapErr("open", &err)
 	r, err = os.Open(d.Cur(msg.Filepath()))
+	if err == nil {
+		d.audit(d.options(), OpOpen, msg)
+	}
+	return
+}
+
+// open message in new directory without processing it
+func (d MailDir) OpenNewMessage(msg Message) (r io.ReadCloser, err error) {
+	defer d.wrapErr("open new", &err)
+	r, err = os.Open(d.New(msg.Filepath()))
+	if err == nil {
+		d.audit(d.options(), OpOpen, msg)
+	}
 	return
 }
@@ -0,0 +1,106 @@
+//go:build bench
+
+package maildir
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+// fill cur with n seen messages then list it
+func benchmarkListCur(b *testing.B, n int) {
+	d := MailDir(b.TempDir())
+	if err := d.Ensure(); err != nil {
+		b.Fatal(err)
+	}
+	body := []byte("Subject: bench\r\n\r\nbody\r\n")
+	for i := 0; i < n; i++ {
+		if _, err := d.deliverCur(bytes.NewReader(body), Seen); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		msgs, err := d.ListCur()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(msgs) != n {
+			b.Fatalf("listed %d of %d", len(msgs), n)
+		}
+	}
+}
+
+func BenchmarkListCur1000(b *testing.B) {
+	benchmarkListCur(b, 1000)
+}
+
+func BenchmarkListCur100000(b *testing.B) {
+	benchmarkListCur(b, 100000)
+}
+
+// fill new and cur with n messages each
+func benchmarkMailDir(b *testing.B, n int) MailDir {
+	d := MailDir(b.TempDir())
+	if err := d.Ensure(); err != nil {
+		b.Fatal(err)
+	}
+	body := []byte("Subject: bench\r\n\r\nbody\r\n")
+	for i := 0; i < n; i++ {
+		if _, err := d.Deliver(bytes.NewReader(body)); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := d.deliverCur(bytes.NewReader(body), Seen); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return d
+}
+
+// sizes by listing names then stating each file, as it used to be done
+func BenchmarkSizesListDirStat(b *testing.B) {
+	d := benchmarkMailDir(b, 1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var total int64
+		for _, sub := range []string{"new", "cur"} {
+			msgs, err := d.listDir(sub)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for _, msg := range msgs {
+				st, err := os.Stat(d.subdir(sub, msg))
+				if err != nil {
+					b.Fatal(err)
+				}
+				total += st.Size()
+			}
+		}
+	}
+}
+
+// sizes from directory entries
+func BenchmarkSizesEntries(b *testing.B) {
+	d := benchmarkMailDir(b, 1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var total int64
+		for _, sub := range []string{"new", "cur"} {
+			ents, err := d.entries(sub)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for _, ent := range ents {
+				st, err := ent.Info()
+				if err != nil {
+					b.Fatal(err)
+				}
+				total += st.Size()
+			}
+		}
+	}
+}
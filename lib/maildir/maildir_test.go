@@ -0,0 +1,191 @@
+package maildir
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func testMailDir(t *testing.T) MailDir {
+	d := MailDir(t.TempDir())
+	if err := d.Ensure(); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// write a message directly into a maildir subdirectory
+func putMessage(t *testing.T, d MailDir, sub, name, body string) Message {
+	err := ioutil.WriteFile(filepath.Join(d.Filepath(), sub, name), []byte(body), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Message(name)
+}
+
+func TestDeliverThenProcessNew(t *testing.T) {
+	d := testMailDir(t)
+	msg, err := d.Deliver(bytes.NewBufferString("Subject: test\r\n\r\nbody\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	is, _ := d.IsNew(msg)
+	if !is {
+		t.Fatal("delivered message not in new")
+	}
+	cur, err := d.ProcessNew(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cur != Message(msg.Name()+":2,") {
+		t.Fatalf("processed message named %s", cur)
+	}
+	is, _ = d.IsCur(cur)
+	if !is {
+		t.Fatal("processed message not in cur")
+	}
+}
+
+func TestListUnseen(t *testing.T) {
+	d := testMailDir(t)
+	putMessage(t, d, "new", "1.host", "new\r\n")
+	putMessage(t, d, "new", "2.host", "new\r\n")
+	putMessage(t, d, "cur", "3.host:2,S", "seen\r\n")
+	putMessage(t, d, "cur", "4.host:2,FS", "seen and flagged\r\n")
+	putMessage(t, d, "cur", "5.host:2,F", "unseen and flagged\r\n")
+	putMessage(t, d, "cur", "6.host:2,", "unseen\r\n")
+	msgs, err := d.ListUnseen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unseen := map[Message]bool{}
+	for _, msg := range msgs {
+		unseen[msg] = true
+	}
+	if len(msgs) != 4 || !unseen["1.host"] || !unseen["2.host"] || !unseen["5.host:2,F"] || !unseen["6.host:2,"] {
+		t.Fatalf("unseen listing was %v", msgs)
+	}
+	n, err := d.UnseenCount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Fatalf("unseen count was %d", n)
+	}
+}
+
+func FuzzDeliver(f *testing.F) {
+	f.Add([]byte("From: a@example.com\r\nTo: b@example.com\r\nSubject: hi\r\nDate: Mon, 2 Jan 2006 15:04:05 -0700\r\n\r\nbody\r\n"))
+	f.Add([]byte{})
+	d := MailDir(f.TempDir())
+	if err := d.Ensure(); err != nil {
+		f.Fatal(err)
+	}
+	f.Fuzz(func(t *testing.T, body []byte) {
+		before, err := d.ListNew()
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := d.Deliver(bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, sub := range []string{"tmp", "new", "cur"} {
+			files, err := ioutil.ReadDir(filepath.Join(d.Filepath(), sub))
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch sub {
+			case "tmp", "cur":
+				if len(files) != 0 {
+					t.Fatalf("%s has %d files", sub, len(files))
+				}
+			case "new":
+				if len(files) != len(before)+1 {
+					t.Fatalf("new went from %d to %d files", len(before), len(files))
+				}
+			}
+		}
+		data, err := ioutil.ReadFile(d.New(msg.Filepath()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, body) {
+			t.Fatalf("delivered %q stored %q", body, data)
+		}
+	})
+}
+
+// deliver messages of a size from 8 goroutines per cpu
+func benchmarkDeliver(b *testing.B, size int) {
+	d := MailDir(b.TempDir())
+	if err := d.Ensure(); err != nil {
+		b.Fatal(err)
+	}
+	body := bytes.Repeat([]byte("0123456789abcdefghijklmnopqrstuvwxyz\r\n"), size/38+1)[:size]
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	b.SetParallelism(8)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := d.Deliver(bytes.NewReader(body)); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkDeliver1KB(b *testing.B) {
+	benchmarkDeliver(b, 1024)
+}
+
+func BenchmarkDeliver100KB(b *testing.B) {
+	benchmarkDeliver(b, 100*1024)
+}
+
+func BenchmarkDeliver1MB(b *testing.B) {
+	benchmarkDeliver(b, 1024*1024)
+}
+
+func BenchmarkDeliver10MB(b *testing.B) {
+	benchmarkDeliver(b, 10*1024*1024)
+}
+
+func TestProcessNewFlags(t *testing.T) {
+	tests := []struct {
+		name  string
+		new   string
+		flags []Flag
+		cur   string
+	}{
+		{"unsorted", "1.host", []Flag{Seen, Flagged, Replied}, "1.host:2,FRS"},
+		{"duplicates", "1.host", []Flag{Seen, Seen, Flagged, Seen}, "1.host:2,FS"},
+		{"empty", "1.host", nil, "1.host:2,"},
+		{"all", "1.host", []Flag{Trashed, Seen, Replied, Passed, Flagged, Draft}, "1.host:2,DFPRST"},
+		{"same flags", "1.host:2,FS", []Flag{Flagged, Seen}, "1.host:2,FS"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := testMailDir(t)
+			msg := putMessage(t, d, "new", test.new, "hi\n")
+			cur, err := d.ProcessNew(msg, test.flags...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cur != Message(test.cur) {
+				t.Fatalf("processed to %q", cur)
+			}
+			if is, _ := d.IsCur(cur); !is {
+				t.Fatal("not on disk in cur")
+			}
+			// setting the same flags again changes nothing
+			again, err := d.ProcessCur(cur, cur.GetFlags()...)
+			if err != nil || again != cur {
+				t.Fatalf("no-op update gave %q %v", again, err)
+			}
+		})
+	}
+}
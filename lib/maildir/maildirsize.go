@@ -0,0 +1,160 @@
+package maildir
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// name of the maildir++ quota file in the maildir root
+// the first line is the quota definition, every line after it is a
+// <bytes> <messages> delta that deliverers append
+const maildirSizeFile = "maildirsize"
+
+// recalculate maildirsize once it has this many lines, as dovecot does
+const DefaultMaildirSizeLines = 1000
+
+// recalculate maildirsize once it is this big in bytes, as the maildir++ spec says
+const DefaultMaildirSizeBytes = 5120
+
+// mutexes serializing maildirsize updates keyed by maildir path
+// separate from the maildir mutex as Remove already holds that
+var maildirSizeMutexes sync.Map
+
+// get the lines and bytes at which maildirsize is recalculated
+func (o Options) maildirSizeLimits() (lines int, bytes int64) {
+	lines, bytes = o.MaildirSizeLines, o.MaildirSizeBytes
+	if lines <= 0 {
+		lines = DefaultMaildirSizeLines
+	}
+	if bytes <= 0 {
+		bytes = DefaultMaildirSizeBytes
+	}
+	return
+}
+
+// get the maildir whose maildirsize counts this maildir's messages
+// a maildir++ subfolder is counted by its parent
+func (d MailDir) quotaRoot() MailDir {
+	if _, err := os.Stat(filepath.Join(d.Filepath(), "maildirfolder")); err == nil {
+		return MailDir(filepath.Dir(d.Filepath()))
+	}
+	return d
+}
+
+// note messages added or removed in maildirsize if there is one
+// it is only kept up to date, never created, as it holds a quota we don't set
+// o is this maildir's options, the limits are read from the root's
+// the change already happened so failures are only logged
+func (d MailDir) updateMaildirSize(o Options, size int64, count int) {
+	root := d.quotaRoot()
+	mtx, _ := maildirSizeMutexes.LoadOrStore(root.Filepath(), new(sync.Mutex))
+	mtx.(*sync.Mutex).Lock()
+	defer mtx.(*sync.Mutex).Unlock()
+	fname := filepath.Join(root.Filepath(), maildirSizeFile)
+	f, err := os.OpenFile(fname, os.O_WRONLY|os.O_APPEND, 0600)
+	if os.IsNotExist(err) {
+		return
+	}
+	var st os.FileInfo
+	if err == nil {
+		_, err = fmt.Fprintf(f, "%d %d\n", size, count)
+		if err == nil {
+			st, err = f.Stat()
+		}
+		if e := f.Close(); err == nil {
+			err = e
+		}
+	}
+	if err == nil {
+		if root != d {
+			o = root.options()
+		}
+		maxLines, maxBytes := o.maildirSizeLimits()
+		over := st.Size() >= maxBytes
+		if !over {
+			var lines int
+			lines, err = countFileLines(fname)
+			over = lines >= maxLines
+		}
+		if err == nil && over {
+			err = root.recalculateMaildirSize()
+		}
+	}
+	if err != nil {
+		log.Warn("failed to update ", maildirSizeFile, " of ", root, ": ", err)
+	}
+}
+
+// count the lines in a file
+func countFileLines(fname string) (lines int, err error) {
+	var data []byte
+	data, err = ioutil.ReadFile(fname)
+	if err == nil {
+		lines = bytes.Count(data, []byte("\n"))
+	}
+	return
+}
+
+// replace maildirsize with its quota definition and one line counting every
+// message in this maildir and its subfolders
+// the caller holds the maildirsize mutex
+func (d MailDir) recalculateMaildirSize() (err error) {
+	fname := filepath.Join(d.Filepath(), maildirSizeFile)
+	var quota string
+	var f *os.File
+	f, err = os.Open(fname)
+	if err != nil {
+		return
+	}
+	sc := bufio.NewScanner(f)
+	if sc.Scan() {
+		quota = sc.Text()
+	}
+	err = sc.Err()
+	f.Close()
+	var size int64
+	var count int
+	var names []string
+	if err == nil {
+		names, err = d.folders()
+	}
+	dirs := []MailDir{d}
+	for _, name := range names {
+		dirs = append(dirs, d.Folder(name))
+	}
+	for _, md := range dirs {
+		for _, sub := range []string{"new", "cur"} {
+			if err != nil {
+				return
+			}
+			var ents []os.DirEntry
+			ents, err = md.entries(sub)
+			if os.IsNotExist(err) {
+				err = nil
+			}
+			for _, ent := range ents {
+				info, e := ent.Info()
+				if e != nil || !info.Mode().IsRegular() {
+					// removed since listing
+					continue
+				}
+				size += info.Size()
+				count++
+			}
+		}
+	}
+	if err == nil {
+		data := fmt.Sprintf("%s\n%d %d\n", quota, size, count)
+		err = ioutil.WriteFile(fname+".tmp", []byte(data), 0600)
+		if err == nil {
+			err = os.Rename(fname+".tmp", fname)
+		}
+	}
+	return
+}
@@ -0,0 +1,80 @@
+package maildir
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// read maildirsize and sum its deltas
+func readMaildirSize(t *testing.T, d MailDir) (lines []string, size int64, count int) {
+	data, err := ioutil.ReadFile(filepath.Join(d.Filepath(), maildirSizeFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines = strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	for _, line := range lines[1:] {
+		var s int64
+		var c int
+		if _, err = fmt.Sscanf(line, "%d %d", &s, &c); err != nil {
+			t.Fatalf("bad maildirsize line %q", line)
+		}
+		size += s
+		count += c
+	}
+	return
+}
+
+func TestMaildirSizeRecalculate(t *testing.T) {
+	d := testMailDir(t)
+	if err := d.SetOptions(Options{MaildirSizeLines: 5}); err != nil {
+		t.Fatal(err)
+	}
+	sent, err := d.EnsureFolder("Sent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(d.Filepath(), maildirSizeFile), []byte("1000000S\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var msgs []Message
+	for i := 0; i < 3; i++ {
+		msg, err := d.Deliver(strings.NewReader(fmt.Sprintf("message %d\n", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, msg)
+	}
+	if lines, _, _ := readMaildirSize(t, d); len(lines) != 4 {
+		t.Fatalf("maildirsize is %q before reaching the limit", lines)
+	}
+	// deliveries to subfolders count towards the maildir
+	if _, err = sent.Deliver(strings.NewReader("sent message\n")); err != nil {
+		t.Fatal(err)
+	}
+	lines, size, count := readMaildirSize(t, d)
+	total := int64(len("message 0\n")*3 + len("sent message\n"))
+	if len(lines) != 2 || lines[0] != "1000000S" || size != total || count != 4 {
+		t.Fatalf("maildirsize is %q after recalculating", lines)
+	}
+	if err = d.Remove(msgs[0]); err != nil {
+		t.Fatal(err)
+	}
+	lines, size, count = readMaildirSize(t, d)
+	if len(lines) != 3 || size != total-int64(len("message 0\n")) || count != 3 {
+		t.Fatalf("maildirsize is %q after a removal", lines)
+	}
+}
+
+func TestMaildirSizeNotCreated(t *testing.T) {
+	d := testMailDir(t)
+	if _, err := d.Deliver(strings.NewReader("hi\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(d.Filepath(), maildirSizeFile)); !os.IsNotExist(err) {
+		t.Fatal("maildirsize created without a quota")
+	}
+}
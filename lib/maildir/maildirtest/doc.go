@@ -0,0 +1,4 @@
+//
+// helpers for testing code that uses maildirs
+//
+package maildirtest
@@ -0,0 +1,43 @@
+package maildirtest
+
+import (
+	"github.com/majestrate/bdsmail/lib/maildir"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// deliver body to dir and read it back out of new, failing the test unless
+// the bytes read are exactly the bytes delivered
+// returns the delivered message
+func RoundTrip(t *testing.T, dir maildir.MailDir, body string) maildir.Message {
+	t.Helper()
+	msg, err := dir.Deliver(strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("deliver: %s", err)
+	}
+	msgs, err := dir.ListNew()
+	if err != nil {
+		t.Fatalf("list new: %s", err)
+	}
+	listed := false
+	for _, m := range msgs {
+		listed = listed || m == msg
+	}
+	if !listed {
+		t.Fatalf("delivered message %s not in new", msg)
+	}
+	r, err := dir.OpenNewMessage(msg)
+	if err != nil {
+		t.Fatalf("open new message: %s", err)
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read %s: %s", msg, err)
+	}
+	if string(data) != body {
+		t.Fatalf("delivered %q read back %q", body, data)
+	}
+	return msg
+}
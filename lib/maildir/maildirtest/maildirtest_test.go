@@ -0,0 +1,23 @@
+package maildirtest
+
+import (
+	"github.com/majestrate/bdsmail/lib/maildir"
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	d := maildir.MailDir(t.TempDir())
+	if err := d.Ensure(); err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{
+		"",
+		"Subject: hi\r\n\r\nbody\r\n",
+		"Subject: bare\n\nno crlf",
+		strings.Repeat("long line ", 100000),
+		"\x00\xff binary\r",
+	} {
+		RoundTrip(t, d, body)
+	}
+}
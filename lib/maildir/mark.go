@@ -0,0 +1,59 @@
+package maildir
+
+import (
+	"os"
+)
+
+// mark a message as answered after replying to it
+// returns the message as it is named after the change
+func (d MailDir) MarkAnswered(msg Message) (Message, error) {
+	return d.AddFlag(msg, Replied)
+}
+
+// mark a message as flagged
+// returns the message as it is named after the change
+func (d MailDir) MarkFlagged(msg Message) (Message, error) {
+	return d.AddFlag(msg, Flagged)
+}
+
+// clear the flagged mark on a message
+// returns the message as it is named after the change
+func (d MailDir) MarkUnflagged(msg Message) (Message, error) {
+	return d.RemoveFlag(msg, Flagged)
+}
+
+// mark a message as passed after forwarding or resending it
+// returns the message as it is named after the change
+func (d MailDir) MarkPassed(msg Message) (Message, error) {
+	return d.AddFlag(msg, Passed)
+}
+
+// mark every message in cur unseen for marking a whole folder unread
+// it is done under the maildir mutex so flag changes in this process can't interleave,
+// messages already unseen are left alone and ones removed meanwhile are skipped
+// returns how many messages were changed
+func (d MailDir) ClearSeenAll() (n int, err error) {
+	defer d.wrapErr("clear seen all", &err)
+	mtx := d.mutex()
+	mtx.Lock()
+	defer mtx.Unlock()
+	o := d.options()
+	var msgs []Message
+	msgs, err = d.listDir("cur")
+	for _, msg := range msgs {
+		if err != nil {
+			break
+		}
+		if !msg.HasFlag(Seen) {
+			continue
+		}
+		var changed bool
+		_, changed, err = d.removeFlag(o, msg, Seen)
+		if os.IsNotExist(err) {
+			err = nil
+		} else if changed {
+			n++
+		}
+	}
+	return
+}
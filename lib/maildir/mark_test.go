@@ -0,0 +1,107 @@
+package maildir
+
+import (
+	"testing"
+)
+
+func TestMarkFlags(t *testing.T) {
+	d := testMailDir(t)
+	msg := putMessage(t, d, "cur", "1.host:2,S", "body\r\n")
+	for _, step := range []struct {
+		mark func(Message) (Message, error)
+		want Message
+	}{
+		{d.MarkAnswered, "1.host:2,RS"},
+		{d.MarkAnswered, "1.host:2,RS"},
+		{d.MarkFlagged, "1.host:2,FRS"},
+		{d.MarkFlagged, "1.host:2,FRS"},
+		{d.MarkUnflagged, "1.host:2,RS"},
+		{d.MarkUnflagged, "1.host:2,RS"},
+	} {
+		m, err := step.mark(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m != step.want {
+			t.Fatalf("got %s expected %s", m, step.want)
+		}
+		is, _ := d.IsCur(m)
+		if !is {
+			t.Fatalf("%s not on disk", m)
+		}
+		msg = m
+	}
+	// stale names resolve to the real file
+	m, err := d.MarkFlagged("1.host:2,S")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m != "1.host:2,FRS" {
+		t.Fatalf("got %s from stale name", m)
+	}
+}
+
+func TestMarkNewMessage(t *testing.T) {
+	d := testMailDir(t)
+	msg := putMessage(t, d, "new", "1.host", "body\r\n")
+	m, err := d.MarkFlagged(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m != "1.host:2,F" {
+		t.Fatalf("got %s", m)
+	}
+}
+
+func TestMarkPassed(t *testing.T) {
+	d := testMailDir(t)
+	msg := putMessage(t, d, "cur", "1.host:2,FS", "body\r\n")
+	m, err := d.MarkPassed(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// P sorts between F and S
+	if m != "1.host:2,FPS" {
+		t.Fatalf("got %s", m)
+	}
+	if !m.HasFlag(Passed) || m.Flags().String() != "FPS" {
+		t.Fatalf("flags of %s parsed as %s", m, m.Flags())
+	}
+	if m, err = d.MarkAnswered(m); err != nil || m != "1.host:2,FPRS" {
+		t.Fatalf("got %s %v", m, err)
+	}
+	if m, err = d.RemoveFlag(m, Passed); err != nil || m != "1.host:2,FRS" {
+		t.Fatalf("got %s %v", m, err)
+	}
+}
+
+func TestClearSeenAll(t *testing.T) {
+	d := testMailDir(t)
+	putMessage(t, d, "cur", "1.host:2,S", "body\r\n")
+	putMessage(t, d, "cur", "2.host:2,FS", "body\r\n")
+	putMessage(t, d, "cur", "3.host:2,", "body\r\n")
+	putMessage(t, d, "cur", "4.host:2,RS", "body\r\n")
+	putMessage(t, d, "new", "5.host", "body\r\n")
+	n, err := d.ClearSeenAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("cleared %d messages", n)
+	}
+	msgs, _ := d.ListCur()
+	if len(msgs) != 4 {
+		t.Fatalf("%d messages in cur after clearing", len(msgs))
+	}
+	for _, msg := range msgs {
+		if msg.HasFlag(Seen) {
+			t.Fatalf("%s is still seen", msg)
+		}
+	}
+	if is, _ := d.IsCur(Message("2.host:2,F")); !is {
+		t.Fatal("other flags were not kept")
+	}
+	if n, err = d.ClearSeenAll(); err != nil || n != 0 {
+		t.Fatalf("clearing again changed %d messages %v", n, err)
+	}
+}
@@ -0,0 +1,163 @@
+package maildir
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// how long to wait for another mbox user to release its lock
+const mboxLockTimeout = time.Second * 30
+
+// dotlocks older than this are left over from a crash
+const mboxStaleLock = time.Minute * 5
+
+// append every message in new and cur to an mbox file in mboxrd format
+// the mbox is created if missing and locked with both a dotlock and flock while
+// appending so other mbox readers and writers see all or none of the batch
+// returns how many messages were appended
+func (d MailDir) AppendMbox(path string) (n int, err error) {
+	defer d.wrapErr("append mbox", &err)
+	type entry struct {
+		fname string
+		mtime time.Time
+	}
+	var entries []entry
+	for _, sub := range []string{"new", "cur"} {
+		var msgs []Message
+		msgs, err = d.listDir(sub)
+		if err != nil {
+			return
+		}
+		for _, msg := range msgs {
+			fname := d.subdir(sub, msg)
+			st, e := os.Stat(fname)
+			if e == nil {
+				entries = append(entries, entry{fname, st.ModTime()})
+			}
+		}
+	}
+	// oldest first like a mailbox would have got them
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].mtime.Equal(entries[j].mtime) {
+			return entries[i].fname < entries[j].fname
+		}
+		return entries[i].mtime.Before(entries[j].mtime)
+	})
+	var unlock func()
+	unlock, err = dotlock(path)
+	if err != nil {
+		return
+	}
+	defer unlock()
+	var f *os.File
+	f, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	err = flock(f)
+	if err != nil {
+		return
+	}
+	defer funlock(f)
+	var st os.FileInfo
+	st, err = f.Stat()
+	if err != nil {
+		return
+	}
+	w := bufio.NewWriter(f)
+	for _, e := range entries {
+		var data []byte
+		data, err = ioutil.ReadFile(e.fname)
+		if os.IsNotExist(err) {
+			// removed while we were working
+			err = nil
+			continue
+		} else if err != nil {
+			break
+		}
+		err = writeMboxMessage(w, data, e.mtime)
+		if err != nil {
+			break
+		}
+		n++
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		// leave the mbox as we found it
+		f.Truncate(st.Size())
+		n = 0
+	}
+	return
+}
+
+// write one message in mboxrd format
+func writeMboxMessage(w *bufio.Writer, data []byte, received time.Time) (err error) {
+	sender := "MAILER-DAEMON"
+	m, e := mail.ReadMessage(bytes.NewReader(data))
+	if e == nil {
+		if addr, e := mail.ParseAddress(m.Header.Get("Return-Path")); e == nil {
+			sender = addr.Address
+		} else if addr, e := mail.ParseAddress(m.Header.Get("From")); e == nil {
+			sender = addr.Address
+		}
+	}
+	_, err = w.WriteString("From " + sender + " " + received.UTC().Format(time.ANSIC) + "\n")
+	data = bytes.Replace(data, []byte("\r\n"), []byte("\n"), -1)
+	lines := strings.SplitAfter(string(data), "\n")
+	for _, line := range lines {
+		if err != nil {
+			return
+		}
+		if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+			// mboxrd quoting
+			line = ">" + line
+		}
+		_, err = w.WriteString(line)
+	}
+	if err == nil {
+		if !bytes.HasSuffix(data, []byte("\n")) {
+			w.WriteString("\n")
+		}
+		// blank line before the next From
+		_, err = w.WriteString("\n")
+	}
+	return
+}
+
+// take a dotlock on path
+// returns a function to release it
+func dotlock(path string) (unlock func(), err error) {
+	lock := path + ".lock"
+	deadline := time.Now().Add(mboxLockTimeout)
+	for {
+		var f *os.File
+		f, err = os.OpenFile(lock, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			f.Close()
+			unlock = func() {
+				os.Remove(lock)
+			}
+			return
+		}
+		if !os.IsExist(err) {
+			return
+		}
+		if st, e := os.Stat(lock); e == nil && time.Since(st.ModTime()) > mboxStaleLock {
+			os.Remove(lock)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+}
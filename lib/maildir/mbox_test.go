@@ -0,0 +1,50 @@
+package maildir
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAppendMbox(t *testing.T) {
+	d := testMailDir(t)
+	putMessage(t, d, "new", "1.host", "From: a@example.com\nSubject: one\n\nFrom the start\n")
+	putMessage(t, d, "cur", "2.host:2,S", "Return-Path: <b@example.com>\nSubject: two\n\n>From quoted\n")
+	mbox := filepath.Join(t.TempDir(), "backup.mbox")
+	for i := 0; i < 2; i++ {
+		n, err := d.AppendMbox(mbox)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 2 {
+			t.Fatalf("appended %d messages", n)
+		}
+	}
+	if _, err := os.Stat(mbox + ".lock"); !os.IsNotExist(err) {
+		t.Fatal("dotlock left behind")
+	}
+	data, err := ioutil.ReadFile(mbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var froms, subjects int
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "From ") {
+			froms++
+		}
+		if strings.HasPrefix(line, "Subject: ") {
+			subjects++
+		}
+	}
+	if froms != 4 || subjects != 4 {
+		t.Fatalf("%d separators and %d messages in %q", froms, subjects, data)
+	}
+	if !strings.Contains(string(data), "\n>From the start\n") || !strings.Contains(string(data), "\n>>From quoted\n") {
+		t.Fatalf("body not quoted %q", data)
+	}
+	if !strings.Contains(string(data), "From b@example.com ") || !strings.HasPrefix(string(data), "From ") {
+		t.Fatalf("bad separators %q", data)
+	}
+}
@@ -0,0 +1,58 @@
+package maildir
+
+import (
+	"os"
+	"sort"
+	"time"
+)
+
+// a message in a merged listing of several maildirs
+type MergedEntry struct {
+	// maildir the message is in
+	Dir MailDir
+	Msg Message
+	// when it was delivered
+	T time.Time
+}
+
+// list a subdirectory, new or cur, of several maildirs as one listing newest first
+// messages that vanish while listing are skipped
+func MergeList(dirs []MailDir, sub string) (entries []MergedEntry, err error) {
+	for _, d := range dirs {
+		var msgs []Message
+		msgs, err = d.listDir(sub)
+		if err != nil {
+			d.wrapErr("merge list", &err)
+			return
+		}
+		for _, msg := range msgs {
+			t, e := d.deliveryTime(sub, msg)
+			if e == nil {
+				entries = append(entries, MergedEntry{Dir: d, Msg: msg, T: t})
+			}
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].T.Equal(entries[j].T) {
+			return entries[i].Msg.Name() > entries[j].Msg.Name()
+		}
+		return entries[i].T.After(entries[j].T)
+	})
+	return
+}
+
+// get when a message was delivered
+// uses the timestamp leading a conventional maildir name like 1500000000.M1P2.host
+// and the file's mtime otherwise
+func (d MailDir) deliveryTime(sub string, msg Message) (t time.Time, err error) {
+	var ok bool
+	if t, ok = msg.Timestamp(); ok {
+		return
+	}
+	var st os.FileInfo
+	st, err = os.Stat(d.subdir(sub, msg))
+	if err == nil {
+		t = st.ModTime()
+	}
+	return
+}
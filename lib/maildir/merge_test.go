@@ -0,0 +1,45 @@
+package maildir
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMergeList(t *testing.T) {
+	work := testMailDir(t)
+	home := testMailDir(t)
+	putMessage(t, work, "cur", "1500000300.M1.host:2,S", "")
+	putMessage(t, work, "cur", "1500000100.M2.host:2,S", "")
+	putMessage(t, home, "cur", "1500000200.M3.host:2,", "")
+	// non conventional name falls back to mtime
+	odd := putMessage(t, home, "cur", "abcdef.host:2,S", "")
+	mtime := time.Unix(1500000250, 0)
+	if err := os.Chtimes(home.Cur(odd.Filepath()), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := MergeList([]MailDir{work, home}, "cur")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		dir MailDir
+		msg Message
+	}{
+		{work, "1500000300.M1.host:2,S"},
+		{home, "abcdef.host:2,S"},
+		{home, "1500000200.M3.host:2,"},
+		{work, "1500000100.M2.host:2,S"},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("got %d entries", len(entries))
+	}
+	for idx, e := range entries {
+		if e.Dir != want[idx].dir || e.Msg != want[idx].msg {
+			t.Fatalf("entry %d was %s in %s", idx, e.Msg, e.Dir)
+		}
+		if idx > 0 && e.T.After(entries[idx-1].T) {
+			t.Fatal("not newest first")
+		}
+	}
+}
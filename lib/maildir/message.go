@@ -1,11 +1,18 @@
 package maildir
 
 import (
+	"strconv"
 	"strings"
+	"time"
 )
 
 type Message string
 
+// make a message name with an info section holding flags
+func infoName(name string, flags []Flag) Message {
+	return Message(name + ":2," + NewFlagSet(flags...).String())
+}
+
 func (m Message) Filepath() string {
 	return string(m)
 }
@@ -15,14 +22,68 @@ func (m Message) Name() string {
 }
 
 // get flags on this message
+// tolerates broken names with repeated info sections or stray commas like name:2,S:2,,F
 func (m Message) GetFlags() (flags []Flag) {
 	s := m.Filepath()
-	if strings.Count(s, ":2,") == 1 {
+	idx := strings.Index(s, ":2,")
+	if idx >= 0 {
 		// we have flags
-		f := strings.Split(s, ",")[1]
-		for _, fl := range f {
-			flags = append(flags, Flag(fl))
+		info := strings.Replace(s[idx+3:], ":2,", "", -1)
+		for _, fl := range info {
+			if fl != ',' {
+				flags = append(flags, Flag(fl))
+			}
+		}
+	}
+	return
+}
+
+// get this message's name with a single info section holding its flags in order
+// names without an info section are returned as is
+func (m Message) Canonical() Message {
+	if !strings.Contains(m.Filepath(), ":2,") {
+		return m
+	}
+	return infoName(m.Name(), m.GetFlags())
+}
+
+// return true if this message's name is in canonical form
+func (m Message) IsCanonical() bool {
+	return m.Canonical() == m
+}
+
+// get flags on this message as a flag set
+func (m Message) Flags() FlagSet {
+	return NewFlagSet(m.GetFlags()...)
+}
+
+// return true if this message has a flag set
+func (m Message) HasFlag(flag Flag) bool {
+	for _, f := range m.GetFlags() {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// get the delivery time leading a conventional name like 1500000000.M1P2.host
+// returns false if the name doesn't start with a unix timestamp
+func (m Message) Timestamp() (t time.Time, ok bool) {
+	name := m.Name()
+	idx := strings.Index(name, ".")
+	if idx <= 0 || idx > 10 || (name[0] == '0' && idx > 1) {
+		return
+	}
+	for _, c := range name[:idx] {
+		if c < '0' || c > '9' {
+			return
 		}
 	}
+	secs, err := strconv.ParseInt(name[:idx], 10, 64)
+	if err == nil {
+		t = time.Unix(secs, 0)
+		ok = true
+	}
 	return
 }
@@ -0,0 +1,91 @@
+package maildir
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// names as written by various delivery agents
+var seedNames = []string{
+	// qmail
+	"1276528487.12345.host.example.com",
+	// dovecot
+	"1276528487.M364837P9451.kurkku,S=1355,W=1394:2,RS",
+	// courier
+	"1276528487.M364837P9451V0000000000000803I00000000000ABCDE_0.host,S=1234:2,",
+	// postfix
+	"1276528487.V803I1a2bM123456.host:2,FS",
+	// ours
+	"3f2a9c01b7e4d5a615000000001234.host",
+	// broken
+	"name:2,S:2,,F",
+	"",
+	":2,",
+}
+
+func TestMessageTimestamp(t *testing.T) {
+	tests := []struct {
+		name string
+		secs int64
+		ok   bool
+	}{
+		{"1276528487.M364837P9451.kurkku:2,S", 1276528487, true},
+		{"0.x", 0, true},
+		{"01.x", 0, false},
+		{"+5.x", 0, false},
+		{"12345678901.x", 0, false},
+		{"3f2a9c01b7e4d5a615000000001234.host", 0, false},
+	}
+	for _, test := range tests {
+		ts, ok := Message(test.name).Timestamp()
+		if ok != test.ok || (ok && ts.Unix() != test.secs) {
+			t.Errorf("%q gave %v %v", test.name, ts, ok)
+		}
+	}
+}
+
+func FuzzParseFlags(f *testing.F) {
+	for _, name := range seedNames {
+		f.Add(name)
+	}
+	f.Fuzz(func(t *testing.T, name string) {
+		m := Message(name)
+		fs := m.Flags()
+		// written out and parsed again they are the same flags
+		again := infoName(m.Name(), fs).Flags()
+		if len(fs) == 0 {
+			fs = nil
+		}
+		if len(again) == 0 {
+			again = nil
+		}
+		if !reflect.DeepEqual(fs, again) {
+			t.Fatalf("%q has flags %q but %q after a round trip", name, fs, again)
+		}
+		if c := m.Canonical(); !c.IsCanonical() {
+			t.Fatalf("canonical name %q of %q is not canonical", c, name)
+		}
+	})
+}
+
+func FuzzMessageTimestamp(f *testing.F) {
+	for _, name := range seedNames {
+		f.Add(name, uint32(1276528487))
+	}
+	f.Fuzz(func(t *testing.T, name string, secs uint32) {
+		// parsing anything is fine as long as it gives back what it parsed
+		if ts, ok := Message(name).Timestamp(); ok {
+			want := fmt.Sprintf("%d.", ts.Unix())
+			if len(name) < len(want) || name[:len(want)] != want {
+				t.Fatalf("%q parsed as %d", name, ts.Unix())
+			}
+		}
+		// a name we make parses back to the time we made it with
+		made := Message(fmt.Sprintf("%d.M1P2.host:2,S", secs))
+		ts, ok := made.Timestamp()
+		if !ok || ts.Unix() != int64(secs) {
+			t.Fatalf("%q parsed as %v %v", made, ts, ok)
+		}
+	})
+}
@@ -0,0 +1,301 @@
+package maildir
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// returned by SetFlags for messages changed since the modseq it was given
+var ErrModified = errors.New("maildir: message modified")
+
+// name of the modseq log in the maildir root
+// each line is <modseq> <unique name> with modseqs growing line by line,
+// so the last line holds the highest
+// it is appended to and every so often compacted to the last line of each message
+const modSeqFile = "bdsmail-modseq.log"
+
+// modseq of messages whose flags never changed and of a maildir with no changes
+const baseModSeq = 1
+
+// how much of the end of the modseq log is read to find the highest modseq
+const modSeqTail = 4096
+
+// the modseq log is compacted each time this many modseqs were given out
+const modSeqCompactEvery = 4096
+
+// note a change of flags, the caller holds the maildir mutex
+// o is the maildir's options, read once by the caller
+// returns the message's new modseq, 0 if the flags are the same or it couldn't be bumped
+func (d MailDir) flagsChanged(o Options, msg Message, old, flags FlagSet) (modseq uint64) {
+	d.recordFlags(o, msg, old, flags)
+	if old.String() != flags.String() {
+		modseq = d.bumpModSeq(msg)
+	}
+	return
+}
+
+// read the last complete line of the modseq log
+// also returns if the log ends in a line torn by a crash
+func lastModSeq(f *os.File) (modseq uint64, torn bool, err error) {
+	modseq = baseModSeq
+	var st os.FileInfo
+	st, err = f.Stat()
+	if err != nil || st.Size() == 0 {
+		return
+	}
+	off := st.Size() - modSeqTail
+	if off < 0 {
+		off = 0
+	}
+	buf := make([]byte, st.Size()-off)
+	_, err = f.ReadAt(buf, off)
+	if err != nil && err != io.EOF {
+		return
+	}
+	err = nil
+	torn = buf[len(buf)-1] != '\n'
+	lines := bytes.Split(bytes.TrimRight(buf, "\n"), []byte("\n"))
+	for idx := len(lines) - 1; idx >= 0; idx-- {
+		if (torn && idx == len(lines)-1) || (off > 0 && idx == 0) {
+			// torn or cut off by where we started reading
+			continue
+		}
+		fields := strings.Fields(string(lines[idx]))
+		if len(fields) != 2 {
+			continue
+		}
+		if n, e := strconv.ParseUint(fields[0], 10, 64); e == nil && n > modseq {
+			modseq = n
+			break
+		}
+	}
+	return
+}
+
+// give a message the next modseq, the caller holds the maildir mutex
+// the change already happened so failures are only logged and give 0
+func (d MailDir) bumpModSeq(msg Message) (modseq uint64) {
+	f, err := os.OpenFile(filepath.Join(d.Filepath(), modSeqFile), os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err == nil {
+		var torn bool
+		modseq, torn, err = lastModSeq(f)
+		if err == nil {
+			modseq++
+			line := strconv.FormatUint(modseq, 10) + " " + msg.Name() + "\n"
+			if torn {
+				// keep the torn line apart so it is skipped
+				line = "\n" + line
+			}
+			_, err = f.WriteString(line)
+		}
+		if e := f.Close(); err == nil {
+			err = e
+		}
+	}
+	if err != nil {
+		log.Warn("failed to bump modseq of ", msg, " in ", d, ": ", err)
+		modseq = 0
+	}
+	if modseq%modSeqCompactEvery == 0 && modseq > 0 {
+		if err = d.compactModSeqs(); err != nil {
+			log.Warn("failed to compact modseq log of ", d, ": ", err)
+		}
+	}
+	return
+}
+
+// rewrite the modseq log with only the last line of each message still here,
+// the caller holds the maildir mutex
+// the line with the highest modseq is always kept so it still ends the log
+func (d MailDir) compactModSeqs() (err error) {
+	var modseqs map[string]uint64
+	modseqs, err = d.ModSeqs()
+	var msgs, newMsgs []Message
+	if err == nil {
+		msgs, err = d.listDir("cur")
+	}
+	if err == nil {
+		newMsgs, err = d.listDir("new")
+	}
+	if err != nil {
+		return
+	}
+	here := make(map[string]bool)
+	for _, msg := range append(msgs, newMsgs...) {
+		here[msg.Name()] = true
+	}
+	var highest uint64
+	names := make([]string, 0, len(modseqs))
+	for name, modseq := range modseqs {
+		names = append(names, name)
+		if modseq > highest {
+			highest = modseq
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return modseqs[names[i]] < modseqs[names[j]]
+	})
+	var buf bytes.Buffer
+	for _, name := range names {
+		if here[name] || modseqs[name] == highest {
+			buf.WriteString(strconv.FormatUint(modseqs[name], 10) + " " + name + "\n")
+		}
+	}
+	fname := filepath.Join(d.Filepath(), modSeqFile)
+	err = ioutil.WriteFile(fname+".tmp", buf.Bytes(), 0600)
+	if err == nil {
+		err = os.Rename(fname+".tmp", fname)
+	}
+	return
+}
+
+// set a message's flags to exactly flags, the caller holds the maildir mutex
+// a message in new is moved to cur when it gets any
+// returns its new modseq, 0 if its flags didn't change
+func (d MailDir) setFlags(o Options, msg Message, flags FlagSet) (m Message, modseq uint64, err error) {
+	// another process may rename it between finding and renaming, try again once
+	for try := 0; try < 2; try++ {
+		var sub string
+		sub, m, err = d.find(msg)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return
+		}
+		var old FlagSet
+		if sub == "cur" {
+			old = m.Flags()
+		} else if len(flags) == 0 {
+			// stays in new
+			return
+		}
+		nm := infoName(m.Name(), flags)
+		if sub == "cur" && nm == m {
+			return
+		}
+		err = os.Rename(d.subdir(sub, m), d.Cur(nm.Filepath()))
+		if err == nil {
+			m = nm
+			modseq = d.flagsChanged(o, m, old, m.Flags())
+			return
+		} else if !os.IsNotExist(err) {
+			return
+		}
+	}
+	m = ""
+	return
+}
+
+// set the flags of messages, each to exactly the flags at the same index
+// a message in new is moved to cur when it gets any
+// with unchangedSince above 0 a message whose modseq is higher is left alone and
+// gets ErrModified, the check and the change are done under the maildir mutex so
+// no one changes the flags in between
+// returns each message as it is named after with its new modseq, the modseq is 0
+// if its flags didn't change and errs holds an error for each message that failed
+// messages that are gone get an error matching os.ErrNotExist
+func (d MailDir) SetFlags(msgs []Message, flags []FlagSet, unchangedSince uint64) (after []Message, modseqs []uint64, errs []error) {
+	mtx := d.mutex()
+	mtx.Lock()
+	defer mtx.Unlock()
+	o := d.options()
+	var current map[string]uint64
+	var err error
+	if unchangedSince > 0 {
+		current, err = d.ModSeqs()
+	}
+	after = make([]Message, len(msgs))
+	modseqs = make([]uint64, len(msgs))
+	errs = make([]error, len(msgs))
+	for idx, msg := range msgs {
+		if err != nil {
+			errs[idx] = err
+			continue
+		}
+		if unchangedSince > 0 && current[msg.Name()] > unchangedSince {
+			after[idx] = msg
+			errs[idx] = ErrModified
+			continue
+		}
+		var e error
+		after[idx], modseqs[idx], e = d.setFlags(o, msg, flags[idx])
+		d.wrapErr("set flags", &e)
+		errs[idx] = e
+	}
+	return
+}
+
+// get the highest modseq given out in this maildir
+// it only grows, every flag change gets a new one
+func (d MailDir) HighestModSeq() (modseq uint64, err error) {
+	defer d.wrapErr("highest modseq", &err)
+	var f *os.File
+	f, err = os.Open(filepath.Join(d.Filepath(), modSeqFile))
+	if os.IsNotExist(err) {
+		modseq = baseModSeq
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	modseq, _, err = lastModSeq(f)
+	return
+}
+
+// get the modseq of every message whose flags changed keyed by unique name
+// messages not in the map have modseq 1, removed messages may still be in it
+func (d MailDir) ModSeqs() (modseqs map[string]uint64, err error) {
+	defer d.wrapErr("modseqs", &err)
+	modseqs = make(map[string]uint64)
+	var f *os.File
+	f, err = os.Open(filepath.Join(d.Filepath(), modSeqFile))
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		n, e := strconv.ParseUint(fields[0], 10, 64)
+		if e != nil {
+			// skip lines torn by a crash
+			continue
+		}
+		modseqs[fields[1]] = n
+	}
+	err = sc.Err()
+	return
+}
+
+// get a message's modseq, 1 if its flags never changed
+// the message may be given with any flags
+func (d MailDir) ModSeq(msg Message) (modseq uint64, err error) {
+	var modseqs map[string]uint64
+	modseqs, err = d.ModSeqs()
+	if err == nil {
+		modseq = modseqs[msg.Name()]
+		if modseq == 0 {
+			modseq = baseModSeq
+		}
+	}
+	return
+}
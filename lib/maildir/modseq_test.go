@@ -0,0 +1,121 @@
+package maildir
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestModSeq(t *testing.T) {
+	d := testMailDir(t)
+	if n, err := d.HighestModSeq(); err != nil || n != 1 {
+		t.Fatalf("highest modseq of an empty maildir is %d, %v", n, err)
+	}
+	msg, err := d.Deliver(strings.NewReader("hi\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := d.Deliver(strings.NewReader("other\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := d.ModSeq(other); n != 1 {
+		t.Fatalf("untouched message has modseq %d", n)
+	}
+	if msg, err = d.AddFlag(msg, Seen); err != nil {
+		t.Fatal(err)
+	}
+	if other, err = d.ProcessNew(other, Flagged); err != nil {
+		t.Fatal(err)
+	}
+	// no change, no new modseq
+	if msg, err = d.AddFlag(msg, Seen); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err = d.RemoveFlag(msg, Seen); err != nil {
+		t.Fatal(err)
+	}
+	modseqs, err := d.ModSeqs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if modseqs[msg.Name()] != 4 || modseqs[other.Name()] != 3 {
+		t.Fatalf("modseqs are %v", modseqs)
+	}
+	if n, _ := d.HighestModSeq(); n != 4 {
+		t.Fatalf("highest modseq is %d", n)
+	}
+	// a line torn by a crash is skipped
+	f, err := os.OpenFile(filepath.Join(d.Filepath(), modSeqFile), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("99")
+	f.Close()
+	if msg, err = d.AddFlag(msg, Flagged); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := d.ModSeq(Message(msg.Name() + ":2,S")); n != 5 {
+		t.Fatalf("modseq after a torn line is %d", n)
+	}
+}
+
+func TestSetFlags(t *testing.T) {
+	d := testMailDir(t)
+	a, _ := d.Deliver(strings.NewReader("a\n"))
+	b, _ := d.Deliver(strings.NewReader("b\n"))
+	after, modseqs, errs := d.SetFlags([]Message{a, b}, []FlagSet{NewFlagSet(Seen), nil}, 0)
+	if errs[0] != nil || errs[1] != nil || !after[0].HasFlag(Seen) || modseqs[0] != 2 {
+		t.Fatalf("set flags gave %v %v %v", after, modseqs, errs)
+	}
+	// no flags leaves a message in new
+	if after[1] != b || modseqs[1] != 0 {
+		t.Fatalf("message without flags became %q with modseq %d", after[1], modseqs[1])
+	}
+	a = after[0]
+	// a changed since 1 so only b is set
+	after, modseqs, errs = d.SetFlags([]Message{a, b}, []FlagSet{nil, NewFlagSet(Flagged)}, 1)
+	if errs[0] != ErrModified || after[0] != a || errs[1] != nil || modseqs[1] != 3 {
+		t.Fatalf("conditional set flags gave %v %v %v", after, modseqs, errs)
+	}
+	d.Remove(a)
+	if _, _, errs = d.SetFlags([]Message{a}, []FlagSet{nil}, 0); !errors.Is(errs[0], os.ErrNotExist) {
+		t.Fatalf("setting flags of a removed message gave %v", errs[0])
+	}
+}
+
+func TestModSeqCompact(t *testing.T) {
+	d := testMailDir(t)
+	msg, _ := d.Deliver(strings.NewReader("hi\n"))
+	gone, _ := d.Deliver(strings.NewReader("gone\n"))
+	gone, _ = d.AddFlag(gone, Seen)
+	d.Remove(gone)
+	var err error
+	for i := 0; i < modSeqCompactEvery; i++ {
+		if i%2 == 0 {
+			msg, err = d.AddFlag(msg, Seen)
+		} else {
+			msg, err = d.RemoveFlag(msg, Seen)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := ioutil.ReadFile(filepath.Join(d.Filepath(), modSeqFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// compacted when the highest reached modSeqCompactEvery, two changes since
+	if lines := strings.Count(string(data), "\n"); lines != 3 {
+		t.Fatalf("compacted log has %d lines:\n%s", lines, data)
+	}
+	if n, _ := d.HighestModSeq(); n != modSeqCompactEvery+2 {
+		t.Fatalf("highest modseq after compacting is %d", n)
+	}
+	if modseqs, _ := d.ModSeqs(); len(modseqs) != 1 || modseqs[msg.Name()] != modSeqCompactEvery+2 {
+		t.Fatalf("modseqs after compacting are %v", modseqs)
+	}
+}
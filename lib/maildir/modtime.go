@@ -0,0 +1,26 @@
+package maildir
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// get the latest modification time of new and cur for cheap change polling
+// both change when a message is delivered, has its flags changed or is removed,
+// so a poller can skip listing while this stays the same
+// changes within the filesystem's timestamp granularity can't be told apart
+func (d MailDir) ModTime() (t time.Time, err error) {
+	defer d.wrapErr("mod time", &err)
+	for _, sub := range []string{"new", "cur"} {
+		var st os.FileInfo
+		st, err = os.Stat(filepath.Join(d.Filepath(), sub))
+		if err != nil {
+			return
+		}
+		if st.ModTime().After(t) {
+			t = st.ModTime()
+		}
+	}
+	return
+}
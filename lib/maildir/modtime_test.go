@@ -0,0 +1,52 @@
+package maildir
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestModTime(t *testing.T) {
+	d := testMailDir(t)
+	// wind the directories back so changes show whatever the timestamp granularity
+	rewind := func() time.Time {
+		past := time.Now().Add(-time.Hour).Truncate(time.Second)
+		for _, sub := range []string{"new", "cur"} {
+			if err := os.Chtimes(filepath.Join(d.Filepath(), sub), past, past); err != nil {
+				t.Fatal(err)
+			}
+		}
+		mt, err := d.ModTime()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !mt.Equal(past) {
+			t.Fatalf("mod time is %s not %s", mt, past)
+		}
+		return mt
+	}
+	before := rewind()
+	msg, err := d.Deliver(strings.NewReader("hi\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mt, _ := d.ModTime(); !mt.After(before) {
+		t.Fatal("mod time didn't advance after a delivery")
+	}
+	if msg, err = d.ProcessNew(msg); err != nil {
+		t.Fatal(err)
+	}
+	before = rewind()
+	if _, err = d.AddFlag(msg, Seen); err != nil {
+		t.Fatal(err)
+	}
+	if mt, _ := d.ModTime(); !mt.After(before) {
+		t.Fatal("mod time didn't advance after a flag change")
+	}
+	if _, err = MailDir(filepath.Join(d.Filepath(), "missing")).ModTime(); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("mod time of a missing maildir gave %v", err)
+	}
+}
@@ -0,0 +1,85 @@
+package maildir
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// where a message was moved from and to
+type MovedMessage struct {
+	Src Message
+	Dst Message
+}
+
+// move messages to another maildir keeping their names, flags and whether they are new
+// messages are moved in order and failures don't stop the rest, the mapping has
+// every message that was moved in the order given and the error joins every failure
+// messages already in dst under the same name are not overwritten
+func (d MailDir) MoveBatch(msgs []Message, dst MailDir) (moved []MovedMessage, err error) {
+	defer d.wrapErr("move batch", &err)
+	if d.Filepath() == dst.Filepath() {
+		err = &os.PathError{Op: "move", Path: dst.Filepath(), Err: os.ErrInvalid}
+		return
+	}
+	// lock both in path order so moves the other way can't deadlock with us
+	first, second := d.mutex(), dst.mutex()
+	if dst.Filepath() < d.Filepath() {
+		first, second = second, first
+	}
+	first.Lock()
+	defer first.Unlock()
+	second.Lock()
+	defer second.Unlock()
+	srcOpts, dstOpts := d.options(), dst.options()
+	var errs []error
+	var gone []Message
+	for _, msg := range msgs {
+		sub, m, e := d.find(msg)
+		var st os.FileInfo
+		if e == nil {
+			st, e = os.Stat(d.subdir(sub, m))
+		}
+		if e == nil {
+			e = moveFile(d.subdir(sub, m), dst.subdir(sub, m))
+		}
+		if e != nil {
+			errs = append(errs, e)
+			continue
+		}
+		moved = append(moved, MovedMessage{Src: m, Dst: m})
+		gone = append(gone, m)
+		// the cached preview is kept by the maildir it was made in
+		os.Remove(d.previewPath(m))
+		d.audit(srcOpts, OpDelete, m)
+		dst.audit(dstOpts, OpDeliver, m)
+		d.updateMaildirSize(srcOpts, -st.Size(), -1)
+		dst.updateMaildirSize(dstOpts, st.Size(), 1)
+	}
+	d.journalExpunges(gone)
+	err = errors.Join(errs...)
+	return
+}
+
+// move a file without replacing anything at dst, copying it across filesystems
+func moveFile(src, dst string) (err error) {
+	err = os.Link(src, dst)
+	if le, ok := err.(*os.LinkError); ok && le.Err == syscall.EXDEV {
+		var st os.FileInfo
+		st, err = os.Stat(src)
+		if err == nil {
+			err = copyFile(src, dst, st.Mode().Perm())
+		}
+		if err == nil {
+			os.Chtimes(dst, st.ModTime(), st.ModTime())
+		}
+	}
+	if err == nil {
+		err = os.Remove(src)
+		if err != nil {
+			// don't leave it in both
+			os.Remove(dst)
+		}
+	}
+	return
+}
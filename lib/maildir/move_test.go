@@ -0,0 +1,76 @@
+package maildir
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMoveBatch(t *testing.T) {
+	d := testMailDir(t)
+	putMessage(t, d, "new", "1.host", "one\r\n")
+	putMessage(t, d, "cur", "2.host:2,FS", "two\r\n")
+	putMessage(t, d, "cur", "3.host:2,R", "three\r\n")
+	dst, err := d.EnsureFolder("Archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(filepath.Dir(d.previewPath("1.host")), 0700)
+	if err = ioutil.WriteFile(d.previewPath("1.host"), []byte("one"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// a stale name is found by its unique part, a missing one is an error
+	moved, err := d.MoveBatch([]Message{"3.host:2,", "missing.host", "1.host", "2.host:2,FS"}, dst)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("moving a missing message gave %v", err)
+	}
+	want := []MovedMessage{{"3.host:2,R", "3.host:2,R"}, {"1.host", "1.host"}, {"2.host:2,FS", "2.host:2,FS"}}
+	if len(moved) != len(want) {
+		t.Fatalf("moved %v", moved)
+	}
+	for idx, m := range moved {
+		if m != want[idx] {
+			t.Fatalf("moved %v", moved)
+		}
+	}
+	if is, _ := dst.IsNew("1.host"); !is {
+		t.Fatal("new message not kept new")
+	}
+	for _, m := range moved {
+		if _, err = dst.resolve(m.Dst); err != nil {
+			t.Fatalf("%s not in destination", m.Dst)
+		}
+		if _, err = d.resolve(m.Src); !os.IsNotExist(err) {
+			t.Fatalf("%s still in source", m.Src)
+		}
+	}
+	if _, err = os.Stat(d.previewPath("1.host")); !os.IsNotExist(err) {
+		t.Fatal("preview left behind in source")
+	}
+}
+
+func TestMoveBatchMaildirSize(t *testing.T) {
+	d := testMailDir(t)
+	dst := testMailDir(t)
+	for _, m := range []MailDir{d, dst} {
+		if err := ioutil.WriteFile(filepath.Join(m.Filepath(), maildirSizeFile), []byte("1000000S\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	msg, err := d.Deliver(strings.NewReader("moved\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = d.MoveBatch([]Message{msg}, dst); err != nil {
+		t.Fatal(err)
+	}
+	if _, size, count := readMaildirSize(t, d); size != 0 || count != 0 {
+		t.Fatalf("source maildirsize has %d bytes in %d messages", size, count)
+	}
+	if _, size, count := readMaildirSize(t, dst); size != int64(len("moved\n")) || count != 1 {
+		t.Fatalf("destination maildirsize has %d bytes in %d messages", size, count)
+	}
+}
@@ -0,0 +1,45 @@
+package maildir
+
+import (
+	"testing"
+)
+
+func TestProcessNewDefault(t *testing.T) {
+	d := testMailDir(t)
+	msg := putMessage(t, d, "new", "1.host", "hi\n")
+	cur, err := d.ProcessNew(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cur != "1.host:2," || len(cur.GetFlags()) != 0 {
+		t.Fatalf("processed to %q", cur)
+	}
+	if is, _ := d.IsCur(cur); !is {
+		t.Fatal("not on disk in cur")
+	}
+	// the old behaviour marks it seen
+	if err = d.SetOptions(Options{ProcessNewDefault: NewFlagSet(Seen)}); err != nil {
+		t.Fatal(err)
+	}
+	if opts, _ := d.Options(); opts.ProcessNewDefault.String() != "S" {
+		t.Fatalf("options read back as %+v", opts)
+	}
+	msg = putMessage(t, d, "new", "2.host", "hi\n")
+	cur, err = d.ProcessNew(msg)
+	if err != nil || cur != "2.host:2,S" {
+		t.Fatalf("processed to %q %v", cur, err)
+	}
+	// given flags win over the default
+	msg = putMessage(t, d, "new", "3.host", "hi\n")
+	cur, err = d.ProcessNew(msg, Flagged)
+	if err != nil || cur != "3.host:2,F" {
+		t.Fatalf("processed to %q %v", cur, err)
+	}
+	// other maildirs don't get it
+	other := testMailDir(t)
+	msg = putMessage(t, other, "new", "4.host", "hi\n")
+	cur, err = other.ProcessNew(msg)
+	if err != nil || cur != "4.host:2," {
+		t.Fatalf("processed to %q %v", cur, err)
+	}
+}
@@ -0,0 +1,47 @@
+package maildir
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"os"
+)
+
+// rename messages in cur with malformed info sections to their canonical names
+// a message is left alone if its canonical name is already taken so distinct
+// messages are never merged
+// returns how many messages were renamed
+func (d MailDir) NormalizeNames() (n int, err error) {
+	defer d.wrapErr("normalize names", &err)
+	mtx := d.mutex()
+	mtx.Lock()
+	defer mtx.Unlock()
+	var msgs []Message
+	msgs, err = d.ListCur()
+	if err != nil {
+		return
+	}
+	for _, msg := range msgs {
+		canon := msg.Canonical()
+		if canon == msg {
+			continue
+		}
+		// link fails instead of clobbering an existing message like rename would
+		err = os.Link(d.Cur(msg.Filepath()), d.Cur(canon.Filepath()))
+		if os.IsExist(err) {
+			log.Warn("not normalizing ", msg, " in ", d, ", ", canon, " already exists")
+			err = nil
+			continue
+		} else if os.IsNotExist(err) {
+			// gone since we listed
+			err = nil
+			continue
+		} else if err != nil {
+			return
+		}
+		err = os.Remove(d.Cur(msg.Filepath()))
+		if err != nil {
+			return
+		}
+		n++
+	}
+	return
+}
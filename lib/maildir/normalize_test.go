@@ -0,0 +1,49 @@
+package maildir
+
+import (
+	"testing"
+)
+
+func TestCanonical(t *testing.T) {
+	for name, canon := range map[Message]Message{
+		"1.host":           "1.host",
+		"1.host:2,S":       "1.host:2,S",
+		"1.host:2,S:2,S":   "1.host:2,S",
+		"1.host:2,,S":      "1.host:2,S",
+		"1.host:2,SF":      "1.host:2,FS",
+		"1.host:2,S:2,,RF": "1.host:2,FRS",
+		"1.host:2,":        "1.host:2,",
+	} {
+		if got := name.Canonical(); got != canon {
+			t.Fatalf("%s canonicalized to %s not %s", name, got, canon)
+		}
+		if name.IsCanonical() != (name == canon) {
+			t.Fatalf("%s IsCanonical was wrong", name)
+		}
+	}
+}
+
+func TestNormalizeNames(t *testing.T) {
+	d := testMailDir(t)
+	putMessage(t, d, "cur", "1.host:2,S:2,S", "one\n")
+	putMessage(t, d, "cur", "2.host:2,,F", "two\n")
+	putMessage(t, d, "cur", "3.host:2,S", "three\n")
+	// would collide with the canonical name of the first one
+	putMessage(t, d, "cur", "4.host:2,S", "four\n")
+	putMessage(t, d, "cur", "4.host:2,S:2,", "four again\n")
+	n, err := d.NormalizeNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("normalized %d names", n)
+	}
+	msgs, _ := d.ListCur()
+	names := map[Message]bool{}
+	for _, msg := range msgs {
+		names[msg] = true
+	}
+	if len(msgs) != 5 || !names["1.host:2,S"] || !names["2.host:2,F"] || !names["3.host:2,S"] || !names["4.host:2,S"] || !names["4.host:2,S:2,"] {
+		t.Fatalf("names after normalizing %v", msgs)
+	}
+}
@@ -0,0 +1,75 @@
+package maildir
+
+import (
+	"encoding/json"
+	log "github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// name of the options file in the maildir root, Options as json
+const optionsFile = "bdsmail-options.json"
+
+// settings of a maildir
+// they are kept in its root so every process and every MailDir naming it
+// uses the same ones, a maildir++ subfolder has its own
+type Options struct {
+	// flags ProcessNew gives messages when called without any
+	// none by default so moving a message to cur doesn't mark it read,
+	// Seen keeps the old behaviour of marking it seen
+	ProcessNewDefault FlagSet `json:"process_new_default,omitempty"`
+	// record every flag change on messages in an append only log in the root
+	FlagHistory bool `json:"flag_history,omitempty"`
+	// record every deliver, process, delete and open in an audit log in the root,
+	// a logger set with WithAuditLogger is used instead
+	Audit bool `json:"audit,omitempty"`
+	// user the audit log records operations as done by
+	AuditUser string `json:"audit_user,omitempty"`
+	// how big maildirsize may grow before Deliver or Remove recalculates it,
+	// 0 for DefaultMaildirSizeLines or DefaultMaildirSizeBytes
+	// only read from the maildir holding maildirsize, not its subfolders
+	MaildirSizeLines int   `json:"maildirsize_lines,omitempty"`
+	MaildirSizeBytes int64 `json:"maildirsize_bytes,omitempty"`
+}
+
+// get the settings of this maildir, the zero Options if none were set
+func (d MailDir) Options() (opts Options, err error) {
+	defer d.wrapErr("options", &err)
+	var data []byte
+	data, err = ioutil.ReadFile(filepath.Join(d.Filepath(), optionsFile))
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &opts)
+	}
+	return
+}
+
+// replace the settings of this maildir
+func (d MailDir) SetOptions(opts Options) (err error) {
+	defer d.wrapErr("set options", &err)
+	var data []byte
+	data, err = json.Marshal(opts)
+	if err == nil {
+		fname := filepath.Join(d.Filepath(), optionsFile)
+		err = ioutil.WriteFile(fname+".tmp", data, 0600)
+		if err == nil {
+			err = os.Rename(fname+".tmp", fname)
+		}
+	}
+	return
+}
+
+// get the settings of this maildir for an operation
+// read once per operation and handed down to what needs them
+// failing to read them is only logged and gives the defaults
+func (d MailDir) options() Options {
+	opts, err := d.Options()
+	if err != nil {
+		log.Warn("failed to read options of ", d, ": ", err)
+	}
+	return opts
+}
@@ -0,0 +1,64 @@
+package maildir
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// deliver bodies with a pool of workers for bulk imports
+// deliveries don't take the maildir lock, unique names and exclusive creation in tmp
+// keep concurrent deliveries from clobbering each other
+// every delivered message is sent on the message channel, which must be read until
+// it is closed, the error channel then gives the first error if there was one
+// delivery stops at the first error or when ctx is done, bodies left unread in
+// the channel are not delivered
+func (d MailDir) ParallelDeliver(ctx context.Context, bodies <-chan io.Reader, workers int) (<-chan Message, <-chan error) {
+	if workers < 1 {
+		workers = 1
+	}
+	msgs := make(chan Message, workers)
+	errs := make(chan error, 1)
+	wctx, cancel := context.WithCancel(ctx)
+	var once sync.Once
+	fail := func(err error) {
+		once.Do(func() {
+			errs <- err
+			cancel()
+		})
+	}
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for wctx.Err() == nil {
+				var body io.Reader
+				var ok bool
+				select {
+				case body, ok = <-bodies:
+				case <-wctx.Done():
+				}
+				if !ok || wctx.Err() != nil {
+					return
+				}
+				msg, err := d.Deliver(body)
+				if err != nil {
+					fail(err)
+					return
+				}
+				msgs <- msg
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		if err := ctx.Err(); err != nil {
+			fail(err)
+		}
+		cancel()
+		close(msgs)
+		close(errs)
+	}()
+	return msgs, errs
+}
@@ -0,0 +1,62 @@
+package maildir
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestParallelDeliver(t *testing.T) {
+	d := testMailDir(t)
+	const count = 200
+	bodies := make(chan io.Reader)
+	go func() {
+		for i := 0; i < count; i++ {
+			bodies <- strings.NewReader(fmt.Sprintf("Subject: %d\r\n\r\nbody\r\n", i))
+		}
+		close(bodies)
+	}()
+	msgs, errs := d.ParallelDeliver(context.Background(), bodies, 8)
+	names := make(map[string]bool)
+	for msg := range msgs {
+		if names[msg.Name()] {
+			t.Fatalf("%s delivered twice", msg)
+		}
+		names[msg.Name()] = true
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != count {
+		t.Fatalf("delivered %d messages", len(names))
+	}
+	listed, err := d.ListNew()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != count {
+		t.Fatalf("%d messages in new", len(listed))
+	}
+	for _, msg := range listed {
+		if !names[msg.Name()] {
+			t.Fatalf("%s was not reported", msg)
+		}
+	}
+}
+
+func TestParallelDeliverCancel(t *testing.T) {
+	d := testMailDir(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	bodies := make(chan io.Reader)
+	msgs, errs := d.ParallelDeliver(ctx, bodies, 4)
+	bodies <- strings.NewReader("Subject: first\r\n\r\nbody\r\n")
+	<-msgs
+	cancel()
+	for range msgs {
+	}
+	if err := <-errs; err != context.Canceled {
+		t.Fatalf("cancelled delivery gave %v", err)
+	}
+}
@@ -0,0 +1,56 @@
+package maildir
+
+import (
+	"io"
+	"os"
+)
+
+// what delivery plugins know about the message being delivered
+type DeliverMeta struct {
+	// size of the body as given to Deliver, -1 if it isn't known up front
+	Size int64
+	// envelope sender and recipient from DeliverOpts
+	Sender    string
+	Recipient string
+}
+
+// a step in delivery like spam checking, signing or rewriting headers
+// it gets the body so far and returns the body to hand to the next plugin
+// an error, either returned or from reading the body it returns, aborts the delivery
+// and nothing is left behind
+type DeliverPlugin func(in io.Reader, meta *DeliverMeta) (io.Reader, error)
+
+// get the size of a body if it can be known without reading it
+func bodySize(body io.Reader) int64 {
+	switch r := body.(type) {
+	case interface{ Len() int }:
+		return int64(r.Len())
+	case *os.File:
+		if st, err := r.Stat(); err == nil && st.Mode().IsRegular() {
+			if off, err := r.Seek(0, io.SeekCurrent); err == nil {
+				return st.Size() - off
+			}
+		}
+	}
+	return -1
+}
+
+// run the plugins in order over a body
+func (opts DeliverOpts) runPlugins(body io.Reader) (r io.Reader, err error) {
+	r = body
+	if len(opts.Plugins) == 0 {
+		return
+	}
+	meta := &DeliverMeta{
+		Size:      bodySize(body),
+		Sender:    opts.Sender,
+		Recipient: opts.Recipient,
+	}
+	for _, p := range opts.Plugins {
+		r, err = p(r, meta)
+		if err != nil {
+			break
+		}
+	}
+	return
+}
@@ -0,0 +1,72 @@
+package maildir
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+var errRejected = errors.New("rejected")
+
+// prepends a header naming the recipient
+func addHeader(in io.Reader, meta *DeliverMeta) (io.Reader, error) {
+	return io.MultiReader(strings.NewReader("X-Delivered-To: "+meta.Recipient+"\n"), in), nil
+}
+
+// rejects mail without the header added above
+func requireHeader(in io.Reader, meta *DeliverMeta) (io.Reader, error) {
+	data, err := ioutil.ReadAll(in)
+	if err == nil && !bytes.HasPrefix(data, []byte("X-Delivered-To:")) {
+		err = errRejected
+	}
+	return bytes.NewReader(data), err
+}
+
+func TestDeliverPlugins(t *testing.T) {
+	d := testMailDir(t)
+	var meta DeliverMeta
+	record := func(in io.Reader, m *DeliverMeta) (io.Reader, error) {
+		meta = *m
+		return in, nil
+	}
+	opts := DeliverOpts{
+		Sender:    "a@remote",
+		Recipient: "b@local",
+		Plugins:   []DeliverPlugin{record, addHeader, requireHeader},
+	}
+	msg, err := d.DeliverWith(strings.NewReader("Subject: hi\n\nbody\n"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Size != 18 || meta.Sender != "a@remote" || meta.Recipient != "b@local" {
+		t.Fatalf("plugins got %+v", meta)
+	}
+	data, err := ioutil.ReadFile(d.New(msg.Filepath()))
+	if err != nil || string(data) != "X-Delivered-To: b@local\nSubject: hi\n\nbody\n" {
+		t.Fatalf("delivered %q %v", data, err)
+	}
+	// the other way around the header isn't there yet so it is rejected
+	d = testMailDir(t)
+	opts.Plugins = []DeliverPlugin{requireHeader, addHeader}
+	_, err = d.DeliverWith(strings.NewReader("Subject: hi\n\nbody\n"), opts)
+	if !errors.Is(err, errRejected) {
+		t.Fatalf("rejected delivery gave %v", err)
+	}
+	assertEmpty(t, d)
+}
+
+func TestDeliverPluginRejectWhileReading(t *testing.T) {
+	d := testMailDir(t)
+	reject := func(in io.Reader, meta *DeliverMeta) (io.Reader, error) {
+		return io.MultiReader(in, iotest.ErrReader(errRejected)), nil
+	}
+	_, err := d.DeliverWith(strings.NewReader("Subject: hi\n\nbody\n"), DeliverOpts{Plugins: []DeliverPlugin{reject}})
+	if !errors.Is(err, errRejected) {
+		t.Fatalf("rejected delivery gave %v", err)
+	}
+	assertEmpty(t, d)
+}
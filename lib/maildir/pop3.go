@@ -0,0 +1,55 @@
+package maildir
+
+import (
+	"os"
+	"sort"
+)
+
+// a message as seen by a pop3 session
+type POP3Entry struct {
+	// unique id listing
+	UIDL string
+	// size in octets
+	Size int64
+	// the message as currently named on disk
+	Msg Message
+}
+
+// get the pop3 unique id listing for this message
+// it is stable across flag changes
+func (m Message) POP3UIDL() string {
+	return m.Name()
+}
+
+// list all messages in new and cur for a pop3 session sorted by UIDL
+func (d MailDir) ListForPOP3() (entries []POP3Entry, err error) {
+	defer d.wrapErr("list for pop3", &err)
+	for _, sub := range []string{"new", "cur"} {
+		var ents []os.DirEntry
+		ents, err = d.entries(sub)
+		if err != nil {
+			return
+		}
+		for _, ent := range ents {
+			msg := Message(ent.Name())
+			var st os.FileInfo
+			st, err = ent.Info()
+			if os.IsNotExist(err) {
+				// moved while we were listing
+				err = nil
+				continue
+			} else if err != nil {
+				return
+			}
+			entries = append(entries, POP3Entry{
+				UIDL: msg.POP3UIDL(),
+				Size: st.Size(),
+				Msg:  msg,
+			})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].UIDL < entries[j].UIDL
+	})
+	return
+}
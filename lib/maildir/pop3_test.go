@@ -0,0 +1,41 @@
+package maildir
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPOP3UIDLStable(t *testing.T) {
+	d := testMailDir(t)
+	body := "Subject: test\r\n\r\nbody\r\n"
+	msg, err := d.Deliver(bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	uidl := msg.POP3UIDL()
+	entries, err := d.ListForPOP3()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].UIDL != uidl || entries[0].Size != int64(len(body)) {
+		t.Fatalf("bad listing %v", entries)
+	}
+	cur, err := d.ProcessNew(msg, Seen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cur.POP3UIDL() != uidl {
+		t.Fatalf("uidl changed from %s to %s", uidl, cur.POP3UIDL())
+	}
+	cur, err = d.ProcessCur(cur, Flagged, Seen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err = d.ListForPOP3()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].UIDL != uidl || entries[0].Msg != cur {
+		t.Fatalf("bad listing after flag change %v", entries)
+	}
+}
@@ -0,0 +1,195 @@
+package maildir
+
+import (
+	"bufio"
+	"encoding/base64"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// most bytes of a message read to make a preview
+const previewReadLimit = 256 * 1024
+
+// directory in the maildir holding cached previews as <unique name>.preview
+// kept out of new and cur so they never look like messages
+const previewDir = "bdsmail-preview"
+
+// most characters in a cached preview, what IMAP PREVIEW asks for
+const cachedPreviewChars = 200
+
+// most bytes in a cached preview
+const cachedPreviewBytes = 256
+
+func (d MailDir) previewPath(msg Message) string {
+	return filepath.Join(d.Filepath(), previewDir, msg.Name()+".preview")
+}
+
+// get a message's preview of at most 200 characters, making it once and caching it
+// the cache is kept by unique name so flag changes don't lose it, a failure
+// to write it is only logged
+func (d MailDir) CachedPreview(msg Message) (preview string, err error) {
+	defer d.wrapErr("cached preview", &err)
+	fname := d.previewPath(msg)
+	var data []byte
+	data, err = ioutil.ReadFile(fname)
+	if err == nil {
+		preview = string(data)
+		return
+	}
+	preview, err = d.Preview(msg, cachedPreviewBytes)
+	if err != nil {
+		return
+	}
+	if runes := []rune(preview); len(runes) > cachedPreviewChars {
+		preview = string(runes[:cachedPreviewChars])
+	}
+	e := os.MkdirAll(filepath.Dir(fname), 0700)
+	if e == nil {
+		e = ioutil.WriteFile(fname+".tmp", []byte(preview), 0600)
+	}
+	if e == nil {
+		e = os.Rename(fname+".tmp", fname)
+	}
+	if e != nil {
+		log.Warn("failed to cache preview of ", msg, " in ", d, ": ", e)
+	}
+	return
+}
+
+// get a short plain text snippet of a message body for list views
+// the first text/plain part is used, or text/html with the tags stripped if there is none
+// whitespace is collapsed and at most maxBytes bytes are returned without splitting a character
+// at most the first 256KiB of the message are read
+func (d MailDir) Preview(msg Message, maxBytes int) (preview string, err error) {
+	defer d.wrapErr("preview", &err)
+	var fname string
+	fname, err = d.resolve(msg)
+	if err != nil {
+		return
+	}
+	var f *os.File
+	f, err = os.Open(fname)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	var m *mail.Message
+	m, err = mail.ReadMessage(bufio.NewReader(io.LimitReader(f, previewReadLimit)))
+	if err != nil {
+		return
+	}
+	text, html := previewEntity(textproto.MIMEHeader(m.Header), m.Body, 0)
+	if text == "" && html != "" {
+		text = stripTags(html)
+	}
+	preview = truncateUTF8(strings.Join(strings.Fields(text), " "), maxBytes)
+	return
+}
+
+// find the first text/plain and text/html content in a mime entity
+// the body may be cut short so decoding errors are ignored
+func previewEntity(hdr textproto.MIMEHeader, body io.Reader, depth int) (text, html string) {
+	mediatype, params, err := mime.ParseMediaType(hdr.Get("Content-Type"))
+	if err != nil {
+		// rfc 2045 default
+		mediatype = "text/plain"
+	}
+	if strings.HasPrefix(mediatype, "multipart/") {
+		if params["boundary"] == "" || depth > 8 {
+			return
+		}
+		mr := multipart.NewReader(body, params["boundary"])
+		for text == "" {
+			p, err := mr.NextPart()
+			if err != nil {
+				break
+			}
+			t, h := previewEntity(p.Header, p, depth+1)
+			text = t
+			if html == "" {
+				html = h
+			}
+		}
+		return
+	}
+	if mediatype != "text/plain" && mediatype != "text/html" {
+		return
+	}
+	switch strings.ToLower(strings.TrimSpace(hdr.Get("Content-Transfer-Encoding"))) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, &newlineStripper{r: body})
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	data, _ := ioutil.ReadAll(body)
+	if mediatype == "text/plain" {
+		text = string(data)
+	} else {
+		html = string(data)
+	}
+	return
+}
+
+// drops line breaks so base64 wrapped at 76 columns decodes
+type newlineStripper struct {
+	r io.Reader
+}
+
+func (n *newlineStripper) Read(p []byte) (int, error) {
+	c, err := n.r.Read(p)
+	out := p[:0]
+	for _, b := range p[:c] {
+		if b != '\r' && b != '\n' {
+			out = append(out, b)
+		}
+	}
+	return len(out), err
+}
+
+// crudely turn html into text by dropping tags, style and script content
+func stripTags(html string) string {
+	var sb strings.Builder
+	lower := strings.ToLower(html)
+	for idx := 0; idx < len(html); {
+		if html[idx] != '<' {
+			sb.WriteByte(html[idx])
+			idx++
+			continue
+		}
+		for _, skip := range []string{"style", "script"} {
+			if strings.HasPrefix(lower[idx+1:], skip) {
+				if end := strings.Index(lower[idx:], "</"+skip); end > 0 {
+					idx += end
+				}
+			}
+		}
+		end := strings.IndexByte(html[idx:], '>')
+		if end < 0 {
+			break
+		}
+		idx += end + 1
+		sb.WriteByte(' ')
+	}
+	return strings.NewReplacer("&nbsp;", " ", "&amp;", "&", "&lt;", "<", "&gt;", ">", "&quot;", `"`, "&#39;", "'").Replace(sb.String())
+}
+
+// cut a string to at most max bytes without splitting a character
+func truncateUTF8(str string, max int) string {
+	if max < 0 || len(str) <= max {
+		return str
+	}
+	for max > 0 && !utf8.RuneStart(str[max]) {
+		max--
+	}
+	return str[:max]
+}
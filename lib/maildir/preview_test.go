@@ -0,0 +1,88 @@
+package maildir
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPreviewPlain(t *testing.T) {
+	d := testMailDir(t)
+	msg := putMessage(t, d, "new", "1.host", "Subject: hi\nContent-Transfer-Encoding: quoted-printable\n\nH=C3=A9llo there,\n\n  how are   you doing today?\n")
+	p, err := d.Preview(msg, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != "Héllo there, how are you doing today?" {
+		t.Fatalf("preview was %q", p)
+	}
+	// cut without splitting the é
+	p, err = d.Preview(msg, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != "H" {
+		t.Fatalf("short preview was %q", p)
+	}
+}
+
+func TestPreviewMultipart(t *testing.T) {
+	d := testMailDir(t)
+	body := "Subject: hi\nMIME-Version: 1.0\nContent-Type: multipart/alternative; boundary=xyz\n\n" +
+		"--xyz\nContent-Type: text/html\n\n<html><style>p{}</style><p>html <b>version</b></p></html>\n" +
+		"--xyz\nContent-Type: text/plain; charset=utf-8\nContent-Transfer-Encoding: base64\n\ndGV4dCB2ZXJz\naW9uIGhlcmU=\n" +
+		"--xyz--\n"
+	msg := putMessage(t, d, "cur", "2.host:2,S", body)
+	p, err := d.Preview(msg, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != "text vers" {
+		t.Fatalf("preview was %q", p)
+	}
+	// html only
+	html := "Subject: hi\nContent-Type: text/html\n\n<p>only &amp; html</p>\n"
+	msg = putMessage(t, d, "cur", "3.host:2,S", html)
+	p, err = d.Preview(msg, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != "only & html" {
+		t.Fatalf("html preview was %q", p)
+	}
+}
+
+func TestCachedPreview(t *testing.T) {
+	d := testMailDir(t)
+	msg := putMessage(t, d, "cur", "1.host:2,S", "Subject: hi\n\n"+strings.Repeat("é", 300)+"\n")
+	p, err := d.CachedPreview(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != strings.Repeat("é", 128) {
+		t.Fatalf("preview was %q", p)
+	}
+	if _, err = os.Stat(d.previewPath(msg)); err != nil {
+		t.Fatal("preview not cached")
+	}
+	// the cache is used even with other flags
+	if err = ioutil.WriteFile(d.previewPath(msg), []byte("cached"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ = d.CachedPreview(Message("1.host:2,FS")); p != "cached" {
+		t.Fatalf("cached preview was %q", p)
+	}
+	if msg, err = d.Replace(msg, strings.NewReader("Subject: hi\n\nnew text\n")); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ = d.CachedPreview(msg); p != "new text" {
+		t.Fatalf("preview after replacing was %q", p)
+	}
+	if err = d.Remove(msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(d.previewPath(msg)); !os.IsNotExist(err) {
+		t.Fatal("cached preview left after removal")
+	}
+}
@@ -0,0 +1,33 @@
+package maildir
+
+import (
+	"fmt"
+)
+
+// create a maildir at root, or take over an existing one, with a fresh uid list
+// using uidValidity, which must be above the uidvalidity of any uid list already there
+// so imap clients throw away what they know about the old mailbox
+func Provision(root string, uidValidity uint32) (d MailDir, err error) {
+	d = MailDir(root)
+	defer d.wrapErr("provision", &err)
+	if uidValidity == 0 {
+		err = fmt.Errorf("maildir: uidvalidity must not be 0")
+		return
+	}
+	err = d.Ensure()
+	if err != nil {
+		return
+	}
+	mtx := d.mutex()
+	mtx.Lock()
+	defer mtx.Unlock()
+	var old *UIDList
+	old, err = d.UIDList()
+	if err == nil && old.Validity >= uidValidity {
+		err = fmt.Errorf("maildir: uidvalidity %d is not above %d already used", uidValidity, old.Validity)
+	}
+	if err == nil {
+		err = d.SaveUIDList(&UIDList{Validity: uidValidity, Next: 1})
+	}
+	return
+}
@@ -0,0 +1,44 @@
+package maildir
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestProvision(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "mailbox")
+	d, err := Provision(root, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := d.UIDList()
+	if err != nil || l.Validity != 100 || l.Next != 1 || len(l.Entries) != 0 {
+		t.Fatalf("fresh uid list %+v %v", l, err)
+	}
+	msg, err := d.Deliver(strings.NewReader("hi\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Add(msg)
+	if err = d.SaveUIDList(l); err != nil {
+		t.Fatal(err)
+	}
+	// same or lower validity is refused and changes nothing
+	for _, v := range []uint32{0, 99, 100} {
+		if _, err = Provision(root, v); err == nil {
+			t.Fatalf("provisioned again with %d", v)
+		}
+	}
+	if l, _ = d.UIDList(); l.Validity != 100 || len(l.Entries) != 1 {
+		t.Fatalf("refused provision changed uid list to %+v", l)
+	}
+	d, err = Provision(root, 101)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err = d.UIDList()
+	if err != nil || l.Validity != 101 || l.Next != 1 || len(l.Entries) != 0 {
+		t.Fatalf("reprovisioned uid list %+v %v", l, err)
+	}
+}
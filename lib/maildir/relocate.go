@@ -0,0 +1,78 @@
+package maildir
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// move this whole maildir including subfolders and index files to a new path
+// refuses to overwrite anything already at newPath
+// falls back to copying when newPath is on another filesystem
+// returns the maildir at its new location
+func (d MailDir) RelocateTo(newPath string) (nd MailDir, err error) {
+	defer d.wrapErr("relocate", &err)
+	nd = MailDir(newPath)
+	dst := nd.Filepath()
+	_, err = os.Lstat(dst)
+	if err == nil {
+		err = &os.PathError{Op: "relocate", Path: dst, Err: os.ErrExist}
+	} else if os.IsNotExist(err) {
+		src := d.Filepath()
+		err = os.Rename(src, dst)
+		if le, ok := err.(*os.LinkError); ok && le.Err == syscall.EXDEV {
+			// other filesystem
+			err = copyTree(src, dst)
+			if err == nil {
+				err = os.RemoveAll(src)
+			} else {
+				// don't leave half a copy behind
+				os.RemoveAll(dst)
+			}
+		}
+	}
+	if err != nil {
+		nd = ""
+	}
+	return
+}
+
+// recursively copy a directory tree keeping file modes and times
+func copyTree(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.Mkdir(target, info.Mode().Perm())
+		}
+		err = copyFile(path, target, info.Mode().Perm())
+		if err == nil {
+			err = os.Chtimes(target, info.ModTime(), info.ModTime())
+		}
+		return err
+	})
+}
+
+// copy a single file, the target must not exist
+func copyFile(src, dst string, mode os.FileMode) (err error) {
+	var in, out *os.File
+	in, err = os.Open(src)
+	if err == nil {
+		defer in.Close()
+		out, err = os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+		if err == nil {
+			_, err = io.Copy(out, in)
+			if e := out.Close(); err == nil {
+				err = e
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,46 @@
+package maildir
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRelocateTo(t *testing.T) {
+	d := testMailDir(t)
+	putMessage(t, d, "cur", "1.host:2,S", "body\r\n")
+	if _, err := d.EnsureFolder("Sent"); err != nil {
+		t.Fatal(err)
+	}
+	target := filepath.Join(t.TempDir(), "renamed")
+	nd, err := d.RelocateTo(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nd.Filepath() != target {
+		t.Fatalf("relocated to %s", nd)
+	}
+	if _, err = os.Stat(d.Filepath()); !os.IsNotExist(err) {
+		t.Fatal("old maildir still exists")
+	}
+	is, _ := nd.IsCur("1.host:2,S")
+	if !is {
+		t.Fatal("message not relocated")
+	}
+	if _, err = os.Stat(filepath.Join(nd.Folder("Sent").Filepath(), "maildirfolder")); err != nil {
+		t.Fatal("subfolder not relocated")
+	}
+}
+
+func TestRelocateToExisting(t *testing.T) {
+	d := testMailDir(t)
+	other := testMailDir(t)
+	_, err := d.RelocateTo(other.String())
+	if !errors.Is(err, os.ErrExist) {
+		t.Fatalf("relocating over existing maildir gave %v", err)
+	}
+	if _, err = os.Stat(d.Filepath()); err != nil {
+		t.Fatal("refused relocation removed the maildir")
+	}
+}
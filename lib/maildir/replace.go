@@ -0,0 +1,36 @@
+package maildir
+
+import (
+	"io"
+	"os"
+)
+
+// replace the content of a message keeping its name, so its unique id and flags stay the same
+// the new content is written to tmp and renamed over the old file so readers
+// see either the old or the new content, never a mix
+// returns the message as it is currently named
+func (d MailDir) Replace(msg Message, newBody io.Reader) (m Message, err error) {
+	defer d.wrapErr("replace", &err)
+	mtx := d.mutex()
+	mtx.Lock()
+	defer mtx.Unlock()
+	var sub string
+	sub, m, err = d.find(msg)
+	if err == nil {
+		var fname string
+		fname, err = d.writeTemp(newBody)
+		if err == nil {
+			err = os.Rename(d.Temp(fname), d.subdir(sub, m))
+			if err == nil {
+				// the cached preview is of the old content
+				os.Remove(d.previewPath(m))
+			} else {
+				os.Remove(d.Temp(fname))
+			}
+		}
+	}
+	if err != nil {
+		m = ""
+	}
+	return
+}
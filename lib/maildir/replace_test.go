@@ -0,0 +1,43 @@
+package maildir
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestReplace(t *testing.T) {
+	d := testMailDir(t)
+	msg, err := d.Deliver(bytes.NewBufferString("Subject: old\r\n\r\nold body\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err = d.ProcessNew(msg, Seen, Flagged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := d.Replace(msg, bytes.NewBufferString("Subject: new\r\n\r\nnew body\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m != msg {
+		t.Fatalf("replaced message renamed from %s to %s", msg, m)
+	}
+	r, err := d.OpenMessage(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	b, _ := ioutil.ReadAll(r)
+	if string(b) != "Subject: new\r\n\r\nnew body\r\n" {
+		t.Fatalf("replaced content is %q", b)
+	}
+	msgs, _ := d.ListCur()
+	if len(msgs) != 1 {
+		t.Fatalf("cur has %d messages", len(msgs))
+	}
+	tmp, _ := ioutil.ReadDir(d.Temp(""))
+	if len(tmp) != 0 {
+		t.Fatal("tmp not empty")
+	}
+}
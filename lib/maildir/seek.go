@@ -0,0 +1,41 @@
+package maildir
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// returned when a message is stored compressed and can't be seeked
+var ErrCompressed = errors.New("maildir: message is stored compressed")
+
+// open a message in either cur or new directory for random access
+// messages stored gzip compressed give ErrCompressed
+func (d MailDir) OpenSeekable(msg Message) (r io.ReadSeekCloser, err error) {
+	defer d.wrapErr("open seekable", &err)
+	var fname string
+	fname, err = d.resolve(msg)
+	if err != nil {
+		return
+	}
+	var f *os.File
+	f, err = os.Open(fname)
+	if err != nil {
+		return
+	}
+	// look for the gzip magic
+	magic := make([]byte, 2)
+	n, _ := io.ReadFull(f, magic)
+	if n == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		f.Close()
+		err = ErrCompressed
+		return
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err == nil {
+		r = f
+	} else {
+		f.Close()
+	}
+	return
+}
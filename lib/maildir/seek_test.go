@@ -0,0 +1,33 @@
+package maildir
+
+import (
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestOpenSeekable(t *testing.T) {
+	d := testMailDir(t)
+	putMessage(t, d, "new", "1.host", "Subject: partial\n\n0123456789\n")
+	putMessage(t, d, "cur", "2.host:2,S", "\x1f\x8bcompressed")
+	r, err := d.OpenSeekable("1.host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	// like BODY[]<21.4>
+	if _, err = r.Seek(21, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 4)
+	if _, err = io.ReadFull(r, b); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "3456" {
+		t.Fatalf("read %q", b)
+	}
+	_, err = d.OpenSeekable("2.host:2,S")
+	if !errors.Is(err, ErrCompressed) {
+		t.Fatalf("compressed message gave %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+package maildir
+
+import (
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// returned by a snapshot for a message that was removed after the snapshot was taken
+var ErrVanished = errors.New("maildir: message vanished since snapshot")
+
+// the messages in a maildir at a point in time
+// renames after the snapshot are followed, removals give ErrVanished
+type Snapshot struct {
+	dir MailDir
+	// when the snapshot was taken
+	taken time.Time
+	// captured messages in listing order
+	msgs []Message
+	// subdirectory each captured message was in keyed by unique name
+	subs map[string]string
+}
+
+// capture the messages in new and cur
+func (d MailDir) Snapshot() (s *Snapshot, err error) {
+	defer d.wrapErr("snapshot", &err)
+	snap := &Snapshot{
+		dir:   d,
+		taken: time.Now(),
+		subs:  make(map[string]string),
+	}
+	for _, sub := range []string{"new", "cur"} {
+		var msgs []Message
+		msgs, err = d.listDir(sub)
+		if err != nil {
+			return
+		}
+		for _, msg := range msgs {
+			snap.msgs = append(snap.msgs, msg)
+			snap.subs[msg.Name()] = sub
+		}
+	}
+	s = snap
+	return
+}
+
+// get the maildir this snapshot was taken of
+func (s *Snapshot) Dir() MailDir {
+	return s.dir
+}
+
+// get when this snapshot was taken
+func (s *Snapshot) Time() time.Time {
+	return s.taken
+}
+
+// list messages as they were named when the snapshot was taken
+func (s *Snapshot) List() (msgs []Message) {
+	msgs = append(msgs, s.msgs...)
+	return
+}
+
+// open a message from the snapshot by the name it had when the snapshot was taken
+// returns ErrVanished if it has been removed since
+func (s *Snapshot) Open(msg Message) (r io.ReadCloser, err error) {
+	defer s.dir.wrapErr("snapshot open", &err)
+	sub, ok := s.subs[msg.Name()]
+	if !ok {
+		err = &os.PathError{Op: "open", Path: s.dir.Cur(msg.Name()), Err: os.ErrNotExist}
+		return
+	}
+	r, err = os.Open(s.dir.subdir(sub, msg))
+	if os.IsNotExist(err) {
+		// flags changed or it was processed, look for where it went
+		var m Message
+		sub, m, err = s.dir.find(msg)
+		if err == nil {
+			r, err = os.Open(s.dir.subdir(sub, m))
+		}
+		if os.IsNotExist(err) {
+			err = ErrVanished
+		}
+	}
+	return
+}
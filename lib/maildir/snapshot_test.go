@@ -0,0 +1,50 @@
+package maildir
+
+import (
+	"errors"
+	"io/ioutil"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	d := testMailDir(t)
+	putMessage(t, d, "new", "1.host", "one\n")
+	putMessage(t, d, "cur", "2.host:2,S", "two\n")
+	putMessage(t, d, "cur", "3.host:2,", "three\n")
+	s, err := d.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// change things under the snapshot
+	if _, err = d.AddFlag("2.host:2,S", Flagged); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = d.ProcessNew("1.host"); err != nil {
+		t.Fatal(err)
+	}
+	if err = d.Remove("3.host:2,"); err != nil {
+		t.Fatal(err)
+	}
+	names := map[Message]bool{}
+	for _, msg := range s.List() {
+		names[msg] = true
+	}
+	if len(names) != 3 || !names["1.host"] || !names["2.host:2,S"] || !names["3.host:2,"] {
+		t.Fatalf("snapshot listing was %v", s.List())
+	}
+	for msg, body := range map[Message]string{"1.host": "one\n", "2.host:2,S": "two\n"} {
+		r, err := s.Open(msg)
+		if err != nil {
+			t.Fatalf("open %s: %s", msg, err)
+		}
+		b, _ := ioutil.ReadAll(r)
+		r.Close()
+		if string(b) != body {
+			t.Fatalf("%s read %q", msg, b)
+		}
+	}
+	_, err = s.Open("3.host:2,")
+	if !errors.Is(err, ErrVanished) {
+		t.Fatalf("removed message gave %v", err)
+	}
+}
@@ -0,0 +1,160 @@
+package maildir
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// storage backend used to put messages into maildirs
+type Store interface {
+	// deliver a message into the new directory of a maildir
+	Deliver(d MailDir, body io.Reader) (Message, error)
+	// remove a message from a maildir
+	Remove(d MailDir, msg Message) error
+}
+
+// store that writes every message straight into its maildir
+type FileStore struct{}
+
+func (FileStore) Deliver(d MailDir, body io.Reader) (Message, error) {
+	return d.Deliver(body)
+}
+
+func (FileStore) Remove(d MailDir, msg Message) error {
+	return d.Remove(msg)
+}
+
+// content addressed store that keeps one copy of each distinct message in
+// a shared pool directory and hard links it into every maildir it is
+// delivered to, the pool must be on the same filesystem as the maildirs
+type PoolStore string
+
+// get absolute filepath for this pool
+func (p PoolStore) Filepath() (str string) {
+	str, _ = filepath.Abs(string(p))
+	return
+}
+
+// ensure the pool directory exists
+func (p PoolStore) Ensure() (err error) {
+	err = os.MkdirAll(filepath.Join(p.Filepath(), "tmp"), 0700)
+	return
+}
+
+// get the path of the blob for a content hash
+func (p PoolStore) blob(h []byte) string {
+	str := hex.EncodeToString(h)
+	return filepath.Join(p.Filepath(), str[:2], str[2:])
+}
+
+// deliver a message into the pool and hard link it into the new directory of a maildir
+func (p PoolStore) Deliver(d MailDir, body io.Reader) (msg Message, err error) {
+	defer d.wrapErr("deliver", &err)
+	var f *os.File
+	f, err = os.CreateTemp(filepath.Join(p.Filepath(), "tmp"), "blob")
+	if err != nil {
+		return
+	}
+	tmp := f.Name()
+	// the tmp file holds the content until the maildir has a link to it
+	defer os.Remove(tmp)
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), body)
+	f.Close()
+	if err == nil {
+		blob := p.blob(h.Sum(nil))
+		err = os.MkdirAll(filepath.Dir(blob), 0700)
+		fname := d.tempName()
+		for err == nil {
+			// put blob in the pool unless we already have it
+			err = os.Link(tmp, blob)
+			if os.IsExist(err) {
+				err = nil
+			}
+			if err == nil {
+				err = os.Link(blob, d.Temp(fname))
+				if os.IsNotExist(err) {
+					// the blob was released under us, put it back
+					err = nil
+					continue
+				}
+			}
+			break
+		}
+		if err == nil {
+			err = os.Rename(d.Temp(fname), d.New(fname))
+			if err == nil {
+				msg = Message(fname)
+			} else {
+				os.Remove(d.Temp(fname))
+			}
+		}
+	}
+	return
+}
+
+// remove a message from a maildir and its blob from the pool if nothing else links to it
+func (p PoolStore) Remove(d MailDir, msg Message) (err error) {
+	defer d.wrapErr("remove", &err)
+	var fname string
+	fname, err = d.resolve(msg)
+	if err == nil {
+		var f *os.File
+		f, err = os.Open(fname)
+		if err == nil {
+			h := sha256.New()
+			_, err = io.Copy(h, f)
+			f.Close()
+			if err == nil {
+				err = os.Remove(fname)
+				if err == nil {
+					err = p.release(p.blob(h.Sum(nil)))
+				}
+			}
+		}
+	}
+	return
+}
+
+// remove a blob if the pool holds the only link to it
+func (p PoolStore) release(blob string) (err error) {
+	var st os.FileInfo
+	st, err = os.Stat(blob)
+	if os.IsNotExist(err) {
+		err = nil
+	} else if err == nil {
+		if count, ok := links(st); ok && count <= 1 {
+			err = os.Remove(blob)
+		}
+	}
+	return
+}
+
+// remove all blobs that are no longer linked into any maildir
+// this catches messages removed without going through the pool
+// returns the number of blobs removed
+func (p PoolStore) Collect() (n int, err error) {
+	root := p.Filepath()
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path == filepath.Join(root, "tmp") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if count, ok := links(info); ok && count <= 1 {
+			err = os.Remove(path)
+			if err == nil {
+				n++
+			}
+		}
+		return err
+	})
+	return
+}
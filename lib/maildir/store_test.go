@@ -0,0 +1,62 @@
+package maildir
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// count blobs held in a pool
+func countBlobs(t *testing.T, p PoolStore) (n int) {
+	filepath.Walk(p.Filepath(), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.IsDir() {
+			n++
+		}
+		return nil
+	})
+	return
+}
+
+func TestPoolStoreDedup(t *testing.T) {
+	p := PoolStore(t.TempDir())
+	if err := p.Ensure(); err != nil {
+		t.Fatal(err)
+	}
+	a := testMailDir(t)
+	b := testMailDir(t)
+	body := "Subject: newsletter\r\n\r\nsame for everyone\r\n"
+	var s Store = p
+	ma, err := s.Deliver(a, bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mb, err := s.Deliver(b, bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := countBlobs(t, p); n != 1 {
+		t.Fatalf("pool has %d blobs", n)
+	}
+	sa, _ := os.Stat(a.New(ma.Filepath()))
+	sb, _ := os.Stat(b.New(mb.Filepath()))
+	if !os.SameFile(sa, sb) {
+		t.Fatal("messages are not linked to the same blob")
+	}
+
+	if err = s.Remove(a, ma); err != nil {
+		t.Fatal(err)
+	}
+	if n := countBlobs(t, p); n != 1 {
+		t.Fatalf("blob removed while still linked, pool has %d blobs", n)
+	}
+	if err = s.Remove(b, mb); err != nil {
+		t.Fatal(err)
+	}
+	if n := countBlobs(t, p); n != 0 {
+		t.Fatalf("pool has %d blobs after removing all messages", n)
+	}
+}
@@ -0,0 +1,64 @@
+package maildir
+
+import (
+	"sort"
+	"time"
+)
+
+// bring the uid list in line with the messages on disk in one scan
+// every message in new and cur gets a uid, listed names are updated to
+// the message's current flags and messages that are gone are dropped
+// new messages get uids in delivery order
+func (d MailDir) SyncUIDs() (err error) {
+	defer d.wrapErr("sync uids", &err)
+	mtx := d.mutex()
+	mtx.Lock()
+	defer mtx.Unlock()
+	var l *UIDList
+	l, err = d.UIDList()
+	if err != nil {
+		return
+	}
+	// current name of each live message by unique name
+	live := make(map[string]Message)
+	type unlisted struct {
+		msg Message
+		t   time.Time
+	}
+	var added []unlisted
+	idx := l.index()
+	for _, sub := range []string{"new", "cur"} {
+		var msgs []Message
+		msgs, err = d.listDir(sub)
+		if err != nil {
+			return
+		}
+		for _, msg := range msgs {
+			live[msg.Name()] = msg
+			if _, ok := idx[msg.Name()]; !ok {
+				t, _ := d.deliveryTime(sub, msg)
+				added = append(added, unlisted{msg, t})
+			}
+		}
+	}
+	entries := l.Entries[:0]
+	for _, e := range l.Entries {
+		if msg, ok := live[Message(e.Name).Name()]; ok {
+			e.Name = msg.Filepath()
+			entries = append(entries, e)
+		}
+	}
+	l.Entries = entries
+	l.byName = nil
+	sort.Slice(added, func(i, j int) bool {
+		if added[i].t.Equal(added[j].t) {
+			return added[i].msg.Name() < added[j].msg.Name()
+		}
+		return added[i].t.Before(added[j].t)
+	})
+	for _, u := range added {
+		l.Add(u.msg)
+	}
+	err = d.SaveUIDList(l)
+	return
+}
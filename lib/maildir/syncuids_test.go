@@ -0,0 +1,74 @@
+package maildir
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyncUIDs(t *testing.T) {
+	d := testMailDir(t)
+	var msgs []Message
+	for i := 0; i < 3; i++ {
+		msg, err := d.Deliver(strings.NewReader("hi\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// delivered a second apart
+		mt := time.Now().Add(time.Duration(i-10) * time.Second)
+		os.Chtimes(d.New(msg.Filepath()), mt, mt)
+		msgs = append(msgs, msg)
+	}
+	if err := d.SyncUIDs(); err != nil {
+		t.Fatal(err)
+	}
+	l, err := d.UIDList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, msg := range msgs {
+		if uid, ok := l.UID(msg); !ok || uid != uint32(i+1) {
+			t.Fatalf("message %d has uid %d %v", i, uid, ok)
+		}
+	}
+	// change flags and remove one
+	m0, err := d.ProcessNew(msgs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	m0, err = d.AddFlag(m0, Flagged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m2, err := d.ProcessNew(msgs[2], Replied)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = d.Remove(msgs[1]); err != nil {
+		t.Fatal(err)
+	}
+	m3, err := d.Deliver(strings.NewReader("later\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = d.SyncUIDs(); err != nil {
+		t.Fatal(err)
+	}
+	l, err = d.UIDList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []UIDEntry{{UID: 1, Name: m0.Filepath()}, {UID: 3, Name: m2.Filepath()}, {UID: 4, Name: m3.Filepath()}}
+	if len(l.Entries) != len(want) {
+		t.Fatalf("entries %+v", l.Entries)
+	}
+	for i, e := range l.Entries {
+		if e.UID != want[i].UID || e.Name != want[i].Name {
+			t.Errorf("entry %d is %+v not %+v", i, e, want[i])
+		}
+	}
+	if l.Next != 5 {
+		t.Fatalf("next uid is %d", l.Next)
+	}
+}
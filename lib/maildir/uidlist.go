@@ -0,0 +1,235 @@
+package maildir
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// returned when a uid list isn't in dovecot's version 3 format
+var ErrBadUIDList = errors.New("maildir: bad dovecot-uidlist")
+
+// name of the uid list in the maildir root, shared with dovecot
+const uidListFile = "dovecot-uidlist"
+
+// a message's line in a uid list
+type UIDEntry struct {
+	UID uint32
+	// extension fields like W1394 kept as is
+	Ext []string
+	// file name the message had when it was listed, flags may have changed since
+	Name string
+}
+
+// uids assigned to messages in a maildir, in dovecot-uidlist version 3 format
+type UIDList struct {
+	// uidvalidity of the mailbox
+	Validity uint32
+	// next uid to assign
+	Next uint32
+	// mailbox guid, may be empty
+	GUID string
+	// other header fields kept as is
+	Ext []string
+	// entries in ascending uid order
+	Entries []UIDEntry
+	// index of each entry keyed by unique name, built when needed
+	byName map[string]int
+}
+
+// parse a uid list in dovecot-uidlist version 3 format
+func ReadUIDList(r io.Reader) (l *UIDList, err error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1024*1024)
+	if !sc.Scan() {
+		err = sc.Err()
+		if err == nil {
+			err = ErrBadUIDList
+		}
+		return
+	}
+	fields := strings.Fields(sc.Text())
+	if len(fields) == 0 || fields[0] != "3" {
+		err = ErrBadUIDList
+		return
+	}
+	l = new(UIDList)
+	for _, f := range fields[1:] {
+		var n uint64
+		switch f[0] {
+		case 'V':
+			n, err = strconv.ParseUint(f[1:], 10, 32)
+			l.Validity = uint32(n)
+		case 'N':
+			n, err = strconv.ParseUint(f[1:], 10, 32)
+			l.Next = uint32(n)
+		case 'G':
+			l.GUID = f[1:]
+		default:
+			l.Ext = append(l.Ext, f)
+		}
+		if err != nil {
+			err = ErrBadUIDList
+			return
+		}
+	}
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" {
+			continue
+		}
+		idx := strings.Index(line, ":")
+		if idx < 1 {
+			err = ErrBadUIDList
+			return
+		}
+		fields = strings.Fields(line[:idx])
+		if len(fields) == 0 {
+			err = ErrBadUIDList
+			return
+		}
+		var uid uint64
+		uid, err = strconv.ParseUint(fields[0], 10, 32)
+		if err != nil || uid == 0 {
+			err = ErrBadUIDList
+			return
+		}
+		e := UIDEntry{UID: uint32(uid), Name: line[idx+1:]}
+		if len(fields) > 1 {
+			e.Ext = fields[1:]
+		}
+		l.Entries = append(l.Entries, e)
+		if e.UID >= l.Next {
+			l.Next = e.UID + 1
+		}
+	}
+	err = sc.Err()
+	if l.Next == 0 {
+		l.Next = 1
+	}
+	return
+}
+
+// write the uid list in dovecot-uidlist version 3 format
+func (l *UIDList) WriteTo(w io.Writer) (n int64, err error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "3 V%d N%d", l.Validity, l.Next)
+	if l.GUID != "" {
+		buf.WriteString(" G" + l.GUID)
+	}
+	for _, f := range l.Ext {
+		buf.WriteString(" " + f)
+	}
+	buf.WriteString("\n")
+	for _, e := range l.Entries {
+		buf.WriteString(strconv.FormatUint(uint64(e.UID), 10))
+		for _, f := range e.Ext {
+			buf.WriteString(" " + f)
+		}
+		buf.WriteString(" :" + e.Name + "\n")
+	}
+	return buf.WriteTo(w)
+}
+
+// get the index of entries keyed by unique name, which flag changes don't touch
+func (l *UIDList) index() map[string]int {
+	if l.byName == nil {
+		l.byName = make(map[string]int, len(l.Entries))
+		for idx, e := range l.Entries {
+			l.byName[Message(e.Name).Name()] = idx
+		}
+	}
+	return l.byName
+}
+
+// get the uid of a message, matched by unique name so flag changes don't matter
+func (l *UIDList) UID(msg Message) (uid uint32, ok bool) {
+	var idx int
+	idx, ok = l.index()[msg.Name()]
+	if ok {
+		uid = l.Entries[idx].UID
+	}
+	return
+}
+
+// give a message the next uid
+func (l *UIDList) Add(msg Message) (uid uint32) {
+	if l.Next == 0 {
+		l.Next = 1
+	}
+	uid = l.Next
+	l.Next++
+	l.index()[msg.Name()] = len(l.Entries)
+	l.Entries = append(l.Entries, UIDEntry{UID: uid, Name: msg.Filepath()})
+	return
+}
+
+// read this maildir's uid list
+// a maildir without one gets an empty list with no uidvalidity yet
+func (d MailDir) UIDList() (l *UIDList, err error) {
+	defer d.wrapErr("read uid list", &err)
+	var f *os.File
+	f, err = os.Open(filepath.Join(d.Filepath(), uidListFile))
+	if os.IsNotExist(err) {
+		l = &UIDList{Next: 1}
+		err = nil
+		return
+	} else if err != nil {
+		return
+	}
+	defer f.Close()
+	l, err = ReadUIDList(f)
+	return
+}
+
+// atomically replace this maildir's uid list
+// a list without a uidvalidity gets one from the current time like dovecot does
+func (d MailDir) SaveUIDList(l *UIDList) (err error) {
+	defer d.wrapErr("save uid list", &err)
+	if l.Validity == 0 {
+		l.Validity = uint32(time.Now().Unix())
+	}
+	var buf bytes.Buffer
+	_, err = l.WriteTo(&buf)
+	if err == nil {
+		fname := filepath.Join(d.Filepath(), uidListFile)
+		err = ioutil.WriteFile(fname+".tmp", buf.Bytes(), 0600)
+		if err == nil {
+			err = os.Rename(fname+".tmp", fname)
+		}
+	}
+	return
+}
+
+// find the message with a uid as it is named on disk now
+// returns false if the uid was never given out or its message is gone
+func (d MailDir) MessageByUID(uid uint32) (msg Message, ok bool, err error) {
+	defer d.wrapErr("message by uid", &err)
+	var l *UIDList
+	l, err = d.UIDList()
+	if err != nil {
+		return
+	}
+	idx := sort.Search(len(l.Entries), func(i int) bool {
+		return l.Entries[i].UID >= uid
+	})
+	if idx == len(l.Entries) || l.Entries[idx].UID != uid {
+		return
+	}
+	_, msg, err = d.find(Message(l.Entries[idx].Name))
+	if os.IsNotExist(err) {
+		err = nil
+	} else if err == nil {
+		ok = true
+	}
+	return
+}
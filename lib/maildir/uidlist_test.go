@@ -0,0 +1,122 @@
+package maildir
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// taken from a dovecot 2.2 maildir
+const dovecotUIDList = `3 V1275660208 N25 G3085f01b7f11094c501100008c4a11c1
+1 :1276528487.M364837P9451.kurkku,S=1355,W=1394:2,
+2 :1276528488.M308198P9451.kurkku,S=1371,W=1410:2,S
+3 :1276528490.M372416P9451.kurkku,S=1372,W=1411:2,
+4 :1276528535.M394485P9454.kurkku,S=1352,W=1390:2,RS
+23 W2417 :1276533073.M242911P3632.kurkku,S=2362:2,FS
+24 W1405 S1367 :1276533074.M25577P3632.kurkku
+`
+
+func TestReadUIDList(t *testing.T) {
+	l, err := ReadUIDList(strings.NewReader(dovecotUIDList))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Validity != 1275660208 || l.Next != 25 || l.GUID != "3085f01b7f11094c501100008c4a11c1" {
+		t.Fatalf("header parsed as V%d N%d G%s", l.Validity, l.Next, l.GUID)
+	}
+	if len(l.Entries) != 6 {
+		t.Fatalf("got %d entries", len(l.Entries))
+	}
+	e := l.Entries[5]
+	if e.UID != 24 || len(e.Ext) != 2 || e.Ext[1] != "S1367" || e.Name != "1276533074.M25577P3632.kurkku" {
+		t.Fatalf("last entry parsed as %+v", e)
+	}
+	// flags changed since it was listed
+	uid, ok := l.UID(Message("1276528488.M308198P9451.kurkku,S=1371,W=1410:2,FS"))
+	if !ok || uid != 2 {
+		t.Fatalf("uid lookup gave %d %v", uid, ok)
+	}
+	var buf bytes.Buffer
+	if _, err = l.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != dovecotUIDList {
+		t.Fatalf("round trip gave\n%s", buf.String())
+	}
+}
+
+func TestReadUIDListBad(t *testing.T) {
+	for _, s := range []string{"", "1 1275660208 25\n", "3 Vx N1\n", "3 V1 N2\nfoo\n", "3 V1 N2\n0 :name\n", "3 V1 N2\n  :name\n"} {
+		if _, err := ReadUIDList(strings.NewReader(s)); err != ErrBadUIDList {
+			t.Errorf("%q gave %v", s, err)
+		}
+	}
+}
+
+func TestMailDirUIDList(t *testing.T) {
+	d := testMailDir(t)
+	l, err := d.UIDList()
+	if err != nil || len(l.Entries) != 0 || l.Next != 1 {
+		t.Fatalf("empty maildir gave %+v %v", l, err)
+	}
+	msg, err := d.Deliver(strings.NewReader("hi\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uid := l.Add(msg); uid != 1 {
+		t.Fatalf("first uid is %d", uid)
+	}
+	if err = d.SaveUIDList(l); err != nil {
+		t.Fatal(err)
+	}
+	if l.Validity == 0 {
+		t.Fatal("no uidvalidity given")
+	}
+	data, err := ioutil.ReadFile(filepath.Join(d.Filepath(), "dovecot-uidlist"))
+	if err != nil || !strings.HasSuffix(string(data), "N2\n1 :"+msg.Filepath()+"\n") {
+		t.Fatalf("saved %q %v", data, err)
+	}
+	l2, err := d.UIDList()
+	if err != nil || l2.Validity != l.Validity || l2.Next != 2 {
+		t.Fatalf("reread %+v %v", l2, err)
+	}
+}
+
+func TestMessageByUID(t *testing.T) {
+	d := testMailDir(t)
+	var msgs []Message
+	for i := 0; i < 3; i++ {
+		msg, _, err := d.Append(strings.NewReader("hi\n"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, msg)
+	}
+	// flags changed since the uid was given
+	flagged, err := d.AddFlag(msgs[0], Flagged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = d.Remove(msgs[1]); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		uid uint32
+		msg Message
+		ok  bool
+	}{
+		{1, flagged, true},
+		{2, "", false},
+		{3, msgs[2], true},
+		{4, "", false},
+		{0, "", false},
+	}
+	for _, test := range tests {
+		msg, ok, err := d.MessageByUID(test.uid)
+		if err != nil || ok != test.ok || msg != test.msg {
+			t.Errorf("uid %d gave %q %v %v", test.uid, msg, ok, err)
+		}
+	}
+}
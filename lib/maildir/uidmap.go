@@ -0,0 +1,32 @@
+package maildir
+
+// a message's position in a mailbox as imap numbers it
+type UIDMapping struct {
+	// 1 based sequence number
+	Seq int
+	UID uint32
+	// message as it is named on disk
+	Msg Message
+}
+
+// get every message in new and cur in uid order with its sequence number
+// messages without a uid are given one first
+func (d MailDir) UIDMap() (m []UIDMapping, err error) {
+	defer d.wrapErr("uid map", &err)
+	err = d.SyncUIDs()
+	var l *UIDList
+	if err == nil {
+		l, err = d.UIDList()
+	}
+	if err == nil {
+		m = make([]UIDMapping, len(l.Entries))
+		for idx, e := range l.Entries {
+			m[idx] = UIDMapping{
+				Seq: idx + 1,
+				UID: e.UID,
+				Msg: Message(e.Name),
+			}
+		}
+	}
+	return
+}
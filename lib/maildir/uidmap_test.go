@@ -0,0 +1,45 @@
+package maildir
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUIDMap(t *testing.T) {
+	d := testMailDir(t)
+	for i := 0; i < 3; i++ {
+		if _, _, err := d.Append(strings.NewReader("hi\n"), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// expunging one leaves a gap in the uids but not the sequence numbers
+	m, err := d.UIDMap()
+	if err != nil || len(m) != 3 {
+		t.Fatalf("mapped %v %v", m, err)
+	}
+	if err = d.Remove(m[1].Msg); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := d.Deliver(strings.NewReader("later\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err = d.UIDMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 3 {
+		t.Fatalf("mapped %d messages", len(m))
+	}
+	for idx, e := range m {
+		if e.Seq != idx+1 {
+			t.Fatalf("entry %d has sequence number %d", idx, e.Seq)
+		}
+		if idx > 0 && e.UID <= m[idx-1].UID {
+			t.Fatalf("uid %d follows %d", e.UID, m[idx-1].UID)
+		}
+	}
+	if m[1].UID != 3 || m[2].UID != 4 || m[2].Msg != msg {
+		t.Fatalf("mapped %v", m)
+	}
+}
@@ -0,0 +1,57 @@
+package maildir
+
+import (
+	"os"
+	"sort"
+	"strings"
+)
+
+// label UnreadAcrossFolders gives messages in the maildir itself
+const inboxFolder = "INBOX"
+
+// a message and the folder it is in
+type FolderMessage struct {
+	// name of the maildir++ subfolder, INBOX for the maildir itself
+	Folder string
+	Msg    Message
+}
+
+// get the names of this maildir's maildir++ subfolders in order
+func (d MailDir) folders() (names []string, err error) {
+	var ents []os.DirEntry
+	ents, err = os.ReadDir(d.Filepath())
+	for _, ent := range ents {
+		name := ent.Name()
+		if ent.IsDir() && len(name) > 1 && strings.HasPrefix(name, ".") {
+			names = append(names, name[1:])
+		}
+	}
+	sort.Strings(names)
+	return
+}
+
+// list unseen messages in this maildir and all its subfolders for a unified unread view
+// each message is labelled with the folder it is in, INBOX for this maildir
+func (d MailDir) UnreadAcrossFolders() (msgs []FolderMessage, err error) {
+	defer d.wrapErr("unread across folders", &err)
+	var names []string
+	names, err = d.folders()
+	if err != nil {
+		return
+	}
+	for _, name := range append([]string{inboxFolder}, names...) {
+		f := d
+		if name != inboxFolder {
+			f = d.Folder(name)
+		}
+		var unseen []Message
+		unseen, err = f.ListUnseen()
+		if err != nil {
+			return
+		}
+		for _, msg := range unseen {
+			msgs = append(msgs, FolderMessage{Folder: name, Msg: msg})
+		}
+	}
+	return
+}
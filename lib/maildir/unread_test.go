@@ -0,0 +1,38 @@
+package maildir
+
+import (
+	"testing"
+)
+
+func TestUnreadAcrossFolders(t *testing.T) {
+	d := testMailDir(t)
+	putMessage(t, d, "new", "1.host", "Subject: new\r\n\r\nbody\r\n")
+	putMessage(t, d, "cur", "2.host:2,S", "Subject: read\r\n\r\nbody\r\n")
+	putMessage(t, d, "cur", "3.host:2,F", "Subject: flagged\r\n\r\nbody\r\n")
+	lists, err := d.EnsureFolder("Lists")
+	if err != nil {
+		t.Fatal(err)
+	}
+	putMessage(t, lists, "new", "4.host", "Subject: list\r\n\r\nbody\r\n")
+	putMessage(t, lists, "cur", "5.host:2,RS", "Subject: replied\r\n\r\nbody\r\n")
+	if _, err = d.EnsureFolder("Empty"); err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := d.UnreadAcrossFolders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	for _, m := range msgs {
+		got[m.Msg.Name()] = m.Folder
+	}
+	want := map[string]string{"1.host": "INBOX", "3.host": "INBOX", "4.host": "Lists"}
+	if len(got) != len(want) || len(msgs) != len(want) {
+		t.Fatalf("unread is %v", msgs)
+	}
+	for name, folder := range want {
+		if got[name] != folder {
+			t.Fatalf("%s is in %q not %q", name, got[name], folder)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package maildir
+
+import (
+	"bufio"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// name of the delivery journal in the maildir root
+const walFile = "bdsmail-wal"
+
+// journal records, each followed by the tmp file name
+const (
+	// we are about to write the file
+	walStart = "start"
+	// the file is on disk in full, followed by its size
+	walCommit = "commit"
+	// the file was renamed into new, journals are checkpointed instead now
+	// but older ones may still have it
+	walDone = "done"
+)
+
+// get the mutex serializing changes to the journal in this process
+// it is separate from the maildir mutex so journaling never waits on flag changes
+func (d MailDir) journalMutex() *sync.Mutex {
+	mtx, _ := mutexes.LoadOrStore(filepath.Join(d.Filepath(), walFile), new(sync.Mutex))
+	return mtx.(*sync.Mutex)
+}
+
+// append a record to the delivery journal and sync it
+func (d MailDir) journal(record, fname string, args ...string) (err error) {
+	mtx := d.journalMutex()
+	mtx.Lock()
+	defer mtx.Unlock()
+	var f *os.File
+	f, err = os.OpenFile(filepath.Join(d.Filepath(), walFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err == nil {
+		line := strings.Join(append([]string{record, fname}, args...), " ") + "\n"
+		_, err = io.WriteString(f, line)
+		if err == nil {
+			err = f.Sync()
+		}
+		if e := f.Close(); err == nil {
+			err = e
+		}
+	}
+	return
+}
+
+// drop the records of a file that was renamed into new from the journal
+// so it only ever holds deliveries in progress, the new journal replaces
+// the old one with a rename so a crash leaves one or the other
+func (d MailDir) checkpoint(fname string) (err error) {
+	mtx := d.journalMutex()
+	mtx.Lock()
+	defer mtx.Unlock()
+	path := filepath.Join(d.Filepath(), walFile)
+	var data []byte
+	data, err = ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	var kept []string
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		fields := strings.Fields(line)
+		if line != "" && (len(fields) < 2 || fields[1] != fname) {
+			kept = append(kept, line)
+		}
+	}
+	tmp := path + ".tmp"
+	var f *os.File
+	f, err = os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err == nil {
+		_, err = io.WriteString(f, strings.Join(kept, ""))
+		if err == nil {
+			err = f.Sync()
+		}
+		if e := f.Close(); err == nil {
+			err = e
+		}
+		if err == nil {
+			err = os.Rename(tmp, path)
+		}
+		if err != nil {
+			os.Remove(tmp)
+		}
+	}
+	return
+}
+
+// write body to tmp recording it in the journal before and after
+// the file is synced before it is committed so a committed file is complete
+func (d MailDir) writeTempWAL(body io.Reader) (fname string, err error) {
+	fname = d.tempName()
+	err = d.journal(walStart, fname)
+	if err == nil {
+		var n int64
+		n, err = d.writeTempAs(fname, body, true)
+		if err == nil {
+			err = d.journal(walCommit, fname, strconv.FormatInt(n, 10))
+			if err != nil {
+				os.Remove(d.Temp(fname))
+			}
+		}
+	}
+	return
+}
+
+// finish deliveries journaled with DeliverOpts.WAL that were cut short by a crash
+// fully written files left in tmp are moved into new and partial ones are removed
+// returns how many messages were recovered
+//
+// this should be run on startup before anything delivers to the maildir,
+// the journal is emptied once it has been replayed
+func (d MailDir) RecoverWAL() (n int, err error) {
+	defer d.wrapErr("recover wal", &err)
+	mtx := d.journalMutex()
+	mtx.Lock()
+	defer mtx.Unlock()
+	fname := filepath.Join(d.Filepath(), walFile)
+	var f *os.File
+	f, err = os.Open(fname)
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	} else if err != nil {
+		return
+	}
+	// committed size of each unfinished file, -1 if it was never committed
+	pending := make(map[string]int64)
+	var order []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 2 {
+			// a torn record from the crash
+			continue
+		}
+		name := fields[1]
+		switch fields[0] {
+		case walStart:
+			pending[name] = -1
+			order = append(order, name)
+		case walCommit:
+			if len(fields) == 3 {
+				pending[name], _ = strconv.ParseInt(fields[2], 10, 64)
+			}
+		case walDone:
+			delete(pending, name)
+		}
+	}
+	err = sc.Err()
+	f.Close()
+	if err != nil {
+		return
+	}
+	for _, name := range order {
+		size, ok := pending[name]
+		if !ok {
+			continue
+		}
+		tmp := d.Temp(name)
+		st, e := os.Stat(tmp)
+		if e != nil {
+			// never written or already renamed
+			continue
+		}
+		if size < 0 || st.Size() != size {
+			log.Warn("discarding partial delivery ", name, " in ", d)
+			err = os.Remove(tmp)
+		} else {
+			err = os.Rename(tmp, d.New(name))
+			if err == nil {
+				n++
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+	err = os.Truncate(fname, 0)
+	return
+}
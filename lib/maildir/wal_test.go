@@ -0,0 +1,86 @@
+package maildir
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDeliverWAL(t *testing.T) {
+	d := testMailDir(t)
+	msg, err := d.DeliverWith(strings.NewReader("hi\n"), DeliverOpts{WAL: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(d.Filepath(), walFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// finished deliveries are dropped from the journal
+	if len(data) != 0 {
+		t.Fatalf("journal is %q", data)
+	}
+	n, err := d.RecoverWAL()
+	if err != nil || n != 0 {
+		t.Fatalf("nothing to recover gave %d %v", n, err)
+	}
+	if is, _ := d.IsNew(msg); !is {
+		t.Fatal("message moved by recovery")
+	}
+}
+
+func TestRecoverWAL(t *testing.T) {
+	d := testMailDir(t)
+	// crashed after writing but before the rename
+	full := putMessage(t, d, "tmp", "1.full.host", "Subject: hi\n\nall here\n")
+	// crashed while writing
+	partial := putMessage(t, d, "tmp", "2.partial.host", "Subject: hi\n\nall")
+	// committed but the size doesn't match
+	short := putMessage(t, d, "tmp", "3.short.host", "Subject")
+	journal := "start 1.full.host\ncommit 1.full.host 22\n" +
+		"start 2.partial.host\n" +
+		"start 3.short.host\ncommit 3.short.host 100\n" +
+		// renamed before the crash
+		"start 4.gone.host\ncommit 4.gone.host 5\n" +
+		"start 5.torn"
+	if err := ioutil.WriteFile(filepath.Join(d.Filepath(), walFile), []byte(journal), 0600); err != nil {
+		t.Fatal(err)
+	}
+	n, err := d.RecoverWAL()
+	if err != nil || n != 1 {
+		t.Fatalf("recovered %d %v", n, err)
+	}
+	data, err := ioutil.ReadFile(d.New(full.Filepath()))
+	if err != nil || string(data) != "Subject: hi\n\nall here\n" {
+		t.Fatalf("recovered %q %v", data, err)
+	}
+	for _, msg := range []Message{full, partial, short} {
+		if _, err = os.Stat(d.Temp(msg.Filepath())); !os.IsNotExist(err) {
+			t.Errorf("%s left in tmp", msg)
+		}
+	}
+	if is, _ := d.IsNew(partial); is {
+		t.Fatal("partial delivery promoted")
+	}
+	st, err := os.Stat(filepath.Join(d.Filepath(), walFile))
+	if err != nil || st.Size() != 0 {
+		t.Fatalf("journal not emptied: %v", err)
+	}
+}
+
+func TestCheckpointWAL(t *testing.T) {
+	d := testMailDir(t)
+	journal := "start 1.a.host\ncommit 1.a.host 5\nstart 2.b.host\ncommit 2.b.host 7\ndone 3.c.host\n"
+	if err := ioutil.WriteFile(filepath.Join(d.Filepath(), walFile), []byte(journal), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.checkpoint("1.a.host"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(d.Filepath(), walFile))
+	if err != nil || string(data) != "start 2.b.host\ncommit 2.b.host 7\ndone 3.c.host\n" {
+		t.Fatalf("journal is %q %v", data, err)
+	}
+}
@@ -0,0 +1,448 @@
+package managesieve
+
+import (
+	"fmt"
+	"strings"
+)
+
+// sieve extensions we accept in require
+var Extensions = []string{
+	"body",
+	"copy",
+	"envelope",
+	"fileinto",
+	"imap4flags",
+	"include",
+	"reject",
+	"subaddress",
+	"vacation",
+	"variables",
+}
+
+// commands and tests every script may use
+var coreCommands = []string{"require", "if", "elsif", "else", "stop", "keep", "discard", "redirect"}
+var coreTests = []string{"address", "allof", "anyof", "exists", "false", "header", "not", "size", "true"}
+
+// commands and tests an extension adds
+var extCommands = map[string][]string{
+	"fileinto":   {"fileinto"},
+	"reject":     {"reject"},
+	"vacation":   {"vacation"},
+	"imap4flags": {"setflag", "addflag", "removeflag"},
+	"variables":  {"set"},
+	"include":    {"include", "return", "global"},
+}
+var extTests = map[string][]string{
+	"body":       {"body"},
+	"envelope":   {"envelope"},
+	"imap4flags": {"hasflag"},
+	"variables":  {"string"},
+}
+
+// an error in a sieve script
+type SyntaxError struct {
+	Line int
+	Msg  string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+// kinds of sieve tokens
+const (
+	tokEOF = iota
+	tokIdent
+	tokTag
+	tokNumber
+	tokString
+	tokPunct
+)
+
+type token struct {
+	kind int
+	val  string
+	line int
+}
+
+// splits a sieve script into tokens
+type lexer struct {
+	src  string
+	pos  int
+	line int
+}
+
+func (l *lexer) errorf(format string, args ...interface{}) error {
+	return &SyntaxError{Line: l.line, Msg: fmt.Sprintf(format, args...)}
+}
+
+func isAlpha(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// read an identifier starting at the current position
+func (l *lexer) ident() string {
+	start := l.pos
+	for l.pos < len(l.src) && (isAlpha(l.src[l.pos]) || isDigit(l.src[l.pos])) {
+		l.pos++
+	}
+	return l.src[start:l.pos]
+}
+
+// skip whitespace and comments
+func (l *lexer) skip() error {
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch {
+		case c == '\n':
+			l.line++
+			l.pos++
+		case c == ' ' || c == '\t' || c == '\r':
+			l.pos++
+		case c == '#':
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		case strings.HasPrefix(l.src[l.pos:], "/*"):
+			end := strings.Index(l.src[l.pos+2:], "*/")
+			if end < 0 {
+				return l.errorf("unterminated comment")
+			}
+			l.line += strings.Count(l.src[l.pos:l.pos+2+end], "\n")
+			l.pos += end + 4
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func (l *lexer) next() (tok token, err error) {
+	err = l.skip()
+	tok.line = l.line
+	if err != nil || l.pos >= len(l.src) {
+		return
+	}
+	c := l.src[l.pos]
+	switch {
+	case strings.IndexByte("[](){},;", c) >= 0:
+		tok.kind, tok.val = tokPunct, string(c)
+		l.pos++
+	case c == ':':
+		l.pos++
+		if l.pos >= len(l.src) || !isAlpha(l.src[l.pos]) {
+			err = l.errorf("bad tag")
+			return
+		}
+		tok.kind, tok.val = tokTag, l.ident()
+	case isDigit(c):
+		start := l.pos
+		for l.pos < len(l.src) && isDigit(l.src[l.pos]) {
+			l.pos++
+		}
+		if l.pos < len(l.src) && strings.IndexByte("KMGkmg", l.src[l.pos]) >= 0 {
+			l.pos++
+		}
+		tok.kind, tok.val = tokNumber, l.src[start:l.pos]
+	case c == '"':
+		tok.kind = tokString
+		tok.val, err = l.quoted()
+	case isAlpha(c):
+		tok.kind, tok.val = tokIdent, l.ident()
+		if tok.val == "text" && l.pos < len(l.src) && l.src[l.pos] == ':' {
+			l.pos++
+			tok.kind = tokString
+			tok.val, err = l.multiline()
+		}
+	default:
+		err = l.errorf("unexpected %q", c)
+	}
+	return
+}
+
+// read a quoted string
+func (l *lexer) quoted() (str string, err error) {
+	var sb strings.Builder
+	for l.pos++; l.pos < len(l.src); l.pos++ {
+		c := l.src[l.pos]
+		switch c {
+		case '"':
+			l.pos++
+			return sb.String(), nil
+		case '\\':
+			l.pos++
+			if l.pos < len(l.src) {
+				c = l.src[l.pos]
+			}
+		case '\n':
+			l.line++
+		}
+		sb.WriteByte(c)
+	}
+	err = l.errorf("unterminated string")
+	return
+}
+
+// read a text: string ending with a line holding a single dot
+func (l *lexer) multiline() (str string, err error) {
+	// rest of the text: line may only hold whitespace or a comment
+	for l.pos < len(l.src) && (l.src[l.pos] == ' ' || l.src[l.pos] == '\t') {
+		l.pos++
+	}
+	end := strings.IndexByte(l.src[l.pos:], '\n')
+	if end < 0 {
+		err = l.errorf("unterminated text")
+		return
+	}
+	rest := strings.TrimRight(l.src[l.pos:l.pos+end], "\r")
+	if rest != "" && rest[0] != '#' {
+		err = l.errorf("unexpected text after text:")
+		return
+	}
+	l.pos += end + 1
+	l.line++
+	var sb strings.Builder
+	for l.pos < len(l.src) {
+		end = strings.IndexByte(l.src[l.pos:], '\n')
+		if end < 0 {
+			break
+		}
+		line := strings.TrimRight(l.src[l.pos:l.pos+end], "\r")
+		l.pos += end + 1
+		l.line++
+		if line == "." {
+			return sb.String(), nil
+		}
+		sb.WriteString(strings.TrimPrefix(line, ".") + "\n")
+	}
+	err = l.errorf("unterminated text")
+	return
+}
+
+// checks a script's structure and the names it uses
+type parser struct {
+	lex  *lexer
+	tok  token
+	exts map[string]bool
+	// we may still see require
+	requireOK bool
+}
+
+func (p *parser) advance() (err error) {
+	p.tok, err = p.lex.next()
+	return
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return &SyntaxError{Line: p.tok.line, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) is(punct string) bool {
+	return p.tok.kind == tokPunct && p.tok.val == punct
+}
+
+func (p *parser) expect(punct string) error {
+	if !p.is(punct) {
+		return p.errorf("expected %q", punct)
+	}
+	return p.advance()
+}
+
+// check a name is a core or required command or test
+func (p *parser) known(name string, core []string, ext map[string][]string) bool {
+	name = strings.ToLower(name)
+	for _, n := range core {
+		if n == name {
+			return true
+		}
+	}
+	for e, names := range ext {
+		for _, n := range names {
+			if n == name && p.exts[e] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parse commands until the end of a block or script
+func (p *parser) commands() (err error) {
+	prev := ""
+	for err == nil && p.tok.kind != tokEOF && !p.is("}") {
+		prev, err = p.command(prev)
+	}
+	return
+}
+
+// parse a command, prev is the command before it in the same block
+func (p *parser) command(prev string) (name string, err error) {
+	if p.tok.kind != tokIdent {
+		err = p.errorf("expected command")
+		return
+	}
+	name = strings.ToLower(p.tok.val)
+	if !p.known(name, coreCommands, extCommands) {
+		err = p.errorf("unknown command %q", p.tok.val)
+		return
+	}
+	if name == "require" && !p.requireOK {
+		err = p.errorf("require must come before other commands")
+		return
+	}
+	if (name == "elsif" || name == "else") && prev != "if" && prev != "elsif" {
+		err = p.errorf("%s without if", name)
+		return
+	}
+	if name != "require" {
+		p.requireOK = false
+	}
+	err = p.advance()
+	if err != nil {
+		return
+	}
+	var strs []string
+	var tests int
+	strs, tests, err = p.arguments()
+	if err != nil {
+		return
+	}
+	if name == "require" {
+		for _, ext := range strs {
+			if !p.supported(ext) {
+				err = p.errorf("unsupported extension %q", ext)
+				return
+			}
+			p.exts[ext] = true
+		}
+	}
+	control := name == "if" || name == "elsif" || name == "else"
+	if (name == "if" || name == "elsif") && tests != 1 {
+		err = p.errorf("%s needs a test", name)
+		return
+	}
+	if control {
+		err = p.expect("{")
+		if err == nil {
+			err = p.commands()
+		}
+		if err == nil {
+			err = p.expect("}")
+		}
+	} else {
+		err = p.expect(";")
+	}
+	return
+}
+
+func (p *parser) supported(ext string) bool {
+	for _, e := range Extensions {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// parse arguments and any tests after them
+// returns the strings given and how many tests there were
+func (p *parser) arguments() (strs []string, tests int, err error) {
+	for err == nil {
+		switch {
+		case p.tok.kind == tokTag || p.tok.kind == tokNumber:
+			err = p.advance()
+		case p.tok.kind == tokString:
+			strs = append(strs, p.tok.val)
+			err = p.advance()
+		case p.is("["):
+			var list []string
+			list, err = p.stringList()
+			strs = append(strs, list...)
+		case p.tok.kind == tokIdent:
+			tests = 1
+			err = p.test()
+			return
+		case p.is("("):
+			tests, err = p.testList()
+			return
+		default:
+			return
+		}
+	}
+	return
+}
+
+// parse [ string, string ]
+func (p *parser) stringList() (strs []string, err error) {
+	err = p.advance()
+	for err == nil {
+		if p.tok.kind != tokString {
+			err = p.errorf("expected string")
+			return
+		}
+		strs = append(strs, p.tok.val)
+		err = p.advance()
+		if err == nil && p.is("]") {
+			err = p.advance()
+			return
+		}
+		if err == nil {
+			err = p.expect(",")
+		}
+	}
+	return
+}
+
+func (p *parser) test() (err error) {
+	if !p.known(p.tok.val, coreTests, extTests) {
+		return p.errorf("unknown test %q", p.tok.val)
+	}
+	err = p.advance()
+	if err == nil {
+		_, _, err = p.arguments()
+	}
+	return
+}
+
+// parse ( test, test )
+func (p *parser) testList() (n int, err error) {
+	err = p.advance()
+	for err == nil {
+		if p.tok.kind != tokIdent {
+			err = p.errorf("expected test")
+			return
+		}
+		err = p.test()
+		n++
+		if err == nil && p.is(")") {
+			err = p.advance()
+			return
+		}
+		if err == nil {
+			err = p.expect(",")
+		}
+	}
+	return
+}
+
+// check that a sieve script is well formed and only uses extensions we support
+// returns a *SyntaxError saying what is wrong
+func CheckScript(script []byte) (err error) {
+	p := &parser{
+		lex:       &lexer{src: string(script), line: 1},
+		exts:      make(map[string]bool),
+		requireOK: true,
+	}
+	err = p.advance()
+	if err == nil {
+		err = p.commands()
+	}
+	if err == nil && p.tok.kind != tokEOF {
+		err = p.errorf("unexpected %q", p.tok.val)
+	}
+	return
+}
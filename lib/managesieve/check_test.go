@@ -0,0 +1,62 @@
+package managesieve
+
+import (
+	"testing"
+)
+
+func TestCheckScript(t *testing.T) {
+	good := []string{
+		"",
+		"keep;",
+		`require ["fileinto", "imap4flags"];
+# file lists away
+if anyof (header :contains "list-id" "golang-nuts", address :domain :is "from" "lists.example.com") {
+	fileinto "Lists";
+	addflag "\\Seen";
+	stop;
+} elsif not exists "subject" {
+	discard;
+} else {
+	/* everything else */
+	keep;
+}
+`,
+		`require "vacation";
+vacation :days 7 :subject "away" text:
+I'm away.
+..and back soon
+.
+;`,
+		`if size :over 1M { discard; }`,
+	}
+	for _, script := range good {
+		if err := CheckScript([]byte(script)); err != nil {
+			t.Errorf("%q failed: %v", script, err)
+		}
+	}
+	bad := []struct {
+		script string
+		line   int
+	}{
+		{"keep", 1},
+		{"fileinto \"x\";", 1},
+		{"require \"nonsense\";", 1},
+		{"keep;\nrequire \"fileinto\";", 2},
+		{"else { keep; }", 1},
+		{"if { keep; }", 1},
+		{"if true {\nkeep;\n", 3},
+		{"if header :is \"a\" \"b\" { keep; ", 1},
+		{"redirect \"unterminated;", 1},
+		{"if true { frobnicate; }", 1},
+		{"keep; /* open", 1},
+	}
+	for _, test := range bad {
+		err := CheckScript([]byte(test.script))
+		se, ok := err.(*SyntaxError)
+		if !ok {
+			t.Errorf("%q gave %v", test.script, err)
+		} else if se.Line != test.line {
+			t.Errorf("%q failed on line %d: %v", test.script, se.Line, se)
+		}
+	}
+}
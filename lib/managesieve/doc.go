@@ -0,0 +1,4 @@
+//
+// managesieve protocol implementation for uploading sieve scripts
+//
+package managesieve
@@ -0,0 +1,188 @@
+package managesieve
+
+import (
+	"errors"
+	"github.com/majestrate/bdsmail/lib/maildir"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+var ErrNoScript = errors.New("managesieve: no such script")
+var ErrScriptExists = errors.New("managesieve: script already exists")
+var ErrScriptActive = errors.New("managesieve: script is active")
+var ErrBadScriptName = errors.New("managesieve: bad script name")
+
+// name of the directory in a user's maildir holding their scripts
+const scriptsDir = ".sieve"
+
+// symlink in the scripts directory pointing at the active script
+// a mail filter runs whatever it points to
+const activeLink = ".active"
+
+// file suffix of stored scripts
+const scriptExt = ".sieve"
+
+// a user's sieve scripts kept as name.sieve files in a directory
+type Scripts string
+
+// a stored script
+type ScriptInfo struct {
+	Name   string
+	Active bool
+}
+
+// get the scripts stored in a user's maildir
+func ScriptsFor(d maildir.MailDir) Scripts {
+	return Scripts(filepath.Join(d.Filepath(), scriptsDir))
+}
+
+// check a script name can be stored
+func validName(name string) bool {
+	if name == "" || len(name) > 128 || name[0] == '.' || strings.ContainsRune(name, '/') {
+		return false
+	}
+	for _, c := range name {
+		if unicode.IsControl(c) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s Scripts) path(name string) string {
+	return filepath.Join(string(s), name+scriptExt)
+}
+
+// get the name of the active script, empty if none
+func (s Scripts) Active() (name string, err error) {
+	var target string
+	target, err = os.Readlink(filepath.Join(string(s), activeLink))
+	if os.IsNotExist(err) {
+		err = nil
+	} else if err == nil {
+		name = strings.TrimSuffix(target, scriptExt)
+	}
+	return
+}
+
+// list stored scripts sorted by name
+func (s Scripts) List() (scripts []ScriptInfo, err error) {
+	var active string
+	active, err = s.Active()
+	if err != nil {
+		return
+	}
+	var files []os.FileInfo
+	files, err = ioutil.ReadDir(string(s))
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	for _, f := range files {
+		name := f.Name()
+		if f.Mode().IsRegular() && strings.HasSuffix(name, scriptExt) && validName(name) {
+			name = strings.TrimSuffix(name, scriptExt)
+			scripts = append(scripts, ScriptInfo{Name: name, Active: name == active})
+		}
+	}
+	sort.Slice(scripts, func(i, j int) bool {
+		return scripts[i].Name < scripts[j].Name
+	})
+	return
+}
+
+// get a script's content
+func (s Scripts) Get(name string) (script []byte, err error) {
+	if !validName(name) {
+		err = ErrNoScript
+		return
+	}
+	script, err = ioutil.ReadFile(s.path(name))
+	if os.IsNotExist(err) {
+		err = ErrNoScript
+	}
+	return
+}
+
+// store a script replacing any with the same name
+func (s Scripts) Put(name string, script []byte) (err error) {
+	if !validName(name) {
+		return ErrBadScriptName
+	}
+	err = os.MkdirAll(string(s), 0700)
+	if err == nil {
+		tmp := filepath.Join(string(s), ".tmp-"+name)
+		err = ioutil.WriteFile(tmp, script, 0600)
+		if err == nil {
+			err = os.Rename(tmp, s.path(name))
+		}
+	}
+	return
+}
+
+// delete a script, the active script can't be deleted
+func (s Scripts) Delete(name string) (err error) {
+	if !validName(name) {
+		return ErrNoScript
+	}
+	var active string
+	active, err = s.Active()
+	if err == nil && active == name {
+		err = ErrScriptActive
+	}
+	if err == nil {
+		err = os.Remove(s.path(name))
+		if os.IsNotExist(err) {
+			err = ErrNoScript
+		}
+	}
+	return
+}
+
+// rename a script keeping it active if it was
+func (s Scripts) Rename(oldName, newName string) (err error) {
+	if !validName(newName) {
+		return ErrBadScriptName
+	}
+	if _, err = s.Get(oldName); err != nil {
+		return
+	}
+	if _, err = os.Stat(s.path(newName)); err == nil {
+		return ErrScriptExists
+	}
+	var active string
+	active, err = s.Active()
+	if err == nil {
+		err = os.Rename(s.path(oldName), s.path(newName))
+	}
+	if err == nil && active == oldName {
+		err = s.SetActive(newName)
+	}
+	return
+}
+
+// make a script the active one, an empty name deactivates all scripts
+func (s Scripts) SetActive(name string) (err error) {
+	link := filepath.Join(string(s), activeLink)
+	if name == "" {
+		err = os.Remove(link)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	if _, err = s.Get(name); err != nil {
+		return
+	}
+	// swap the link atomically
+	tmp := link + ".tmp"
+	os.Remove(tmp)
+	err = os.Symlink(name+scriptExt, tmp)
+	if err == nil {
+		err = os.Rename(tmp, link)
+	}
+	return
+}
@@ -0,0 +1,121 @@
+package managesieve
+
+import (
+	"crypto/tls"
+	log "github.com/Sirupsen/logrus"
+	"github.com/majestrate/bdsmail/lib/maildir"
+	"net"
+	"time"
+)
+
+// largest script we take by default
+const DefaultMaxScriptSize = 1024 * 1024
+
+// how long a client may be idle by default before we hang up
+const DefaultIdleTimeout = 30 * time.Minute
+
+// checks login credentials
+type Authenticator interface {
+	// check a username and password given with AUTHENTICATE "PLAIN"
+	Authenticate(username, password string) (bool, error)
+}
+
+// maps users to the maildir their scripts are kept in
+type Router interface {
+	Route(user string) (maildir.MailDir, error)
+}
+
+// managesieve server, scripts go in a .sieve directory in each user's maildir
+type Server struct {
+	// hostname we announce ourselves as
+	Hostname string
+	// checks logins
+	Auth Authenticator
+	// maps users to maildirs
+	Router Router
+	// largest script in bytes, 0 for DefaultMaxScriptSize
+	MaxScriptSize int64
+	// idle time before a client is hung up on, 0 for DefaultIdleTimeout
+	IdleTimeout time.Duration
+	// offer PLAIN without tls, only for connections that can't be snooped on
+	AllowInsecureAuth bool
+
+	// unexported fields
+
+	// listener for serving
+	listener net.Listener
+	// tls config for STARTTLS, nil to not offer it
+	tlsConfig *tls.Config
+}
+
+// offer STARTTLS with a tls config
+func (s *Server) WithTLS(cfg *tls.Config) *Server {
+	s.tlsConfig = cfg
+	return s
+}
+
+func (s *Server) maxScriptSize() int64 {
+	if s.MaxScriptSize > 0 {
+		return s.MaxScriptSize
+	}
+	return DefaultMaxScriptSize
+}
+
+func (s *Server) idleTimeout() time.Duration {
+	if s.IdleTimeout > 0 {
+		return s.IdleTimeout
+	}
+	return DefaultIdleTimeout
+}
+
+// serve managesieve on a tcp address, usually port 4190
+// blocks until the server is closed
+func (s *Server) ListenAndServe(addr string) (err error) {
+	var l net.Listener
+	l, err = net.Listen("tcp", addr)
+	if err == nil {
+		err = s.Serve(l)
+	}
+	return
+}
+
+// serve managesieve on an existing listener
+// blocks until the server is closed
+func (s *Server) Serve(l net.Listener) (err error) {
+	s.listener = l
+	log.Info("Serving ManageSieve server on ", l.Addr())
+	for {
+		var c net.Conn
+		c, err = l.Accept()
+		if err != nil {
+			break
+		}
+		go s.handle(c)
+	}
+	log.Info("ManageSieve server ended")
+	return
+}
+
+// stop serving
+func (s *Server) Close() (err error) {
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	return
+}
+
+// handle an inbound connection
+func (s *Server) handle(c net.Conn) {
+	sess := newSession(s, c)
+	sess.run()
+	sess.c.Close()
+}
+
+// create a new managesieve server
+func New(hostname string, auth Authenticator, router Router) *Server {
+	return &Server{
+		Hostname: hostname,
+		Auth:     auth,
+		Router:   router,
+	}
+}
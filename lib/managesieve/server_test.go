@@ -0,0 +1,166 @@
+package managesieve
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"github.com/majestrate/bdsmail/lib/maildir"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// one user with one password and maildir
+type testAuth struct {
+	user, pass string
+	dir        maildir.MailDir
+}
+
+func (a *testAuth) Authenticate(user, pass string) (bool, error) {
+	return user == a.user && pass == a.pass, nil
+}
+
+func (a *testAuth) Route(user string) (maildir.MailDir, error) {
+	return a.dir, nil
+}
+
+// a client reading managesieve responses
+type testClient struct {
+	t *testing.T
+	c net.Conn
+	r *bufio.Reader
+}
+
+// start a server and dial it
+func testServer(t *testing.T) (*testClient, *testAuth) {
+	a := &testAuth{user: "alice", pass: "secret", dir: maildir.MailDir(t.TempDir())}
+	s := New("localhost", a, a)
+	s.AllowInsecureAuth = true
+	s.MaxScriptSize = 4096
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	tc := &testClient{t: t, c: c, r: bufio.NewReader(c)}
+	tc.expect("", "OK")
+	return tc, a
+}
+
+// send a command and read response lines up to one starting with status
+func (tc *testClient) expect(cmd, status string) (lines []string) {
+	if cmd != "" {
+		fmt.Fprintf(tc.c, "%s\r\n", cmd)
+	}
+	for {
+		line, err := tc.r.ReadString('\n')
+		if err != nil {
+			tc.t.Fatalf("%s: %s", cmd, err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if strings.HasPrefix(line, "OK") || strings.HasPrefix(line, "NO") || strings.HasPrefix(line, "BYE") {
+			if !strings.HasPrefix(line, status) {
+				tc.t.Fatalf("%s: got %s", cmd, line)
+			}
+			return
+		}
+		lines = append(lines, line)
+	}
+}
+
+func (tc *testClient) login() {
+	plain := base64.StdEncoding.EncodeToString([]byte("\x00alice\x00secret"))
+	tc.expect(`AUTHENTICATE "PLAIN" "`+plain+`"`, "OK")
+}
+
+func literal(s string) string {
+	return fmt.Sprintf("{%d+}\r\n%s", len(s), s)
+}
+
+func TestScripts(t *testing.T) {
+	tc, a := testServer(t)
+	tc.expect("LISTSCRIPTS", "NO")
+	tc.login()
+	script := "require \"fileinto\";\r\nfileinto \"Lists\";\r\n"
+	tc.expect("HAVESPACE \"lists\" 100", "OK")
+	tc.expect("HAVESPACE \"lists\" 100000", "NO (QUOTA/MAXSIZE)")
+	tc.expect("PUTSCRIPT \"lists\" "+literal(script), "OK")
+	tc.expect("PUTSCRIPT \"other\" \"keep;\"", "OK")
+	tc.expect("SETACTIVE \"lists\"", "OK")
+	lines := tc.expect("LISTSCRIPTS", "OK")
+	if strings.Join(lines, "|") != `"lists" ACTIVE|"other"` {
+		t.Fatalf("listed %q", lines)
+	}
+	lines = tc.expect("GETSCRIPT \"lists\"", "OK")
+	if strings.Join(lines, "\r\n") != fmt.Sprintf("{%d}\r\n%s", len(script), script) {
+		t.Fatalf("got %q", lines)
+	}
+	// a filter finds the active script through the link
+	data, err := ioutil.ReadFile(filepath.Join(a.dir.Filepath(), ".sieve", ".active"))
+	if err != nil || string(data) != script {
+		t.Fatalf("active script is %q %v", data, err)
+	}
+	tc.expect("DELETESCRIPT \"lists\"", "NO (ACTIVE)")
+	tc.expect("RENAMESCRIPT \"lists\" \"mailing lists\"", "OK")
+	tc.expect("GETSCRIPT \"lists\"", "NO (NONEXISTENT)")
+	tc.expect("SETACTIVE \"\"", "OK")
+	tc.expect("DELETESCRIPT \"mailing lists\"", "OK")
+	tc.expect("DELETESCRIPT \"mailing lists\"", "NO (NONEXISTENT)")
+	lines = tc.expect("LISTSCRIPTS", "OK")
+	if strings.Join(lines, "|") != `"other"` {
+		t.Fatalf("listed %q", lines)
+	}
+	tc.expect("LOGOUT", "OK")
+}
+
+func TestCheckAndPutBadScript(t *testing.T) {
+	tc, a := testServer(t)
+	tc.login()
+	tc.expect("CHECKSCRIPT "+literal("keep;\r\n"), "OK")
+	tc.expect("CHECKSCRIPT "+literal("keep;\r\nfrobnicate;\r\n"), `NO "line 2`)
+	tc.expect("PUTSCRIPT \"bad\" "+literal("keep"), "NO")
+	tc.expect("PUTSCRIPT \"big\" "+literal(strings.Repeat("#", 5000)), "NO (QUOTA/MAXSIZE)")
+	tc.expect("PUTSCRIPT \".hidden\" \"keep;\"", "NO")
+	// checking never stores or activates anything
+	if _, err := os.Stat(filepath.Join(a.dir.Filepath(), ".sieve")); !os.IsNotExist(err) {
+		t.Fatalf("scripts stored: %v", err)
+	}
+	tc.expect("NOOP", "OK")
+}
+
+func TestAuthenticate(t *testing.T) {
+	tc, _ := testServer(t)
+	bad := base64.StdEncoding.EncodeToString([]byte("\x00alice\x00wrong"))
+	tc.expect(`AUTHENTICATE "PLAIN" "`+bad+`"`, "NO")
+	// challenge then response
+	fmt.Fprintf(tc.c, "AUTHENTICATE \"PLAIN\"\r\n")
+	if line, _ := tc.r.ReadString('\n'); line != "\"\"\r\n" {
+		t.Fatalf("challenge was %q", line)
+	}
+	fmt.Fprintf(tc.c, "\"%s\"\r\n", base64.StdEncoding.EncodeToString([]byte("alice\x00alice\x00secret")))
+	tc.expect("", "OK")
+	lines := tc.expect("CAPABILITY", "OK")
+	if !strings.Contains(strings.Join(lines, "\n"), `"OWNER" "alice"`) {
+		t.Fatalf("capabilities %q", lines)
+	}
+	tc.expect(`AUTHENTICATE "PLAIN"`, "NO")
+}
+
+func TestCommandLimits(t *testing.T) {
+	tc, _ := testServer(t)
+	// scripts can't be sent before authenticating
+	tc.expect("NOOP "+literal(strings.Repeat("x", maxString+1)), "NO (QUOTA/MAXSIZE)")
+	tc.expect("NOOP"+strings.Repeat(" a", maxArgs), "NO")
+	tc.expect("NOOP", "OK")
+	// a command too big to skip ends the session
+	tc.expect(fmt.Sprintf("NOOP {%d+}", maxCommandSize+1), "BYE")
+}
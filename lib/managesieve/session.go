@@ -0,0 +1,505 @@
+package managesieve
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errSyntax = errors.New("syntax error")
+var errTooBig = errors.New("literal too big")
+var errCommandTooBig = errors.New("command too big")
+
+// longest atom or quoted string we read
+const maxString = 1024
+
+// most arguments a command may have
+const maxArgs = 8
+
+// most bytes a command may take besides its literals after authenticating
+// before authenticating this covers the literals too
+const maxCommandSize = 16 * 1024
+
+// a managesieve session for one connection
+type session struct {
+	s   *Server
+	c   net.Conn
+	r   *bufio.Reader
+	w   *bufio.Writer
+	tls bool
+	// logged in user, empty before AUTHENTICATE
+	user    string
+	scripts Scripts
+	// bytes the command being read may still take
+	left int64
+}
+
+func newSession(s *Server, c net.Conn) *session {
+	return &session{
+		s: s,
+		c: c,
+		r: bufio.NewReader(c),
+		w: bufio.NewWriter(c),
+	}
+}
+
+// quote a string for a response, strings that can't be quoted are sent as literals
+func quote(str string) string {
+	if len(str) > maxString || strings.ContainsAny(str, "\r\n") {
+		return fmt.Sprintf("{%d}\r\n%s", len(str), str)
+	}
+	str = strings.Replace(str, `\`, `\\`, -1)
+	return `"` + strings.Replace(str, `"`, `\"`, -1) + `"`
+}
+
+// send a response line
+func (sess *session) line(str string) (err error) {
+	_, err = sess.w.WriteString(str + "\r\n")
+	if err == nil {
+		err = sess.w.Flush()
+	}
+	return
+}
+
+// send an OK response
+func (sess *session) ok(msg string) error {
+	return sess.line("OK " + quote(msg))
+}
+
+// send a NO response with an optional response code
+func (sess *session) no(code, msg string) error {
+	if code != "" {
+		return sess.line("NO (" + code + ") " + quote(msg))
+	}
+	return sess.line("NO " + quote(msg))
+}
+
+// can we take a password on this session
+func (sess *session) authAllowed() bool {
+	return sess.s.Auth != nil && (sess.tls || sess.s.AllowInsecureAuth)
+}
+
+// send our capabilities followed by OK
+func (sess *session) capability() (err error) {
+	caps := []string{
+		`"IMPLEMENTATION" "BDSMail"`,
+		`"SIEVE" ` + quote(strings.Join(Extensions, " ")),
+		`"VERSION" "1.0"`,
+		`"MAXREDIRECTS" "0"`,
+	}
+	if sess.authAllowed() {
+		caps = append(caps, `"SASL" "PLAIN"`)
+	} else {
+		caps = append(caps, `"SASL" ""`)
+	}
+	if sess.s.tlsConfig != nil && !sess.tls {
+		caps = append(caps, `"STARTTLS"`)
+	}
+	if sess.user != "" {
+		caps = append(caps, `"OWNER" `+quote(sess.user))
+	}
+	for _, c := range caps {
+		if _, err = sess.w.WriteString(c + "\r\n"); err != nil {
+			return
+		}
+	}
+	return sess.ok(sess.s.Hostname + " ManageSieve ready")
+}
+
+// read a byte of the command being read
+// returns errCommandTooBig once the command has used up what it may take
+func (sess *session) readByte() (c byte, err error) {
+	if sess.left <= 0 {
+		err = errCommandTooBig
+		return
+	}
+	c, err = sess.r.ReadByte()
+	if err == nil {
+		sess.left--
+	}
+	return
+}
+
+// give back the last byte read with readByte
+func (sess *session) unreadByte() {
+	if sess.r.UnreadByte() == nil {
+		sess.left++
+	}
+}
+
+// skip the rest of a command line we can't parse
+func (sess *session) skipLine() (err error) {
+	for c := byte(0); err == nil && c != '\n'; {
+		c, err = sess.readByte()
+	}
+	return
+}
+
+// read a command as its words, quoted strings and literals
+// returns errSyntax or errTooBig with the line consumed if it was bad
+// returns errCommandTooBig if the command is bigger than we read, the session can't go on
+func (sess *session) readCommand() (args []string, err error) {
+	sess.left = maxCommandSize
+	if sess.user != "" {
+		sess.left += sess.s.maxScriptSize()
+	}
+	var bad error
+	for {
+		var c byte
+		c, err = sess.readByte()
+		if err != nil {
+			return
+		}
+		var str string
+		switch c {
+		case ' ', '\t', '\r':
+			continue
+		case '\n':
+			err = bad
+			return
+		case '"':
+			str, err = sess.readQuoted()
+		case '{':
+			str, err = sess.readLiteral()
+		default:
+			sess.unreadByte()
+			str, err = sess.readAtom()
+		}
+		if err == nil && len(args) >= maxArgs {
+			err = errSyntax
+		}
+		if err == errSyntax {
+			// the rest of the line means nothing now
+			err = sess.skipLine()
+			if err == nil {
+				err = errSyntax
+			}
+			return
+		} else if err == errTooBig {
+			bad = err
+		} else if err != nil {
+			return
+		}
+		args = append(args, str)
+	}
+}
+
+// read an atom up to a space or the end of the line
+func (sess *session) readAtom() (str string, err error) {
+	var sb strings.Builder
+	for {
+		var c byte
+		c, err = sess.readByte()
+		if err != nil {
+			return
+		}
+		if c == ' ' || c == '\r' || c == '\n' {
+			sess.unreadByte()
+			return sb.String(), nil
+		}
+		if sb.Len() >= maxString || c == '"' || c == '{' {
+			sess.unreadByte()
+			err = errSyntax
+			return
+		}
+		sb.WriteByte(c)
+	}
+}
+
+// read a quoted string after its opening quote
+func (sess *session) readQuoted() (str string, err error) {
+	var sb strings.Builder
+	for {
+		var c byte
+		c, err = sess.readByte()
+		if err != nil {
+			return
+		}
+		switch c {
+		case '"':
+			return sb.String(), nil
+		case '\\':
+			c, err = sess.readByte()
+			if err != nil {
+				return
+			}
+		case '\r', '\n':
+			sess.unreadByte()
+			err = errSyntax
+			return
+		}
+		if sb.Len() >= maxString {
+			err = errSyntax
+			return
+		}
+		sb.WriteByte(c)
+	}
+}
+
+// read a {n} or {n+} literal after its opening brace
+// literals over the size limit are read and thrown away with errTooBig
+// before authenticating literals can't be bigger than a string so only scripts are big
+func (sess *session) readLiteral() (str string, err error) {
+	var spec string
+	for err == nil && !strings.HasSuffix(spec, "\n") {
+		var c byte
+		c, err = sess.readByte()
+		spec += string(c)
+	}
+	if err != nil {
+		return
+	}
+	spec = strings.TrimRight(spec, "\r\n")
+	n, perr := strconv.ParseInt(strings.TrimSuffix(strings.TrimSuffix(spec, "}"), "+"), 10, 64)
+	if !strings.HasSuffix(spec, "}") || perr != nil || n < 0 {
+		// we ate the line so give back its newline to be skipped
+		sess.unreadByte()
+		err = errSyntax
+		return
+	}
+	limit := int64(maxString)
+	if sess.user != "" {
+		limit = sess.s.maxScriptSize()
+	}
+	if n > sess.left {
+		// too much to even skip
+		err = errCommandTooBig
+		return
+	}
+	sess.left -= n
+	if n > limit {
+		_, err = io.CopyN(ioutil.Discard, sess.r, n)
+		if err == nil {
+			err = errTooBig
+		}
+		return
+	}
+	buf := make([]byte, n)
+	_, err = io.ReadFull(sess.r, buf)
+	str = string(buf)
+	return
+}
+
+// run the session until the client logs out or the connection drops
+func (sess *session) run() {
+	err := sess.capability()
+	for err == nil {
+		var args []string
+		sess.c.SetReadDeadline(time.Now().Add(sess.s.idleTimeout()))
+		args, err = sess.readCommand()
+		if err == errSyntax {
+			err = sess.no("", "Syntax error")
+			continue
+		} else if err == errTooBig {
+			err = sess.no("QUOTA/MAXSIZE", "Script too big")
+			continue
+		} else if err == errCommandTooBig {
+			sess.line(`BYE "Command too big"`)
+			break
+		} else if e, ok := err.(net.Error); ok && e.Timeout() {
+			sess.line(`BYE "Idle for too long"`)
+			break
+		} else if err != nil || len(args) == 0 {
+			continue
+		}
+		cmd := strings.ToUpper(args[0])
+		args = args[1:]
+		switch cmd {
+		case "CAPABILITY":
+			err = sess.capability()
+		case "AUTHENTICATE":
+			err = sess.authenticate(args)
+		case "STARTTLS":
+			err = sess.startTLS()
+		case "NOOP":
+			err = sess.ok("Done")
+		case "LOGOUT":
+			sess.ok("Logout")
+			return
+		case "HAVESPACE", "PUTSCRIPT", "LISTSCRIPTS", "GETSCRIPT", "SETACTIVE", "DELETESCRIPT", "RENAMESCRIPT", "CHECKSCRIPT":
+			if sess.user == "" {
+				err = sess.no("", "Authenticate first")
+			} else {
+				err = sess.scriptCommand(cmd, args)
+			}
+		default:
+			err = sess.no("", "Unknown command")
+		}
+	}
+	if err != nil && err != io.EOF {
+		log.Warn("managesieve session with ", sess.c.RemoteAddr(), " ended: ", err)
+	}
+}
+
+// handle STARTTLS
+func (sess *session) startTLS() (err error) {
+	if sess.s.tlsConfig == nil || sess.tls {
+		return sess.no("", "STARTTLS not available")
+	}
+	err = sess.ok("Begin TLS negotiation")
+	if err == nil {
+		tc := tls.Server(sess.c, sess.s.tlsConfig)
+		err = tc.Handshake()
+		if err == nil {
+			sess.c = tc
+			sess.r = bufio.NewReader(tc)
+			sess.w = bufio.NewWriter(tc)
+			sess.tls = true
+			// capabilities may have changed
+			err = sess.capability()
+		}
+	}
+	return
+}
+
+// handle AUTHENTICATE "PLAIN" [initial-response]
+func (sess *session) authenticate(args []string) (err error) {
+	if sess.user != "" {
+		return sess.no("", "Already authenticated")
+	}
+	if len(args) == 0 || len(args) > 2 {
+		return sess.no("", "Syntax: AUTHENTICATE mechanism [initial-response]")
+	}
+	if !strings.EqualFold(args[0], "PLAIN") || sess.s.Auth == nil {
+		return sess.no("", "Unsupported mechanism")
+	}
+	if !sess.authAllowed() {
+		return sess.no("ENCRYPT-NEEDED", "Use STARTTLS first")
+	}
+	var resp string
+	if len(args) == 2 {
+		resp = args[1]
+	} else {
+		err = sess.line(`""`)
+		if err != nil {
+			return
+		}
+		var reply []string
+		reply, err = sess.readCommand()
+		if err == errSyntax || err == errTooBig || (err == nil && len(reply) != 1) {
+			return sess.no("", "Bad authentication response")
+		} else if err != nil {
+			return
+		}
+		resp = reply[0]
+	}
+	if resp == "*" {
+		return sess.no("", "Authentication cancelled")
+	}
+	data, e := base64.StdEncoding.DecodeString(resp)
+	parts := bytes.Split(data, []byte{0})
+	if e != nil || len(parts) != 3 {
+		return sess.no("", "Bad authentication response")
+	}
+	// we don't support acting as someone else
+	user := string(parts[1])
+	if len(parts[0]) > 0 && string(parts[0]) != user {
+		return sess.no("", "Authentication failed")
+	}
+	ok, e := sess.s.Auth.Authenticate(user, string(parts[2]))
+	if e != nil {
+		log.Error("managesieve failed to check login for ", user, ": ", e)
+		return sess.no("TRYLATER", "Authentication failed")
+	}
+	if !ok {
+		return sess.no("", "Authentication failed")
+	}
+	d, e := sess.s.Router.Route(user)
+	if e != nil {
+		log.Error("managesieve failed to route ", user, ": ", e)
+		return sess.no("TRYLATER", "Mailbox unavailable")
+	}
+	sess.user = user
+	sess.scripts = ScriptsFor(d)
+	return sess.ok("Logged in")
+}
+
+// number of arguments each script command takes
+var scriptArgs = map[string]int{
+	"HAVESPACE":    2,
+	"PUTSCRIPT":    2,
+	"LISTSCRIPTS":  0,
+	"GETSCRIPT":    1,
+	"SETACTIVE":    1,
+	"DELETESCRIPT": 1,
+	"RENAMESCRIPT": 2,
+	"CHECKSCRIPT":  1,
+}
+
+// handle a command working on the user's scripts
+func (sess *session) scriptCommand(cmd string, args []string) (err error) {
+	if len(args) != scriptArgs[cmd] {
+		return sess.no("", "Wrong number of arguments")
+	}
+	var e error
+	switch cmd {
+	case "HAVESPACE":
+		size, perr := strconv.ParseInt(args[1], 10, 64)
+		if perr != nil {
+			return sess.no("", "Bad size")
+		}
+		if size > sess.s.maxScriptSize() {
+			return sess.no("QUOTA/MAXSIZE", "Script too big")
+		}
+	case "PUTSCRIPT":
+		e = CheckScript([]byte(args[1]))
+		if e == nil {
+			e = sess.scripts.Put(args[0], []byte(args[1]))
+		}
+	case "CHECKSCRIPT":
+		e = CheckScript([]byte(args[0]))
+	case "LISTSCRIPTS":
+		var scripts []ScriptInfo
+		scripts, e = sess.scripts.List()
+		for _, sc := range scripts {
+			if e != nil {
+				break
+			}
+			if sc.Active {
+				_, e = sess.w.WriteString(quote(sc.Name) + " ACTIVE\r\n")
+			} else {
+				_, e = sess.w.WriteString(quote(sc.Name) + "\r\n")
+			}
+		}
+	case "GETSCRIPT":
+		var script []byte
+		script, e = sess.scripts.Get(args[0])
+		if e == nil {
+			_, e = fmt.Fprintf(sess.w, "{%d}\r\n%s\r\n", len(script), script)
+		}
+	case "SETACTIVE":
+		e = sess.scripts.SetActive(args[0])
+	case "DELETESCRIPT":
+		e = sess.scripts.Delete(args[0])
+	case "RENAMESCRIPT":
+		e = sess.scripts.Rename(args[0], args[1])
+	}
+	if e == nil {
+		return sess.ok("Done")
+	}
+	switch e {
+	case ErrNoScript:
+		return sess.no("NONEXISTENT", "No such script")
+	case ErrScriptActive:
+		return sess.no("ACTIVE", "Script is active")
+	case ErrScriptExists:
+		return sess.no("ALREADYEXISTS", "Script already exists")
+	case ErrBadScriptName:
+		return sess.no("", "Bad script name")
+	}
+	if se, ok := e.(*SyntaxError); ok {
+		return sess.no("", se.Error())
+	}
+	log.Error("managesieve ", cmd, " for ", sess.user, " failed: ", e)
+	return sess.no("TRYLATER", "Internal error")
+}
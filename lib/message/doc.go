@@ -0,0 +1,4 @@
+//
+// helpers for working with raw rfc 5322 messages
+//
+package message
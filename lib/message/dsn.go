@@ -0,0 +1,127 @@
+package message
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// status of one recipient in a delivery status notification
+type RecipientStatus struct {
+	// ORCPT given by the client as addr-type;address, may be empty
+	OriginalRecipient string
+	// address the message was delivered to
+	FinalRecipient string
+	// one of delivered, failed, delayed, relayed or expanded
+	Action string
+	// enhanced status code like 2.0.0
+	Status string
+	// smtp reply from the remote mta if any
+	Diagnostic string
+}
+
+// delivery status notification from RFC 3464
+type DSN struct {
+	// hostname of the mta generating the report
+	ReportingMTA string
+	// ENVID given by the client, may be empty
+	EnvID string
+	// when the message arrived
+	ArrivalDate time.Time
+	// status of each recipient reported on
+	Recipients []RecipientStatus
+	// only include the headers of the original message like RET=HDRS
+	HeadersOnly bool
+}
+
+// build a multipart/report message from sender to recipient carrying
+// the report and the original message, lines end with crlf
+func (d *DSN) Build(from, to string, original []byte) (msg []byte, err error) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	action := "delivered"
+	if len(d.Recipients) > 0 {
+		action = d.Recipients[0].Action
+	}
+	subject := "Delivery Status Notification"
+	switch action {
+	case "delivered":
+		subject = "Successful Mail Delivery Report"
+	case "failed":
+		subject = "Undelivered Mail Returned to Sender"
+	case "delayed":
+		subject = "Delayed Mail"
+	}
+	fmt.Fprintf(&buf, "From: Mail Delivery System <%s>\r\n", from)
+	fmt.Fprintf(&buf, "To: <%s>\r\n", to)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Auto-Submitted: auto-replied\r\n")
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/report; report-type=delivery-status; boundary=\"%s\"\r\n\r\n", mw.Boundary())
+
+	// human readable part
+	hdr := make(textproto.MIMEHeader)
+	hdr.Set("Content-Type", "text/plain; charset=us-ascii")
+	w, err := mw.CreatePart(hdr)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "This is the mail system at host %s.\r\n\r\n", d.ReportingMTA)
+	for _, r := range d.Recipients {
+		fmt.Fprintf(w, "<%s>: %s (%s)\r\n", r.FinalRecipient, r.Action, r.Status)
+	}
+
+	// machine readable part
+	hdr = make(textproto.MIMEHeader)
+	hdr.Set("Content-Type", "message/delivery-status")
+	w, err = mw.CreatePart(hdr)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "Reporting-MTA: dns; %s\r\n", d.ReportingMTA)
+	if d.EnvID != "" {
+		fmt.Fprintf(w, "Original-Envelope-Id: %s\r\n", d.EnvID)
+	}
+	if !d.ArrivalDate.IsZero() {
+		fmt.Fprintf(w, "Arrival-Date: %s\r\n", d.ArrivalDate.Format(time.RFC1123Z))
+	}
+	for _, r := range d.Recipients {
+		fmt.Fprintf(w, "\r\n")
+		if r.OriginalRecipient != "" {
+			fmt.Fprintf(w, "Original-Recipient: %s\r\n", r.OriginalRecipient)
+		}
+		fmt.Fprintf(w, "Final-Recipient: rfc822; %s\r\n", r.FinalRecipient)
+		fmt.Fprintf(w, "Action: %s\r\n", r.Action)
+		fmt.Fprintf(w, "Status: %s\r\n", r.Status)
+		if r.Diagnostic != "" {
+			fmt.Fprintf(w, "Diagnostic-Code: smtp; %s\r\n", r.Diagnostic)
+		}
+	}
+
+	// the original message or just its headers
+	hdr = make(textproto.MIMEHeader)
+	if d.HeadersOnly {
+		hdr.Set("Content-Type", "text/rfc822-headers")
+		original = original[:headerLength(original)]
+	} else {
+		hdr.Set("Content-Type", "message/rfc822")
+	}
+	w, err = mw.CreatePart(hdr)
+	if err != nil {
+		return
+	}
+	// keep line endings consistent with the rest of the report
+	orig := strings.Replace(string(original), "\r\n", "\n", -1)
+	_, err = w.Write([]byte(strings.Replace(orig, "\n", "\r\n", -1)))
+	if err == nil {
+		err = mw.Close()
+	}
+	if err == nil {
+		msg = buf.Bytes()
+	}
+	return
+}
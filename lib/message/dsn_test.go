@@ -0,0 +1,56 @@
+package message
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDSNBuild(t *testing.T) {
+	d := &DSN{
+		ReportingMTA: "mx.example.com",
+		EnvID:        "abc123",
+		ArrivalDate:  time.Now(),
+		Recipients: []RecipientStatus{
+			{FinalRecipient: "bob@example.com", Action: "delivered", Status: "2.0.0"},
+		},
+		HeadersOnly: true,
+	}
+	orig := []byte("Subject: hello\nFrom: alice@remote\n\nsecret body\n")
+	msg, err := d.Build("MAILER-DAEMON@example.com", "alice@remote", orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mt, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil || mt != "multipart/report" || params["report-type"] != "delivery-status" {
+		t.Fatalf("bad content type %q", m.Header.Get("Content-Type"))
+	}
+	mr := multipart.NewReader(m.Body, params["boundary"])
+	var parts []string
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		b, _ := ioutil.ReadAll(p)
+		parts = append(parts, p.Header.Get("Content-Type")+"\n"+string(b))
+	}
+	if len(parts) != 3 {
+		t.Fatalf("got %d parts", len(parts))
+	}
+	if !strings.Contains(parts[1], "Original-Envelope-Id: abc123") || !strings.Contains(parts[1], "Action: delivered") {
+		t.Fatalf("bad status part %q", parts[1])
+	}
+	if !strings.HasPrefix(parts[2], "text/rfc822-headers") || strings.Contains(parts[2], "secret body") {
+		t.Fatalf("bad original part %q", parts[2])
+	}
+}
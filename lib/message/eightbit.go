@@ -0,0 +1,159 @@
+package message
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strings"
+)
+
+// return true if data has any bytes outside of 7 bit ascii
+func Is8Bit(data []byte) bool {
+	for _, b := range data {
+		if b >= 0x80 {
+			return true
+		}
+	}
+	return false
+}
+
+// convert a message with an 8 bit body for a next hop without 8BITMIME
+// 8 bit text parts are re-encoded as quoted-printable and multipart bodies
+// are converted part by part, headers are left alone
+// messages that are already 7 bit are returned as is
+func To7Bit(msg []byte) (out []byte, err error) {
+	if !Is8Bit(msg) {
+		out = msg
+		return
+	}
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(msg)))
+	var hdr textproto.MIMEHeader
+	hdr, err = r.ReadMIMEHeader()
+	if err != nil {
+		return
+	}
+	var body []byte
+	body, err = ioutil.ReadAll(r.R)
+	if err != nil {
+		return
+	}
+	var buf bytes.Buffer
+	// keep the original header order, only the encoding changes
+	headerEnd := headerLength(msg)
+	var newBody []byte
+	newBody, hdr, err = entityTo7Bit(hdr, body)
+	if err == nil {
+		writeHeaderFrom(&buf, msg[:headerEnd], hdr)
+		buf.WriteString("\r\n")
+		buf.Write(newBody)
+		out = buf.Bytes()
+	}
+	return
+}
+
+// get the length of the header block of a message not including the blank line
+func headerLength(msg []byte) int {
+	for _, sep := range []string{"\r\n\r\n", "\n\n"} {
+		if idx := bytes.Index(msg, []byte(sep)); idx >= 0 {
+			return idx + len(sep)/2
+		}
+	}
+	return len(msg)
+}
+
+// write the raw header lines of orig in order with Content-Transfer-Encoding
+// taken from hdr, lines are written with crlf
+func writeHeaderFrom(w io.Writer, orig []byte, hdr textproto.MIMEHeader) {
+	cte := hdr.Get("Content-Transfer-Encoding")
+	wrote := false
+	skip := false
+	for _, line := range strings.SplitAfter(string(orig), "\n") {
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			// continuation of the previous header
+			if !skip {
+				io.WriteString(w, line+"\r\n")
+			}
+			continue
+		}
+		skip = false
+		if idx := strings.Index(line, ":"); idx > 0 && textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(line[:idx])) == "Content-Transfer-Encoding" {
+			skip = true
+			if !wrote && cte != "" {
+				io.WriteString(w, "Content-Transfer-Encoding: "+cte+"\r\n")
+				wrote = true
+			}
+			continue
+		}
+		io.WriteString(w, line+"\r\n")
+	}
+	if !wrote && cte != "" {
+		io.WriteString(w, "Content-Transfer-Encoding: "+cte+"\r\n")
+	}
+}
+
+// convert one mime entity to 7 bit
+// returns the new body and header
+func entityTo7Bit(hdr textproto.MIMEHeader, body []byte) (out []byte, newHdr textproto.MIMEHeader, err error) {
+	newHdr = hdr
+	out = body
+	if !Is8Bit(body) {
+		return
+	}
+	mediatype, params, e := mime.ParseMediaType(hdr.Get("Content-Type"))
+	if e == nil && strings.HasPrefix(mediatype, "multipart/") && params["boundary"] != "" {
+		var buf bytes.Buffer
+		mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+		mw := multipart.NewWriter(&buf)
+		err = mw.SetBoundary(params["boundary"])
+		for err == nil {
+			var p *multipart.Part
+			p, err = mr.NextRawPart()
+			if err == io.EOF {
+				err = mw.Close()
+				break
+			} else if err != nil {
+				break
+			}
+			var pbody []byte
+			pbody, err = ioutil.ReadAll(p)
+			if err != nil {
+				break
+			}
+			var phdr textproto.MIMEHeader
+			pbody, phdr, err = entityTo7Bit(p.Header, pbody)
+			if err != nil {
+				break
+			}
+			var pw io.Writer
+			pw, err = mw.CreatePart(phdr)
+			if err == nil {
+				_, err = pw.Write(pbody)
+			}
+		}
+		out = buf.Bytes()
+		return
+	}
+	// leaf entity, quoted-printable it
+	var buf bytes.Buffer
+	qp := quotedprintable.NewWriter(&buf)
+	_, err = qp.Write(body)
+	if err == nil {
+		err = qp.Close()
+	}
+	out = buf.Bytes()
+	newHdr = make(textproto.MIMEHeader)
+	for k, v := range hdr {
+		newHdr[k] = v
+	}
+	newHdr.Set("Content-Transfer-Encoding", "quoted-printable")
+	return
+}
@@ -0,0 +1,42 @@
+package message
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime/quotedprintable"
+	"net/mail"
+	"testing"
+)
+
+func TestTo7Bit(t *testing.T) {
+	msg := []byte("Subject: hi\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\nX-After: yes\r\n\r\nh\xc3\xa9llo w\xc3\xb6rld\r\n")
+	out, err := To7Bit(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Is8Bit(out) {
+		t.Fatalf("still 8 bit: %q", out)
+	}
+	m, err := mail.ReadMessage(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Header.Get("Content-Transfer-Encoding") != "quoted-printable" || m.Header.Get("X-After") != "yes" {
+		t.Fatalf("bad headers %v", m.Header)
+	}
+	body, _ := ioutil.ReadAll(quotedprintable.NewReader(m.Body))
+	if string(body) != "h\xc3\xa9llo w\xc3\xb6rld\r\n" {
+		t.Fatalf("decoded body is %q", body)
+	}
+}
+
+func TestTo7BitMultipart(t *testing.T) {
+	msg := []byte("Content-Type: multipart/alternative; boundary=b\r\n\r\n--b\r\nContent-Type: text/plain\r\n\r\nplain\r\n--b\r\nContent-Type: text/plain; charset=utf-8\r\n\r\nh\xc3\xa9llo\r\n--b--\r\n")
+	out, err := To7Bit(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Is8Bit(out) || !bytes.Contains(out, []byte("h=C3=A9llo")) || !bytes.Contains(out, []byte("\r\nplain\r\n")) {
+		t.Fatalf("bad conversion %q", out)
+	}
+}
@@ -1,9 +1,176 @@
 package pop3
 
+import (
+	"crypto/tls"
+	log "github.com/Sirupsen/logrus"
+	"github.com/majestrate/bdsmail/lib/maildir"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// how long a client may be idle by default, RFC 1939 asks for at least 10 minutes
+const DefaultIdleTimeout = 10 * time.Minute
+
+// capabilities from RFC 2449 every server has
+var defaultCapabilities = []string{"USER", "TOP", "UIDL", "EXPIRE NEVER", "LOGIN-DELAY 0"}
+
+// checks login credentials
+type Authenticator interface {
+	// check a username and password given with USER and PASS
+	Authenticate(username, password string) (bool, error)
+}
+
+// maps users to the maildir whose new and cur messages they download
+type Router interface {
+	Route(user string) (maildir.MailDir, error)
+}
+
 // pop3 server
 type Server struct {
+	// hostname we announce ourselves as
+	Hostname string
+	// checks logins
+	Auth Authenticator
+	// maps users to maildirs
+	Router Router
+	// idle time before a client is hung up on, 0 for DefaultIdleTimeout
+	IdleTimeout time.Duration
+	// allow USER and PASS without tls, only for connections that can't be snooped on
+	AllowInsecureAuth bool
+
+	// unexported fields
+
+	// listener for serving
+	listener net.Listener
+	// tls config for STLS, nil to not offer it
+	tlsConfig *tls.Config
+	// capabilities besides the defaults in the order they were added
+	capabilities []string
+}
+
+// offer STLS with a tls config
+func (s *Server) WithTLS(cfg *tls.Config) *Server {
+	s.tlsConfig = cfg
+	return s
+}
+
+// advertise a capability in CAPA, like "TOP" or "SASL PLAIN"
+// a capability with the same keyword as one already there replaces it,
+// so "EXPIRE 30" replaces the default "EXPIRE NEVER"
+func (s *Server) AddCapability(capability string) *Server {
+	keyword := capabilityKeyword(capability)
+	if keyword == "" {
+		return s
+	}
+	for idx, c := range s.capabilities {
+		if capabilityKeyword(c) == keyword {
+			s.capabilities[idx] = capability
+			return s
+		}
+	}
+	s.capabilities = append(s.capabilities, capability)
+	return s
+}
+
+// get the keyword a capability starts with in upper case
+func capabilityKeyword(capability string) string {
+	fields := strings.Fields(capability)
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.ToUpper(fields[0])
+}
+
+// get the capabilities CAPA lists
+// STLS is only listed when there is a tls config and the connection isn't already encrypted,
+// USER only when a password may be sent over the connection
+func (s *Server) Capabilities(encrypted bool) (caps []string) {
+	added := make(map[string]bool)
+	for _, c := range s.capabilities {
+		added[capabilityKeyword(c)] = true
+	}
+	for _, c := range defaultCapabilities {
+		if c == "USER" && !encrypted && !s.AllowInsecureAuth {
+			continue
+		}
+		if !added[capabilityKeyword(c)] {
+			caps = append(caps, c)
+		}
+	}
+	if s.tlsConfig != nil && !encrypted && !added["STLS"] {
+		caps = append(caps, "STLS")
+	}
+	caps = append(caps, s.capabilities...)
+	return
+}
+
+// write the multi-line response to CAPA
+func (s *Server) writeCapa(w io.Writer, encrypted bool) (err error) {
+	resp := "+OK Capability list follows\r\n"
+	for _, c := range s.Capabilities(encrypted) {
+		resp += c + "\r\n"
+	}
+	_, err = io.WriteString(w, resp+".\r\n")
+	return
+}
+
+func (s *Server) idleTimeout() time.Duration {
+	if s.IdleTimeout > 0 {
+		return s.IdleTimeout
+	}
+	return DefaultIdleTimeout
+}
+
+// serve pop3 on a tcp address, usually port 110
+// blocks until the server is closed
+func (s *Server) ListenAndServe(addr string) (err error) {
+	var l net.Listener
+	l, err = net.Listen("tcp", addr)
+	if err == nil {
+		err = s.Serve(l)
+	}
+	return
+}
+
+// serve pop3 on an existing listener
+// blocks until the server is closed
+func (s *Server) Serve(l net.Listener) (err error) {
+	s.listener = l
+	log.Info("Serving POP3 server on ", l.Addr())
+	for {
+		var c net.Conn
+		c, err = l.Accept()
+		if err != nil {
+			break
+		}
+		go s.handle(c)
+	}
+	log.Info("POP3 server ended")
+	return
+}
+
+// stop serving
+func (s *Server) Close() (err error) {
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	return
+}
+
+// handle an inbound connection
+func (s *Server) handle(c net.Conn) {
+	sess := newSession(s, c)
+	sess.run()
+	sess.c.Close()
 }
 
-func New() *Server {
-	return nil
+// create a new pop3 server
+func New(hostname string, auth Authenticator, router Router) *Server {
+	return &Server{
+		Hostname: hostname,
+		Auth:     auth,
+		Router:   router,
+	}
 }
@@ -0,0 +1,142 @@
+package pop3
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"github.com/majestrate/bdsmail/lib/maildir"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCapa(t *testing.T) {
+	s := New("localhost", nil, nil)
+	var buf bytes.Buffer
+	if err := s.writeCapa(&buf, true); err != nil {
+		t.Fatal(err)
+	}
+	want := "+OK Capability list follows\r\nUSER\r\nTOP\r\nUIDL\r\nEXPIRE NEVER\r\nLOGIN-DELAY 0\r\n.\r\n"
+	if buf.String() != want {
+		t.Fatalf("CAPA gave %q", buf.String())
+	}
+	s.WithTLS(&tls.Config{}).AddCapability("SASL PLAIN").AddCapability("expire 30").AddCapability(" ")
+	buf.Reset()
+	s.writeCapa(&buf, false)
+	// no USER until a password can be sent safely
+	want = "+OK Capability list follows\r\nTOP\r\nUIDL\r\nLOGIN-DELAY 0\r\nSTLS\r\nSASL PLAIN\r\nexpire 30\r\n.\r\n"
+	if buf.String() != want {
+		t.Fatalf("CAPA with added capabilities gave %q", buf.String())
+	}
+	// no STLS once the connection is encrypted
+	for _, c := range s.Capabilities(true) {
+		if c == "STLS" {
+			t.Fatal("STLS offered over tls")
+		}
+	}
+}
+
+// one user with one password and maildir
+type testAuth struct {
+	user, pass string
+	dir        maildir.MailDir
+}
+
+func (a *testAuth) Authenticate(user, pass string) (bool, error) {
+	return user == a.user && pass == a.pass, nil
+}
+
+func (a *testAuth) Route(user string) (maildir.MailDir, error) {
+	return a.dir, nil
+}
+
+func TestSession(t *testing.T) {
+	a := &testAuth{user: "alice", pass: "secret words", dir: maildir.MailDir(t.TempDir())}
+	if err := a.dir.Ensure(); err != nil {
+		t.Fatal(err)
+	}
+	first, err := a.dir.Deliver(strings.NewReader("Subject: one\n\nfirst\n.dotted\nthird\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = a.dir.Deliver(strings.NewReader("Subject: two\n\nsecond\n")); err != nil {
+		t.Fatal(err)
+	}
+	s := New("localhost", a, a)
+	s.AllowInsecureAuth = true
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(c)
+	// send a command and read its status line, and the lines after it if it is multi line
+	command := func(cmd, status string, multi bool) (lines []string) {
+		if cmd != "" {
+			fmt.Fprintf(c, "%s\r\n", cmd)
+		}
+		line, err := r.ReadString('\n')
+		if err != nil || !strings.HasPrefix(line, status) {
+			t.Fatalf("%s: got %q %v", cmd, line, err)
+		}
+		for multi {
+			line, err = r.ReadString('\n')
+			if err != nil {
+				t.Fatalf("%s: %v", cmd, err)
+			}
+			if line == ".\r\n" {
+				break
+			}
+			lines = append(lines, strings.TrimSuffix(line, "\r\n"))
+		}
+		return
+	}
+	command("", "+OK", false)
+	if caps := command("CAPA", "+OK", true); len(caps) != 5 || caps[0] != "USER" {
+		t.Fatalf("CAPA gave %q", caps)
+	}
+	command("STAT", "-ERR", false)
+	command("USER alice", "+OK", false)
+	command("PASS wrong", "-ERR", false)
+	command("PASS secret words", "-ERR", false)
+	command("USER alice", "+OK", false)
+	command("PASS secret words", "+OK", false)
+	command("STAT", "+OK 2 ", false)
+	uidls := command("UIDL", "+OK", true)
+	if len(uidls) != 2 {
+		t.Fatalf("UIDL gave %q", uidls)
+	}
+	idx := "1"
+	if uidls[1] == "2 "+first.POP3UIDL() {
+		idx = "2"
+	}
+	if body := command("RETR "+idx, "+OK", true); strings.Join(body, "\n") != "Subject: one\n\nfirst\n..dotted\nthird" {
+		t.Fatalf("RETR gave %q", body)
+	}
+	if top := command("TOP "+idx+" 1", "+OK", true); strings.Join(top, "\n") != "Subject: one\n\nfirst" {
+		t.Fatalf("TOP gave %q", top)
+	}
+	if top := command("TOP "+idx+" 0", "+OK", true); strings.Join(top, "\n") != "Subject: one\n" {
+		t.Fatalf("TOP 0 gave %q", top)
+	}
+	command("DELE "+idx, "+OK", false)
+	command("RETR "+idx, "-ERR", false)
+	if list := command("LIST", "+OK", true); len(list) != 1 {
+		t.Fatalf("LIST after DELE gave %q", list)
+	}
+	command("RETR 3", "-ERR", false)
+	command(strings.Repeat("x", maxLine+1), "-ERR", false)
+	command("QUIT", "+OK", false)
+	if msgs, _ := a.dir.ListNew(); len(msgs) != 1 || msgs[0] == first {
+		t.Fatalf("messages left after QUIT %v", msgs)
+	}
+}
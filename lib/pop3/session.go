@@ -0,0 +1,352 @@
+package pop3
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/majestrate/bdsmail/lib/maildir"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errLineTooLong = errors.New("line too long")
+
+// longest command line we take, RFC 2449 allows 255 octets
+const maxLine = 512
+
+// a pop3 session for one connection
+type session struct {
+	s   *Server
+	c   net.Conn
+	r   *bufio.Reader
+	w   *bufio.Writer
+	tls bool
+	// user given with USER, waiting for PASS
+	pending string
+	// logged in user, empty before PASS
+	user string
+	dir  maildir.MailDir
+	// messages as they were when the user logged in, numbered from 1
+	entries []maildir.POP3Entry
+	// messages marked with DELE by index into entries
+	deleted map[int]bool
+}
+
+func newSession(s *Server, c net.Conn) *session {
+	return &session{
+		s: s,
+		c: c,
+		r: bufio.NewReader(c),
+		w: bufio.NewWriter(c),
+	}
+}
+
+// send a response line
+func (sess *session) line(str string) (err error) {
+	_, err = sess.w.WriteString(str + "\r\n")
+	if err == nil {
+		err = sess.w.Flush()
+	}
+	return
+}
+
+// send a +OK response
+func (sess *session) ok(msg string) error {
+	return sess.line("+OK " + msg)
+}
+
+// send a -ERR response
+func (sess *session) err(msg string) error {
+	return sess.line("-ERR " + msg)
+}
+
+// can we take a password on this session
+func (sess *session) authAllowed() bool {
+	return sess.s.Auth != nil && (sess.tls || sess.s.AllowInsecureAuth)
+}
+
+// read a command line without its line ending
+// returns errLineTooLong with the line consumed if it was longer than maxLine
+func (sess *session) readLine() (line string, err error) {
+	var sb strings.Builder
+	for {
+		var c byte
+		c, err = sess.r.ReadByte()
+		if err != nil {
+			return
+		}
+		if c == '\n' {
+			break
+		}
+		if sb.Len() <= maxLine {
+			sb.WriteByte(c)
+		}
+	}
+	if sb.Len() > maxLine {
+		err = errLineTooLong
+	} else {
+		line = strings.TrimRight(sb.String(), "\r")
+	}
+	return
+}
+
+// run the session until the client quits or the connection drops
+func (sess *session) run() {
+	err := sess.ok(sess.s.Hostname + " POP3 ready")
+	for err == nil {
+		var line string
+		sess.c.SetReadDeadline(time.Now().Add(sess.s.idleTimeout()))
+		line, err = sess.readLine()
+		if err == errLineTooLong {
+			err = sess.err("Line too long")
+			continue
+		} else if e, ok := err.(net.Error); ok && e.Timeout() {
+			sess.err("Idle for too long")
+			break
+		} else if err != nil {
+			break
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			err = sess.err("Empty command")
+			continue
+		}
+		cmd := strings.ToUpper(args[0])
+		args = args[1:]
+		switch cmd {
+		case "CAPA":
+			err = sess.s.writeCapa(sess.w, sess.tls)
+			if err == nil {
+				err = sess.w.Flush()
+			}
+		case "NOOP":
+			err = sess.ok("Done")
+		case "QUIT":
+			sess.quit()
+			return
+		case "STLS":
+			err = sess.startTLS()
+		case "USER":
+			err = sess.userCommand(args)
+		case "PASS":
+			err = sess.pass(line)
+		case "STAT", "LIST", "UIDL", "RETR", "TOP", "DELE", "RSET":
+			if sess.user == "" {
+				err = sess.err("Log in first")
+			} else {
+				err = sess.transaction(cmd, args)
+			}
+		default:
+			err = sess.err("Unknown command")
+		}
+	}
+	if err != nil && err != io.EOF {
+		log.Warn("pop3 session with ", sess.c.RemoteAddr(), " ended: ", err)
+	}
+}
+
+// handle STLS from RFC 2595
+func (sess *session) startTLS() (err error) {
+	if sess.s.tlsConfig == nil || sess.tls || sess.user != "" {
+		return sess.err("STLS not available")
+	}
+	err = sess.ok("Begin TLS negotiation")
+	if err == nil {
+		tc := tls.Server(sess.c, sess.s.tlsConfig)
+		err = tc.Handshake()
+		if err == nil {
+			sess.c = tc
+			sess.r = bufio.NewReader(tc)
+			sess.w = bufio.NewWriter(tc)
+			sess.tls = true
+			sess.pending = ""
+		}
+	}
+	return
+}
+
+// handle USER name
+func (sess *session) userCommand(args []string) error {
+	if sess.user != "" {
+		return sess.err("Already logged in")
+	}
+	if !sess.authAllowed() {
+		return sess.err("Use STLS first")
+	}
+	if len(args) != 1 {
+		return sess.err("Syntax: USER name")
+	}
+	sess.pending = args[0]
+	return sess.ok("Send PASS")
+}
+
+// handle PASS password, the password is the rest of the line so it may have spaces
+func (sess *session) pass(line string) (err error) {
+	user := sess.pending
+	sess.pending = ""
+	if sess.user != "" {
+		return sess.err("Already logged in")
+	}
+	if user == "" {
+		return sess.err("Send USER first")
+	}
+	password := ""
+	if idx := strings.IndexByte(line, ' '); idx >= 0 {
+		password = line[idx+1:]
+	}
+	ok, e := sess.s.Auth.Authenticate(user, password)
+	if e != nil {
+		log.Error("pop3 failed to check login for ", user, ": ", e)
+		return sess.err("Authentication failed")
+	}
+	if !ok {
+		return sess.err("Authentication failed")
+	}
+	sess.dir, e = sess.s.Router.Route(user)
+	if e == nil {
+		sess.entries, e = sess.dir.ListForPOP3()
+	}
+	if e != nil {
+		log.Error("pop3 failed to open maildir for ", user, ": ", e)
+		return sess.err("Mailbox unavailable")
+	}
+	sess.user = user
+	sess.deleted = make(map[int]bool)
+	return sess.ok(fmt.Sprintf("Logged in, %d messages", len(sess.entries)))
+}
+
+// get the index into entries of a message number that isn't deleted
+func (sess *session) message(arg string) (idx int, ok bool) {
+	n, err := strconv.Atoi(arg)
+	idx = n - 1
+	ok = err == nil && idx >= 0 && idx < len(sess.entries) && !sess.deleted[idx]
+	return
+}
+
+// handle a command from the transaction state
+func (sess *session) transaction(cmd string, args []string) (err error) {
+	switch cmd {
+	case "STAT":
+		var count int
+		var size int64
+		for idx, ent := range sess.entries {
+			if !sess.deleted[idx] {
+				count++
+				size += ent.Size
+			}
+		}
+		return sess.ok(fmt.Sprintf("%d %d", count, size))
+	case "RSET":
+		sess.deleted = make(map[int]bool)
+		return sess.ok("Deletions undone")
+	case "LIST", "UIDL":
+		listing := func(idx int) string {
+			if cmd == "LIST" {
+				return fmt.Sprintf("%d %d", idx+1, sess.entries[idx].Size)
+			}
+			return fmt.Sprintf("%d %s", idx+1, sess.entries[idx].UIDL)
+		}
+		if len(args) == 1 {
+			idx, ok := sess.message(args[0])
+			if !ok {
+				return sess.err("No such message")
+			}
+			return sess.ok(listing(idx))
+		} else if len(args) > 1 {
+			return sess.err("Syntax: " + cmd + " [msg]")
+		}
+		if _, err = sess.w.WriteString("+OK\r\n"); err != nil {
+			return
+		}
+		for idx := range sess.entries {
+			if !sess.deleted[idx] {
+				if _, err = sess.w.WriteString(listing(idx) + "\r\n"); err != nil {
+					return
+				}
+			}
+		}
+		return sess.line(".")
+	}
+	// the rest take a message number
+	want := 1
+	if cmd == "TOP" {
+		want = 2
+	}
+	if len(args) != want {
+		return sess.err("Wrong number of arguments")
+	}
+	idx, ok := sess.message(args[0])
+	if !ok {
+		return sess.err("No such message")
+	}
+	switch cmd {
+	case "DELE":
+		sess.deleted[idx] = true
+		return sess.ok("Marked to be deleted")
+	case "TOP":
+		lines, e := strconv.Atoi(args[1])
+		if e != nil || lines < 0 {
+			return sess.err("Bad line count")
+		}
+		return sess.send(idx, lines)
+	default:
+		return sess.send(idx, -1)
+	}
+}
+
+// send a message for RETR, or its header and the first lines of its body for TOP
+// lines is -1 to send all of it
+func (sess *session) send(idx, lines int) (err error) {
+	r, e := sess.dir.OpenSeekable(sess.entries[idx].Msg)
+	if e != nil {
+		log.Error("pop3 failed to open ", sess.entries[idx].Msg, " for ", sess.user, ": ", e)
+		return sess.err("Message unavailable")
+	}
+	defer r.Close()
+	if _, err = sess.w.WriteString("+OK\r\n"); err != nil {
+		return
+	}
+	// the dot writer makes line endings crlf and escapes lines starting with a dot
+	dw := textproto.NewWriter(sess.w).DotWriter()
+	br := bufio.NewReader(r)
+	inBody := false
+	for !inBody || lines != 0 {
+		line, e := br.ReadString('\n')
+		if _, err = io.WriteString(dw, line); err != nil {
+			return
+		}
+		if e != nil {
+			break
+		}
+		if inBody {
+			if lines > 0 {
+				lines--
+			}
+		} else if strings.TrimRight(line, "\r\n") == "" {
+			inBody = true
+		}
+	}
+	return dw.Close()
+}
+
+// handle QUIT, messages marked with DELE are removed when logged in
+func (sess *session) quit() {
+	failed := 0
+	for idx := range sess.deleted {
+		if err := sess.dir.Remove(sess.entries[idx].Msg); err != nil {
+			log.Error("pop3 failed to remove ", sess.entries[idx].Msg, " for ", sess.user, ": ", err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		sess.err(fmt.Sprintf("%d messages not removed", failed))
+	} else {
+		sess.ok("Bye")
+	}
+}
@@ -0,0 +1,4 @@
+//
+// outbound mail queue with retries
+//
+package queue
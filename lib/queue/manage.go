@@ -0,0 +1,97 @@
+package queue
+
+import (
+	"github.com/majestrate/bdsmail/lib/maildir"
+	"os"
+	"sort"
+)
+
+// a message waiting in the queue
+type QueueEntry struct {
+	JobStatus
+	// size of the spooled message in bytes
+	Size int64
+}
+
+// list queued messages in the order they are due
+func (q *Queue) List() (entries []QueueEntry, err error) {
+	q.mtx.Lock()
+	var jobs []*JobStatus
+	jobs, err = q.jobs()
+	q.mtx.Unlock()
+	if err != nil {
+		return
+	}
+	for _, job := range jobs {
+		if job.State != Queued {
+			continue
+		}
+		e := QueueEntry{JobStatus: *job}
+		// spooled messages stay in new
+		if st, err := os.Stat(q.spool.New(job.ID)); err == nil {
+			e.Size = st.Size()
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].NextAttempt.Before(entries[j].NextAttempt)
+	})
+	return
+}
+
+// remove a message from the queue without telling the sender
+func (q *Queue) Cancel(jobID string) error {
+	return q.cancel(jobID, false)
+}
+
+// remove a message from the queue and bounce it back to the sender
+func (q *Queue) CancelAndBounce(jobID string) error {
+	return q.cancel(jobID, true)
+}
+
+func (q *Queue) cancel(jobID string, bounce bool) (err error) {
+	q.mtx.Lock()
+	var job *JobStatus
+	job, err = q.load(jobID)
+	if err == nil && job.State != Queued {
+		err = ErrNotQueued
+	}
+	if err == nil {
+		job.State = Cancelled
+		if job.LastError == "" {
+			job.LastError = "cancelled"
+		}
+		err = q.save(job)
+	}
+	q.mtx.Unlock()
+	if err == nil {
+		if bounce {
+			q.bounce(job, "5.0.0")
+		}
+		q.spool.Remove(maildir.Message(job.ID))
+	}
+	return
+}
+
+// try every queued message now instead of waiting for its retry time
+// blocks until the attempts are done
+func (q *Queue) Flush() (err error) {
+	q.mtx.Lock()
+	var jobs []*JobStatus
+	jobs, err = q.jobs()
+	now := q.now()
+	for _, job := range jobs {
+		if err != nil {
+			break
+		}
+		if job.State == Queued && job.NextAttempt.After(now) {
+			job.NextAttempt = now
+			err = q.save(job)
+		}
+	}
+	q.mtx.Unlock()
+	if err == nil {
+		q.runDue()
+	}
+	return
+}
@@ -0,0 +1,62 @@
+package queue
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestQueueManage(t *testing.T) {
+	tr := &testTransport{errs: []error{errors.New("refused"), errors.New("refused")}}
+	q, _ := testQueue(t, tr)
+	first, err := q.Enqueue("a@example.com", []string{"b@example.net"}, []byte("Subject: one\n\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := q.Enqueue("a@example.com", []string{"c@example.net"}, []byte("Subject: two\n\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// both fail and are deferred
+	q.runDue()
+	entries, err := q.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Attempts != 1 || entries[0].Size != int64(len("Subject: one\n\n")) {
+		t.Fatalf("listing was %+v", entries)
+	}
+	if err = q.CancelAndBounce(first); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Cancel(first); err != ErrNotQueued {
+		t.Fatalf("cancelling twice gave %v", err)
+	}
+	st, _ := q.Status(first)
+	if st.State != Cancelled {
+		t.Fatalf("cancelled job %+v", st)
+	}
+	// flush sends the deferred message and the bounce without waiting
+	if err = q.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	st, _ = q.Status(second)
+	if st.State != Delivered {
+		t.Fatalf("flushed job %+v", st)
+	}
+	if len(tr.sent) != 2 {
+		t.Fatalf("sent %d messages", len(tr.sent))
+	}
+	bounced := false
+	for idx, body := range tr.sent {
+		if tr.to[idx][0] == "a@example.com" && strings.Contains(body, "Action: failed") {
+			bounced = true
+		}
+	}
+	if !bounced {
+		t.Fatal("cancelled message was not bounced")
+	}
+	if entries, _ = q.List(); len(entries) != 0 {
+		t.Fatalf("queue not empty %+v", entries)
+	}
+}
@@ -0,0 +1,466 @@
+package queue
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"github.com/majestrate/bdsmail/lib/maildir"
+	"github.com/majestrate/bdsmail/lib/message"
+	"github.com/majestrate/bdsmail/lib/smtpclient"
+	"io"
+	"io/ioutil"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// returned for a job id the queue doesn't know
+var ErrNoJob = errors.New("queue: no such job")
+
+// returned when cancelling a job that is no longer queued
+var ErrNotQueued = errors.New("queue: job is not queued")
+
+// delays before each retry of a failed delivery
+// a delivery failing after the last one bounces
+var Backoff = []time.Duration{
+	time.Minute,
+	time.Minute * 5,
+	time.Minute * 15,
+	time.Hour,
+	time.Hour * 4,
+	time.Hour * 24,
+}
+
+// how often Run looks for due jobs when nothing wakes it
+const PollInterval = time.Second * 30
+
+// how long a job waits after its domain's rate limit was used up
+const RateLimitDelay = time.Minute
+
+// how long the status of a finished job can still be looked up
+const KeepFinished = time.Hour * 24
+
+// state of a queued job
+type State string
+
+const (
+	// waiting for its next delivery attempt
+	Queued = State("queued")
+	// accepted by the next hop
+	Delivered = State("delivered")
+	// gave up and told the sender
+	Bounced = State("bounced")
+	// removed from the queue by hand
+	Cancelled = State("cancelled")
+)
+
+// sends a message on to the next hop, smtpclient.Relay is one
+// a failure is retried unless it is a 5xx reply or a *PermanentError,
+// smtpclient.ErrRateLimited is retried without counting as an attempt
+type Transport interface {
+	Send(from string, to []string, msg io.Reader) error
+}
+
+// a transport failure retrying won't fix that isn't an smtp reply
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// state of a job in the queue
+type JobStatus struct {
+	ID string
+	// envelope
+	From string
+	To   []string
+	// where it is at
+	State State
+	// delivery attempts made so far
+	Attempts int
+	// when it was enqueued
+	Queued time.Time
+	// when it will next be tried if it is queued
+	NextAttempt time.Time
+	// error from the last failed attempt
+	LastError string
+}
+
+// outbound queue spooling messages in a maildir
+// job state is kept as json next to the spool in a jobs directory,
+// finished jobs move to its done directory until KeepFinished passes
+type Queue struct {
+	// hostname bounces are reported from
+	Hostname string
+
+	spool     maildir.MailDir
+	transport Transport
+	// serializes job updates
+	mtx sync.Mutex
+	// serializes delivery runs so a job is never sent twice at once
+	runMtx sync.Mutex
+	// poked when a job is enqueued
+	wake chan struct{}
+	// per domain retry limits, nil to use Backoff for everything
+	policies *smtpclient.PolicyStore
+	// when finished jobs were last pruned
+	pruned time.Time
+	// clock, for tests
+	now func() time.Time
+}
+
+func New(spool maildir.MailDir, hostname string, transport Transport) *Queue {
+	return &Queue{
+		Hostname:  hostname,
+		spool:     spool,
+		transport: transport,
+		wake:      make(chan struct{}, 1),
+		now:       time.Now,
+	}
+}
+
+// take retry limits from per domain policies
+func (q *Queue) WithPolicies(ps *smtpclient.PolicyStore) *Queue {
+	q.policies = ps
+	return q
+}
+
+// get how many attempts a job gets before it bounces
+// a job going to several domains gets the smallest limit of them
+func (q *Queue) attempts(job *JobStatus) (limit int) {
+	limit = len(Backoff) + 1
+	if q.policies == nil {
+		return
+	}
+	for _, to := range job.To {
+		domain := to[strings.LastIndex(to, "@")+1:]
+		if p := q.policies.GetPolicy(domain); p.RetryLimit > 0 && p.RetryLimit < limit {
+			limit = p.RetryLimit
+		}
+	}
+	return
+}
+
+// ensure the spool is well formed
+func (q *Queue) Ensure() (err error) {
+	err = q.spool.Ensure()
+	if err == nil {
+		err = os.MkdirAll(q.doneDir(), 0700)
+	}
+	return
+}
+
+func (q *Queue) jobsDir() string {
+	return filepath.Join(q.spool.Filepath(), "jobs")
+}
+
+func (q *Queue) doneDir() string {
+	return filepath.Join(q.jobsDir(), "done")
+}
+
+// get where a job is kept, queued jobs are apart from finished ones
+// so polling only reads what is still queued
+func (q *Queue) jobPath(id string, state State) string {
+	if state == Queued {
+		return filepath.Join(q.jobsDir(), id+".json")
+	}
+	return filepath.Join(q.doneDir(), id+".json")
+}
+
+// spool a message for delivery and schedule it to be sent right away
+// returns the id to get its status with
+func (q *Queue) Enqueue(from string, to []string, msg []byte) (jobID string, err error) {
+	var m maildir.Message
+	m, err = q.spool.Deliver(bytes.NewReader(msg))
+	if err != nil {
+		return
+	}
+	now := q.now()
+	job := &JobStatus{
+		ID:          m.Name(),
+		From:        from,
+		To:          to,
+		State:       Queued,
+		Queued:      now,
+		NextAttempt: now,
+	}
+	q.mtx.Lock()
+	err = q.save(job)
+	q.mtx.Unlock()
+	if err == nil {
+		jobID = job.ID
+		select {
+		case q.wake <- struct{}{}:
+		default:
+		}
+	} else {
+		q.spool.Remove(m)
+	}
+	return
+}
+
+// get the current state of a job
+func (q *Queue) Status(jobID string) (st JobStatus, err error) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	var job *JobStatus
+	job, err = q.load(jobID)
+	if err == nil {
+		st = *job
+	}
+	return
+}
+
+// read a job, the caller holds the mutex
+func (q *Queue) load(id string) (job *JobStatus, err error) {
+	if strings.ContainsAny(id, "/\\") || id == "" {
+		err = ErrNoJob
+		return
+	}
+	var data []byte
+	data, err = ioutil.ReadFile(q.jobPath(id, Queued))
+	if os.IsNotExist(err) {
+		data, err = ioutil.ReadFile(q.jobPath(id, Delivered))
+	}
+	if os.IsNotExist(err) {
+		err = ErrNoJob
+	}
+	if err == nil {
+		job = new(JobStatus)
+		err = json.Unmarshal(data, job)
+	}
+	return
+}
+
+// write a job atomically, the caller holds the mutex
+// a finished job is moved out of the queued jobs
+func (q *Queue) save(job *JobStatus) (err error) {
+	var data []byte
+	data, err = json.Marshal(job)
+	if err == nil {
+		fname := q.jobPath(job.ID, job.State)
+		err = ioutil.WriteFile(fname+".tmp", data, 0600)
+		if err == nil {
+			err = os.Rename(fname+".tmp", fname)
+		}
+	}
+	if err == nil && job.State != Queued {
+		err = os.Remove(q.jobPath(job.ID, Queued))
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	return
+}
+
+// forget finished jobs older than KeepFinished, the caller holds the mutex
+// runs at most once an hour
+func (q *Queue) prune() {
+	now := q.now()
+	if now.Sub(q.pruned) < time.Hour {
+		return
+	}
+	q.pruned = now
+	files, err := ioutil.ReadDir(q.doneDir())
+	if err != nil {
+		log.Error("failed to list finished queue jobs: ", err)
+		return
+	}
+	for _, f := range files {
+		if now.Sub(f.ModTime()) > KeepFinished {
+			os.Remove(filepath.Join(q.doneDir(), f.Name()))
+		}
+	}
+}
+
+// read every queued job, the caller holds the mutex
+func (q *Queue) jobs() (jobs []*JobStatus, err error) {
+	var files []os.FileInfo
+	files, err = ioutil.ReadDir(q.jobsDir())
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		job, e := q.load(strings.TrimSuffix(f.Name(), ".json"))
+		if e != nil {
+			log.Warn("skipping unreadable queue job ", f.Name(), ": ", e)
+			continue
+		}
+		if job.State != Queued {
+			// finished before jobs were moved out when they finish
+			q.save(job)
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	return
+}
+
+// get the queued jobs that are due, the caller holds the mutex
+func (q *Queue) due() (due []*JobStatus, err error) {
+	var jobs []*JobStatus
+	jobs, err = q.jobs()
+	now := q.now()
+	for _, job := range jobs {
+		if job.State == Queued && !job.NextAttempt.After(now) {
+			due = append(due, job)
+		}
+	}
+	return
+}
+
+// drive deliveries until the context is done
+func (q *Queue) Run(ctx context.Context) error {
+	ticker := time.NewTicker(PollInterval)
+	defer ticker.Stop()
+	for {
+		q.runDue()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-q.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// attempt every job that is due
+func (q *Queue) runDue() {
+	q.runMtx.Lock()
+	defer q.runMtx.Unlock()
+	q.mtx.Lock()
+	q.prune()
+	jobs, err := q.due()
+	q.mtx.Unlock()
+	if err != nil {
+		log.Error("failed to list queue: ", err)
+		return
+	}
+	for _, job := range jobs {
+		q.attempt(job)
+	}
+}
+
+// try to deliver a job once and record the outcome
+func (q *Queue) attempt(job *JobStatus) {
+	msg := maildir.Message(job.ID)
+	r, err := q.spool.OpenSeekable(msg)
+	if err == nil {
+		err = q.transport.Send(job.From, job.To, r)
+		r.Close()
+	}
+	// a rate limited domain was never tried so it doesn't count as an attempt
+	rateLimited := errors.Is(err, smtpclient.ErrRateLimited)
+	if !rateLimited {
+		job.Attempts++
+	}
+	if err == nil {
+		log.Info("queue delivered ", job.ID, " from ", job.From)
+		job.State = Delivered
+		job.LastError = ""
+		q.spool.Remove(msg)
+	} else if rateLimited {
+		job.LastError = err.Error()
+		job.NextAttempt = q.now().Add(RateLimitDelay)
+		log.Info("queue rate limited ", job.ID, " until ", job.NextAttempt)
+	} else if permanent(err) || job.Attempts >= q.attempts(job) {
+		log.Warn("queue giving up on ", job.ID, ": ", err)
+		job.State = Bounced
+		job.LastError = err.Error()
+		status := "5.0.0"
+		if !permanent(err) {
+			// retries ran out
+			status = "5.4.7"
+		}
+		q.bounce(job, status)
+		q.spool.Remove(msg)
+	} else {
+		job.LastError = err.Error()
+		job.NextAttempt = q.now().Add(Backoff[job.Attempts-1])
+		log.Info("queue will retry ", job.ID, " at ", job.NextAttempt, ": ", err)
+	}
+	q.mtx.Lock()
+	if cur, e := q.load(job.ID); e == nil && cur.State == Cancelled {
+		// cancelled while we were sending, leave it be
+		err = nil
+	} else {
+		err = q.save(job)
+	}
+	q.mtx.Unlock()
+	if err != nil {
+		log.Error("failed to save queue job ", job.ID, ": ", err)
+	}
+}
+
+// return true if retrying won't help
+// only 5xx replies and errors marked permanent are, failing to reach the
+// next hop is always retried
+func permanent(err error) bool {
+	var p *PermanentError
+	if errors.As(err, &p) {
+		return true
+	}
+	var d *smtpclient.DeliveryError
+	if errors.As(err, &d) {
+		// only the last host tried counts
+		return !d.Temporary()
+	}
+	var e *textproto.Error
+	if errors.As(err, &e) {
+		return e.Code >= 500
+	}
+	return false
+}
+
+// queue a failure report back to the sender of a job with a permanent status
+// bounces have a null sender so they never bounce themselves
+func (q *Queue) bounce(job *JobStatus, status string) {
+	if job.From == "" {
+		return
+	}
+	var original []byte
+	r, err := q.spool.OpenSeekable(maildir.Message(job.ID))
+	if err == nil {
+		original, err = ioutil.ReadAll(r)
+		r.Close()
+	}
+	if err != nil {
+		log.Error("failed to read bounced message ", job.ID, ": ", err)
+		return
+	}
+	dsn := &message.DSN{
+		ReportingMTA: q.Hostname,
+		ArrivalDate:  job.Queued,
+		HeadersOnly:  true,
+	}
+	for _, to := range job.To {
+		dsn.Recipients = append(dsn.Recipients, message.RecipientStatus{
+			FinalRecipient: to,
+			Action:         "failed",
+			Status:         status,
+			Diagnostic:     job.LastError,
+		})
+	}
+	var body []byte
+	body, err = dsn.Build("MAILER-DAEMON@"+q.Hostname, job.From, original)
+	if err == nil {
+		_, err = q.Enqueue("", []string{job.From}, body)
+	}
+	if err != nil {
+		log.Error("failed to bounce ", job.ID, " to ", job.From, ": ", err)
+	}
+}
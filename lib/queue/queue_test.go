@@ -0,0 +1,207 @@
+package queue
+
+import (
+	"errors"
+	"github.com/majestrate/bdsmail/lib/maildir"
+	"github.com/majestrate/bdsmail/lib/smtpclient"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// transport failing with each error in turn then succeeding
+type testTransport struct {
+	errs []error
+	sent []string
+	to   [][]string
+}
+
+func (t *testTransport) Send(from string, to []string, msg io.Reader) error {
+	if len(t.errs) > 0 {
+		err := t.errs[0]
+		t.errs = t.errs[1:]
+		return err
+	}
+	body, _ := ioutil.ReadAll(msg)
+	t.sent = append(t.sent, string(body))
+	t.to = append(t.to, to)
+	return nil
+}
+
+// get the error from dialing a port nothing listens on
+func refused(t *testing.T) error {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err == nil {
+		c.Close()
+		t.Fatal("dial to a closed port worked")
+	}
+	return err
+}
+
+// make a queue with a clock that only moves when told to
+func testQueue(t *testing.T, tr Transport) (*Queue, *time.Time) {
+	q := New(maildir.MailDir(t.TempDir()), "mx.example.com", tr)
+	if err := q.Ensure(); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	q.now = func() time.Time { return now }
+	return q, &now
+}
+
+func TestQueueRetry(t *testing.T) {
+	tr := &testTransport{errs: []error{refused(t), refused(t)}}
+	q, now := testQueue(t, tr)
+	id, err := q.Enqueue("a@example.com", []string{"b@example.net"}, []byte("Subject: hi\n\nbody\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.runDue()
+	st, err := q.Status(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.State != Queued || st.Attempts != 1 || !st.NextAttempt.Equal(now.Add(time.Minute)) {
+		t.Fatalf("after first failure %+v", st)
+	}
+	// not due yet
+	q.runDue()
+	if st, _ = q.Status(id); st.Attempts != 1 {
+		t.Fatalf("retried early %+v", st)
+	}
+	*now = now.Add(time.Minute)
+	q.runDue()
+	if st, _ = q.Status(id); st.Attempts != 2 || !st.NextAttempt.Equal(now.Add(time.Minute*5)) {
+		t.Fatalf("after second failure %+v", st)
+	}
+	*now = now.Add(time.Minute * 5)
+	q.runDue()
+	if st, _ = q.Status(id); st.State != Delivered || st.LastError != "" {
+		t.Fatalf("after delivery %+v", st)
+	}
+	if len(tr.sent) != 1 || tr.sent[0] != "Subject: hi\n\nbody\n" {
+		t.Fatalf("sent %q", tr.sent)
+	}
+	if msgs, _ := q.spool.ListNew(); len(msgs) != 0 {
+		t.Fatal("delivered message left in spool")
+	}
+	if queued, _ := filepath.Glob(filepath.Join(q.jobsDir(), "*.json")); len(queued) != 0 {
+		t.Fatalf("delivered job still queued %q", queued)
+	}
+	// finished jobs are forgotten after a while
+	*now = now.Add(KeepFinished + time.Hour)
+	q.runDue()
+	if _, err = q.Status(id); err != ErrNoJob {
+		t.Fatalf("old finished job gave %v", err)
+	}
+	if _, err = os.Stat(q.jobPath(id, Delivered)); !os.IsNotExist(err) {
+		t.Fatalf("old finished job left behind: %v", err)
+	}
+}
+
+func TestQueueBounce(t *testing.T) {
+	tr := &testTransport{errs: []error{&textproto.Error{Code: 550, Msg: "5.1.1 no such user"}}}
+	q, _ := testQueue(t, tr)
+	id, err := q.Enqueue("a@example.com", []string{"b@example.net"}, []byte("Subject: hi\n\nbody\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.runDue()
+	st, _ := q.Status(id)
+	if st.State != Bounced || st.Attempts != 1 {
+		t.Fatalf("permanent failure %+v", st)
+	}
+	// the bounce goes out on the next run
+	q.runDue()
+	if len(tr.sent) != 1 || tr.to[0][0] != "a@example.com" || !strings.Contains(tr.sent[0], "no such user") {
+		t.Fatalf("bounce was %q to %v", tr.sent, tr.to)
+	}
+}
+
+func TestQueueGiveUp(t *testing.T) {
+	tr := &testTransport{}
+	for i := 0; i <= len(Backoff); i++ {
+		tr.errs = append(tr.errs, errors.New("timeout"))
+	}
+	q, now := testQueue(t, tr)
+	id, err := q.Enqueue("", []string{"b@example.net"}, []byte("Subject: hi\n\nbody\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i <= len(Backoff); i++ {
+		q.runDue()
+		*now = now.Add(time.Hour * 24)
+	}
+	st, _ := q.Status(id)
+	if st.State != Bounced || st.Attempts != len(Backoff)+1 {
+		t.Fatalf("after all retries %+v", st)
+	}
+	// null sender gets no bounce
+	q.runDue()
+	if len(tr.sent) != 0 {
+		t.Fatalf("bounced a bounce %q", tr.sent)
+	}
+	if _, err = q.Status("nope"); err != ErrNoJob {
+		t.Fatalf("unknown job gave %v", err)
+	}
+}
+
+func TestQueueRetryLimit(t *testing.T) {
+	tr := &testTransport{errs: []error{errors.New("timeout"), errors.New("timeout")}}
+	q, now := testQueue(t, tr)
+	ps := smtpclient.NewPolicyStore()
+	ps.SetPolicy("*.net", smtpclient.DomainPolicy{RetryLimit: 2})
+	q.WithPolicies(ps)
+	id, err := q.Enqueue("a@example.com", []string{"b@example.net"}, []byte("Subject: hi\n\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.runDue()
+	*now = now.Add(time.Minute)
+	q.runDue()
+	st, _ := q.Status(id)
+	if st.State != Bounced || st.Attempts != 2 {
+		t.Fatalf("after retry limit %+v", st)
+	}
+	// running out of retries is a permanent failure too
+	q.runDue()
+	if len(tr.sent) != 1 || !strings.Contains(tr.sent[0], "Status: 5.4.7") {
+		t.Fatalf("bounce was %q", tr.sent)
+	}
+}
+
+func TestQueueRateLimited(t *testing.T) {
+	tr := &testTransport{errs: []error{smtpclient.ErrRateLimited, smtpclient.ErrRateLimited}}
+	q, now := testQueue(t, tr)
+	ps := smtpclient.NewPolicyStore()
+	ps.SetPolicy("*", smtpclient.DomainPolicy{RetryLimit: 1})
+	q.WithPolicies(ps)
+	id, err := q.Enqueue("a@example.com", []string{"b@example.net"}, []byte("Subject: hi\n\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// waiting on a rate limit never uses up retries
+	for i := 0; i < 2; i++ {
+		q.runDue()
+		st, _ := q.Status(id)
+		if st.State != Queued || st.Attempts != 0 || !st.NextAttempt.Equal(now.Add(RateLimitDelay)) {
+			t.Fatalf("after being rate limited %+v", st)
+		}
+		*now = now.Add(RateLimitDelay)
+	}
+	q.runDue()
+	if st, _ := q.Status(id); st.State != Delivered || st.Attempts != 1 {
+		t.Fatalf("after delivery %+v", st)
+	}
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"strings"
+)
+
+var errAuthCancel = errors.New("auth cancelled")
+var errAuthSyntax = errors.New("bad auth response")
+
+// checks credentials for SMTP AUTH
+type Authenticator interface {
+	// check a username and password given with AUTH PLAIN or AUTH LOGIN
+	Authenticate(username, password string) (bool, error)
+	// get the stored key of a user for AUTH SCRAM-SHA-256
+	// in the form made by NewSCRAMStoredKey
+	StoredKey(username string) ([]byte, error)
+}
+
+// enable SMTP AUTH checked against an authenticator
+// PLAIN and LOGIN are only offered over tls, SCRAM-SHA-256 is always offered
+func (s *Server) WithAuthenticator(a Authenticator) *Server {
+	s.auth = a
+	return s
+}
+
+// get the auth mechanisms we offer on this session
+func (sess *session) authMechs() (mechs []string) {
+	if sess.s.auth != nil {
+		if sess.tls {
+			mechs = append(mechs, "PLAIN", "LOGIN")
+		}
+		mechs = append(mechs, scramMech)
+	}
+	return
+}
+
+// send a 334 challenge and read the base64 response
+// returns errAuthCancel if the client gave up
+func (sess *session) challenge(data string) (resp []byte, err error) {
+	err = sess.reply(334, base64.StdEncoding.EncodeToString([]byte(data)))
+	if err == nil {
+		var line string
+		line, err = sess.readLine()
+		if err == nil {
+			resp, err = sess.decodeAuth(line)
+		}
+	}
+	return
+}
+
+// decode a base64 auth response line
+func (sess *session) decodeAuth(line string) (resp []byte, err error) {
+	if line == "*" {
+		err = errAuthCancel
+		return
+	}
+	resp, err = base64.StdEncoding.DecodeString(line)
+	if err != nil {
+		err = errAuthSyntax
+	}
+	return
+}
+
+// handle AUTH command
+func (sess *session) authenticate(arg string) (err error) {
+	if sess.tx.Helo == "" || !sess.extended {
+		return sess.reply(503, "5.5.1 Send EHLO first")
+	}
+	if sess.tx.User != "" {
+		return sess.reply(503, "5.5.1 Already authenticated")
+	}
+	if sess.mailed {
+		return sess.reply(503, "5.5.1 AUTH not allowed during a mail transaction")
+	}
+	parts := strings.Fields(arg)
+	if len(parts) == 0 || len(parts) > 2 {
+		return sess.reply(501, "5.5.4 Syntax: AUTH mechanism [initial-response]")
+	}
+	mech := strings.ToUpper(parts[0])
+	offered := false
+	for _, m := range sess.authMechs() {
+		offered = offered || m == mech
+	}
+	if !offered {
+		return sess.reply(504, "5.5.4 Unrecognized authentication type")
+	}
+	// initial response, "=" is an empty one
+	var initial []byte
+	hasInitial := len(parts) == 2
+	if hasInitial && parts[1] != "=" {
+		initial, err = sess.decodeAuth(parts[1])
+	}
+	var user string
+	var ok bool
+	if err == nil {
+		switch mech {
+		case "PLAIN":
+			if !hasInitial {
+				initial, err = sess.challenge("")
+			}
+			if err == nil {
+				user, ok, err = sess.authPlain(initial)
+			}
+		case "LOGIN":
+			user, ok, err = sess.authLogin(initial, hasInitial)
+		case scramMech:
+			user, ok, err = sess.authSCRAM(initial, hasInitial)
+		}
+	}
+	switch err {
+	case nil:
+		if ok {
+			sess.tx.User = user
+			return sess.reply(235, "2.7.0 Authentication successful")
+		}
+		return sess.reply(535, "5.7.8 Authentication credentials invalid")
+	case errAuthCancel:
+		return sess.reply(501, "5.0.0 Authentication cancelled")
+	case errAuthSyntax, errSCRAM, errSCRAMProof:
+		return sess.reply(535, "5.7.8 Authentication credentials invalid")
+	}
+	return
+}
+
+// check PLAIN credentials
+func (sess *session) authPlain(resp []byte) (user string, ok bool, err error) {
+	parts := bytes.Split(resp, []byte{0})
+	if len(parts) != 3 {
+		err = errAuthSyntax
+		return
+	}
+	// we don't support acting as someone else
+	user = string(parts[1])
+	if len(parts[0]) > 0 && string(parts[0]) != user {
+		return
+	}
+	ok, err = sess.s.auth.Authenticate(user, string(parts[2]))
+	if err != nil {
+		sess.authError(err)
+	}
+	return
+}
+
+// check LOGIN credentials
+func (sess *session) authLogin(initial []byte, hasInitial bool) (user string, ok bool, err error) {
+	if !hasInitial {
+		initial, err = sess.challenge("Username:")
+	}
+	if err == nil {
+		var passwd []byte
+		passwd, err = sess.challenge("Password:")
+		if err == nil {
+			user = string(initial)
+			ok, err = sess.s.auth.Authenticate(user, string(passwd))
+			if err != nil {
+				sess.authError(err)
+			}
+		}
+	}
+	return
+}
+
+// run a SCRAM-SHA-256 exchange
+func (sess *session) authSCRAM(initial []byte, hasInitial bool) (user string, ok bool, err error) {
+	if !hasInitial {
+		initial, err = sess.challenge("")
+		if err != nil {
+			return
+		}
+	}
+	sc := newSCRAMServer(sess.s.auth)
+	var serverFirst, serverFinal string
+	serverFirst, err = sc.first(string(initial))
+	if err != nil {
+		if err != errSCRAM {
+			sess.authError(err)
+			err = errSCRAMProof
+		}
+		return
+	}
+	var resp []byte
+	resp, err = sess.challenge(serverFirst)
+	if err == nil {
+		serverFinal, err = sc.final(string(resp))
+	}
+	if err == nil {
+		// client acknowledges our signature with an empty response
+		_, err = sess.challenge(serverFinal)
+		if err == nil {
+			user = sc.username
+			ok = true
+		}
+	}
+	return
+}
+
+// log an error from the authenticator
+func (sess *session) authError(err error) {
+	log.Error("smtp auth from ", sess.tx.Addr, " failed: ", err)
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+var errBadChunk = errors.New("bad BDAT chunk size")
+
+// handle BDAT command from RFC 3030
+// the chunk is always read off the wire, even when the command is refused,
+// so a pipelining client stays in sync with us
+func (sess *session) bdat(arg string) (err error) {
+	args := strings.Fields(arg)
+	var size int64 = -1
+	if len(args) > 0 {
+		size, err = strconv.ParseInt(args[0], 10, 64)
+	}
+	if err != nil || size < 0 {
+		// we can't know how much data follows so the client can't be resynced
+		sess.reply(501, "5.5.4 Syntax: BDAT <size> [LAST]")
+		sess.w.Flush()
+		return errBadChunk
+	}
+	last := len(args) == 2 && strings.EqualFold(args[1], "LAST")
+	code, status := 0, ""
+	if len(args) > 2 || (len(args) == 2 && !last) {
+		code, status = 501, "5.5.4 Syntax: BDAT <size> [LAST]"
+	} else if len(sess.tx.To) == 0 {
+		code, status = 503, "5.5.1 Send RCPT first"
+	} else if size > sess.s.maxSize()-int64(len(sess.chunks)) {
+		// the transaction is over, later chunks get 503 until the client starts again
+		sess.reset()
+		code, status = 552, "5.3.4 Message too big"
+	}
+	if code != 0 {
+		_, err = io.CopyN(ioutil.Discard, sess.br, size)
+		if err == nil {
+			err = sess.reply(code, status)
+		}
+		return
+	}
+	if sess.chunks == nil {
+		sess.chunks = make([]byte, 0, size)
+	}
+	// read exactly the declared size, a short read means the client went away
+	n := len(sess.chunks)
+	sess.chunks = append(sess.chunks, make([]byte, size)...)
+	_, err = io.ReadFull(sess.br, sess.chunks[n:])
+	if err != nil {
+		return
+	}
+	if !last {
+		return sess.reply(250, fmt.Sprintf("2.0.0 %d bytes received", size))
+	}
+	// stored messages use plain newlines like DATA gives us
+	body := bytes.Replace(sess.chunks, []byte("\r\n"), []byte("\n"), -1)
+	return sess.deliver(body)
+}
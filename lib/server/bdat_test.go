@@ -0,0 +1,87 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestBDATLarge(t *testing.T) {
+	c, s := testSession(t)
+	// over 10MB split over a few chunks with crlf line endings
+	line := strings.Repeat("x", 998) + "\r\n"
+	body := "Subject: big\r\n\r\n" + strings.Repeat(line, 11*1024)
+	chunks := []string{body[:4<<20], body[4<<20 : 8<<20], body[8<<20:]}
+	go func() {
+		fmt.Fprintf(c.W, "EHLO client\r\nMAIL FROM:<a@remote>\r\nRCPT TO:<b@localhost>\r\n")
+		for idx, chunk := range chunks {
+			if idx == len(chunks)-1 {
+				fmt.Fprintf(c.W, "BDAT %d LAST\r\n", len(chunk))
+			} else {
+				fmt.Fprintf(c.W, "BDAT %d\r\n", len(chunk))
+			}
+			c.W.WriteString(chunk)
+		}
+		c.W.Flush()
+	}()
+	caps := expect(t, c, 250)
+	if !strings.Contains(caps, "CHUNKING") {
+		t.Fatalf("CHUNKING not advertised: %s", caps)
+	}
+	expect(t, c, 250)
+	expect(t, c, 250)
+	expect(t, c, 250)
+	expect(t, c, 250)
+	expect(t, c, 250)
+	ev := <-s.chnl
+	got := ev.Body.Bytes()
+	want := []byte(strings.Replace(body, "\r\n", "\n", -1))
+	if !bytes.HasSuffix(got, want) {
+		t.Fatalf("got %d bytes wanted %d", len(got), len(want))
+	}
+	if !bytes.HasPrefix(got, []byte("Received: ")) {
+		t.Fatal("message not stamped")
+	}
+}
+
+func TestBDATWithoutRcpt(t *testing.T) {
+	c, _ := testSession(t)
+	go func() {
+		fmt.Fprintf(c.W, "EHLO client\r\nBDAT 5 LAST\r\nhelloNOOP\r\n")
+		c.W.Flush()
+	}()
+	expect(t, c, 250)
+	// the chunk is skipped and the next command still parses
+	expect(t, c, 503)
+	expect(t, c, 250)
+}
+
+func TestDATADuringBDAT(t *testing.T) {
+	c, _ := testSession(t)
+	go func() {
+		fmt.Fprintf(c.W, "EHLO client\r\nMAIL FROM:<a@remote>\r\nRCPT TO:<b@localhost>\r\nBDAT 3\r\nabcDATA\r\n")
+		c.W.Flush()
+	}()
+	for i := 0; i < 4; i++ {
+		expect(t, c, 250)
+	}
+	expect(t, c, 503)
+}
+
+func TestBDATTooBig(t *testing.T) {
+	c, _ := testSession(t, func(s *Server) {
+		s.WithMaxMessageSize(8)
+	})
+	go func() {
+		fmt.Fprintf(c.W, "EHLO client\r\nMAIL FROM:<a@remote>\r\nRCPT TO:<b@localhost>\r\n")
+		fmt.Fprintf(c.W, "BDAT 5\r\nhelloBDAT 5 LAST\r\nworldBDAT 3 LAST\r\nabc")
+		c.W.Flush()
+	}()
+	for i := 0; i < 4; i++ {
+		expect(t, c, 250)
+	}
+	// the chunk going over the limit is skipped and refused
+	expect(t, c, 552)
+	expect(t, c, 503)
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	log "github.com/Sirupsen/logrus"
+	"github.com/majestrate/bdsmail/lib/dkim"
+	"io/ioutil"
+	"time"
+)
+
+// selector used when the signer doesn't set one
+const defaultDKIMSelector = "default"
+
+// dkim sign mail submitted by authenticated users for our hostname
+func (s *Server) WithDKIMSigner(signer *dkim.Signer) *Server {
+	s.dkim = signer
+	return s
+}
+
+// sign an outbound message if we have a signer
+// messages that can't be signed are passed on as is
+func (s *Server) signOutbound(body []byte) []byte {
+	if s.dkim == nil {
+		return body
+	}
+	selector := s.dkim.Selector
+	if selector == "" {
+		selector = defaultDKIMSelector
+	}
+	r, err := s.dkim.Sign(bytes.NewReader(body), selector, s.hostname)
+	if err == nil {
+		var signed []byte
+		signed, err = ioutil.ReadAll(r)
+		if err == nil {
+			return signed
+		}
+	}
+	log.Warn("not dkim signing message: ", err)
+	return body
+}
+
+// how long the middleware lets key lookups for one message take
+const dkimTimeout = 20 * time.Second
+
+// middleware that verifies dkim signatures on inbound mail
+type dkimVerify struct {
+	r dkim.Resolver
+}
+
+// make a middleware that rejects messages whose dkim signatures all fail
+// a message with a passing signature, no signatures, or only signatures we
+// can't check is accepted, mail from authenticated clients is not checked
+func DKIMMiddleware(r dkim.Resolver) SMTPMiddleware {
+	return &dkimVerify{
+		r: r,
+	}
+}
+
+func (d *dkimVerify) WrapMAILFROM(next MailFromFunc) MailFromFunc {
+	return next
+}
+
+func (d *dkimVerify) WrapRCPTTO(next RcptToFunc) RcptToFunc {
+	return next
+}
+
+func (d *dkimVerify) WrapDATA(next DataFunc) DataFunc {
+	return func(tx *Transaction, body []byte) error {
+		if tx.User != "" {
+			return next(tx, body)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), dkimTimeout)
+		vs, _ := dkim.Verify(ctx, d.r, bytes.NewReader(body))
+		cancel()
+		failed, temp := false, false
+		for _, v := range vs {
+			switch v.Result {
+			case dkim.ResultPass:
+				return next(tx, body)
+			case dkim.ResultFail:
+				failed = true
+			case dkim.ResultTempError:
+				temp = true
+			}
+		}
+		if temp {
+			return &SMTPError{451, "4.4.3", "DKIM key lookup failed, try again later"}
+		}
+		if failed {
+			return &SMTPError{550, "5.7.20", "No passing DKIM signature found"}
+		}
+		return next(tx, body)
+	}
+}
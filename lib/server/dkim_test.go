@@ -0,0 +1,73 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"github.com/majestrate/bdsmail/lib/dkim"
+	"testing"
+)
+
+func TestSignOutbound(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{hostname: "example.com"}
+	msg := []byte("From: a@example.com\nSubject: hi\n\nbody\n")
+	if got := s.signOutbound(msg); !bytes.Equal(got, msg) {
+		t.Fatal("signed without a signer")
+	}
+	s.WithDKIMSigner(dkim.New("").WithKey(key))
+	got := s.signOutbound(msg)
+	if !bytes.HasPrefix(got, []byte("DKIM-Signature: ")) || !bytes.Contains(got, []byte("d=example.com; s=default;")) {
+		t.Fatalf("signed message %q", got)
+	}
+}
+
+func TestDKIMMiddleware(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	r := &testResolver{
+		txt: map[string][]string{
+			"default._domainkey.example.com": {"v=DKIM1; p=" + base64.StdEncoding.EncodeToString(pub)},
+		},
+	}
+	s := (&Server{hostname: "example.com"}).WithDKIMSigner(dkim.New("").WithKey(key))
+	msg := []byte("From: a@example.com\nSubject: hi\n\nbody\n")
+	signed := s.signOutbound(msg)
+	delivered := 0
+	data := DKIMMiddleware(r).WrapDATA(func(tx *Transaction, body []byte) error {
+		delivered++
+		return nil
+	})
+	tx := &Transaction{}
+	for _, body := range [][]byte{signed, msg} {
+		if err = data(tx, body); err != nil {
+			t.Fatalf("%q got %v", body, err)
+		}
+	}
+	tampered := bytes.Replace(signed, []byte("body"), []byte("changed"), 1)
+	var e *SMTPError
+	if err = data(tx, tampered); !errors.As(err, &e) || e.Code != 550 {
+		t.Fatalf("failing signature got %v", err)
+	}
+	s.hostname = "broken.example"
+	if err = data(tx, s.signOutbound(msg)); !errors.As(err, &e) || e.Code != 451 {
+		t.Fatalf("failed key lookup got %v", err)
+	}
+	// authenticated clients aren't checked
+	tx.User = "alice"
+	if err = data(tx, tampered); err != nil {
+		t.Fatalf("authenticated client got %v", err)
+	}
+	if delivered != 3 {
+		t.Fatalf("%d messages passed on", delivered)
+	}
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/majestrate/bdsmail/lib/maildir"
+	"github.com/majestrate/bdsmail/lib/message"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var errBadXText = errors.New("bad xtext")
+
+// values of the RET parameter from RFC 3461
+const (
+	RetFull    = "FULL"
+	RetHeaders = "HDRS"
+)
+
+// values of the NOTIFY parameter from RFC 3461
+const (
+	NotifyNever   = "NEVER"
+	NotifySuccess = "SUCCESS"
+	NotifyFailure = "FAILURE"
+	NotifyDelay   = "DELAY"
+)
+
+// headers delivered messages keep their dsn parameters in
+// values are xtext encoded like they were on the wire
+const (
+	HeaderDSNRet    = "X-Dsn-Ret"
+	HeaderDSNEnvID  = "X-Dsn-Envid"
+	HeaderDSNNotify = "X-Dsn-Notify"
+	HeaderDSNORcpt  = "X-Dsn-Orcpt"
+)
+
+// dsn parameters given with RCPT TO
+type RcptParams struct {
+	// NOTIFY conditions, empty if the client gave none
+	Notify []string
+	// ORCPT as addr-type;address, empty if the client gave none
+	ORcpt string
+}
+
+// return true if the sender asked to be told about a condition for this recipient
+// with no NOTIFY given only failures and delays are reported
+func (ev *MailEvent) WantsNotify(cond string) bool {
+	if len(ev.Notify) == 0 {
+		return cond == NotifyFailure || cond == NotifyDelay
+	}
+	for _, n := range ev.Notify {
+		if n == cond {
+			return true
+		}
+	}
+	return false
+}
+
+// decode xtext from RFC 3461 where +XX is a hex encoded byte
+func decodeXText(str string) (string, error) {
+	var buf bytes.Buffer
+	for idx := 0; idx < len(str); idx++ {
+		c := str[idx]
+		if c == '+' {
+			if idx+2 >= len(str) {
+				return "", errBadXText
+			}
+			b, err := strconv.ParseUint(str[idx+1:idx+3], 16, 8)
+			if err != nil {
+				return "", errBadXText
+			}
+			buf.WriteByte(byte(b))
+			idx += 2
+		} else if c < '!' || c > '~' || c == '=' {
+			return "", errBadXText
+		} else {
+			buf.WriteByte(c)
+		}
+	}
+	return buf.String(), nil
+}
+
+// encode a string as xtext from RFC 3461
+func encodeXText(str string) string {
+	var buf bytes.Buffer
+	for idx := 0; idx < len(str); idx++ {
+		c := str[idx]
+		if c < '!' || c > '~' || c == '=' || c == '+' {
+			fmt.Fprintf(&buf, "+%02X", c)
+		} else {
+			buf.WriteByte(c)
+		}
+	}
+	return buf.String()
+}
+
+// delivery plugin that puts the dsn parameters given for this message in its header
+// so they are kept with the message, nothing is added if the client gave none
+func (ev *MailEvent) dsnHeaders(in io.Reader, meta *maildir.DeliverMeta) (io.Reader, error) {
+	var hdr bytes.Buffer
+	add := func(key, val string) {
+		if val != "" {
+			hdr.WriteString(key + ": " + val + "\n")
+		}
+	}
+	add(HeaderDSNRet, ev.Ret)
+	add(HeaderDSNEnvID, encodeXText(ev.EnvID))
+	add(HeaderDSNNotify, strings.Join(ev.Notify, ","))
+	if idx := strings.Index(ev.ORcpt, ";"); idx > 0 {
+		add(HeaderDSNORcpt, ev.ORcpt[:idx]+";"+encodeXText(ev.ORcpt[idx+1:]))
+	}
+	if hdr.Len() == 0 {
+		return in, nil
+	}
+	return io.MultiReader(&hdr, in), nil
+}
+
+// parse a NOTIFY parameter, NEVER may not be combined with anything else
+func parseNotify(val string) (notify []string, err error) {
+	for _, n := range strings.Split(strings.ToUpper(val), ",") {
+		switch n {
+		case NotifyNever, NotifySuccess, NotifyFailure, NotifyDelay:
+			notify = append(notify, n)
+		default:
+			err = errBadPath
+			return
+		}
+	}
+	for _, n := range notify {
+		if n == NotifyNever && len(notify) > 1 {
+			err = errBadPath
+			notify = nil
+			return
+		}
+	}
+	return
+}
+
+// parse an ORCPT parameter of the form addr-type;xtext
+func parseORcpt(val string) (orcpt string, err error) {
+	idx := strings.Index(val, ";")
+	if idx <= 0 {
+		err = errBadPath
+		return
+	}
+	var addr string
+	addr, err = decodeXText(val[idx+1:])
+	if err == nil {
+		orcpt = val[:idx] + ";" + addr
+	}
+	return
+}
+
+// tell the sender their message was delivered
+// local senders get the report in their maildir, anyone else gets it
+// through the outbound queue with a null sender so it never bounces
+func (s *Server) notifySuccess(ev *MailEvent) {
+	if ev.Sender == "" {
+		// null return path, never reply
+		return
+	}
+	dsn := &message.DSN{
+		ReportingMTA: s.hostname,
+		EnvID:        ev.EnvID,
+		ArrivalDate:  ev.Arrived,
+		Recipients: []message.RecipientStatus{
+			{
+				OriginalRecipient: ev.ORcpt,
+				FinalRecipient:    ev.Recip,
+				Action:            "delivered",
+				Status:            "2.0.0",
+			},
+		},
+		HeadersOnly: ev.Ret != RetFull,
+	}
+	body, err := dsn.Build("MAILER-DAEMON@"+s.hostname, ev.Sender, ev.Body.Bytes())
+	if err != nil {
+		log.Error("failed to build dsn for ", ev.Sender, ": ", err)
+		return
+	}
+	if !s.allowRecip(ev.Sender) {
+		if s.queue == nil {
+			log.Warn("not sending dsn to non local sender ", ev.Sender, ", no queue")
+			return
+		}
+		_, err = s.queue.Enqueue("", []string{ev.Sender}, s.signOutbound(body))
+		if err != nil {
+			log.Error("failed to queue dsn to ", ev.Sender, ": ", err)
+		}
+		return
+	}
+	// maildir messages use plain newlines
+	body = bytes.Replace(body, []byte("\r\n"), []byte("\n"), -1)
+	_, err = s.getUserMaildir(ev.Sender).Deliver(bytes.NewReader(body))
+	if err != nil {
+		log.Error("failed to deliver dsn to ", ev.Sender, ": ", err)
+	}
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/majestrate/bdsmail/lib/maildir"
+	"github.com/majestrate/bdsmail/lib/queue"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestDecodeXText(t *testing.T) {
+	str, err := decodeXText("a+2Bb+3Dc")
+	if err != nil || str != "a+b=c" {
+		t.Fatalf("decoded %q %v", str, err)
+	}
+	for _, bad := range []string{"a+2", "a+zz", "a=b"} {
+		if _, err = decodeXText(bad); err == nil {
+			t.Fatalf("%q decoded", bad)
+		}
+	}
+}
+
+func TestDSNParams(t *testing.T) {
+	c, s := testSession(t)
+	go func() {
+		fmt.Fprintf(c.W, "EHLO client\r\nMAIL FROM:<a@localhost> RET=HDRS ENVID=id+2B1\r\n")
+		fmt.Fprintf(c.W, "RCPT TO:<b@localhost> NOTIFY=SUCCESS,FAILURE ORCPT=rfc822;b+40localhost\r\n")
+		fmt.Fprintf(c.W, "RCPT TO:<c@localhost> NOTIFY=NEVER,SUCCESS\r\n")
+		fmt.Fprintf(c.W, "DATA\r\nSubject: hi\r\n\r\nbody\r\n.\r\n")
+		c.W.Flush()
+	}()
+	caps := expect(t, c, 250)
+	if !strings.Contains(caps, "DSN") {
+		t.Fatalf("DSN not advertised: %s", caps)
+	}
+	expect(t, c, 250)
+	expect(t, c, 250)
+	expect(t, c, 501)
+	expect(t, c, 354)
+	expect(t, c, 250)
+	ev := <-s.chnl
+	if ev.Ret != RetHeaders || ev.EnvID != "id+1" || ev.ORcpt != "rfc822;b@localhost" {
+		t.Fatalf("bad dsn params %+v", ev)
+	}
+	if !ev.WantsNotify(NotifySuccess) || ev.WantsNotify(NotifyDelay) {
+		t.Fatalf("bad notify %v", ev.Notify)
+	}
+}
+
+func TestNotifySuccess(t *testing.T) {
+	d := maildir.MailDir(t.TempDir())
+	if err := d.Ensure(); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{hostname: "localhost", mail: d}
+	ev := &MailEvent{
+		Sender: "a@localhost",
+		Recip:  "b@localhost",
+		Body:   bytes.NewBufferString("Subject: hi\n\nbody\n"),
+		Ret:    RetHeaders,
+		EnvID:  "id 1",
+		Notify: []string{NotifySuccess},
+		ORcpt:  "rfc822;b@localhost",
+	}
+	if err := s.gotMail(ev); err != nil {
+		t.Fatal(err)
+	}
+	msgs, _ := d.ListNew()
+	if len(msgs) != 2 {
+		t.Fatalf("%d messages delivered", len(msgs))
+	}
+	found := false
+	for _, msg := range msgs {
+		b, _ := ioutil.ReadFile(d.New(msg.Filepath()))
+		if bytes.Contains(b, []byte("Action: delivered")) && bytes.Contains(b, []byte("To: <a@localhost>")) {
+			found = true
+		} else if !strings.HasPrefix(string(b), "X-Dsn-Ret: HDRS\nX-Dsn-Envid: id+201\nX-Dsn-Notify: SUCCESS\nX-Dsn-Orcpt: rfc822;b@localhost\nSubject: hi\n") {
+			t.Fatalf("dsn parameters not kept: %q", b)
+		}
+	}
+	if !found {
+		t.Fatal("no dsn delivered")
+	}
+}
+
+func TestNotifySuccessRemote(t *testing.T) {
+	d := maildir.MailDir(t.TempDir())
+	spool := maildir.MailDir(t.TempDir())
+	if err := d.Ensure(); err != nil {
+		t.Fatal(err)
+	}
+	q := queue.New(spool, "localhost", nil)
+	if err := q.Ensure(); err != nil {
+		t.Fatal(err)
+	}
+	s := (&Server{hostname: "localhost", mail: d}).WithQueue(q)
+	ev := &MailEvent{
+		Sender: "a@example.com",
+		Recip:  "b@localhost",
+		Body:   bytes.NewBufferString("Subject: hi\n\nbody\n"),
+		Notify: []string{NotifySuccess},
+	}
+	if err := s.gotMail(ev); err != nil {
+		t.Fatal(err)
+	}
+	if msgs, _ := d.ListNew(); len(msgs) != 1 {
+		t.Fatalf("%d messages delivered locally", len(msgs))
+	}
+	queued, _ := spool.ListNew()
+	if len(queued) != 1 {
+		t.Fatalf("%d messages queued", len(queued))
+	}
+	st, err := q.Status(queued[0].Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.From != "" || len(st.To) != 1 || st.To[0] != "a@example.com" {
+		t.Fatalf("dsn queued as %+v", st)
+	}
+	b, _ := ioutil.ReadFile(spool.New(queued[0].Filepath()))
+	if !bytes.Contains(b, []byte("Action: delivered")) {
+		t.Fatalf("queued message isn't a dsn: %q", b)
+	}
+}
@@ -3,6 +3,7 @@ package server
 import (
 	"bytes"
 	"net"
+	"time"
 )
 
 // event fired when we got a new mail message
@@ -15,6 +16,13 @@ type MailEvent struct {
 	Sender string
 	// body of message
 	Body *bytes.Buffer
+	// dsn parameters the client gave for this recipient
+	Ret    string
+	EnvID  string
+	Notify []string
+	ORcpt  string
+	// when the message arrived
+	Arrived time.Time
 }
 
 func (ev *MailEvent) Read(d []byte) (int, error) {
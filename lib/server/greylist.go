@@ -0,0 +1,129 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// how long greylisting remembers a triplet
+const greylistMaxAge = time.Hour * 24 * 35
+
+// identifies a delivery attempt for greylisting
+type Triplet struct {
+	// ip of the sending host
+	IP string
+	// envelope sender
+	From string
+	// envelope recipient
+	To string
+}
+
+// storage for greylisted triplets
+type GreylistStore interface {
+	// record when a triplet was first seen, does nothing if it is already recorded
+	Add(t Triplet, now time.Time) error
+	// return true if a triplet was first seen at least delay before now
+	IsAllowed(t Triplet, delay time.Duration, now time.Time) (bool, error)
+	// forget triplets first seen before a time
+	Expire(before time.Time) error
+}
+
+// in memory greylist store
+type MemoryGreylistStore struct {
+	mtx  sync.Mutex
+	seen map[Triplet]time.Time
+}
+
+func NewMemoryGreylistStore() *MemoryGreylistStore {
+	return &MemoryGreylistStore{
+		seen: make(map[Triplet]time.Time),
+	}
+}
+
+func (g *MemoryGreylistStore) Add(t Triplet, now time.Time) error {
+	g.mtx.Lock()
+	if _, ok := g.seen[t]; !ok {
+		g.seen[t] = now
+	}
+	g.mtx.Unlock()
+	return nil
+}
+
+func (g *MemoryGreylistStore) IsAllowed(t Triplet, delay time.Duration, now time.Time) (bool, error) {
+	g.mtx.Lock()
+	first, ok := g.seen[t]
+	g.mtx.Unlock()
+	return ok && !now.Before(first.Add(delay)), nil
+}
+
+func (g *MemoryGreylistStore) Expire(before time.Time) error {
+	g.mtx.Lock()
+	for t, first := range g.seen {
+		if first.Before(before) {
+			delete(g.seen, t)
+		}
+	}
+	g.mtx.Unlock()
+	return nil
+}
+
+// middleware that greylists recipients
+type greylist struct {
+	store GreylistStore
+	delay time.Duration
+	// when we last expired old triplets
+	expired time.Time
+	mtx     sync.Mutex
+}
+
+// make a middleware that temporarily rejects the first attempt from each
+// (ip, sender, recipient) triplet and accepts retries after delay has passed
+func GreylistingMiddleware(store GreylistStore, delay time.Duration) SMTPMiddleware {
+	return &greylist{
+		store: store,
+		delay: delay,
+	}
+}
+
+func (g *greylist) WrapMAILFROM(next MailFromFunc) MailFromFunc {
+	return next
+}
+
+func (g *greylist) WrapRCPTTO(next RcptToFunc) RcptToFunc {
+	return func(tx *Transaction, to string) (err error) {
+		now := time.Now()
+		g.expire(now)
+		t := Triplet{
+			IP:   remoteIP(tx.Addr),
+			From: tx.From,
+			To:   to,
+		}
+		var allowed bool
+		allowed, err = g.store.IsAllowed(t, g.delay, now)
+		if err == nil {
+			if allowed {
+				err = next(tx, to)
+			} else {
+				err = g.store.Add(t, now)
+				if err == nil {
+					err = &SMTPError{451, "4.7.1", "Greylisted, try again later"}
+				}
+			}
+		}
+		return
+	}
+}
+
+func (g *greylist) WrapDATA(next DataFunc) DataFunc {
+	return next
+}
+
+// expire old triplets at most once an hour
+func (g *greylist) expire(now time.Time) {
+	g.mtx.Lock()
+	if now.Sub(g.expired) > time.Hour {
+		g.expired = now
+		go g.store.Expire(now.Add(-greylistMaxAge))
+	}
+	g.mtx.Unlock()
+}
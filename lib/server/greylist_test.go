@@ -0,0 +1,40 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestGreylisting(t *testing.T) {
+	store := NewMemoryGreylistStore()
+	delay := time.Minute
+	accepted := 0
+	rcpt := GreylistingMiddleware(store, delay).WrapRCPTTO(func(tx *Transaction, to string) error {
+		accepted++
+		return nil
+	})
+	tx := &Transaction{
+		Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 2525},
+		From: "sender@remote",
+	}
+	err := rcpt(tx, "user@local")
+	if e, ok := err.(*SMTPError); !ok || e.Code != 451 {
+		t.Fatalf("first attempt got %v", err)
+	}
+	err = rcpt(tx, "user@local")
+	if err == nil {
+		t.Fatal("retry before delay accepted")
+	}
+	// pretend the delay passed
+	store.seen[Triplet{"10.0.0.1", "sender@remote", "user@local"}] = time.Now().Add(-delay)
+	err = rcpt(tx, "user@local")
+	if err != nil || accepted != 1 {
+		t.Fatalf("retry after delay got %v", err)
+	}
+	// different recipient is a new triplet
+	err = rcpt(tx, "other@local")
+	if err == nil {
+		t.Fatal("new triplet accepted")
+	}
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"fmt"
+	"net"
+)
+
+// state of an smtp transaction passed to middleware
+type Transaction struct {
+	// remote address of the client
+	Addr net.Addr
+	// name the client gave in HELO or EHLO
+	Helo string
+	// user the client authenticated as, empty if it did not
+	User string
+	// envelope sender
+	From string
+	// BODY parameter given with MAIL FROM, empty if the client gave none
+	Body string
+	// dsn RET and ENVID parameters given with MAIL FROM
+	Ret   string
+	EnvID string
+	// dsn parameters given with RCPT TO keyed by recipient
+	Rcpt map[string]RcptParams
+	// envelope recipients accepted so far
+	To []string
+}
+
+// values of the BODY parameter from RFC 6152
+const (
+	Body7Bit     = "7BIT"
+	Body8BitMIME = "8BITMIME"
+)
+
+// checks the envelope sender given in MAIL FROM
+type MailFromFunc func(tx *Transaction, from string) error
+
+// checks an envelope recipient given in RCPT TO
+type RcptToFunc func(tx *Transaction, to string) error
+
+// handles the message body after DATA
+type DataFunc func(tx *Transaction, body []byte) error
+
+// hooks into each stage of an smtp transaction
+// each method wraps the next handler in the chain and may reject the
+// command by returning an error instead of calling it
+type SMTPMiddleware interface {
+	WrapMAILFROM(next MailFromFunc) MailFromFunc
+	WrapRCPTTO(next RcptToFunc) RcptToFunc
+	WrapDATA(next DataFunc) DataFunc
+}
+
+// error that is sent to the client as an smtp reply
+type SMTPError struct {
+	// reply code
+	Code int
+	// enhanced status code
+	Status string
+	// human readable text
+	Msg string
+}
+
+func (e *SMTPError) Error() string {
+	return fmt.Sprintf("%d %s %s", e.Code, e.Status, e.Msg)
+}
+
+// get the ip of a client address without its port
+func remoteIP(addr net.Addr) string {
+	ip := addr.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	return ip
+}
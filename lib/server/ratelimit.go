@@ -0,0 +1,36 @@
+package server
+
+import (
+	"github.com/majestrate/bdsmail/lib/limit"
+	"time"
+)
+
+// middleware that limits how many transactions each ip may start
+type rateLimit struct {
+	rate *limit.Rate
+}
+
+// make a middleware that allows each ip at most maxPerIP MAIL FROM commands
+// within a sliding window, more get a temporary failure
+func RateLimitMiddleware(maxPerIP int, window time.Duration) SMTPMiddleware {
+	return &rateLimit{
+		rate: limit.NewRate(maxPerIP, window),
+	}
+}
+
+func (r *rateLimit) WrapMAILFROM(next MailFromFunc) MailFromFunc {
+	return func(tx *Transaction, from string) error {
+		if !r.rate.AllowIP(remoteIP(tx.Addr), time.Now()) {
+			return &SMTPError{450, "4.7.1", "Too many messages, slow down"}
+		}
+		return next(tx, from)
+	}
+}
+
+func (r *rateLimit) WrapRCPTTO(next RcptToFunc) RcptToFunc {
+	return next
+}
+
+func (r *rateLimit) WrapDATA(next DataFunc) DataFunc {
+	return next
+}
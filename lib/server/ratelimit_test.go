@@ -0,0 +1,32 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimitMiddleware(t *testing.T) {
+	started := 0
+	mail := RateLimitMiddleware(2, time.Minute).WrapMAILFROM(func(tx *Transaction, from string) error {
+		started++
+		return nil
+	})
+	tx := &Transaction{
+		Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 2525},
+	}
+	for i := 0; i < 2; i++ {
+		if err := mail(tx, "sender@remote"); err != nil {
+			t.Fatalf("transaction %d got %v", i, err)
+		}
+	}
+	err := mail(tx, "sender@remote")
+	if e, ok := err.(*SMTPError); !ok || e.Code != 450 || started != 2 {
+		t.Fatalf("third transaction got %v", err)
+	}
+	// other ips have their own limit
+	tx.Addr = &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 2525}
+	if err = mail(tx, "sender@remote"); err != nil {
+		t.Fatalf("other ip got %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const scramMech = "SCRAM-SHA-256"
+
+var errSCRAM = errors.New("scram: bad message")
+var errSCRAMProof = errors.New("scram: bad proof")
+
+// Hi() from rfc 5802, which is pbkdf2 with hmac-sha256 producing one block
+func scramHi(password, salt []byte, iter int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	out := make([]byte, len(u))
+	copy(out, u)
+	for i := 1; i < iter; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range out {
+			out[j] ^= u[j]
+		}
+	}
+	return out
+}
+
+func scramHMAC(key []byte, str string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(str))
+	return mac.Sum(nil)
+}
+
+// make the stored scram-sha-256 key for a password in rfc 5803 form
+// SCRAM-SHA-256$<iterations>:<salt>$<StoredKey>:<ServerKey>
+// if salt is nil a random one is made
+func NewSCRAMStoredKey(password string, salt []byte, iterations int) []byte {
+	if salt == nil {
+		salt = make([]byte, 16)
+		io.ReadFull(rand.Reader, salt)
+	}
+	salted := scramHi([]byte(password), salt, iterations)
+	clientKey := scramHMAC(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	serverKey := scramHMAC(salted, "Server Key")
+	b64 := base64.StdEncoding.EncodeToString
+	return []byte(fmt.Sprintf("%s$%d:%s$%s:%s", scramMech, iterations, b64(salt), b64(storedKey[:]), b64(serverKey)))
+}
+
+// parsed stored scram key
+type scramKey struct {
+	iterations int
+	salt       []byte
+	storedKey  []byte
+	serverKey  []byte
+}
+
+// parse a stored key made by NewSCRAMStoredKey
+func parseSCRAMStoredKey(data []byte) (k scramKey, err error) {
+	parts := strings.Split(string(data), "$")
+	if len(parts) != 3 || parts[0] != scramMech {
+		err = errSCRAM
+		return
+	}
+	salt := strings.Split(parts[1], ":")
+	keys := strings.Split(parts[2], ":")
+	if len(salt) != 2 || len(keys) != 2 {
+		err = errSCRAM
+		return
+	}
+	k.iterations, err = strconv.Atoi(salt[0])
+	if err == nil {
+		k.salt, err = base64.StdEncoding.DecodeString(salt[1])
+	}
+	if err == nil {
+		k.storedKey, err = base64.StdEncoding.DecodeString(keys[0])
+	}
+	if err == nil {
+		k.serverKey, err = base64.StdEncoding.DecodeString(keys[1])
+	}
+	return
+}
+
+// server side of a scram-sha-256 exchange
+type scramServer struct {
+	auth Authenticator
+	// our half of the nonce
+	nonce string
+	// state carried from the first message
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+	key             scramKey
+	// authenticated username
+	username string
+}
+
+func newSCRAMServer(auth Authenticator) *scramServer {
+	b := make([]byte, 18)
+	io.ReadFull(rand.Reader, b)
+	return &scramServer{
+		auth:  auth,
+		nonce: base64.RawStdEncoding.EncodeToString(b),
+	}
+}
+
+// parse comma separated attributes into a map
+func scramAttrs(msg string) (attrs map[string]string, order []string) {
+	attrs = make(map[string]string)
+	for _, part := range strings.Split(msg, ",") {
+		if len(part) < 2 || part[1] != '=' {
+			continue
+		}
+		attrs[part[:1]] = part[2:]
+		order = append(order, part[:1])
+	}
+	return
+}
+
+// handle client-first-message and return server-first-message
+func (sc *scramServer) first(clientFirst string) (serverFirst string, err error) {
+	// gs2 header is "n,," or "y,," and optional authzid, no channel binding
+	parts := strings.SplitN(clientFirst, ",", 3)
+	if len(parts) != 3 || (parts[0] != "n" && parts[0] != "y") {
+		err = errSCRAM
+		return
+	}
+	sc.gs2Header = parts[0] + "," + parts[1] + ","
+	sc.clientFirstBare = parts[2]
+	attrs, order := scramAttrs(sc.clientFirstBare)
+	if len(order) < 2 || order[0] != "n" || order[1] != "r" || attrs["r"] == "" {
+		err = errSCRAM
+		return
+	}
+	sc.username = strings.NewReplacer("=2C", ",", "=3D", "=").Replace(attrs["n"])
+	var stored []byte
+	stored, err = sc.auth.StoredKey(sc.username)
+	if err == nil {
+		sc.key, err = parseSCRAMStoredKey(stored)
+	}
+	if err == nil {
+		sc.serverFirst = fmt.Sprintf("r=%s%s,s=%s,i=%d", attrs["r"], sc.nonce, base64.StdEncoding.EncodeToString(sc.key.salt), sc.key.iterations)
+		serverFirst = sc.serverFirst
+	}
+	return
+}
+
+// handle client-final-message and return server-final-message
+func (sc *scramServer) final(clientFinal string) (serverFinal string, err error) {
+	idx := strings.LastIndex(clientFinal, ",p=")
+	if idx < 0 {
+		err = errSCRAM
+		return
+	}
+	withoutProof := clientFinal[:idx]
+	attrs, _ := scramAttrs(withoutProof)
+	nonce := attrs["r"]
+	if attrs["c"] != base64.StdEncoding.EncodeToString([]byte(sc.gs2Header)) || !strings.HasSuffix(nonce, sc.nonce) || !strings.HasPrefix(sc.serverFirst, "r="+nonce+",") {
+		err = errSCRAM
+		return
+	}
+	var proof []byte
+	proof, err = base64.StdEncoding.DecodeString(clientFinal[idx+3:])
+	if err != nil {
+		return
+	}
+	authMessage := sc.clientFirstBare + "," + sc.serverFirst + "," + withoutProof
+	clientSig := scramHMAC(sc.key.storedKey, authMessage)
+	if len(proof) != len(clientSig) {
+		err = errSCRAMProof
+		return
+	}
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ clientSig[i]
+	}
+	storedKey := sha256.Sum256(clientKey)
+	if !hmac.Equal(storedKey[:], sc.key.storedKey) {
+		err = errSCRAMProof
+		return
+	}
+	serverFinal = "v=" + base64.StdEncoding.EncodeToString(scramHMAC(sc.key.serverKey, authMessage))
+	return
+}
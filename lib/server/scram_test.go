@@ -0,0 +1,68 @@
+package server
+
+import (
+	"encoding/base64"
+	"errors"
+	"testing"
+)
+
+// authenticator for a single user
+type testAuth struct {
+	user   string
+	passwd string
+	key    []byte
+}
+
+func (a *testAuth) Authenticate(user, passwd string) (bool, error) {
+	return user == a.user && passwd == a.passwd, nil
+}
+
+func (a *testAuth) StoredKey(user string) ([]byte, error) {
+	if user != a.user {
+		return nil, errors.New("no such user")
+	}
+	return a.key, nil
+}
+
+// exchange from rfc 7677 section 3
+func TestSCRAMExchange(t *testing.T) {
+	salt, _ := base64.StdEncoding.DecodeString("W22ZaJ0SNY7soEsUEjb6gQ==")
+	auth := &testAuth{
+		user: "user",
+		key:  NewSCRAMStoredKey("pencil", salt, 4096),
+	}
+	sc := newSCRAMServer(auth)
+	sc.nonce = "%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0"
+	first, err := sc.first("n,,n=user,r=rOprNGfwEbeRWgbNEkqO")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096" {
+		t.Fatalf("server first message was %q", first)
+	}
+	final, err := sc.final("c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if final != "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=" {
+		t.Fatalf("server final message was %q", final)
+	}
+}
+
+func TestSCRAMBadProof(t *testing.T) {
+	salt, _ := base64.StdEncoding.DecodeString("W22ZaJ0SNY7soEsUEjb6gQ==")
+	auth := &testAuth{
+		user: "user",
+		key:  NewSCRAMStoredKey("not pencil", salt, 4096),
+	}
+	sc := newSCRAMServer(auth)
+	sc.nonce = "%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0"
+	_, err := sc.first("n,,n=user,r=rOprNGfwEbeRWgbNEkqO")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = sc.final("c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=")
+	if err != errSCRAMProof {
+		t.Fatalf("wrong password gave %v", err)
+	}
+}
@@ -2,16 +2,30 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
+	"github.com/majestrate/bdsmail/lib/dkim"
+	"github.com/majestrate/bdsmail/lib/limit"
 	"github.com/majestrate/bdsmail/lib/lua"
 	"github.com/majestrate/bdsmail/lib/maildir"
-	"github.com/mhale/smtpd"
+	"github.com/majestrate/bdsmail/lib/queue"
+	"golang.org/x/crypto/acme/autocert"
 	"net"
+	"net/http"
 	"strings"
 	"sync"
+	"time"
 )
 
+// largest message we take by default
+const DefaultMaxMessageSize = 32 * 1024 * 1024
+
+// how long a client may be idle by default, RFC 5321 asks for at least 5 minutes
+const DefaultIdleTimeout = 5 * time.Minute
+
 // handler of mail messages
 type MailHandler interface {
 	// we got a mail message
@@ -31,18 +45,102 @@ type Server struct {
 
 	// lua interpreter core
 	l *lua.Lua
-	// the server implementation
-	serv *smtpd.Server
+	// name we announce in the smtp greeting
+	appname string
+	// hostname we serve mail for
+	hostname string
 	// listener for server implementation
 	listener net.Listener
 	// recv mail events from handlers
 	chnl chan *MailEvent
+	// closes chnl once however many times the server is stopped
+	chnlOnce sync.Once
 	// maildir storage
 	mail maildir.MailDir
 	// lock to use to ensure 1 thread accessing lua
 	luamtx sync.RWMutex
 	// filepath to configuration
 	configFname string
+	// per ip connection rate limit, nil for none
+	connRate *limit.Rate
+	// limit on open connections, nil for none
+	maxConns *limit.Concurrent
+	// hooks run on each smtp transaction in order
+	middleware []SMTPMiddleware
+	// tls config for STARTTLS, nil to not offer it
+	tlsConfig *tls.Config
+	// checks SMTP AUTH credentials, nil to not offer it
+	auth Authenticator
+	// signs mail from authenticated users, nil to not sign
+	dkim *dkim.Signer
+	// outbound queue for mail to non local addresses, nil for none
+	queue *queue.Queue
+	// how long a client may be idle between commands, 0 for DefaultIdleTimeout
+	idleTimeout time.Duration
+	// largest message in bytes, 0 for DefaultMaxMessageSize
+	maxMessageSize int64
+	// open sessions
+	sessions map[*session]struct{}
+	// set once Shutdown is called
+	shutdown bool
+	// closed when Run's main loop returns, nil if it was not started
+	stopped chan struct{}
+	// protects sessions, shutdown and stopped
+	sessMtx sync.Mutex
+}
+
+// limit each ip to maxPerIP connections within a sliding window
+// connections over the limit get a 421 reply before any command is read
+func (s *Server) WithConnectionLimit(maxPerIP int, windowDuration time.Duration) *Server {
+	s.connRate = limit.NewRate(maxPerIP, windowDuration)
+	return s
+}
+
+// serve at most n connections at once
+// connections over the limit get a 421 reply and are closed before any command is read
+func (s *Server) WithMaxConnections(n int) *Server {
+	s.maxConns = limit.NewConcurrent(n)
+	return s
+}
+
+// close connections that send nothing for d with a 421 reply
+// the idle timer restarts before each command is read, RFC 5321 says to allow at least 5 minutes
+func (s *Server) WithIdleTimeout(d time.Duration) *Server {
+	s.idleTimeout = d
+	return s
+}
+
+// refuse messages bigger than n bytes with a 552 reply
+func (s *Server) WithMaxMessageSize(n int64) *Server {
+	s.maxMessageSize = n
+	return s
+}
+
+// send mail for non local addresses, like delivery reports, through an outbound queue
+func (s *Server) WithQueue(q *queue.Queue) *Server {
+	s.queue = q
+	return s
+}
+
+func (s *Server) idle() time.Duration {
+	if s.idleTimeout > 0 {
+		return s.idleTimeout
+	}
+	return DefaultIdleTimeout
+}
+
+func (s *Server) maxSize() int64 {
+	if s.maxMessageSize > 0 {
+		return s.maxMessageSize
+	}
+	return DefaultMaxMessageSize
+}
+
+// add middleware hooked into every smtp transaction
+// middleware runs in the order it was added
+func (s *Server) Use(middlewares ...SMTPMiddleware) *Server {
+	s.middleware = append(s.middleware, middlewares...)
+	return s
 }
 
 // bind server to address in config
@@ -56,19 +154,67 @@ func (s *Server) Bind() (err error) {
 	}
 	log.Info("Bind mail server to", addr)
 	s.listener, err = net.Listen("tcp", addr)
-	s.serv.Addr = addr
+	if err == nil {
+		// get certificates with acme if configured
+		cache, ok := s.l.GetConfigOpt("acme_cache")
+		if ok && s.tlsConfig == nil {
+			m := &autocert.Manager{
+				Prompt: autocert.AcceptTOS,
+				Cache:  autocert.DirCache(cache),
+			}
+			m.Email, _ = s.l.GetConfigOpt("acme_email")
+			s.WithACMEManager(m)
+			httpAddr, ok := s.l.GetConfigOpt("acme_http")
+			if ok {
+				// answer http-01 challenges
+				go func() {
+					log.Info("Serving ACME challenges on ", httpAddr)
+					err := http.ListenAndServe(httpAddr, m.HTTPHandler(nil))
+					log.Error("ACME challenge server ended ", err)
+				}()
+			}
+		}
+	}
 	return
 }
 
+// accept smtp connections until the listener is closed
+func (s *Server) serve(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(c)
+	}
+}
+
+// handle an inbound smtp connection
+func (s *Server) handle(c net.Conn) {
+	sess := newSession(s, c)
+	if s.track(sess) {
+		sess.run()
+		s.untrack(sess)
+	}
+	sess.c.Close()
+}
+
 // queue mail to be filtered
-func (s *Server) queueMail(addr net.Addr, from string, to []string, body []byte) {
+func (s *Server) queueMail(tx *Transaction, body []byte) {
+	now := time.Now()
 	// for each recip fire a mail event
-	for _, recip := range to {
+	for _, recip := range tx.To {
+		rp := tx.Rcpt[recip]
 		ev := &MailEvent{
-			Addr:   addr,
-			Sender: from,
-			Recip:  recip,
-			Body:   bytes.NewBuffer(body),
+			Addr:    tx.Addr,
+			Sender:  tx.From,
+			Recip:   recip,
+			Body:    bytes.NewBuffer(body),
+			Ret:     tx.Ret,
+			EnvID:   tx.EnvID,
+			Notify:  rp.Notify,
+			ORcpt:   rp.ORcpt,
+			Arrived: now,
 		}
 		s.chnl <- ev
 	}
@@ -88,7 +234,14 @@ func (s *Server) gotMail(ev *MailEvent) (err error) {
 	if s.mail.String() != "" {
 		r := bytes.NewReader(ev.Body.Bytes())
 		// deliver
-		err = s.mail.Deliver(r)
+		_, err = s.mail.DeliverWith(r, maildir.DeliverOpts{
+			Sender:    ev.Sender,
+			Recipient: ev.Recip,
+			Plugins:   []maildir.DeliverPlugin{ev.dsnHeaders},
+		})
+		if err == nil && ev.WantsNotify(NotifySuccess) {
+			s.notifySuccess(ev)
+		}
 	}
 	if s.Handler != nil {
 		go s.Handler.GotMail(ev)
@@ -145,10 +298,22 @@ func (s *Server) filterMail(ev *MailEvent) (err error) {
 }
 
 func (s *Server) Run() {
+	stopped := make(chan struct{})
+	defer close(stopped)
+	s.sessMtx.Lock()
+	s.stopped = stopped
+	s.sessMtx.Unlock()
 	// run acceptor
+	l := s.listener
+	if s.connRate != nil {
+		l = limit.Listen(l, s.connRate, "421 4.7.0 "+s.hostname+" Too many connections, try again later")
+	}
+	if s.maxConns != nil {
+		l = limit.Listen(l, s.maxConns, "421 4.3.2 "+s.hostname+" Service temporarily unavailable")
+	}
 	go func() {
-		log.Info("Serving SMTP server on ", s.listener.Addr())
-		s.serv.Serve(s.listener)
+		log.Info("Serving SMTP server on ", l.Addr())
+		s.serve(l)
 		log.Info("SMTP Server ended")
 	}()
 	log.Debug("run mail")
@@ -175,21 +340,22 @@ func (s *Server) Run() {
 func (s *Server) allowRecip(recip string) (allow bool) {
 	if s.Handler == nil {
 		// allow recip that only match the hostname of the server
-		allow = strings.HasSuffix(recip, "@"+s.serv.Hostname)
+		allow = strings.HasSuffix(recip, "@"+s.hostname)
 	} else {
 		allow = s.Handler.AllowRecipiant(recip)
 	}
 	return
 }
 
-// stop server
+// stop server right away, open connections are closed without finishing their transactions
+// use Shutdown to let them finish, calling both or either more than once is safe
 func (s *Server) Stop() {
-	close(s.chnl)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.Shutdown(ctx)
 	s.luamtx.Lock()
 	s.l.Close()
-	s.listener.Close()
 	s.luamtx.Unlock()
-	log.Info("Server Stopped")
 }
 
 // load configuration file
@@ -219,7 +385,19 @@ func (s *Server) ReloadConfig() (err error) {
 				str = "localhost"
 			}
 			log.Info("Setting mail hostname to ", str)
-			s.serv.Hostname = str
+			s.hostname = str
+		}
+		if err == nil {
+			keyfile, ok := s.l.GetConfigOpt("dkim_key")
+			if ok {
+				var key *rsa.PrivateKey
+				key, err = dkim.LoadKey(keyfile)
+				if err == nil {
+					selector, _ := s.l.GetConfigOpt("dkim_selector")
+					log.Info("DKIM signing with key ", keyfile)
+					s.WithDKIMSigner(dkim.New(selector).WithKey(key))
+				}
+			}
 		}
 	}
 	return
@@ -227,15 +405,12 @@ func (s *Server) ReloadConfig() (err error) {
 
 func New() (s *Server) {
 	s = &Server{
-		chnl: make(chan *MailEvent, 1024),
-		l:    lua.New(),
-		serv: &smtpd.Server{
-			Appname: fmt.Sprintf("BDSMail-%s", Version()),
-		},
+		chnl:    make(chan *MailEvent, 1024),
+		l:       lua.New(),
+		appname: fmt.Sprintf("BDSMail-%s", Version()),
 	}
 	if s.l.JIT() != nil {
 		log.Fatal("failed to initialize luajit")
 	}
-	s.serv.Handler = s.queueMail
 	return
 }
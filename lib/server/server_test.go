@@ -0,0 +1,89 @@
+package server
+
+import (
+	"github.com/majestrate/bdsmail/lib/maildir"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSMTPDeliveryIntegration(t *testing.T) {
+	d := maildir.MailDir(t.TempDir())
+	if err := d.Ensure(); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		appname:  "test",
+		hostname: "localhost",
+		chnl:     make(chan *MailEvent, 16),
+		mail:     d,
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go s.serve(l)
+	// deliver everything queued, the lua filters are left out
+	go func() {
+		for ev := range s.chnl {
+			s.gotMail(ev)
+		}
+	}()
+	t.Cleanup(func() { close(s.chnl) })
+
+	c, err := smtp.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Hello("client.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Mail("sender@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Rcpt("user@localhost"); err != nil {
+		t.Fatal(err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("Subject: integration\r\n\r\nhello over smtp\r\n"))
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Quit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// delivery happens after the reply so wait for it
+	var msgs []maildir.Message
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		msgs, err = d.ListNew()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msgs) > 0 {
+			break
+		}
+	}
+	if len(msgs) != 1 {
+		t.Fatalf("%d messages in new", len(msgs))
+	}
+	r, err := d.OpenNewMessage(msgs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(data), "Subject: integration\n\nhello over smtp\n") {
+		t.Fatalf("delivered %q", data)
+	}
+}
@@ -0,0 +1,474 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errBadPath = errors.New("bad address syntax")
+
+// an smtp session for one connection
+type session struct {
+	s *Server
+	c net.Conn
+	// buffered reader under r
+	br *bufio.Reader
+	r  *textproto.Reader
+	// replies are buffered so pipelined commands get batched replies
+	w *bufio.Writer
+	// current transaction, From is empty until MAIL
+	tx Transaction
+	// did the client use EHLO
+	extended bool
+	// is the connection encrypted
+	tls bool
+	// did we get MAIL yet
+	mailed bool
+	// message data from BDAT chunks so far, nil when not in a BDAT transfer
+	chunks []byte
+	// waiting for a command outside a transaction
+	idle bool
+	// protects idle and changing the connection
+	mtx sync.Mutex
+	// hooks wrapped in the server's middleware
+	mailFrom MailFromFunc
+	rcptTo   RcptToFunc
+	data     DataFunc
+}
+
+func newSession(s *Server, c net.Conn) (sess *session) {
+	sess = &session{
+		s: s,
+		tx: Transaction{
+			Addr: c.RemoteAddr(),
+		},
+	}
+	sess.setConn(c)
+	sess.mailFrom = func(tx *Transaction, from string) error {
+		return nil
+	}
+	sess.rcptTo = func(tx *Transaction, to string) error {
+		return nil
+	}
+	sess.data = func(tx *Transaction, body []byte) error {
+		if tx.User != "" {
+			body = s.signOutbound(body)
+		}
+		s.queueMail(tx, body)
+		return nil
+	}
+	// first middleware runs first so wrap in reverse
+	for idx := len(s.middleware) - 1; idx >= 0; idx-- {
+		m := s.middleware[idx]
+		sess.mailFrom = m.WrapMAILFROM(sess.mailFrom)
+		sess.rcptTo = m.WrapRCPTTO(sess.rcptTo)
+		sess.data = m.WrapDATA(sess.data)
+	}
+	return
+}
+
+// use a connection for reading and writing
+func (sess *session) setConn(c net.Conn) {
+	sess.mtx.Lock()
+	defer sess.mtx.Unlock()
+	sess.c = c
+	sess.br = bufio.NewReader(c)
+	sess.r = textproto.NewReader(sess.br)
+	sess.w = bufio.NewWriter(c)
+}
+
+// send a reply line, it is buffered until the next flush
+func (sess *session) reply(code int, msg string) (err error) {
+	_, err = fmt.Fprintf(sess.w, "%d %s\r\n", code, msg)
+	return
+}
+
+// restart the idle timer
+func (sess *session) touch() {
+	sess.c.SetDeadline(time.Now().Add(sess.s.idle()))
+}
+
+// read a line from the client
+// pending replies are flushed first unless the client already pipelined more commands
+func (sess *session) readLine() (line string, err error) {
+	sess.touch()
+	if sess.br.Buffered() == 0 {
+		err = sess.w.Flush()
+	}
+	if err == nil {
+		line, err = sess.r.ReadLine()
+	}
+	return
+}
+
+// read the next command
+// outside a transaction the read can be interrupted by a server shutting down
+func (sess *session) readCommand() (line string, err error) {
+	// a shutdown starting after this check interrupts the read instead
+	draining := sess.s.draining()
+	sess.mtx.Lock()
+	if !sess.mailed && draining {
+		err = errShuttingDown
+	}
+	sess.idle = !sess.mailed
+	sess.mtx.Unlock()
+	if err != nil {
+		return
+	}
+	line, err = sess.readLine()
+	sess.mtx.Lock()
+	if sess.idle && err == nil {
+		// we got a command so a shutdown that just started must not cut it off
+		sess.c.SetReadDeadline(time.Time{})
+		sess.touch()
+	}
+	sess.idle = false
+	sess.mtx.Unlock()
+	return
+}
+
+// make a read waiting for a command outside a transaction return now
+func (sess *session) interrupt() {
+	sess.mtx.Lock()
+	if sess.idle {
+		sess.c.SetReadDeadline(time.Now())
+	}
+	sess.mtx.Unlock()
+}
+
+// send the reply for an error from a hook
+func (sess *session) replyError(err error, code int, status string) error {
+	if e, ok := err.(*SMTPError); ok {
+		return sess.reply(e.Code, e.Status+" "+e.Msg)
+	}
+	log.Error("smtp transaction from ", sess.tx.Addr, " failed: ", err)
+	return sess.reply(code, status+" Requested action aborted")
+}
+
+// clear the current mail transaction
+func (sess *session) reset() {
+	sess.mailed = false
+	sess.tx.From = ""
+	sess.tx.To = nil
+	sess.tx.Body = ""
+	sess.tx.Ret = ""
+	sess.tx.EnvID = ""
+	sess.tx.Rcpt = nil
+	sess.chunks = nil
+}
+
+// parse an address path argument like FROM:<user@host> KEY=VALUE
+// returns the address and any esmtp parameters after it keyed in upper case
+func parsePath(arg, prefix string) (addr string, params map[string]string, err error) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		err = errBadPath
+		return
+	}
+	arg = strings.TrimSpace(arg[len(prefix):])
+	if !strings.HasPrefix(arg, "<") {
+		err = errBadPath
+		return
+	}
+	idx := strings.Index(arg, ">")
+	if idx < 0 {
+		err = errBadPath
+		return
+	}
+	addr = arg[1:idx]
+	for _, param := range strings.Fields(arg[idx+1:]) {
+		if params == nil {
+			params = make(map[string]string)
+		}
+		kv := strings.SplitN(param, "=", 2)
+		key := strings.ToUpper(kv[0])
+		if len(kv) == 2 {
+			params[key] = kv[1]
+		} else {
+			params[key] = ""
+		}
+	}
+	return
+}
+
+// run the session until the client quits or the connection drops
+func (sess *session) run() {
+	err := sess.reply(220, sess.s.hostname+" ESMTP "+sess.s.appname)
+	for err == nil {
+		var line string
+		line, err = sess.readCommand()
+		if err != nil {
+			break
+		}
+		cmd := line
+		arg := ""
+		if idx := strings.Index(line, " "); idx > 0 {
+			cmd = line[:idx]
+			arg = strings.TrimSpace(line[idx+1:])
+		}
+		switch strings.ToUpper(cmd) {
+		case "HELO", "EHLO":
+			err = sess.hello(strings.ToUpper(cmd), arg)
+		case "STARTTLS":
+			err = sess.startTLS()
+		case "AUTH":
+			err = sess.authenticate(arg)
+		case "MAIL":
+			err = sess.mail(arg)
+		case "RCPT":
+			err = sess.rcpt(arg)
+		case "DATA":
+			err = sess.readData()
+		case "BDAT":
+			err = sess.bdat(arg)
+		case "RSET":
+			sess.reset()
+			err = sess.reply(250, "2.0.0 OK")
+		case "NOOP":
+			err = sess.reply(250, "2.0.0 OK")
+		case "VRFY":
+			err = sess.reply(252, "2.5.0 Cannot VRFY user")
+		case "QUIT":
+			sess.reply(221, "2.0.0 Bye")
+			sess.w.Flush()
+			return
+		default:
+			err = sess.reply(500, "5.5.2 Unknown command")
+		}
+	}
+	if ne, ok := err.(net.Error); err == errShuttingDown || (ok && ne.Timeout() && sess.s.draining()) {
+		sess.c.SetDeadline(time.Now().Add(time.Second))
+		sess.reply(421, "4.3.2 "+sess.s.hostname+" Service shutting down")
+		sess.w.Flush()
+	} else if ok && ne.Timeout() {
+		// give the goodbye a moment to get out
+		sess.c.SetDeadline(time.Now().Add(time.Second))
+		sess.reply(421, "4.4.2 "+sess.s.hostname+" Idle timeout, closing connection")
+		sess.w.Flush()
+		log.Info("smtp session with ", sess.tx.Addr, " timed out")
+	} else if err != nil && err != io.EOF {
+		log.Warn("smtp session with ", sess.tx.Addr, " ended: ", err)
+	}
+}
+
+// handle HELO and EHLO commands
+func (sess *session) hello(cmd, arg string) error {
+	if arg == "" {
+		return sess.reply(501, "5.5.4 "+cmd+" requires domain")
+	}
+	sess.tx.Helo = arg
+	sess.reset()
+	sess.extended = cmd == "EHLO"
+	if !sess.extended {
+		return sess.reply(250, sess.s.hostname)
+	}
+	caps := []string{sess.s.hostname + " greets " + arg, "PIPELINING"}
+	if sess.s.tlsConfig != nil && !sess.tls {
+		caps = append(caps, "STARTTLS")
+	}
+	if mechs := sess.authMechs(); len(mechs) > 0 {
+		caps = append(caps, "AUTH "+strings.Join(mechs, " "))
+	}
+	caps = append(caps, "8BITMIME", "CHUNKING", "DSN", "ENHANCEDSTATUSCODES")
+	for idx, c := range caps {
+		sep := "-"
+		if idx == len(caps)-1 {
+			sep = " "
+		}
+		_, err := fmt.Fprintf(sess.w, "250%s%s\r\n", sep, c)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handle STARTTLS command
+func (sess *session) startTLS() (err error) {
+	if sess.s.tlsConfig == nil {
+		return sess.reply(502, "5.5.1 TLS not available")
+	}
+	if sess.tls {
+		return sess.reply(503, "5.5.1 TLS already active")
+	}
+	if sess.br.Buffered() > 0 {
+		// anything sent after STARTTLS in plaintext could be injected
+		return sess.reply(554, "5.5.1 Commands pipelined after STARTTLS")
+	}
+	err = sess.reply(220, "2.0.0 Ready to start TLS")
+	if err == nil {
+		err = sess.w.Flush()
+	}
+	if err == nil {
+		c := tls.Server(sess.c, sess.s.tlsConfig)
+		err = c.Handshake()
+		if err == nil {
+			sess.setConn(c)
+			sess.tls = true
+			// forget everything said before the handshake
+			sess.tx.Helo = ""
+			sess.tx.User = ""
+			sess.reset()
+		}
+	}
+	return
+}
+
+// handle MAIL command
+func (sess *session) mail(arg string) error {
+	if sess.tx.Helo == "" {
+		return sess.reply(503, "5.5.1 Send HELO first")
+	}
+	if sess.mailed {
+		return sess.reply(503, "5.5.1 Nested MAIL command")
+	}
+	from, params, err := parsePath(arg, "FROM:")
+	if err != nil {
+		return sess.reply(501, "5.5.4 Syntax: MAIL FROM:<address>")
+	}
+	if len(params) > 0 && !sess.extended {
+		return sess.reply(555, "5.5.4 Parameters not recognized, send EHLO first")
+	}
+	body, ret, envid := "", "", ""
+	for key, val := range params {
+		switch key {
+		case "BODY":
+			// bodies are stored as is so 8 bit needs no handling here
+			body = strings.ToUpper(val)
+			if body != Body7Bit && body != Body8BitMIME {
+				return sess.reply(501, "5.5.4 Unsupported BODY type")
+			}
+		case "RET":
+			ret = strings.ToUpper(val)
+			if ret != RetFull && ret != RetHeaders {
+				return sess.reply(501, "5.5.4 Bad RET parameter")
+			}
+		case "ENVID":
+			envid, err = decodeXText(val)
+			if err != nil || envid == "" {
+				return sess.reply(501, "5.5.4 Bad ENVID parameter")
+			}
+		default:
+			return sess.reply(555, "5.5.4 Parameter "+key+" not recognized")
+		}
+	}
+	err = sess.mailFrom(&sess.tx, from)
+	if err != nil {
+		return sess.replyError(err, 451, "4.3.0")
+	}
+	sess.tx.From = from
+	sess.tx.Body = body
+	sess.tx.Ret = ret
+	sess.tx.EnvID = envid
+	sess.mailed = true
+	return sess.reply(250, "2.1.0 OK")
+}
+
+// handle RCPT command
+func (sess *session) rcpt(arg string) error {
+	if !sess.mailed {
+		return sess.reply(503, "5.5.1 Send MAIL first")
+	}
+	to, params, err := parsePath(arg, "TO:")
+	if err != nil || to == "" {
+		return sess.reply(501, "5.5.4 Syntax: RCPT TO:<address>")
+	}
+	if len(params) > 0 && !sess.extended {
+		return sess.reply(555, "5.5.4 Parameters not recognized, send EHLO first")
+	}
+	var rp RcptParams
+	for key, val := range params {
+		switch key {
+		case "NOTIFY":
+			rp.Notify, err = parseNotify(val)
+			if err != nil {
+				return sess.reply(501, "5.5.4 Bad NOTIFY parameter")
+			}
+		case "ORCPT":
+			rp.ORcpt, err = parseORcpt(val)
+			if err != nil {
+				return sess.reply(501, "5.5.4 Bad ORCPT parameter")
+			}
+		default:
+			return sess.reply(555, "5.5.4 Parameter "+key+" not recognized")
+		}
+	}
+	err = sess.rcptTo(&sess.tx, to)
+	if err != nil {
+		return sess.replyError(err, 451, "4.3.0")
+	}
+	sess.tx.To = append(sess.tx.To, to)
+	if sess.tx.Rcpt == nil {
+		sess.tx.Rcpt = make(map[string]RcptParams)
+	}
+	sess.tx.Rcpt[to] = rp
+	return sess.reply(250, "2.1.5 OK")
+}
+
+// handle DATA command
+func (sess *session) readData() (err error) {
+	if len(sess.tx.To) == 0 {
+		return sess.reply(503, "5.5.1 Send RCPT first")
+	}
+	if sess.chunks != nil {
+		return sess.reply(503, "5.5.1 DATA not allowed during BDAT transfer")
+	}
+	err = sess.reply(354, "Start mail input; end with <CRLF>.<CRLF>")
+	if err == nil {
+		// the client waits for this before sending the body
+		err = sess.w.Flush()
+	}
+	if err != nil {
+		return
+	}
+	sess.touch()
+	// read one byte past the limit to know it was passed
+	dot := sess.r.DotReader()
+	var body []byte
+	body, err = ioutil.ReadAll(io.LimitReader(dot, sess.s.maxSize()+1))
+	if err == nil && int64(len(body)) > sess.s.maxSize() {
+		// the rest is read off the wire so the client sees our reply
+		body = nil
+		_, err = io.Copy(ioutil.Discard, dot)
+		if err == nil {
+			sess.reset()
+			err = sess.reply(552, "5.3.4 Message too big")
+		}
+		return
+	}
+	if err != nil {
+		return
+	}
+	return sess.deliver(body)
+}
+
+// stamp a complete message and hand it to the data hooks then reply
+// the body must use plain newlines
+func (sess *session) deliver(body []byte) (err error) {
+	// stamp it with plain newlines to match the body
+	proto := "SMTP"
+	if sess.extended {
+		proto = "ESMTP"
+	}
+	if sess.tls {
+		proto += "S"
+	}
+	hdr := fmt.Sprintf("Received: from %s (%s)\n\tby %s (%s) with %s;\n\t%s\n",
+		sess.tx.Helo, sess.tx.Addr, sess.s.hostname, sess.s.appname, proto, time.Now().Format(time.RFC1123Z))
+	body = append([]byte(hdr), body...)
+	err = sess.data(&sess.tx, body)
+	sess.reset()
+	if err != nil {
+		return sess.replyError(err, 451, "4.3.0")
+	}
+	return sess.reply(250, "2.0.0 OK: queued")
+}
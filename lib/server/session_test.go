@@ -0,0 +1,105 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// start a session on a pipe with a server that queues mail without filtering
+// setup functions can configure the server first
+// returns the client side of the connection and the server
+func testSession(t *testing.T, setup ...func(*Server)) (*textproto.Conn, *Server) {
+	s := &Server{
+		appname:  "test",
+		hostname: "localhost",
+		chnl:     make(chan *MailEvent, 16),
+	}
+	for _, f := range setup {
+		f(s)
+	}
+	client, server := net.Pipe()
+	go s.handle(server)
+	c := textproto.NewConn(client)
+	t.Cleanup(func() { c.Close() })
+	expect(t, c, 220)
+	return c, s
+}
+
+// read a reply and fail unless it has the expected code
+func expect(t *testing.T, c *textproto.Conn, code int) string {
+	t.Helper()
+	_, msg, err := c.ReadResponse(code)
+	if err != nil {
+		t.Fatalf("expected %d got %v", code, err)
+	}
+	return msg
+}
+
+func TestParsePathParams(t *testing.T) {
+	addr, params, err := parsePath("FROM:<a@b.c> body=8BITMIME SMTPUTF8", "FROM:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != "a@b.c" {
+		t.Fatalf("addr is %q", addr)
+	}
+	if params["BODY"] != Body8BitMIME {
+		t.Fatalf("BODY is %q", params["BODY"])
+	}
+	if _, ok := params["SMTPUTF8"]; !ok || len(params) != 2 {
+		t.Fatalf("bad params %v", params)
+	}
+	_, params, err = parsePath("TO:<a@b.c>", "TO:")
+	if err != nil || len(params) != 0 {
+		t.Fatalf("unexpected params %v %v", params, err)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	c, _ := testSession(t, func(s *Server) {
+		s.WithIdleTimeout(100 * time.Millisecond)
+	})
+	// activity restarts the timer
+	for i := 0; i < 3; i++ {
+		time.Sleep(60 * time.Millisecond)
+		if err := c.PrintfLine("NOOP"); err != nil {
+			t.Fatal(err)
+		}
+		expect(t, c, 250)
+	}
+	start := time.Now()
+	expect(t, c, 421)
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Fatalf("idle connection closed after %s", waited)
+	}
+	if _, err := c.ReadLine(); err == nil {
+		t.Fatal("connection still open after idle timeout")
+	}
+}
+
+func TestDATATooBig(t *testing.T) {
+	c, s := testSession(t, func(s *Server) {
+		s.WithMaxMessageSize(16)
+	})
+	go func() {
+		fmt.Fprintf(c.W, "EHLO client\r\nMAIL FROM:<a@remote>\r\nRCPT TO:<b@localhost>\r\nDATA\r\n")
+		fmt.Fprintf(c.W, "Subject: big\r\n\r\n%s\r\n.\r\nNOOP\r\n", strings.Repeat("x", 100))
+		c.W.Flush()
+	}()
+	for i := 0; i < 3; i++ {
+		expect(t, c, 250)
+	}
+	expect(t, c, 354)
+	expect(t, c, 552)
+	// the rest of the message was skipped
+	expect(t, c, 250)
+	select {
+	case ev := <-s.chnl:
+		t.Fatalf("delivered %q", ev.Body.String())
+	default:
+	}
+}
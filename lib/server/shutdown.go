@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"time"
+)
+
+// returned when reading the next command on a session the server is draining
+var errShuttingDown = errors.New("server shutting down")
+
+// how often Shutdown checks for sessions that have finished
+const shutdownPoll = 50 * time.Millisecond
+
+// is the server shutting down
+func (s *Server) draining() bool {
+	s.sessMtx.Lock()
+	defer s.sessMtx.Unlock()
+	return s.shutdown
+}
+
+// keep track of a session while it runs
+// returns false if the server is shutting down and the session should not run
+func (s *Server) track(sess *session) bool {
+	s.sessMtx.Lock()
+	defer s.sessMtx.Unlock()
+	if s.shutdown {
+		return false
+	}
+	if s.sessions == nil {
+		s.sessions = make(map[*session]struct{})
+	}
+	s.sessions[sess] = struct{}{}
+	return true
+}
+
+// stop tracking a session that ended
+func (s *Server) untrack(sess *session) {
+	s.sessMtx.Lock()
+	delete(s.sessions, sess)
+	s.sessMtx.Unlock()
+}
+
+// interrupt sessions waiting for a command outside a transaction
+// returns how many sessions are still open
+func (s *Server) closeIdle() int {
+	s.sessMtx.Lock()
+	defer s.sessMtx.Unlock()
+	for sess := range s.sessions {
+		sess.interrupt()
+	}
+	return len(s.sessions)
+}
+
+// close every session's connection
+func (s *Server) closeAll() {
+	s.sessMtx.Lock()
+	defer s.sessMtx.Unlock()
+	for sess := range s.sessions {
+		sess.mtx.Lock()
+		sess.c.Close()
+		sess.mtx.Unlock()
+	}
+}
+
+// stop the server without dropping mail
+// no new connections are accepted, clients between transactions get a 421 and
+// transactions in progress may finish, then mail already accepted is filtered and
+// delivered before the lua interpreter is closed
+// if ctx expires first the remaining connections are closed, which aborts their
+// transactions without accepting the mail, and ctx's error is returned once the
+// sessions have ended leaving the main loop to finish in the background
+func (s *Server) Shutdown(ctx context.Context) (err error) {
+	s.sessMtx.Lock()
+	s.shutdown = true
+	stopped := s.stopped
+	s.sessMtx.Unlock()
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	ticker := time.NewTicker(shutdownPoll)
+	defer ticker.Stop()
+	expired := ctx.Done()
+	for s.closeIdle() > 0 {
+		select {
+		case <-expired:
+			err = ctx.Err()
+			log.Warn("shutdown timed out, closing remaining smtp connections")
+			s.closeAll()
+			// wait for the sessions to notice
+			expired = nil
+		case <-ticker.C:
+		}
+	}
+	// no more mail can be queued, let the main loop finish what it has
+	s.chnlOnce.Do(func() { close(s.chnl) })
+	if stopped != nil && err == nil {
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	if err == nil && s.l != nil {
+		// the main loop is done with it
+		s.luamtx.Lock()
+		s.l.Close()
+		s.luamtx.Unlock()
+	}
+	log.Info("Server Stopped")
+	return
+}
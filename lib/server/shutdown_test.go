@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/textproto"
+	"testing"
+	"time"
+)
+
+// start another session on a server
+func testAnotherSession(t *testing.T, s *Server) *textproto.Conn {
+	client, server := net.Pipe()
+	go s.handle(server)
+	c := textproto.NewConn(client)
+	t.Cleanup(func() { c.Close() })
+	expect(t, c, 220)
+	return c
+}
+
+func TestShutdownDrains(t *testing.T) {
+	busy, s := testSession(t)
+	idle := testAnotherSession(t, s)
+	for _, line := range []string{"EHLO client", "MAIL FROM:<a@remote>", "RCPT TO:<b@localhost>"} {
+		busy.PrintfLine("%s", line)
+		expect(t, busy, 250)
+	}
+	done := make(chan error)
+	go func() {
+		done <- s.Shutdown(context.Background())
+	}()
+	// clients between transactions are sent away
+	msg := expect(t, idle, 421)
+	if msg[:6] != "4.3.2 " {
+		t.Fatalf("idle client got %q", msg)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("shutdown returned %v during a transaction", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	// the transaction in progress finishes
+	busy.PrintfLine("DATA")
+	expect(t, busy, 354)
+	busy.PrintfLine("Subject: hi\r\n\r\nbody\r\n.")
+	expect(t, busy, 250)
+	expect(t, busy, 421)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if ev, ok := <-s.chnl; !ok || ev.Recip != "b@localhost" {
+		t.Fatal("mail accepted during shutdown was dropped")
+	}
+	if _, ok := <-s.chnl; ok {
+		t.Fatal("mail queue left open after shutdown")
+	}
+	// nothing new is served
+	client, server := net.Pipe()
+	defer client.Close()
+	go s.handle(server)
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Fatal("connection served after shutdown")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	c, s := testSession(t)
+	for _, line := range []string{"HELO client", "MAIL FROM:<a@remote>"} {
+		c.PrintfLine("%s", line)
+		expect(t, c, 250)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("shutdown with a stuck transaction returned %v", err)
+	}
+	if _, err := c.ReadLine(); err == nil {
+		t.Fatal("stuck transaction not aborted")
+	}
+}
+
+func TestStopAfterShutdown(t *testing.T) {
+	c, s := testSession(t)
+	done := make(chan error)
+	go func() {
+		done <- s.Shutdown(context.Background())
+	}()
+	expect(t, c, 421)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	// stopping a server that already shut down must not close anything twice
+	s.Stop()
+	s.Stop()
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
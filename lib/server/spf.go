@@ -0,0 +1,325 @@
+package server
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// result of an spf check from RFC 7208
+type SPFResult string
+
+const (
+	SPFNone      SPFResult = "none"
+	SPFNeutral   SPFResult = "neutral"
+	SPFPass      SPFResult = "pass"
+	SPFFail      SPFResult = "fail"
+	SPFSoftFail  SPFResult = "softfail"
+	SPFTempError SPFResult = "temperror"
+	SPFPermError SPFResult = "permerror"
+)
+
+// dns lookups an spf check needs, a *net.Resolver does these
+type SPFResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+// most terms causing dns lookups one check may evaluate
+const spfMaxLookups = 10
+
+// how long the middleware lets one check take
+const spfTimeout = 20 * time.Second
+
+// state of one spf check
+type spfCheck struct {
+	ctx     context.Context
+	r       SPFResolver
+	ip      net.IP
+	lookups int
+}
+
+// check if an ip may send mail for a domain
+// macros are not supported, records using them give a permerror
+func CheckSPF(ctx context.Context, r SPFResolver, ip net.IP, domain string) SPFResult {
+	c := &spfCheck{
+		ctx: ctx,
+		r:   r,
+		ip:  ip,
+	}
+	return c.check(domain)
+}
+
+// is this a dns error for a name with no records
+func spfNotFound(err error) bool {
+	e, ok := err.(*net.DNSError)
+	return ok && e.IsNotFound
+}
+
+// evaluate a domain's spf record
+func (c *spfCheck) check(domain string) SPFResult {
+	txts, err := c.r.LookupTXT(c.ctx, domain)
+	if spfNotFound(err) {
+		return SPFNone
+	} else if err != nil {
+		return SPFTempError
+	}
+	var record string
+	found := 0
+	for _, txt := range txts {
+		if strings.EqualFold(txt, "v=spf1") || strings.HasPrefix(strings.ToLower(txt), "v=spf1 ") {
+			record = txt
+			found++
+		}
+	}
+	if found == 0 {
+		return SPFNone
+	} else if found > 1 {
+		return SPFPermError
+	}
+	var redirect string
+	for _, term := range strings.Fields(record)[1:] {
+		lower := strings.ToLower(term)
+		if strings.HasPrefix(lower, "redirect=") {
+			redirect = term[len("redirect="):]
+			continue
+		}
+		if i := strings.Index(term, "="); i > 0 && !strings.ContainsAny(term[:i], ":/") {
+			// exp= and unknown modifiers are ignored
+			continue
+		}
+		qual := SPFPass
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			qual = SPFFail
+			term = term[1:]
+		case '~':
+			qual = SPFSoftFail
+			term = term[1:]
+		case '?':
+			qual = SPFNeutral
+			term = term[1:]
+		}
+		match, res := c.mechanism(term, domain)
+		if res != "" {
+			return res
+		}
+		if match {
+			return qual
+		}
+	}
+	if redirect != "" {
+		if !c.lookup() {
+			return SPFPermError
+		}
+		res := c.check(redirect)
+		if res == SPFNone {
+			res = SPFPermError
+		}
+		return res
+	}
+	return SPFNeutral
+}
+
+// count a term that queries dns, false if there were too many
+func (c *spfCheck) lookup() bool {
+	c.lookups++
+	return c.lookups <= spfMaxLookups
+}
+
+// evaluate one mechanism
+// res is set if the check ends here with an error
+func (c *spfCheck) mechanism(term, domain string) (match bool, res SPFResult) {
+	name, arg := term, ""
+	if i := strings.IndexAny(term, ":/"); i >= 0 {
+		name, arg = term[:i], term[i:]
+	}
+	name = strings.ToLower(name)
+	if strings.Contains(arg, "%") {
+		return false, SPFPermError
+	}
+	switch name {
+	case "all":
+		if arg != "" {
+			res = SPFPermError
+		}
+		match = true
+	case "include":
+		if !strings.HasPrefix(arg, ":") || !c.lookup() {
+			return false, SPFPermError
+		}
+		switch c.check(arg[1:]) {
+		case SPFPass:
+			match = true
+		case SPFTempError:
+			res = SPFTempError
+		case SPFPermError, SPFNone:
+			res = SPFPermError
+		}
+	case "a", "mx":
+		target, v4, v6, ok := spfDomainCIDR(arg, domain)
+		if !ok || !c.lookup() {
+			return false, SPFPermError
+		}
+		hosts := []string{target}
+		if name == "mx" {
+			mxs, err := c.r.LookupMX(c.ctx, target)
+			if spfNotFound(err) {
+				return
+			} else if err != nil {
+				return false, SPFTempError
+			}
+			hosts = nil
+			for i, mx := range mxs {
+				if i == spfMaxLookups {
+					return false, SPFPermError
+				}
+				hosts = append(hosts, mx.Host)
+			}
+		}
+		for _, host := range hosts {
+			addrs, err := c.r.LookupIPAddr(c.ctx, host)
+			if spfNotFound(err) {
+				continue
+			} else if err != nil {
+				return false, SPFTempError
+			}
+			for _, addr := range addrs {
+				if cidrMatch(c.ip, addr.IP, v4, v6) {
+					return true, ""
+				}
+			}
+		}
+	case "ip4", "ip6":
+		if !strings.HasPrefix(arg, ":") {
+			return false, SPFPermError
+		}
+		cidr := arg[1:]
+		if !strings.Contains(cidr, "/") {
+			if name == "ip4" {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil || (name == "ip4") != (n.IP.To4() != nil) {
+			return false, SPFPermError
+		}
+		match = n.Contains(c.ip)
+	case "exists":
+		if !strings.HasPrefix(arg, ":") || !c.lookup() {
+			return false, SPFPermError
+		}
+		addrs, err := c.r.LookupIPAddr(c.ctx, arg[1:])
+		if err != nil && !spfNotFound(err) {
+			return false, SPFTempError
+		}
+		match = len(addrs) > 0
+	case "ptr":
+		// deprecated and slow, it never matches
+		if !c.lookup() {
+			res = SPFPermError
+		}
+	default:
+		res = SPFPermError
+	}
+	return
+}
+
+// parse the [:domain][/cidr4][//cidr6] argument of a and mx
+func spfDomainCIDR(arg, domain string) (target string, v4, v6 int, ok bool) {
+	target, v4, v6 = domain, 32, 128
+	if strings.HasPrefix(arg, ":") {
+		arg = arg[1:]
+		i := strings.Index(arg, "/")
+		if i < 0 {
+			i = len(arg)
+		}
+		target, arg = arg[:i], arg[i:]
+		if target == "" {
+			return
+		}
+	}
+	var err error
+	parts := strings.SplitN(arg, "//", 2)
+	if parts[0] != "" {
+		if !strings.HasPrefix(parts[0], "/") {
+			return
+		}
+		v4, err = strconv.Atoi(parts[0][1:])
+		if err != nil || v4 < 0 || v4 > 32 {
+			return
+		}
+	}
+	if len(parts) == 2 {
+		v6, err = strconv.Atoi(parts[1])
+		if err != nil || v6 < 0 || v6 > 128 {
+			return
+		}
+	}
+	ok = true
+	return
+}
+
+// check if two ips of the same family share a prefix
+func cidrMatch(ip, addr net.IP, v4, v6 int) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		a4 := addr.To4()
+		mask := net.CIDRMask(v4, 32)
+		return a4 != nil && ip4.Mask(mask).Equal(a4.Mask(mask))
+	}
+	if addr.To4() != nil {
+		return false
+	}
+	mask := net.CIDRMask(v6, 128)
+	return ip.Mask(mask).Equal(addr.Mask(mask))
+}
+
+// middleware that checks the sender's spf record
+type spf struct {
+	r SPFResolver
+}
+
+// make a middleware that rejects senders whose domain's spf record fails the client
+// the HELO name is checked for null senders and authenticated clients are not checked
+func SPFMiddleware(r SPFResolver) SMTPMiddleware {
+	return &spf{
+		r: r,
+	}
+}
+
+func (s *spf) WrapMAILFROM(next MailFromFunc) MailFromFunc {
+	return func(tx *Transaction, from string) error {
+		domain := tx.Helo
+		if i := strings.LastIndex(from, "@"); i >= 0 {
+			domain = from[i+1:]
+		}
+		ip := net.ParseIP(remoteIP(tx.Addr))
+		if tx.User == "" && ip != nil && domain != "" {
+			ctx, cancel := context.WithTimeout(context.Background(), spfTimeout)
+			res := CheckSPF(ctx, s.r, ip, domain)
+			cancel()
+			switch res {
+			case SPFFail:
+				return &SMTPError{550, "5.7.23", "SPF check failed for " + domain}
+			case SPFTempError:
+				return &SMTPError{451, "4.4.3", "SPF lookup failed, try again later"}
+			}
+		}
+		return next(tx, from)
+	}
+}
+
+func (s *spf) WrapRCPTTO(next RcptToFunc) RcptToFunc {
+	return next
+}
+
+func (s *spf) WrapDATA(next DataFunc) DataFunc {
+	return next
+}
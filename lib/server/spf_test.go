@@ -0,0 +1,128 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+// answers spf lookups from maps, names missing from all of them don't exist
+type testResolver struct {
+	txt map[string][]string
+	ip  map[string][]string
+	mx  map[string][]string
+}
+
+func (r *testResolver) notFound(name string) error {
+	if name == "broken.example" || strings.HasSuffix(name, ".broken.example") {
+		return &net.DNSError{Err: "server failure", Name: name, IsTemporary: true}
+	}
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *testResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if txt, ok := r.txt[name]; ok {
+		return txt, nil
+	}
+	return nil, r.notFound(name)
+}
+
+func (r *testResolver) LookupIPAddr(ctx context.Context, host string) (addrs []net.IPAddr, err error) {
+	ips, ok := r.ip[host]
+	if !ok {
+		return nil, r.notFound(host)
+	}
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return
+}
+
+func (r *testResolver) LookupMX(ctx context.Context, name string) (mxs []*net.MX, err error) {
+	hosts, ok := r.mx[name]
+	if !ok {
+		return nil, r.notFound(name)
+	}
+	for _, h := range hosts {
+		mxs = append(mxs, &net.MX{Host: h, Pref: 10})
+	}
+	return
+}
+
+var spfResolver = &testResolver{
+	txt: map[string][]string{
+		"example.com":      {"some other record", "v=spf1 ip4:192.0.2.0/24 mx include:partner.example -all"},
+		"partner.example":  {"v=spf1 a:out.partner.example/28 ip6:2001:db8::/32 ~all"},
+		"soft.example":     {"v=spf1 ?ip4:198.51.100.1 ~all"},
+		"redirect.example": {"v=spf1 redirect=example.com"},
+		"twice.example":    {"v=spf1 -all", "v=spf1 +all"},
+		"macro.example":    {"v=spf1 exists:%{i}.bl.example -all"},
+		"neutral.example":  {"v=spf1 ip4:192.0.2.1"},
+		"loop.example":     {"v=spf1 include:loop.example -all"},
+		"temp.example":     {"v=spf1 include:broken.example -all"},
+	},
+	ip: map[string][]string{
+		"mx.example.com":      {"203.0.113.5"},
+		"out.partner.example": {"198.51.100.16"},
+	},
+	mx: map[string][]string{
+		"example.com": {"mx.example.com"},
+	},
+}
+
+func TestCheckSPF(t *testing.T) {
+	for _, tc := range []struct {
+		ip, domain string
+		res        SPFResult
+	}{
+		{"192.0.2.55", "example.com", SPFPass},
+		{"203.0.113.5", "example.com", SPFPass},
+		{"198.51.100.20", "example.com", SPFPass},
+		{"198.51.100.40", "example.com", SPFFail},
+		{"2001:db8::1", "example.com", SPFPass},
+		{"2001:db9::1", "partner.example", SPFSoftFail},
+		{"198.51.100.1", "soft.example", SPFNeutral},
+		{"192.0.2.1", "redirect.example", SPFPass},
+		{"10.0.0.1", "redirect.example", SPFFail},
+		{"192.0.2.1", "twice.example", SPFPermError},
+		{"192.0.2.1", "macro.example", SPFPermError},
+		{"10.0.0.1", "neutral.example", SPFNeutral},
+		{"10.0.0.1", "loop.example", SPFPermError},
+		{"10.0.0.1", "temp.example", SPFTempError},
+		{"10.0.0.1", "nospf.example", SPFNone},
+		{"10.0.0.1", "broken.example", SPFTempError},
+	} {
+		res := CheckSPF(context.Background(), spfResolver, net.ParseIP(tc.ip), tc.domain)
+		if res != tc.res {
+			t.Errorf("%s for %s got %s not %s", tc.ip, tc.domain, res, tc.res)
+		}
+	}
+}
+
+func TestSPFMiddleware(t *testing.T) {
+	mail := SPFMiddleware(spfResolver).WrapMAILFROM(func(tx *Transaction, from string) error {
+		return nil
+	})
+	tx := &Transaction{
+		Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 2525},
+		Helo: "soft.example",
+	}
+	var e *SMTPError
+	if err := mail(tx, "someone@example.com"); !errors.As(err, &e) || e.Code != 550 {
+		t.Fatalf("spf fail got %v", err)
+	}
+	if err := mail(tx, "someone@temp.example"); !errors.As(err, &e) || e.Code != 451 {
+		t.Fatalf("spf temperror got %v", err)
+	}
+	// null senders are checked by helo name
+	if err := mail(tx, ""); err != nil {
+		t.Fatalf("null sender got %v", err)
+	}
+	// authenticated clients can send as anyone
+	tx.User = "alice"
+	if err := mail(tx, "someone@example.com"); err != nil {
+		t.Fatalf("authenticated client got %v", err)
+	}
+}
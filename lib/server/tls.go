@@ -0,0 +1,33 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// obtain and renew the certificate used for STARTTLS with acme
+// if the manager has no host policy only our configured hostname is allowed
+// the manager's challenges must be answered elsewhere, see autocert.Manager.HTTPHandler
+func (s *Server) WithACMEManager(manager *autocert.Manager) *Server {
+	if manager.HostPolicy == nil {
+		manager.HostPolicy = func(ctx context.Context, host string) error {
+			if host == s.hostname {
+				return nil
+			}
+			return fmt.Errorf("acme: host %q is not %q", host, s.hostname)
+		}
+	}
+	cfg := manager.TLSConfig()
+	getCert := cfg.GetCertificate
+	cfg.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		// plenty of mtas don't send sni when doing STARTTLS
+		if hello.ServerName == "" {
+			hello.ServerName = s.hostname
+		}
+		return getCert(hello)
+	}
+	s.tlsConfig = cfg
+	return s
+}
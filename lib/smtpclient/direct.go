@@ -0,0 +1,217 @@
+package smtpclient
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+)
+
+// returned for a domain that publishes a null mx and takes no mail
+var ErrNullMX = errors.New("domain does not accept mail")
+
+// error from one mx host
+type HostError struct {
+	// mx host tried
+	Host string
+	// what went wrong
+	Err error
+}
+
+// returned when no mx host for a recipient took the message
+type DeliveryError struct {
+	// recipient the message was for
+	Recipient string
+	// each host tried in order with its error
+	Tried []HostError
+}
+
+func (e *DeliveryError) Error() string {
+	var errs []string
+	for _, h := range e.Tried {
+		errs = append(errs, h.Host+": "+h.Err.Error())
+	}
+	return "delivery to " + e.Recipient + " failed: " + strings.Join(errs, "; ")
+}
+
+// get the errors from each host tried
+func (e *DeliveryError) Unwrap() (errs []error) {
+	for _, h := range e.Tried {
+		errs = append(errs, h.Err)
+	}
+	return
+}
+
+// return false if the last host rejected the message permanently
+func (e *DeliveryError) Temporary() bool {
+	if len(e.Tried) == 0 {
+		return false
+	}
+	return !permanent(e.Tried[len(e.Tried)-1].Err)
+}
+
+// sends mail straight to the mx hosts of each recipient's domain
+type DirectMailer struct {
+	// name we give in EHLO, empty for localhost
+	Hostname string
+	// time allowed for each mx host, 0 means DefaultTimeout
+	Timeout time.Duration
+
+	// tls config used when a host offers STARTTLS, nil to verify against the mx name
+	tlsConfig *tls.Config
+	// per domain limits, nil for none
+	policies *PolicyStore
+	// port to connect to, for tests
+	port string
+	// mx resolver, for tests
+	lookupMX func(domain string) ([]*net.MX, error)
+}
+
+func NewDirectMailer(hostname string) *DirectMailer {
+	return &DirectMailer{
+		Hostname: hostname,
+		port:     "25",
+		lookupMX: net.LookupMX,
+	}
+}
+
+// use this tls config when an mx host offers STARTTLS
+func (m *DirectMailer) WithTLS(cfg *tls.Config) *DirectMailer {
+	m.tlsConfig = cfg
+	return m
+}
+
+// apply per domain policies to deliveries
+func (m *DirectMailer) WithPolicies(ps *PolicyStore) *DirectMailer {
+	m.policies = ps
+	return m
+}
+
+// deliver a message to a recipient through the mx hosts of its domain
+// hosts are tried in order of preference until one accepts the message
+// a permanent rejection stops delivery without trying the rest
+// returns a *DeliveryError listing every host tried if none took it
+func (m *DirectMailer) Deliver(from, to string, msg io.Reader) (err error) {
+	idx := strings.LastIndex(to, "@")
+	if idx < 0 {
+		err = &net.AddrError{Err: "no domain in address", Addr: to}
+		return
+	}
+	domain := to[idx+1:]
+	var policy DomainPolicy
+	if m.policies != nil {
+		policy = m.policies.GetPolicy(domain)
+	}
+	var body []byte
+	body, err = ioutil.ReadAll(msg)
+	if err != nil {
+		return
+	}
+	if policy.MaxMessageSize > 0 && int64(len(body)) > policy.MaxMessageSize {
+		err = &textproto.Error{Code: 552, Msg: "5.3.4 message too big for " + domain}
+		return
+	}
+	if m.policies != nil && !m.policies.allow(domain) {
+		err = ErrRateLimited
+		return
+	}
+	var hosts []string
+	hosts, err = m.mxHosts(domain)
+	if err != nil {
+		return
+	}
+	derr := &DeliveryError{Recipient: to}
+	for _, host := range hosts {
+		err = m.sendTo(host, from, to, body, policy.RequireTLS)
+		if err == nil {
+			return
+		}
+		derr.Tried = append(derr.Tried, HostError{Host: host, Err: err})
+		if permanent(err) {
+			break
+		}
+	}
+	err = derr
+	return
+}
+
+// get mx hosts for a domain in order of preference
+// a domain without mx records is its own mx
+func (m *DirectMailer) mxHosts(domain string) (hosts []string, err error) {
+	var mxs []*net.MX
+	mxs, err = m.lookupMX(domain)
+	if err != nil {
+		if e, ok := err.(*net.DNSError); ok && e.IsNotFound {
+			err = nil
+			hosts = []string{domain}
+		}
+		return
+	}
+	if len(mxs) == 0 {
+		hosts = []string{domain}
+		return
+	}
+	sort.SliceStable(mxs, func(i, j int) bool {
+		return mxs[i].Pref < mxs[j].Pref
+	})
+	for _, mx := range mxs {
+		host := strings.TrimSuffix(mx.Host, ".")
+		if host == "" {
+			// null mx from RFC 7505
+			err = ErrNullMX
+			hosts = nil
+			return
+		}
+		hosts = append(hosts, host)
+	}
+	return
+}
+
+// send a message to one mx host within the timeout
+func (m *DirectMailer) sendTo(host, from, to string, body []byte, requireTLS bool) (err error) {
+	timeout := m.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	var c net.Conn
+	c, err = net.DialTimeout("tcp", net.JoinHostPort(host, m.port), timeout)
+	if err != nil {
+		return
+	}
+	// the whole transaction has to fit in the timeout
+	c.SetDeadline(time.Now().Add(timeout))
+	var cl *smtp.Client
+	cl, err = smtp.NewClient(c, host)
+	if err != nil {
+		c.Close()
+		return
+	}
+	defer cl.Close()
+	if m.Hostname != "" {
+		err = cl.Hello(m.Hostname)
+	}
+	if err == nil {
+		if ok, _ := cl.Extension("STARTTLS"); ok {
+			cfg := m.tlsConfig
+			if cfg == nil {
+				cfg = &tls.Config{ServerName: host}
+			}
+			err = cl.StartTLS(cfg)
+		} else if requireTLS {
+			err = ErrTLSRequired
+		}
+	}
+	if err == nil {
+		err = transmit(cl, nil, from, []string{to}, body)
+	}
+	if err == nil {
+		err = cl.Quit()
+	}
+	return
+}
@@ -0,0 +1,65 @@
+package smtpclient
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+// direct mailer sending to test servers on one port
+func testDirectMailer(port string, mxs []*net.MX) *DirectMailer {
+	m := NewDirectMailer("localhost")
+	m.port = port
+	m.lookupMX = func(domain string) ([]*net.MX, error) {
+		return mxs, nil
+	}
+	return m
+}
+
+func TestDirectMailerPreference(t *testing.T) {
+	s := newTestServer(t)
+	_, port, _ := net.SplitHostPort(s.Addr())
+	// nothing listens on 127.0.0.2 so the preferred host fails
+	m := testDirectMailer(port, []*net.MX{
+		{Host: "127.0.0.1.", Pref: 20},
+		{Host: "127.0.0.2.", Pref: 10},
+	})
+	err := m.Deliver("a@example.com", "b@example.net", strings.NewReader("Subject: hi\r\n\r\nbody\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-s.done
+	if to := s.To(); len(to) != 1 || !strings.Contains(to[0], "<b@example.net>") {
+		t.Fatalf("recipients were %q", to)
+	}
+}
+
+func TestDirectMailerAllFailed(t *testing.T) {
+	s := newTestServer(t)
+	s.rcptReply = "451 4.3.0 try later"
+	_, port, _ := net.SplitHostPort(s.Addr())
+	m := testDirectMailer(port, []*net.MX{
+		{Host: "127.0.0.2.", Pref: 10},
+		{Host: "127.0.0.1.", Pref: 20},
+	})
+	err := m.Deliver("a@example.com", "b@example.net", strings.NewReader("Subject: hi\r\n\r\nbody\r\n"))
+	var derr *DeliveryError
+	if !errors.As(err, &derr) {
+		t.Fatalf("got %v", err)
+	}
+	if len(derr.Tried) != 2 || derr.Tried[0].Host != "127.0.0.2" || derr.Tried[1].Host != "127.0.0.1" {
+		t.Fatalf("tried %+v", derr.Tried)
+	}
+	if !derr.Temporary() {
+		t.Fatal("4xx failure reported as permanent")
+	}
+}
+
+func TestDirectMailerNullMX(t *testing.T) {
+	m := testDirectMailer("25", []*net.MX{{Host: ".", Pref: 0}})
+	err := m.Deliver("a@example.com", "b@example.net", strings.NewReader("Subject: hi\r\n\r\n"))
+	if err != ErrNullMX {
+		t.Fatalf("null mx gave %v", err)
+	}
+}
@@ -0,0 +1,4 @@
+//
+// outbound smtp client for relaying mail to other servers
+//
+package smtpclient
@@ -0,0 +1,125 @@
+package smtpclient
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// returned when a domain's rate limit has been used up, try again later
+var ErrRateLimited = errors.New("smtpclient: domain rate limit reached")
+
+// returned when a domain requires tls and the host didn't offer it
+var ErrTLSRequired = errors.New("smtpclient: domain requires tls but host does not offer STARTTLS")
+
+var errBadPolicyDomain = errors.New("smtpclient: bad policy domain")
+
+// outbound delivery settings for a recipient domain
+// zero values mean no limit
+type DomainPolicy struct {
+	// largest message in bytes we will send
+	MaxMessageSize int64
+	// refuse to send without STARTTLS
+	RequireTLS bool
+	// most delivery attempts before giving up, 0 for the queue's default
+	RetryLimit int
+	// most messages per second
+	RateLimit float64
+}
+
+// per domain delivery policies
+// domains are matched exactly first, then by wildcards like *.example.com
+// from the most specific to the least, then the default set for "*"
+type PolicyStore struct {
+	mtx      sync.Mutex
+	policies map[string]DomainPolicy
+	// rate limit state per domain
+	buckets map[string]*bucket
+}
+
+// token bucket for a domain's rate limit
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func NewPolicyStore() *PolicyStore {
+	return &PolicyStore{
+		policies: make(map[string]DomainPolicy),
+		buckets:  make(map[string]*bucket),
+	}
+}
+
+// set the policy for a domain, a wildcard like *.com, or * for the default
+func (ps *PolicyStore) SetPolicy(domain string, p DomainPolicy) error {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if domain == "" || strings.Contains(strings.TrimPrefix(domain, "*"), "*") || strings.ContainsAny(domain, " @") {
+		return errBadPolicyDomain
+	}
+	if strings.HasPrefix(domain, "*") && domain != "*" && !strings.HasPrefix(domain, "*.") {
+		return errBadPolicyDomain
+	}
+	ps.mtx.Lock()
+	ps.policies[domain] = p
+	ps.mtx.Unlock()
+	return nil
+}
+
+// get the most specific policy for a domain
+func (ps *PolicyStore) GetPolicy(domain string) DomainPolicy {
+	ps.mtx.Lock()
+	defer ps.mtx.Unlock()
+	p, _ := ps.lookup(domain)
+	return p
+}
+
+// find the policy for a domain and the key it was set under, the caller holds the mutex
+func (ps *PolicyStore) lookup(domain string) (p DomainPolicy, key string) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if p, ok := ps.policies[domain]; ok {
+		return p, domain
+	}
+	labels := strings.Split(domain, ".")
+	for idx := 1; idx < len(labels); idx++ {
+		key = "*." + strings.Join(labels[idx:], ".")
+		if p, ok := ps.policies[key]; ok {
+			return p, key
+		}
+	}
+	key = "*"
+	p = ps.policies[key]
+	return
+}
+
+// take one message from a domain's rate limit
+// domains matched by the same wildcard share a limit
+// returns false if the limit is used up
+func (ps *PolicyStore) allow(domain string) bool {
+	ps.mtx.Lock()
+	defer ps.mtx.Unlock()
+	p, key := ps.lookup(domain)
+	if p.RateLimit <= 0 {
+		return true
+	}
+	now := time.Now()
+	b, ok := ps.buckets[key]
+	burst := p.RateLimit
+	if burst < 1 {
+		burst = 1
+	}
+	if !ok {
+		b = &bucket{tokens: burst, last: now}
+		ps.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * p.RateLimit
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
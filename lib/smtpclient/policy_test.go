@@ -0,0 +1,103 @@
+package smtpclient
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestPolicyLookup(t *testing.T) {
+	ps := NewPolicyStore()
+	for domain, size := range map[string]int64{
+		"*":                1,
+		"*.com":            2,
+		"*.example.com":    3,
+		"mail.example.com": 4,
+	} {
+		if err := ps.SetPolicy(domain, DomainPolicy{MaxMessageSize: size}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for domain, size := range map[string]int64{
+		"mail.example.com":  4,
+		"MAIL.example.com.": 4,
+		"mx.example.com":    3,
+		"a.b.example.com":   3,
+		"example.com":       2,
+		"other.com":         2,
+		"example.net":       1,
+	} {
+		if p := ps.GetPolicy(domain); p.MaxMessageSize != size {
+			t.Fatalf("%s got policy %+v", domain, p)
+		}
+	}
+	for _, bad := range []string{"", "a*.com", "*.*.com", "user@example.com"} {
+		if ps.SetPolicy(bad, DomainPolicy{}) == nil {
+			t.Fatalf("%q accepted", bad)
+		}
+	}
+}
+
+func TestPolicyRateLimit(t *testing.T) {
+	ps := NewPolicyStore()
+	ps.SetPolicy("*.example.com", DomainPolicy{RateLimit: 2})
+	if !ps.allow("a.example.com") || !ps.allow("b.example.com") {
+		t.Fatal("burst was refused")
+	}
+	if ps.allow("c.example.com") {
+		t.Fatal("rate limit not shared by the wildcard")
+	}
+	if !ps.allow("example.net") {
+		t.Fatal("unlimited domain was refused")
+	}
+}
+
+func TestDirectMailerPolicy(t *testing.T) {
+	s := newTestServer(t)
+	_, port, _ := net.SplitHostPort(s.Addr())
+	ps := NewPolicyStore()
+	ps.SetPolicy("small.net", DomainPolicy{MaxMessageSize: 10})
+	ps.SetPolicy("secure.net", DomainPolicy{RequireTLS: true})
+	m := testDirectMailer(port, []*net.MX{{Host: "127.0.0.1.", Pref: 10}}).WithPolicies(ps)
+	err := m.Deliver("a@example.com", "b@small.net", strings.NewReader("Subject: too big\r\n\r\n"))
+	if err == nil || !permanent(err) {
+		t.Fatalf("oversize message gave %v", err)
+	}
+	err = m.Deliver("a@example.com", "b@secure.net", strings.NewReader("Subject: hi\r\n\r\n"))
+	if !errors.Is(err, ErrTLSRequired) {
+		t.Fatalf("plaintext host gave %v", err)
+	}
+	if s.From() != "" {
+		t.Fatal("message sent despite policy")
+	}
+}
+
+func TestRelayPolicy(t *testing.T) {
+	s := newTestServer(t)
+	ps := NewPolicyStore()
+	ps.SetPolicy("small.net", DomainPolicy{MaxMessageSize: 10})
+	ps.SetPolicy("secure.net", DomainPolicy{RequireTLS: true})
+	ps.SetPolicy("slow.net", DomainPolicy{RateLimit: 1})
+	r := New(s.Addr()).WithPolicies(ps)
+	// the smallest limit of any recipient's domain applies
+	err := r.Send("a@example.com", []string{"b@example.net", "c@small.net"}, strings.NewReader("Subject: too big\r\n\r\n"))
+	if err == nil || !permanent(err) {
+		t.Fatalf("oversize message gave %v", err)
+	}
+	err = r.Send("a@example.com", []string{"b@secure.net"}, strings.NewReader("Subject: hi\r\n\r\n"))
+	if !errors.Is(err, ErrTLSRequired) {
+		t.Fatalf("plaintext relay gave %v", err)
+	}
+	if s.Conns() != 0 {
+		t.Fatal("relay contacted despite policy")
+	}
+	if err = r.Send("a@example.com", []string{"b@slow.net"}, strings.NewReader("Subject: hi\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	<-s.done
+	err = r.Send("a@example.com", []string{"c@slow.net"}, strings.NewReader("Subject: hi\r\n\r\n"))
+	if !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("second message within the rate limit gave %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+package smtpclient
+
+import (
+	"net/smtp"
+	"sync"
+	"time"
+)
+
+// how long a connection may sit idle in a pool by default
+// servers should wait at least 5 minutes before dropping us, see RFC 5321 4.5.3.2.7
+const DefaultIdleTimeout = time.Minute * 4
+
+// how many idle connections a pool keeps per host by default
+const DefaultMaxIdle = 4
+
+// dials a ready to use connection to a host:port
+type DialFunc func(host string) (*smtp.Client, error)
+
+// pool of idle smtp connections kept per host:port
+// connections are handed out already greeted and authenticated by the dial function
+type Pool struct {
+	// idle connections kept per host, 0 means DefaultMaxIdle
+	MaxIdle int
+	// connections idle longer than this are dropped, 0 means DefaultIdleTimeout
+	IdleTimeout time.Duration
+
+	dial DialFunc
+	mtx  sync.Mutex
+	idle map[string][]idleConn
+}
+
+// a connection waiting in the pool
+type idleConn struct {
+	c     *smtp.Client
+	since time.Time
+}
+
+func NewPool(dial DialFunc) *Pool {
+	return &Pool{
+		dial: dial,
+		idle: make(map[string][]idleConn),
+	}
+}
+
+func (p *Pool) idleTimeout() time.Duration {
+	if p.IdleTimeout > 0 {
+		return p.IdleTimeout
+	}
+	return DefaultIdleTimeout
+}
+
+func (p *Pool) maxIdle() int {
+	if p.MaxIdle > 0 {
+		return p.MaxIdle
+	}
+	return DefaultMaxIdle
+}
+
+// get a connection to a host, reusing an idle one if there is one
+// idle connections are checked with RSET before they are handed out
+func (p *Pool) Get(host string) (c *smtp.Client, err error) {
+	for {
+		c = p.pop(host)
+		if c == nil {
+			break
+		}
+		if c.Reset() == nil {
+			return
+		}
+		// the server hung up on us
+		c.Close()
+	}
+	c, err = p.dial(host)
+	return
+}
+
+// take the most recently used idle connection for a host
+// expired connections are closed on the way
+func (p *Pool) pop(host string) (c *smtp.Client) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	conns := p.idle[host]
+	if n := len(conns); n > 0 {
+		ic := conns[n-1]
+		conns = conns[:n-1]
+		if time.Since(ic.since) > p.idleTimeout() {
+			// the rest have been idle even longer
+			for _, old := range conns {
+				old.c.Close()
+			}
+			ic.c.Close()
+			conns = nil
+		} else {
+			c = ic.c
+		}
+	}
+	p.idle[host] = conns
+	return
+}
+
+// return a connection to the pool after a successful send
+// the connection is closed instead if the host already has enough idle connections
+func (p *Pool) Put(host string, c *smtp.Client) (err error) {
+	p.mtx.Lock()
+	full := len(p.idle[host]) >= p.maxIdle()
+	if !full {
+		p.idle[host] = append(p.idle[host], idleConn{c: c, since: time.Now()})
+	}
+	p.mtx.Unlock()
+	if full {
+		err = c.Quit()
+	}
+	return
+}
+
+// close all idle connections
+func (p *Pool) Close() {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	for host, conns := range p.idle {
+		for _, ic := range conns {
+			ic.c.Quit()
+		}
+		delete(p.idle, host)
+	}
+}
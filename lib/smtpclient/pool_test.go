@@ -0,0 +1,45 @@
+package smtpclient
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPoolReuse(t *testing.T) {
+	s := newTestServer(t)
+	r := New(s.Addr())
+	p := NewPool(r.Dial)
+	defer p.Close()
+	r.WithPool(p)
+	for i := 0; i < 3; i++ {
+		err := r.Send("a@example.com", []string{"b@example.net"}, strings.NewReader("Subject: hi\r\n\r\nbody\r\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-s.done
+	}
+	if n := s.Conns(); n != 1 {
+		t.Fatalf("%d connections made", n)
+	}
+}
+
+func TestPoolIdleTimeout(t *testing.T) {
+	s := newTestServer(t)
+	r := New(s.Addr())
+	p := NewPool(r.Dial)
+	p.IdleTimeout = time.Millisecond * 10
+	defer p.Close()
+	r.WithPool(p)
+	for i := 0; i < 2; i++ {
+		err := r.Send("a@example.com", []string{"b@example.net"}, strings.NewReader("Subject: hi\r\n\r\nbody\r\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-s.done
+		time.Sleep(time.Millisecond * 20)
+	}
+	if n := s.Conns(); n != 2 {
+		t.Fatalf("%d connections made", n)
+	}
+}
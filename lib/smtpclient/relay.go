@@ -0,0 +1,323 @@
+package smtpclient
+
+import (
+	"bytes"
+	"crypto/tls"
+	"github.com/majestrate/bdsmail/lib/message"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+)
+
+// default time allowed for connecting to a relay
+const DefaultTimeout = time.Minute
+
+// default time allowed for each write and for each reply to arrive, see RFC 5321 4.5.3.2
+const DefaultCommandTimeout = time.Minute * 5
+
+// default time allowed for the reply to the end of a message, see RFC 5321 4.5.3.2.6
+const DefaultDataTimeout = time.Minute * 10
+
+// sends mail through a fixed smarthost
+type Relay struct {
+	// host:port of the relay
+	Addr string
+	// name we give in EHLO, empty for localhost
+	Hostname string
+	// credentials for SASL PLAIN, empty to not authenticate
+	Username string
+	Password string
+	// time allowed for connecting, 0 means DefaultTimeout
+	Timeout time.Duration
+	// time allowed for each write and each reply, 0 means DefaultCommandTimeout
+	CommandTimeout time.Duration
+	// time allowed for the reply to the end of a message, 0 means DefaultDataTimeout
+	DataTimeout time.Duration
+
+	// tls config, nil for plaintext
+	tlsConfig *tls.Config
+	// hosts tried in order after Addr fails
+	fallback []string
+	// reuse connections from here, nil to connect for every message
+	pool *Pool
+	// per recipient domain limits, nil for none
+	policies *PolicyStore
+	// connections of the clients Dial made that are still open
+	conns sync.Map
+}
+
+func New(addr string) *Relay {
+	return &Relay{
+		Addr: addr,
+	}
+}
+
+// authenticate to the relay with SASL PLAIN
+// credentials are only sent over tls or to localhost
+func (r *Relay) WithAuth(username, password string) *Relay {
+	r.Username = username
+	r.Password = password
+	return r
+}
+
+// use tls to talk to the relay
+// port 465 gets implicit tls, anything else must offer STARTTLS
+func (r *Relay) WithTLS(cfg *tls.Config) *Relay {
+	r.tlsConfig = cfg
+	return r
+}
+
+// try these relays in order when the previous one fails
+func (r *Relay) WithFallback(hosts []string) *Relay {
+	r.fallback = append(r.fallback, hosts...)
+	return r
+}
+
+// keep connections to the relay open between messages
+// the pool should dial with this relay's Dial
+func (r *Relay) WithPool(p *Pool) *Relay {
+	r.pool = p
+	return r
+}
+
+// apply the policies of the recipients' domains to what we send through the relay
+func (r *Relay) WithPolicies(ps *PolicyStore) *Relay {
+	r.policies = ps
+	return r
+}
+
+// send a message through the relay
+// each relay is tried in order until one accepts it
+// a permanent rejection is returned without trying the rest
+func (r *Relay) Send(from string, to []string, msg io.Reader) (err error) {
+	var body []byte
+	body, err = ioutil.ReadAll(msg)
+	if err == nil {
+		err = r.checkPolicies(to, int64(len(body)))
+	}
+	if err != nil {
+		return
+	}
+	for _, addr := range append([]string{r.Addr}, r.fallback...) {
+		err = r.sendTo(addr, from, to, body)
+		if err == nil || permanent(err) {
+			break
+		}
+	}
+	return
+}
+
+// check a message against the policies of every recipient domain
+// the relay is the next hop so a domain requiring tls needs a tls relay
+func (r *Relay) checkPolicies(to []string, size int64) error {
+	if r.policies == nil {
+		return nil
+	}
+	domains := make(map[string]bool)
+	for _, rcpt := range to {
+		domains[strings.ToLower(rcpt[strings.LastIndex(rcpt, "@")+1:])] = true
+	}
+	for domain := range domains {
+		p := r.policies.GetPolicy(domain)
+		if p.MaxMessageSize > 0 && size > p.MaxMessageSize {
+			return &textproto.Error{Code: 552, Msg: "5.3.4 message too big for " + domain}
+		}
+		if p.RequireTLS && r.tlsConfig == nil {
+			return ErrTLSRequired
+		}
+	}
+	for domain := range domains {
+		if !r.policies.allow(domain) {
+			return ErrRateLimited
+		}
+	}
+	return nil
+}
+
+// return true if an error is a 5xx reply from the server
+func permanent(err error) bool {
+	e, ok := err.(*textproto.Error)
+	return ok && e.Code >= 500
+}
+
+// send a message to one relay
+// pooled connections go back in the pool after a successful send
+func (r *Relay) sendTo(addr, from string, to []string, body []byte) (err error) {
+	var cl *smtp.Client
+	if r.pool != nil {
+		cl, err = r.pool.Get(addr)
+	} else {
+		cl, err = r.Dial(addr)
+	}
+	if err != nil {
+		return
+	}
+	var tc *timeoutConn
+	if c, ok := r.conns.Load(cl); ok {
+		tc = c.(*timeoutConn)
+	}
+	err = transmit(cl, tc, from, to, body)
+	if err != nil {
+		cl.Close()
+	} else if r.pool != nil {
+		err = r.pool.Put(addr, cl)
+	} else {
+		err = cl.Quit()
+	}
+	return
+}
+
+func (r *Relay) commandTimeout() time.Duration {
+	if r.CommandTimeout > 0 {
+		return r.CommandTimeout
+	}
+	return DefaultCommandTimeout
+}
+
+func (r *Relay) dataTimeout() time.Duration {
+	if r.DataTimeout > 0 {
+		return r.DataTimeout
+	}
+	return DefaultDataTimeout
+}
+
+// connection that gives every read and write its own deadline
+// so a stalled relay fails the command instead of hanging forever
+// deadlines are only set while reading or writing so idle pooled connections keep
+type timeoutConn struct {
+	net.Conn
+	command time.Duration
+	data    time.Duration
+	// waiting for the reply to the end of a message, which gets the data timeout
+	ending bool
+	// called once the connection is closed
+	onClose func()
+}
+
+func (c *timeoutConn) Read(p []byte) (int, error) {
+	timeout := c.command
+	if c.ending {
+		timeout = c.data
+	}
+	c.Conn.SetReadDeadline(time.Now().Add(timeout))
+	return c.Conn.Read(p)
+}
+
+func (c *timeoutConn) Write(p []byte) (int, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.command))
+	return c.Conn.Write(p)
+}
+
+func (c *timeoutConn) Close() error {
+	if c.onClose != nil {
+		c.onClose()
+	}
+	return c.Conn.Close()
+}
+
+// connect to a relay and get it ready to send
+// does EHLO, STARTTLS and AUTH as configured
+func (r *Relay) Dial(addr string) (cl *smtp.Client, err error) {
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	var host string
+	host, _, err = net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	cfg := r.tlsConfig
+	if cfg != nil && cfg.ServerName == "" {
+		cfg = cfg.Clone()
+		cfg.ServerName = host
+	}
+	var c net.Conn
+	c, err = net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return
+	}
+	tc := &timeoutConn{
+		Conn:    c,
+		command: r.commandTimeout(),
+		data:    r.dataTimeout(),
+	}
+	c = tc
+	if cfg != nil && isImplicitTLS(addr) {
+		c = tls.Client(c, cfg)
+	}
+	cl, err = smtp.NewClient(c, host)
+	if err != nil {
+		c.Close()
+		return
+	}
+	// remember the connection so sending can give the end of a message longer
+	client := cl
+	r.conns.Store(client, tc)
+	tc.onClose = func() {
+		r.conns.Delete(client)
+	}
+	if r.Hostname != "" {
+		err = cl.Hello(r.Hostname)
+	}
+	if err == nil && cfg != nil && !isImplicitTLS(addr) {
+		err = cl.StartTLS(cfg)
+	}
+	if err == nil && r.Username != "" {
+		err = cl.Auth(smtp.PlainAuth("", r.Username, r.Password, host))
+	}
+	if err != nil {
+		cl.Close()
+		cl = nil
+	}
+	return
+}
+
+// send the envelope and message on a ready client
+// tc is the client's connection if it came from Relay.Dial, nil if not
+func transmit(cl *smtp.Client, tc *timeoutConn, from string, to []string, body []byte) (err error) {
+	if ok, _ := cl.Extension("8BITMIME"); !ok {
+		// next hop can't take 8 bit bodies
+		body, err = message.To7Bit(body)
+	}
+	if err == nil {
+		err = cl.Mail(from)
+	}
+	for _, rcpt := range to {
+		if err != nil {
+			break
+		}
+		err = cl.Rcpt(rcpt)
+	}
+	if err == nil {
+		var w io.WriteCloser
+		w, err = cl.Data()
+		if err == nil {
+			_, err = io.Copy(w, bytes.NewReader(body))
+			if err == nil {
+				// closing sends the end of the message and reads the reply
+				if tc != nil {
+					tc.ending = true
+				}
+				err = w.Close()
+				if tc != nil {
+					tc.ending = false
+				}
+			} else {
+				w.Close()
+			}
+		}
+	}
+	return
+}
+
+// return true if a relay address is on the submissions port
+func isImplicitTLS(addr string) bool {
+	_, port, _ := net.SplitHostPort(addr)
+	return port == "465"
+}
@@ -0,0 +1,242 @@
+package smtpclient
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// minimal smtp server recording what it was sent
+// set it up before calling Addr, which starts it, and read what it was sent through the accessors
+type testServer struct {
+	l     net.Listener
+	start sync.Once
+	// advertise 8BITMIME
+	eightBit bool
+	// reply to RCPT with this instead of 250 if set
+	rcptReply string
+	// never reply to this command if set
+	stall string
+	// wait this long before replying to the end of a message
+	dataDelay time.Duration
+	// protects conns and what was sent
+	mtx sync.Mutex
+	// connections accepted
+	conns int
+	// what was sent
+	auth string
+	from string
+	to   []string
+	body []byte
+	done chan struct{}
+}
+
+func newTestServer(t *testing.T) *testServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{l: l, done: make(chan struct{}, 1)}
+	t.Cleanup(func() { l.Close() })
+	return s
+}
+
+func (s *testServer) Addr() string {
+	s.start.Do(func() { go s.serve() })
+	return s.l.Addr().String()
+}
+
+func (s *testServer) Conns() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.conns
+}
+
+func (s *testServer) Auth() string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.auth
+}
+
+func (s *testServer) From() string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.from
+}
+
+func (s *testServer) To() []string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return append([]string{}, s.to...)
+}
+
+func (s *testServer) Body() []byte {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.body
+}
+
+func (s *testServer) serve() {
+	for {
+		c, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		s.mtx.Lock()
+		s.conns++
+		s.mtx.Unlock()
+		s.handle(textproto.NewConn(c))
+	}
+}
+
+func (s *testServer) handle(c *textproto.Conn) {
+	defer c.Close()
+	c.PrintfLine("220 test ESMTP")
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.Fields(line + " x")[0])
+		if cmd == s.stall {
+			continue
+		}
+		switch cmd {
+		case "EHLO":
+			if s.eightBit {
+				c.PrintfLine("250-test")
+				c.PrintfLine("250-8BITMIME")
+			} else {
+				c.PrintfLine("250-test")
+			}
+			c.PrintfLine("250 AUTH PLAIN")
+		case "AUTH":
+			data, _ := base64.StdEncoding.DecodeString(strings.Fields(line)[2])
+			s.mtx.Lock()
+			s.auth = string(data)
+			s.mtx.Unlock()
+			c.PrintfLine("235 2.7.0 OK")
+		case "MAIL":
+			s.mtx.Lock()
+			s.from = line
+			s.mtx.Unlock()
+			c.PrintfLine("250 OK")
+		case "RCPT":
+			if s.rcptReply != "" {
+				c.PrintfLine("%s", s.rcptReply)
+				continue
+			}
+			s.mtx.Lock()
+			s.to = append(s.to, line)
+			s.mtx.Unlock()
+			c.PrintfLine("250 OK")
+		case "DATA":
+			c.PrintfLine("354 go")
+			body, _ := ioutil.ReadAll(c.DotReader())
+			s.mtx.Lock()
+			s.body = body
+			s.mtx.Unlock()
+			time.Sleep(s.dataDelay)
+			c.PrintfLine("250 queued")
+			s.done <- struct{}{}
+		case "QUIT":
+			c.PrintfLine("221 bye")
+			return
+		default:
+			c.PrintfLine("250 OK")
+		}
+	}
+}
+
+func TestRelaySend(t *testing.T) {
+	s := newTestServer(t)
+	s.eightBit = true
+	r := New(s.Addr()).WithAuth("user", "pass")
+	err := r.Send("a@example.com", []string{"b@example.net", "c@example.net"}, strings.NewReader("Subject: hi\r\n\r\nh\xc3\xa9llo\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-s.done
+	if s.Auth() != "\x00user\x00pass" {
+		t.Fatalf("auth was %q", s.Auth())
+	}
+	if from, to := s.From(), s.To(); !strings.Contains(from, "<a@example.com>") || !strings.Contains(from, "BODY=8BITMIME") || len(to) != 2 {
+		t.Fatalf("envelope was %q %q", from, to)
+	}
+	if body := s.Body(); !bytes.Contains(body, []byte("h\xc3\xa9llo")) {
+		t.Fatalf("body was %q", body)
+	}
+}
+
+func TestRelayDowngrade(t *testing.T) {
+	s := newTestServer(t)
+	err := New(s.Addr()).Send("a@example.com", []string{"b@example.net"}, strings.NewReader("Subject: hi\r\n\r\nh\xc3\xa9llo\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-s.done
+	if body := s.Body(); !bytes.Contains(body, []byte("h=C3=A9llo")) {
+		t.Fatalf("body was not downgraded: %q", body)
+	}
+}
+
+func TestRelayFallback(t *testing.T) {
+	// nothing listening here
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := l.Addr().String()
+	l.Close()
+	s := newTestServer(t)
+	err = New(dead).WithFallback([]string{s.Addr()}).Send("a@example.com", []string{"b@example.net"}, strings.NewReader("Subject: hi\r\n\r\nbody\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-s.done
+}
+
+func TestRelayPermanentNoFallback(t *testing.T) {
+	first := newTestServer(t)
+	first.rcptReply = "550 5.1.1 no such user"
+	second := newTestServer(t)
+	err := New(first.Addr()).WithFallback([]string{second.Addr()}).Send("a@example.com", []string{"b@example.net"}, strings.NewReader("Subject: hi\r\n\r\nbody\r\n"))
+	if err == nil || !permanent(err) {
+		t.Fatalf("rejected recipient gave %v", err)
+	}
+	if second.From() != "" {
+		t.Fatal("permanent failure was retried on the fallback")
+	}
+}
+
+func TestRelayTimeouts(t *testing.T) {
+	s := newTestServer(t)
+	s.stall = "RCPT"
+	r := New(s.Addr())
+	r.CommandTimeout = 100 * time.Millisecond
+	start := time.Now()
+	err := r.Send("a@example.com", []string{"b@example.net"}, strings.NewReader("Subject: hi\r\n\r\nbody\r\n"))
+	if e, ok := err.(net.Error); !ok || !e.Timeout() || time.Since(start) > 5*time.Second {
+		t.Fatalf("stalled relay gave %v after %s", err, time.Since(start))
+	}
+	// the end of a message gets the longer data timeout
+	s = newTestServer(t)
+	s.dataDelay = 300 * time.Millisecond
+	r = New(s.Addr())
+	r.CommandTimeout = 100 * time.Millisecond
+	r.DataTimeout = 5 * time.Second
+	if err = r.Send("a@example.com", []string{"b@example.net"}, strings.NewReader("Subject: hi\r\n\r\nbody\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	<-s.done
+	r.DataTimeout = 100 * time.Millisecond
+	if err = r.Send("a@example.com", []string{"b@example.net"}, strings.NewReader("Subject: hi\r\n\r\nbody\r\n")); err == nil {
+		t.Fatal("slow reply to the end of the message was waited for")
+	}
+}